@@ -9,6 +9,39 @@ type Asset struct {
 	URIs       []string
 	Integrity  integrity.Integrity
 	Qualifiers map[string]string
+	// Compression is the codec that the content at the URIs is compressed with.
+	// If set, the asset refers to the decompressed content:
+	// Integrity (which may be empty) describes the decompressed content,
+	// and CompressedIntegrity (which may also be empty) describes the content at the URIs.
+	Compression         string
+	CompressedIntegrity integrity.Integrity
+}
+
+// Compressed returns the asset that refers to the content at the URIs of a compressed asset.
+func (a Asset) Compressed() Asset {
+	return Asset{
+		URIs:       a.URIs,
+		Integrity:  a.CompressedIntegrity,
+		Qualifiers: a.Qualifiers,
+	}
+}
+
+// IntegrityKey returns the integrity that identifies the content of the asset in caches (like the ChecksumCache).
+// This is the integrity of the asset, unless the asset is compressed and only the integrity
+// of the compressed content is known. In this case, a key is derived from the integrity of the compressed content.
+// The result must only be used for lookups and never to validate content.
+func (a Asset) IntegrityKey() integrity.Integrity {
+	if len(a.Compression) == 0 || !a.Integrity.Empty() {
+		return a.Integrity
+	}
+	var derived []integrity.Checksum
+	for checksum := range a.CompressedIntegrity.Items() {
+		hasher := checksum.Algorithm.Hasher()
+		hasher.Write([]byte("decompressed\x00" + a.Compression + "\x00"))
+		hasher.Write(checksum.Hash)
+		derived = append(derived, integrity.Checksum{Algorithm: checksum.Algorithm, Hash: hasher.Sum(nil)})
+	}
+	return integrity.IntegrityFromChecksums(derived...)
 }
 
 const (
@@ -6,4 +6,7 @@ const (
 	LogLevelEnv = "ASSET_FUSE_LOGGING"
 	// ConfigFileEnv is the environment variable used to set the configuration file.
 	ConfigFileEnv = "ASSET_FUSE_CONFIG_FILE"
+	// DaemonReadyFDEnv is set for processes started via "mount --daemon".
+	// It contains the file descriptor used to report readiness to the parent.
+	DaemonReadyFDEnv = "ASSET_FUSE_DAEMON_READY_FD"
 )
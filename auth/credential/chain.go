@@ -0,0 +1,132 @@
+package credential
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tweag/asset-fuse/internal/transport"
+)
+
+type chainHelper struct {
+	helpers []Helper
+}
+
+// Chain returns a helper that tries the helpers in order.
+// The headers of the first helper that returns any are used.
+// Errors are only returned if every helper failed:
+// a helper that succeeds without headers (like a helper scoped to other hosts) hides the errors of earlier helpers.
+func Chain(helpers ...Helper) Helper {
+	if len(helpers) == 1 {
+		return helpers[0]
+	}
+	return &chainHelper{helpers: helpers}
+}
+
+func (c *chainHelper) Get(ctx context.Context, uri string) (map[string][]string, time.Time, error) {
+	var firstErr error
+	succeeded := false
+	for _, helper := range c.helpers {
+		headers, expiresAt, err := helper.Get(ctx, uri)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if len(headers) > 0 {
+			return headers, expiresAt, nil
+		}
+		succeeded = true
+	}
+	if succeeded {
+		return nil, time.Time{}, nil
+	}
+	return nil, time.Time{}, firstErr
+}
+
+type scopedHelper struct {
+	hosts  []string
+	helper Helper
+}
+
+// Scoped returns a helper that only asks helper for credentials of URIs whose host matches one of hosts.
+// A host starting with "*." or "." matches the domain and all of its subdomains.
+func Scoped(hosts []string, helper Helper) Helper {
+	return &scopedHelper{hosts: hosts, helper: helper}
+}
+
+func (s *scopedHelper) Get(ctx context.Context, uri string) (map[string][]string, time.Time, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range s.hosts {
+		if transport.MatchHost(strings.ToLower(pattern), host) {
+			return s.helper.Get(ctx, uri)
+		}
+	}
+	return nil, time.Time{}, nil
+}
+
+// Route assigns a helper to a scope.
+type Route struct {
+	// Scope is a host name, a wildcard domain ("*.example.com") or empty for all hosts.
+	Scope  string
+	Helper Helper
+}
+
+type routedHelper struct {
+	routes []Route
+}
+
+// Routed returns a helper that asks only the helper of the most specific matching scope for credentials
+// (like Bazel's --credential_helper=[scope=]path):
+// a host scope wins over wildcard scopes, longer wildcard scopes win over shorter ones,
+// and the route without scope is used if no other scope matches.
+// Among routes with the same scope, the first one is used.
+func Routed(routes []Route) Helper {
+	return &routedHelper{routes: routes}
+}
+
+func (r *routedHelper) Get(ctx context.Context, uri string) (map[string][]string, time.Time, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	host := strings.ToLower(u.Hostname())
+	var best Helper
+	bestSpecificity := -1
+	for _, route := range r.routes {
+		scope := strings.ToLower(route.Scope)
+		var specificity int
+		switch {
+		case len(scope) == 0:
+			specificity = 0
+		case !transport.MatchHost(scope, host):
+			continue
+		case strings.HasPrefix(scope, "*.") || strings.HasPrefix(scope, "."):
+			specificity = 1 + len(strings.TrimLeft(scope, "*."))
+		default:
+			// exact host names are more specific than any wildcard
+			specificity = 1 << 16
+		}
+		if specificity > bestSpecificity {
+			best, bestSpecificity = route.Helper, specificity
+		}
+	}
+	if best == nil {
+		return nil, time.Time{}, nil
+	}
+	return best.Get(ctx, uri)
+}
+
+// ParseHelperSpec splits a credential helper specification of the form "[scope=]path".
+func ParseHelperSpec(spec string) (scope, path string) {
+	if scope, path, ok := strings.Cut(spec, "="); ok {
+		return scope, path
+	}
+	return "", spec
+}
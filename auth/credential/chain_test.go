@@ -0,0 +1,90 @@
+package credential
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fixedHelper returns the same result for every URI and counts its invocations.
+type fixedHelper struct {
+	header string
+	err    error
+	calls  int
+}
+
+func (f *fixedHelper) Get(ctx context.Context, uri string) (map[string][]string, time.Time, error) {
+	f.calls++
+	if f.err != nil || len(f.header) == 0 {
+		return nil, time.Time{}, f.err
+	}
+	return map[string][]string{"Authorization": {f.header}}, time.Time{}, nil
+}
+
+func TestChain(t *testing.T) {
+	broken := errors.New("broken helper")
+	for _, tc := range []struct {
+		name           string
+		helpers        []*fixedHelper
+		expectedHeader string
+		expectError    bool
+	}{
+		{name: "first headers win", helpers: []*fixedHelper{{header: "a"}, {header: "b"}}, expectedHeader: "a"},
+		{name: "errors are skipped", helpers: []*fixedHelper{{err: broken}, {header: "b"}}, expectedHeader: "b"},
+		{name: "success without headers hides errors", helpers: []*fixedHelper{{err: broken}, {}}},
+		{name: "all helpers fail", helpers: []*fixedHelper{{err: broken}, {err: broken}}, expectError: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var helpers []Helper
+			for _, helper := range tc.helpers {
+				helpers = append(helpers, helper)
+			}
+			headers, _, err := Chain(helpers...).Get(context.Background(), "https://example.com/file")
+			if (err != nil) != tc.expectError {
+				t.Fatalf("expected error=%v, got %v", tc.expectError, err)
+			}
+			if got := headers["Authorization"]; (len(tc.expectedHeader) == 0 && len(got) > 0) || (len(tc.expectedHeader) > 0 && (len(got) != 1 || got[0] != tc.expectedHeader)) {
+				t.Fatalf("expected header %q, got %v", tc.expectedHeader, got)
+			}
+		})
+	}
+}
+
+func TestHTTPOnly(t *testing.T) {
+	bearer := HTTPOnly(Bearer(func() (string, error) { return "token", nil }))
+	headers, _, err := bearer.Get(context.Background(), "https://example.com/file")
+	if err != nil || len(headers) == 0 {
+		t.Fatalf("expected headers for HTTP origins, got %v (%v)", headers, err)
+	}
+	headers, _, err = bearer.Get(ForGRPC(context.Background()), "https://cache.example.com/build.bazel.remote.execution.v2.ContentAddressableStorage")
+	if err != nil || len(headers) != 0 {
+		t.Fatalf("expected no headers for gRPC calls, got %v (%v)", headers, err)
+	}
+}
+func TestRouted(t *testing.T) {
+	routes := []Route{
+		{Helper: &fixedHelper{header: "default"}},
+		{Scope: "*.example.com", Helper: &fixedHelper{header: "wildcard"}},
+		{Scope: "*.eu.example.com", Helper: &fixedHelper{header: "longer wildcard"}},
+		{Scope: "registry.eu.example.com", Helper: &fixedHelper{header: "host"}},
+		{Scope: "registry.eu.example.com", Helper: &fixedHelper{header: "second host"}},
+	}
+	for _, tc := range []struct {
+		uri, expectedHeader string
+	}{
+		{uri: "https://other.org/file", expectedHeader: "default"},
+		{uri: "https://example.com/file", expectedHeader: "wildcard"},
+		{uri: "https://cdn.example.com/file", expectedHeader: "wildcard"},
+		{uri: "https://cdn.eu.example.com/file", expectedHeader: "longer wildcard"},
+		{uri: "https://REGISTRY.eu.example.com:8443/file", expectedHeader: "host"},
+	} {
+		headers, _, err := Routed(routes).Get(context.Background(), tc.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := headers["Authorization"]; len(got) != 1 || got[0] != tc.expectedHeader {
+			t.Errorf("expected header %q for %s, got %v", tc.expectedHeader, tc.uri, got)
+		}
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"sync"
@@ -16,23 +18,114 @@ type Helper interface {
 	Get(ctx context.Context, uri string) (headers map[string][]string, expiresAt time.Time, err error)
 }
 
+type grpcRequestKey struct{}
+
+// ForGRPC marks ctx as a lookup of credentials for a gRPC call (to the remote cache or remote downloader).
+// Credentials that are not scoped to a host (like the default entry of a netrc file) are meant
+// for the origins of assets and are not returned for gRPC calls.
+func ForGRPC(ctx context.Context) context.Context {
+	return context.WithValue(ctx, grpcRequestKey{}, true)
+}
+
+func isGRPC(ctx context.Context) bool {
+	forGRPC, _ := ctx.Value(grpcRequestKey{}).(bool)
+	return forGRPC
+}
+
+// CacheKey decides which URIs share cached credentials of an external helper.
+type CacheKey string
+
+const (
+	// CacheKeyURI caches credentials per URI.
+	CacheKeyURI CacheKey = "uri"
+	// CacheKeyHost caches credentials per scheme, host and port.
+	CacheKeyHost CacheKey = "host"
+)
+
+// Options configure an external credential helper.
+type Options struct {
+	// Timeout is the maximum time a single invocation of the helper may take (0 means no limit).
+	Timeout time.Duration
+	// CacheKey decides which URIs share cached credentials. Default: CacheKeyURI
+	CacheKey CacheKey
+	// TTL is the time that credentials are cached if the helper doesn't report an expiry time.
+	TTL time.Duration
+	// NegativeTTL is the time that a failure of the helper is cached (0 disables negative caching).
+	NegativeTTL time.Duration
+}
+
 type externalCredentialHelper struct {
 	helperBinary string
+	options      Options
 	cache        map[string]cacheEntry
+	inflight     map[string]*inflightCall
 	mux          sync.RWMutex
 }
 
-func New(credentialHelperBinary string) Helper {
+// New returns a helper that invokes an external credential helper binary.
+// Concurrent requests for the same cache key share a single invocation.
+func New(credentialHelperBinary string, options Options) Helper {
+	if len(options.CacheKey) == 0 {
+		options.CacheKey = CacheKeyURI
+	}
 	return &externalCredentialHelper{
 		helperBinary: credentialHelperBinary,
+		options:      options,
 		cache:        make(map[string]cacheEntry),
+		inflight:     make(map[string]*inflightCall),
 	}
 }
 
 func (e *externalCredentialHelper) Get(ctx context.Context, uri string) (headers map[string][]string, expiresAt time.Time, err error) {
-	if headers, ok := e.getFromCache(uri); ok {
-		return headers, expiresAt, nil
+	key := e.cacheKey(uri)
+	if entry, ok := e.getFromCache(key); ok {
+		return entry.headers, entry.expiresAt, entry.err
+	}
+
+	e.mux.Lock()
+	call, ok := e.inflight[key]
+	if !ok {
+		call = &inflightCall{done: make(chan struct{})}
+		e.inflight[key] = call
+		go e.invoke(key, uri, call)
+	}
+	e.mux.Unlock()
+
+	select {
+	case <-call.done:
+		return call.entry.headers, call.entry.expiresAt, call.entry.err
+	case <-ctx.Done():
+		return nil, time.Time{}, ctx.Err()
+	}
+}
+
+// invoke runs the helper detached from the context of a single caller,
+// since other callers may wait for the same result.
+func (e *externalCredentialHelper) invoke(key, uri string, call *inflightCall) {
+	ctx := context.Background()
+	if e.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.options.Timeout)
+		defer cancel()
 	}
+	headers, expiresAt, err := e.run(ctx, uri)
+	if err != nil {
+		err = fmt.Errorf("credential helper %s: %w", e.helperBinary, err)
+	}
+	call.entry = cacheEntry{headers: headers, expiresAt: expiresAt, err: err}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	delete(e.inflight, key)
+	if err == nil {
+		e.putToCache(key, headers, expiresAt)
+	} else if e.options.NegativeTTL > 0 {
+		e.cache[key] = cacheEntry{err: err, expiresAt: time.Now().Add(e.options.NegativeTTL)}
+	}
+	close(call.done)
+}
+
+func (e *externalCredentialHelper) run(ctx context.Context, uri string) (headers map[string][]string, expiresAt time.Time, err error) {
 	cmd := exec.CommandContext(ctx, e.helperBinary, "get")
 	stdin, err := json.Marshal(externalRequest{URI: uri})
 	if err != nil {
@@ -40,7 +133,12 @@ func (e *externalCredentialHelper) Get(ctx context.Context, uri string) (headers
 	}
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = bytes.NewReader(stdin)
+	// don't wait for children of the helper that keep stdout open after it was killed
+	cmd.WaitDelay = 100 * time.Millisecond
 	stdout, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, time.Time{}, fmt.Errorf("timed out after %v", e.options.Timeout)
+	}
 	if err != nil {
 		return nil, time.Time{}, err
 	}
@@ -55,36 +153,49 @@ func (e *externalCredentialHelper) Get(ctx context.Context, uri string) (headers
 			return nil, time.Time{}, err
 		}
 	}
-	e.putToCache(uri, resp.Headers, expiresAt)
 	return resp.Headers, expiresAt, nil
 }
 
-func (e *externalCredentialHelper) getFromCache(uri string) (headers map[string][]string, ok bool) {
+func (e *externalCredentialHelper) cacheKey(uri string) string {
+	if e.options.CacheKey != CacheKeyHost {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func (e *externalCredentialHelper) getFromCache(key string) (entry cacheEntry, ok bool) {
 	e.mux.RLock()
 	defer e.mux.RUnlock()
-	entry, ok := e.cache[uri]
+	entry, ok = e.cache[key]
 	if !ok {
-		return nil, false
+		return cacheEntry{}, false
 	}
 	if time.Now().After(entry.expiresAt) {
-		return nil, false
+		return cacheEntry{}, false
 	}
-	return entry.headers, true
+	return entry, true
 }
 
-func (e *externalCredentialHelper) putToCache(uri string, headers map[string][]string, expiresAt time.Time) {
-	e.mux.Lock()
-	defer e.mux.Unlock()
+// putToCache must be called with mux held.
+func (e *externalCredentialHelper) putToCache(key string, headers map[string][]string, expiresAt time.Time) {
 	if expiresAt.IsZero() {
-		// TODO: make this configurable
-		expiresAt = time.Now().Add(5 * time.Minute)
+		expiresAt = time.Now().Add(e.options.TTL)
 	}
-	e.cache[uri] = cacheEntry{
+	e.cache[key] = cacheEntry{
 		headers:   headers,
 		expiresAt: expiresAt,
 	}
 }
 
+type inflightCall struct {
+	done  chan struct{}
+	entry cacheEntry
+}
+
 type nopHelper struct{}
 
 func NopHelper() Helper {
@@ -97,11 +208,18 @@ func (nopHelper) Get(ctx context.Context, uri string) (map[string][]string, time
 
 type AuthenticatingRoundTripper struct {
 	helper Helper
+	base   http.RoundTripper
 }
 
-func RoundTripper(helper Helper) *AuthenticatingRoundTripper {
+// RoundTripper returns a round tripper that adds the headers of the credential helper to requests
+// and sends them with base (http.DefaultTransport if nil).
+func RoundTripper(helper Helper, base http.RoundTripper) *AuthenticatingRoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
 	return &AuthenticatingRoundTripper{
 		helper: helper,
+		base:   base,
 	}
 }
 
@@ -115,7 +233,7 @@ func (a *AuthenticatingRoundTripper) RoundTrip(req *http.Request) (*http.Respons
 			req.Header.Add(key, value)
 		}
 	}
-	return http.DefaultTransport.RoundTrip(req)
+	return a.base.RoundTrip(req)
 }
 
 type externalRequest struct {
@@ -130,6 +248,8 @@ type externalResponse struct {
 type cacheEntry struct {
 	headers   map[string][]string
 	expiresAt time.Time
+	// err is set for cached failures
+	err error
 }
 
 var _ http.RoundTripper = &AuthenticatingRoundTripper{}
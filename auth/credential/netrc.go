@@ -0,0 +1,109 @@
+package credential
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// NetrcLine is a single machine (or default) entry of a netrc file.
+type NetrcLine struct {
+	Machine  string // empty for the default entry
+	Login    string
+	Password string
+}
+
+type netrcHelper struct {
+	lines []NetrcLine
+}
+
+// NewNetrc returns a helper that authenticates requests with the login and password of a netrc file
+// (using HTTP basic authentication).
+// The default entry is only used for HTTP origins, not for gRPC calls (see ForGRPC).
+// The file is read once.
+func NewNetrc(path string) (Helper, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading netrc: %w", err)
+	}
+	return &netrcHelper{lines: ParseNetrc(string(data))}, nil
+}
+
+func (n *netrcHelper) Get(ctx context.Context, uri string) (map[string][]string, time.Time, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, line := range n.lines {
+		if line.Machine == host || (len(line.Machine) == 0 && !isGRPC(ctx)) {
+			return basicAuthHeaders(line.Login, line.Password), time.Time{}, nil
+		}
+	}
+	return nil, time.Time{}, nil
+}
+
+// ParseNetrc parses the contents of a netrc file.
+// The default entry (if any) is always last, since it only applies if no machine matches.
+// Macro definitions (macdef) are skipped.
+func ParseNetrc(data string) []NetrcLine {
+	var lines []NetrcLine
+	var defaultLine *NetrcLine
+	var current *NetrcLine
+	inMacro := false
+	for _, line := range strings.Split(data, "\n") {
+		if inMacro {
+			// a macro definition ends with an empty line
+			if len(strings.TrimSpace(line)) == 0 {
+				inMacro = false
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			switch fields[i] {
+			case "machine", "default":
+				if current != nil && len(current.Machine) > 0 {
+					lines = append(lines, *current)
+				}
+				current = &NetrcLine{}
+				if fields[i] == "default" {
+					defaultLine = current
+				} else if i+1 < len(fields) {
+					i++
+					current.Machine = strings.ToLower(fields[i])
+				}
+			case "login", "password", "account":
+				if i+1 >= len(fields) || current == nil {
+					continue
+				}
+				i++
+				switch fields[i-1] {
+				case "login":
+					current.Login = fields[i]
+				case "password":
+					current.Password = fields[i]
+				}
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	if current != nil && len(current.Machine) > 0 {
+		lines = append(lines, *current)
+	}
+	if defaultLine != nil {
+		lines = append(lines, *defaultLine)
+	}
+	return lines
+}
+
+func basicAuthHeaders(username, password string) map[string][]string {
+	credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return map[string][]string{"Authorization": {"Basic " + credentials}}
+}
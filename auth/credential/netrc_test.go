@@ -0,0 +1,82 @@
+package credential
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+	lines := ParseNetrc(`
+default login anonymous password guest
+machine mirror.example.com
+	login alice
+	password secret
+macdef init
+	machine evil.example.com login mallory password nope
+
+machine Registry.example.com login bob account ignored password hunter2
+`)
+	want := []NetrcLine{
+		{Machine: "mirror.example.com", Login: "alice", Password: "secret"},
+		{Machine: "registry.example.com", Login: "bob", Password: "hunter2"},
+		{Login: "anonymous", Password: "guest"},
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("unexpected netrc lines:\n got: %+v\nwant: %+v", lines, want)
+	}
+}
+
+func TestNetrcHelper(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(path, []byte("machine mirror.example.com login alice password secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	helper, err := NewNetrc(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, _, err := helper.Get(context.Background(), "https://mirror.example.com:8443/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := headers["Authorization"]; len(got) != 1 || got[0] != "Basic YWxpY2U6c2VjcmV0" {
+		t.Fatalf("unexpected authorization header: %v", got)
+	}
+
+	// scoped helpers ignore other hosts, and the chain falls through to the next helper
+	chain := Chain(Scoped([]string{"*.internal"}, helper), Bearer(func() (string, error) { return "token", nil }))
+	headers, _, err = chain.Get(context.Background(), "https://mirror.example.com/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := headers["Authorization"]; len(got) != 1 || got[0] != "Bearer token" {
+		t.Fatalf("unexpected authorization header: %v", got)
+	}
+}
+
+func TestNetrcDefaultOnlyForHTTP(t *testing.T) {
+	helper := &netrcHelper{lines: ParseNetrc("machine cache.example.com login alice password secret\ndefault login anonymous password guest\n")}
+	for _, tc := range []struct {
+		name        string
+		ctx         context.Context
+		uri         string
+		expectLogin bool
+	}{
+		{name: "default entry for HTTP origins", ctx: context.Background(), uri: "https://mirror.example.com/file", expectLogin: true},
+		{name: "no default entry for gRPC calls", ctx: ForGRPC(context.Background()), uri: "https://other.example.com/service"},
+		{name: "machine entry for gRPC calls", ctx: ForGRPC(context.Background()), uri: "https://cache.example.com/service", expectLogin: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			headers, _, err := helper.Get(tc.ctx, tc.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(headers) > 0) != tc.expectLogin {
+				t.Fatalf("expected credentials=%v, got %v", tc.expectLogin, headers)
+			}
+		})
+	}
+}
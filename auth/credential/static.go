@@ -0,0 +1,94 @@
+package credential
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Secret returns a token or password.
+// Secrets are read whenever credentials are requested, so rotated secrets are picked up.
+type Secret func() (string, error)
+
+// SecretFromEnv returns a secret that is read from an environment variable.
+func SecretFromEnv(name string) Secret {
+	return func() (string, error) {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	}
+}
+
+// SecretFromFile returns a secret that is read from a file.
+// Leading and trailing whitespace (like a final newline) is removed.
+func SecretFromFile(path string) Secret {
+	return func() (string, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading secret: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+}
+
+type bearerHelper struct {
+	token Secret
+}
+
+// Bearer returns a helper that authenticates every request with a bearer token.
+func Bearer(token Secret) Helper {
+	return &bearerHelper{token: token}
+}
+
+func (b *bearerHelper) Get(ctx context.Context, uri string) (map[string][]string, time.Time, error) {
+	token, err := b.token()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(token) == 0 {
+		return nil, time.Time{}, errors.New("bearer token is empty")
+	}
+	return map[string][]string{"Authorization": {"Bearer " + token}}, time.Time{}, nil
+}
+
+type httpOnlyHelper struct {
+	helper Helper
+}
+
+// HTTPOnly returns a helper that only asks helper for credentials of HTTP origins.
+// It returns no credentials for gRPC calls (see ForGRPC).
+// This keeps credentials that apply to all hosts (like an unscoped bearer token) away from the remote cache and remote downloader.
+func HTTPOnly(helper Helper) Helper {
+	return &httpOnlyHelper{helper: helper}
+}
+
+func (h *httpOnlyHelper) Get(ctx context.Context, uri string) (map[string][]string, time.Time, error) {
+	if isGRPC(ctx) {
+		return nil, time.Time{}, nil
+	}
+	return h.helper.Get(ctx, uri)
+}
+
+type basicHelper struct {
+	username string
+	password Secret
+}
+
+// Basic returns a helper that authenticates every request with a username and password
+// (using HTTP basic authentication).
+func Basic(username string, password Secret) Helper {
+	return &basicHelper{username: username, password: password}
+}
+
+func (b *basicHelper) Get(ctx context.Context, uri string) (map[string][]string, time.Time, error) {
+	password, err := b.password()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return basicAuthHeaders(b.username, password), time.Time{}, nil
+}
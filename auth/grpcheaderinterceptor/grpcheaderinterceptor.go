@@ -40,7 +40,15 @@ func (i *authenticatingInterceptor) streamAddHeaders(ctx context.Context, desc *
 }
 
 func addCredentialsToMD(ctx context.Context, target, method string, md metadata.MD, helper credential.Helper) metadata.MD {
+	if strings.HasPrefix(target, "unix:") {
+		// local sockets have no host name to look up credentials for
+		return md
+	}
 	hostname, ok := strings.CutPrefix(target, "dns:")
+	if !ok {
+		// used for connections through a proxy
+		hostname, ok = strings.CutPrefix(target, "passthrough:///")
+	}
 	if !ok {
 		logging.Warningf("authenticating gRPC: unknown target definition %s", target)
 		return md
@@ -57,7 +65,7 @@ func addCredentialsToMD(ctx context.Context, target, method string, md metadata.
 		Host:   hostname,
 		Path:   "/" + methodParts[1],
 	}
-	headers, _, err := helper.Get(ctx, u.String())
+	headers, _, err := helper.Get(credential.ForGRPC(ctx), u.String())
 	if err != nil {
 		logging.Warningf("authenticating gRPC: failed to get credentials for %s: %v", u.String(), err)
 		return md
@@ -0,0 +1,215 @@
+package ctl
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tweag/asset-fuse/cmd/internal/cmdhelper"
+	"github.com/tweag/asset-fuse/internal/control"
+	"github.com/tweag/asset-fuse/internal/daemon"
+	"github.com/tweag/asset-fuse/service/prefetcher"
+)
+
+const commands = `Commands:
+  reload                               Read the manifest again
+  prefetch [--remote] [--pin] [--wait] PATH...
+                                       Fetch files into the disk cache (or the remote cache)
+  pin [--remote] PATH...               Fetch files into the disk cache and protect them from eviction
+                                       (or keep them alive in the remote cache)
+  unpin PATH...                        Allow eviction of files (locally and remotely)
+  evict PATH...                        Remove files from the disk cache
+  state [PATH...]                      Show the cache state of files (default: all files)
+  metrics                              Show queue and fetch metrics
+  events                               Stream fetch events
+
+PATHs are relative to the mountpoint. Directories refer to all files below them.`
+
+func Run(ctx context.Context, args []string) {
+	var socketPath string
+	var outputJSON bool
+
+	flagSet := flag.NewFlagSet("ctl", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Controls a running mount via its control API.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: asset-fuse ctl [ARGS...] [mountpoint] [COMMAND] [ARGS...]\n")
+		flagSet.PrintDefaults()
+		fmt.Fprintf(flagSet.Output(), "\n%s\n", commands)
+		examples := []string{
+			"asset-fuse ctl ./mnt state",
+			"asset-fuse ctl ./mnt prefetch --wait production/",
+			"asset-fuse ctl ./mnt prefetch --remote production/vm_image.qcow2",
+			"asset-fuse ctl --json ./mnt metrics",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+		os.Exit(1)
+	}
+	flagSet.StringVar(&socketPath, "socket", "", "Path of the control socket. Default: the socket recorded for the mountpoint")
+	flagSet.BoolVar(&outputJSON, "json", false, "Print responses as JSON")
+	flagSet.Parse(args)
+
+	if flagSet.NArg() < 2 {
+		flagSet.Usage()
+	}
+	mountPoint, err := filepath.Abs(flagSet.Arg(0))
+	if err != nil {
+		cmdhelper.FatalFmt("resolving mount point %s: %v", flagSet.Arg(0), err)
+	}
+	if len(socketPath) == 0 {
+		socketPath = daemon.DefaultControlSocket(mountPoint)
+		if record, ok, _ := daemon.ReadRecord(mountPoint); ok && len(record.ControlSocket) > 0 {
+			socketPath = record.ControlSocket
+		}
+	}
+	client := control.NewClient(socketPath)
+	command, commandArgs := flagSet.Arg(1), flagSet.Args()[2:]
+
+	var resp any
+	switch command {
+	case "reload":
+		resp, err = client.Reload(ctx)
+	case "prefetch", "pin":
+		req := control.PrefetchRequest{Pin: command == "pin", Wait: command == "pin"}
+		prefetchFlags := flag.NewFlagSet(command, flag.ExitOnError)
+		var remote bool
+		prefetchFlags.BoolVar(&remote, "remote", false, "Fetch into the remote cache instead of the disk cache")
+		if command == "prefetch" {
+			prefetchFlags.BoolVar(&req.Pin, "pin", false, "Protect the fetched files from eviction")
+			prefetchFlags.BoolVar(&req.Wait, "wait", false, "Wait until all files are fetched")
+		}
+		prefetchFlags.Parse(commandArgs)
+		if remote {
+			req.Destination = "remote"
+		}
+		req.Paths = requirePaths(flagSet, prefetchFlags.Args())
+		resp, err = client.Prefetch(ctx, req)
+	case "unpin":
+		resp, err = client.Unpin(ctx, requirePaths(flagSet, commandArgs))
+	case "evict":
+		resp, err = client.Evict(ctx, requirePaths(flagSet, commandArgs))
+	case "state":
+		resp, err = client.State(ctx, commandArgs)
+	case "metrics":
+		resp, err = client.Metrics(ctx)
+	case "events":
+		encoder := json.NewEncoder(os.Stdout)
+		err = client.Events(ctx, func(event prefetcher.Event) {
+			if outputJSON {
+				encoder.Encode(event)
+				return
+			}
+			printEvent(event)
+		})
+		if err != nil {
+			cmdhelper.FatalFmt("%s: %v", command, err)
+		}
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", command)
+		flagSet.Usage()
+	}
+	if err != nil {
+		cmdhelper.FatalFmt("%s: %v", command, err)
+	}
+	if outputJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(resp)
+		return
+	}
+	printResponse(resp)
+}
+
+func requirePaths(flagSet *flag.FlagSet, paths []string) []string {
+	if len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "no paths given\n\n")
+		flagSet.Usage()
+	}
+	return paths
+}
+
+func printResponse(resp any) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer writer.Flush()
+	switch resp := resp.(type) {
+	case control.ReloadResponse:
+		if resp.Updated {
+			fmt.Fprintln(writer, "manifest reloaded")
+		} else {
+			fmt.Fprintln(writer, "manifest unchanged")
+		}
+	case control.PathsResponse:
+		if len(resp.Results) == 0 {
+			fmt.Fprintf(writer, "queued %d files\n", resp.Queued)
+			return
+		}
+		fmt.Fprintln(writer, "PATH\tDIGEST\tRESULT")
+		for _, result := range resp.Results {
+			outcome := "ok"
+			switch {
+			case len(result.Error) > 0:
+				outcome = result.Error
+			case result.Evicted:
+				outcome = "evicted"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", result.Path, orDash(result.Digest), outcome)
+		}
+	case control.StateResponse:
+		fmt.Fprintln(writer, "PATH\tDIGEST\tSIZE\tLOCAL\tREMOTE\tPINNED\tPINNED REMOTE")
+		for _, state := range resp.Paths {
+			remote := "-"
+			if state.Remote != nil {
+				remote = fmt.Sprintf("%t", *state.Remote)
+			}
+			size := "-"
+			if state.SizeBytes >= 0 {
+				size = fmt.Sprintf("%d", state.SizeBytes)
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%t\t%s\t%t\t%t\n", state.Path, orDash(state.Digest), size, state.Local, remote, state.Pinned, state.PinnedRemote)
+		}
+	case control.MetricsResponse:
+		fmt.Fprintf(writer, "mountpoint\t%s\n", resp.Mount.MountPoint)
+		fmt.Fprintf(writer, "manifest\t%s\n", resp.Mount.ManifestPath)
+		for _, queue := range []struct {
+			name  string
+			stats prefetcher.QueueStats
+		}{{"remote queue", resp.Prefetcher.RemoteQueue}, {"local queue", resp.Prefetcher.LocalQueue}, {"upload queue", resp.Prefetcher.UploadQueue}} {
+			fmt.Fprintf(writer, "%s\t%d queued, %d active, %d workers\n", queue.name, queue.stats.Queued, queue.stats.Active, queue.stats.Workers)
+		}
+		fmt.Fprintf(writer, "fetches\t%d started, %d finished, %d failed\n", resp.Prefetcher.FetchesStarted, resp.Prefetcher.FetchesFinished, resp.Prefetcher.FetchesFailed)
+		for _, mirror := range resp.Mirrors {
+			preferred := ""
+			if mirror.Preferred {
+				preferred = ", preferred"
+			}
+			fmt.Fprintf(writer, "mirror %s\t%d ok, %d failed, %.0f bytes/s, %.0f%% errors%s\n",
+				mirror.Host, mirror.Successes, mirror.Failures, mirror.BytesPerSecond, 100*mirror.ErrorRate, preferred)
+		}
+	}
+}
+
+func printEvent(event prefetcher.Event) {
+	line := fmt.Sprintf("%s %-14s %-6s %s", event.Time.Format("15:04:05.000"), event.Type, event.Destination, strings.Join(event.URIs, " "))
+	if len(event.Digest) > 0 {
+		line += fmt.Sprintf(" (%s, %d bytes)", event.Digest, event.SizeBytes)
+	}
+	if len(event.Error) > 0 {
+		line += ": " + event.Error
+	}
+	fmt.Println(line)
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
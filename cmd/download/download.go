@@ -5,20 +5,16 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"net/http"
 	"os"
 	"strings"
 	"sync"
 
 	"github.com/tweag/asset-fuse/api"
-	"github.com/tweag/asset-fuse/auth/credential"
 	"github.com/tweag/asset-fuse/cmd/internal/cmdhelper"
 	"github.com/tweag/asset-fuse/fs/manifest"
+	"github.com/tweag/asset-fuse/fs/trace"
 	"github.com/tweag/asset-fuse/integrity"
 	"github.com/tweag/asset-fuse/internal/logging"
-	"github.com/tweag/asset-fuse/service/asset"
-	"github.com/tweag/asset-fuse/service/cas"
-	"github.com/tweag/asset-fuse/service/downloader"
 	"github.com/tweag/asset-fuse/service/prefetcher"
 )
 
@@ -26,6 +22,8 @@ func Run(ctx context.Context, args []string) {
 	wg := &sync.WaitGroup{}
 	defer wg.Wait()
 	var destination string
+	var viaLocal bool
+	var fromTrace string
 
 	flagSet := flag.NewFlagSet("download", flag.ExitOnError)
 	flagSet.Usage = func() {
@@ -35,7 +33,9 @@ func Run(ctx context.Context, args []string) {
 		examples := []string{
 			"asset-fuse download",
 			"asset-fuse download --destination=remote",
+			"asset-fuse download --destination=remote --via-local",
 			"asset-fuse download production/vm_image.qcow2",
+			"asset-fuse download --from-trace=ci.trace",
 		}
 		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
 		for _, example := range examples {
@@ -45,6 +45,8 @@ func Run(ctx context.Context, args []string) {
 	}
 
 	flagSet.StringVar(&destination, "destination", "disk", `The destination of the downloaded assets. Allowed values: ["disk", "remote"]`)
+	flagSet.BoolVar(&viaLocal, "via-local", false, `Download assets for the remote cache locally and upload them to the remote CAS instead of using the remote downloader. The assets are pushed to the remote asset service, so other clients can fetch them by URI.`)
+	flagSet.StringVar(&fromTrace, "from-trace", "", `Download exactly the files in this access trace (see "asset-fuse mount --record_trace") in first-access order. Files that were read are downloaded to disk, files whose digest was only read via xattr are fetched into the remote cache. Overrides --destination.`)
 	globalConfig, err := cmdhelper.InjectGlobalFlagsAndConfigure(args, flagSet, cmdhelper.FlagPresetRemote|cmdhelper.FlagPresetDiskCache)
 	if err != nil {
 		cmdhelper.FatalFmt("%v", err)
@@ -54,67 +56,61 @@ func Run(ctx context.Context, args []string) {
 		logging.Errorf("Invalid destination: %s", destination)
 		flagSet.Usage()
 	}
+	if viaLocal && destination != "remote" && len(fromTrace) == 0 {
+		logging.Errorf("--via-local requires --destination=remote")
+		flagSet.Usage()
+	}
+	if len(fromTrace) > 0 && flagSet.NArg() > 0 {
+		logging.Errorf("--from-trace cannot be combined with targets")
+		flagSet.Usage()
+	}
 
-	rawManifest, err := os.ReadFile(globalConfig.ManifestPath)
+	services, err := cmdhelper.NewServices(globalConfig)
 	if err != nil {
-		cmdhelper.FatalFmt("reading manifest file: %v", err)
+		cmdhelper.FatalFmt("%v", err)
 	}
-	initialManifest, err := manifest.ParseManifest(bytes.NewReader(rawManifest))
+	stopServices, err := services.Start(ctx, globalConfig)
 	if err != nil {
-		cmdhelper.FatalFmt("parsing manifest: %v", err)
+		cmdhelper.FatalFmt("%v", err)
 	}
-	paths := initialManifest.Process()
-	if err != nil {
-		cmdhelper.FatalFmt("parsing manifest: %v", err)
+	defer stopServices()
+	if viaLocal && services.RemoteCache == nil {
+		cmdhelper.FatalFmt("--via-local requires a remote cache")
 	}
+	digestFunction := services.DigestFunction
+	checksumCache := services.ChecksumCache
+	prefetcher := services.Prefetcher
 
-	digestFunction, ok := integrity.AlgorithmFromString(globalConfig.DigestFunction)
-	if !ok {
-		cmdhelper.FatalFmt("invalid digest function: %s", globalConfig.DigestFunction)
-	}
-	diskCache, err := cas.NewDisk(cmdhelper.SubstituteHome(globalConfig.DiskCachePath))
-	if err != nil {
-		cmdhelper.FatalFmt("creating disk cache at %s: %v", globalConfig.DiskCachePath, err)
-	}
-	var credentialHelper credential.Helper
-	if len(globalConfig.CredentialHelper) > 0 {
-		credentialHelper = credential.New(globalConfig.CredentialHelper)
-	} else {
-		logging.Warningf("No credential helper specified. Authentication may be required for some URIs.")
-		credentialHelper = credential.NopHelper()
-	}
-	httpClient := &http.Client{Transport: credential.RoundTripper(credentialHelper)}
-	downloader := downloader.New(diskCache, httpClient)
-	var remoteCache cas.CAS
-	var remoteAsset asset.Asset
-	if len(globalConfig.Remote) > 0 {
-		var err error
-		remoteCache, err = cas.NewRemote(globalConfig.Remote, credentialHelper)
+	if len(fromTrace) > 0 {
+		plan, err := trace.PlanFromFile(fromTrace)
 		if err != nil {
-			cmdhelper.FatalFmt("creating remote cache at %s: %v", globalConfig.Remote, err)
+			cmdhelper.FatalFmt("%v", err)
 		}
-		var propagateCredentials bool
-		if globalConfig.RemoteDownloaderPropagateCredentials != nil {
-			propagateCredentials = *globalConfig.RemoteDownloaderPropagateCredentials
+		requests := make([]downloadRequest, 0, len(plan))
+		for _, access := range plan {
+			prefillChecksumCache(checksumCache, access.Asset.Integrity, access.SizeHint, digestFunction)
+			requests = append(requests, downloadRequest{asset: access.Asset, local: access.Local, viaLocal: viaLocal})
 		}
-		remoteAsset, err = asset.NewRemote(globalConfig.Remote, credentialHelper, propagateCredentials)
-		if err != nil {
-			cmdhelper.FatalFmt("creating remote asset service at %s: %v", globalConfig.Remote, err)
+		logging.Basicf("Downloading %d assets from trace %s", len(requests), fromTrace)
+		if err := download(ctx, requests, prefetcher); err != nil {
+			cmdhelper.FatalFmt("%v", err)
 		}
-		logging.Basicf("REAPI server: %s", globalConfig.Remote)
-	} else {
-		logging.Warningf("No REAPI server specified. Running in local mode.")
-		// TODO: instead of nil, use an implementation that returns an error for all operations
-		// to make sure that the code is not accidentally using the remote cache.
-		// Additionally, we can signal to the prefetcher that it should not try to fetch anything.
-	}
-	checksumCache := integrity.NewCache()
-	prefetcher := prefetcher.NewPrefetcher(diskCache, remoteCache, remoteAsset, downloader, checksumCache, digestFunction)
-	stopPrefetcher, err := prefetcher.Start(ctx)
+		logging.Basicf("Downloaded %d assets", len(requests))
+		return
+	}
+
+	rawManifest, err := os.ReadFile(globalConfig.ManifestPath)
 	if err != nil {
-		cmdhelper.FatalFmt("starting prefetcher: %v", err)
+		cmdhelper.FatalFmt("reading manifest file: %v", err)
+	}
+	initialManifest, err := manifest.ParseManifest(bytes.NewReader(rawManifest))
+	if err != nil {
+		cmdhelper.FatalFmt("parsing manifest: %v", err)
+	}
+	paths := initialManifest.Process()
+	if err != nil {
+		cmdhelper.FatalFmt("parsing manifest: %v", err)
 	}
-	defer stopPrefetcher()
 
 	targets := flagSet.Args()
 	var pathsToDownload map[string]manifest.Leaf
@@ -122,6 +118,10 @@ func Run(ctx context.Context, args []string) {
 		logging.Basicf("Downloading all targets into %s cache", destination)
 		pathsToDownload = make(map[string]manifest.Leaf, len(paths))
 		for path, entry := range paths {
+			if entry.Directory {
+				// directory assets are fetched on demand when mounted
+				continue
+			}
 			leaf, err := manifest.LeafFromEntry(entry)
 			if err != nil {
 				cmdhelper.FatalFmt("creating leaf node for %s: %v", path, err)
@@ -133,6 +133,9 @@ func Run(ctx context.Context, args []string) {
 		pathsToDownload = make(map[string]manifest.Leaf)
 		for _, target := range targets {
 			if entry, ok := paths[target]; ok {
+				if entry.Directory {
+					cmdhelper.FatalFmt("path %s is a directory asset, which cannot be downloaded", target)
+				}
 				leaf, err := manifest.LeafFromEntry(entry)
 				if err != nil {
 					cmdhelper.FatalFmt("creating leaf node for %s: %v", target, err)
@@ -143,45 +146,57 @@ func Run(ctx context.Context, args []string) {
 			}
 		}
 	}
+	requests := make([]downloadRequest, 0, len(pathsToDownload))
 	for _, leaf := range pathsToDownload {
 		// Try to prefill the checksum cache with the checksums from the initial manifest.
-		if checksum, ok := leaf.Integrity.ChecksumForAlgorithm(digestFunction); ok && leaf.SizeHint >= 0 {
-			digest := integrity.NewDigest(checksum.Hash, leaf.SizeHint, digestFunction)
-			checksumCache.PutIntegrity(leaf.Integrity, digest)
-		}
+		prefillChecksumCache(checksumCache, leaf.Integrity, leaf.SizeHint, digestFunction)
+		requests = append(requests, downloadRequest{
+			asset:    leaf.Asset(),
+			local:    destination == "disk",
+			viaLocal: viaLocal,
+		})
 	}
 
-	if err := download(pathsToDownload, destination, prefetcher); err != nil {
+	if err := download(ctx, requests, prefetcher); err != nil {
 		cmdhelper.FatalFmt("%v", err)
 	}
 	logging.Basicf("Downloaded %d assets", len(pathsToDownload))
 }
 
-func download(pathsToDownload map[string]manifest.Leaf, destination string, prefetcher *prefetcher.Prefetcher) error {
-	var enqueueForDownload func(asset api.Asset, callbacks ...func(api.Asset, integrity.Digest, error))
-	switch destination {
-	case "disk":
-		enqueueForDownload = prefetcher.EnqueueLocalDownload
-	case "remote":
-		enqueueForDownload = prefetcher.EnqueueRemoteDownload
-	}
+// downloadRequest is an asset that should be downloaded to the disk cache (local) or the remote cache.
+// Assets for the remote cache are uploaded from the disk cache if viaLocal is set.
+type downloadRequest struct {
+	asset    api.Asset
+	local    bool
+	viaLocal bool
+}
 
-	results := make(chan downloadResult, len(pathsToDownload))
-	defer close(results)
+func download(ctx context.Context, requests []downloadRequest, prefetcher *prefetcher.Prefetcher) error {
+	// The channel is never closed, since callbacks may still be running when we return early.
+	// It is buffered, so late callbacks never block.
+	results := make(chan downloadResult, len(requests))
+	callback := func(asset api.Asset, digest integrity.Digest, err error) {
+		results <- downloadResult{asset, digest, err}
+	}
 
-	for _, leaf := range pathsToDownload {
-		asset := api.Asset{
-			URIs:      leaf.URIs,
-			Integrity: leaf.Integrity,
+	for _, request := range requests {
+		if request.local {
+			prefetcher.EnqueueLocalDownload(request.asset, callback)
+		} else if request.viaLocal {
+			prefetcher.EnqueueRemoteUpload(request.asset, callback)
+		} else {
+			prefetcher.EnqueueRemoteDownload(request.asset, callback)
 		}
-		enqueueForDownload(asset, func(asset api.Asset, digest integrity.Digest, err error) {
-			results <- downloadResult{asset, digest, err}
-		})
 	}
 
 	var errors []error
-	for range pathsToDownload {
-		result := <-results
+	for range requests {
+		var result downloadResult
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			return fmt.Errorf("download interrupted: %w", ctx.Err())
+		}
 		if result.err != nil {
 			logging.Errorf("download: %v", result.err)
 			errors = append(errors, result.err)
@@ -193,6 +208,13 @@ func download(pathsToDownload map[string]manifest.Leaf, destination string, pref
 	return nil
 }
 
+func prefillChecksumCache(checksumCache *integrity.ChecksumCache, assetIntegrity integrity.Integrity, sizeHint int64, digestFunction integrity.Algorithm) {
+	if checksum, ok := assetIntegrity.ChecksumForAlgorithm(digestFunction); ok && sizeHint >= 0 {
+		digest := integrity.NewDigest(checksum.Hash, sizeHint, digestFunction)
+		checksumCache.PutIntegrity(assetIntegrity, digest)
+	}
+}
+
 type downloadResult struct {
 	asset  api.Asset
 	digest integrity.Digest
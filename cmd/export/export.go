@@ -8,7 +8,6 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"path/filepath"
 	"slices"
@@ -16,14 +15,10 @@ import (
 	"sync"
 
 	"github.com/tweag/asset-fuse/api"
-	"github.com/tweag/asset-fuse/auth/credential"
 	"github.com/tweag/asset-fuse/cmd/internal/cmdhelper"
 	"github.com/tweag/asset-fuse/fs/manifest"
 	"github.com/tweag/asset-fuse/integrity"
 	"github.com/tweag/asset-fuse/internal/logging"
-	"github.com/tweag/asset-fuse/service/asset"
-	"github.com/tweag/asset-fuse/service/cas"
-	"github.com/tweag/asset-fuse/service/downloader"
 	"github.com/tweag/asset-fuse/service/prefetcher"
 	"golang.org/x/sys/unix"
 )
@@ -124,56 +119,25 @@ func Run(ctx context.Context, args []string) {
 		cmdhelper.FatalFmt("parsing manifest: %v", err)
 	}
 
-	digestFunction, ok := integrity.AlgorithmFromString(globalConfig.DigestFunction)
-	if !ok {
-		cmdhelper.FatalFmt("invalid digest function: %s", globalConfig.DigestFunction)
-	}
-	diskCache, err := cas.NewDisk(cmdhelper.SubstituteHome(globalConfig.DiskCachePath))
+	services, err := cmdhelper.NewServices(globalConfig)
 	if err != nil {
-		cmdhelper.FatalFmt("creating disk cache at %s: %v", globalConfig.DiskCachePath, err)
-	}
-	var credentialHelper credential.Helper
-	if len(globalConfig.CredentialHelper) > 0 {
-		credentialHelper = credential.New(globalConfig.CredentialHelper)
-	} else {
-		logging.Warningf("No credential helper specified. Authentication may be required for some URIs.")
-		credentialHelper = credential.NopHelper()
-	}
-	httpClient := &http.Client{Transport: credential.RoundTripper(credentialHelper)}
-	downloader := downloader.New(diskCache, httpClient)
-	var remoteCache cas.CAS
-	var remoteAsset asset.Asset
-	if len(globalConfig.Remote) > 0 {
-		var err error
-		remoteCache, err = cas.NewRemote(globalConfig.Remote, credentialHelper)
-		if err != nil {
-			cmdhelper.FatalFmt("creating remote cache at %s: %v", globalConfig.Remote, err)
-		}
-		var propagateCredentials bool
-		if globalConfig.RemoteDownloaderPropagateCredentials != nil {
-			propagateCredentials = *globalConfig.RemoteDownloaderPropagateCredentials
-		}
-		remoteAsset, err = asset.NewRemote(globalConfig.Remote, credentialHelper, propagateCredentials)
-		if err != nil {
-			cmdhelper.FatalFmt("creating remote asset service at %s: %v", globalConfig.Remote, err)
-		}
-		logging.Basicf("REAPI server: %s", globalConfig.Remote)
-	} else {
-		logging.Warningf("No REAPI server specified. Running in local mode.")
-		// TODO: instead of nil, use an implementation that returns an error for all operations
-		// to make sure that the code is not accidentally using the remote cache.
-		// Additionally, we can signal to the prefetcher that it should not try to fetch anything.
+		cmdhelper.FatalFmt("%v", err)
 	}
-	checksumCache := integrity.NewCache()
-	prefetcher := prefetcher.NewPrefetcher(diskCache, remoteCache, remoteAsset, downloader, checksumCache, digestFunction)
-	stopPrefetcher, err := prefetcher.Start(ctx)
+	stopServices, err := services.Start(ctx, globalConfig)
 	if err != nil {
-		cmdhelper.FatalFmt("starting prefetcher: %v", err)
+		cmdhelper.FatalFmt("%v", err)
 	}
-	defer stopPrefetcher()
+	defer stopServices()
+	digestFunction := services.DigestFunction
+	checksumCache := services.ChecksumCache
+	prefetcher := services.Prefetcher
 
 	pathsToExport := make(map[string]manifest.Leaf, len(paths))
 	for path, entry := range paths {
+		if entry.Directory {
+			logging.Warningf("skipping directory asset %s", path)
+			continue
+		}
 		leaf, err := manifest.LeafFromEntry(entry)
 		if err != nil {
 			cmdhelper.FatalFmt("creating leaf node for %s: %v", path, err)
@@ -229,11 +193,11 @@ func export(
 	slices.Sort(pathnames)
 
 	for _, path := range pathnames {
-		leaf := pathsToExport[path]
-		asset := api.Asset{
-			URIs:      leaf.URIs,
-			Integrity: leaf.Integrity,
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("export interrupted: %w", err)
 		}
+		leaf := pathsToExport[path]
+		asset := leaf.Asset()
 
 		digest, err := prefetcher.AssetDigest(ctx, asset)
 		if err != nil {
@@ -70,6 +70,7 @@ type flagConfig struct {
 	RemoteDownloaderPropagateCredentials bool
 	FUSEDebug                            bool
 	FailReads                            bool
+	Hardlinks                            bool
 }
 
 func globalFlags(flagSet *flag.FlagSet, preset FlagPreset) *flagConfig {
@@ -77,13 +78,50 @@ func globalFlags(flagSet *flag.FlagSet, preset FlagPreset) *flagConfig {
 	flagSet.StringVar(&config.DigestFunction, "digest_function", "", "Hash function used to compute the digest of a file. It is also used by the remote- and local CAS to reference blobs")
 	flagSet.StringVar(&config.ManifestPath, "manifest", "", "Path to the manifest file")
 	flagSet.StringVar(&config.LogLevel, "log_level", "", `Log level. one of "error", "warning", "basic", "debug"`)
-	flagSet.StringVar(&config.CredentialHelper, "credential_helper", "", "Credential helper to use for authentication")
+	flagSet.Func("credential_helper", `Credential helper to use for authentication, in the form "[scope=]path". The scope is a host name or a wildcard domain like "*.example.com" (can be repeated)`, func(spec string) error {
+		config.CredentialHelpers = append(config.CredentialHelpers, spec)
+		return nil
+	})
+	flagSet.StringVar(&config.CredentialHelperTimeout, "credential_helper_timeout", "", `Maximum time that a single invocation of a credential helper may take. Default: "10s"`)
+	flagSet.StringVar(&config.CredentialHelperCacheKey, "credential_helper_cache_key", "", `Which URIs share credentials returned by a credential helper. One of "uri", "host". Default: "uri"`)
+	flagSet.StringVar(&config.CredentialHelperCacheTTL, "credential_helper_cache_ttl", "", `Time that credentials are cached if the credential helper doesn't report an expiry time. Default: "5m"`)
+	flagSet.StringVar(&config.CredentialHelperNegativeCacheTTL, "credential_helper_negative_cache_ttl", "", `Time that a failure of a credential helper is remembered. "0s" disables negative caching. Default: "30s"`)
+	flagSet.IntVar(&config.RetryMaxAttempts, "retry_max_attempts", 0, `Number of attempts for network requests that fail with a transient error. 1 disables retries. Default: 5`)
+	flagSet.StringVar(&config.RetryInitialBackoff, "retry_initial_backoff", "", `Maximum delay before the first retry (grows exponentially with jitter). Default: "250ms"`)
+	flagSet.StringVar(&config.RetryMaxBackoff, "retry_max_backoff", "", `Maximum delay between retries. Default: "10s"`)
+	flagSet.IntVar(&config.HostFailureThreshold, "host_failure_threshold", 0, `Number of consecutive transient failures after which a mirror is temporarily skipped. A negative value disables skipping. Default: 5`)
+	flagSet.StringVar(&config.HostCooldown, "host_cooldown", "", `Time that an unhealthy mirror is skipped. Default: "30s"`)
+	flagSet.StringVar(&config.MirrorStrategy, "mirror_strategy", "", `Order in which the mirrors of an asset are tried. One of "ordered", "random", "weighted", "race". Default: "ordered"`)
+	flagSet.StringVar(&config.MirrorHedgeDelay, "mirror_hedge_delay", "", `Time after which the "race" mirror strategy starts a request to the next mirror. Default: "2s"`)
+	flagSet.IntVar(&config.DownloadConnections, "download_connections", 0, `Maximum number of concurrent range requests for a single large asset. 1 disables segmented downloads. Default: 4`)
+	flagSet.Int64Var(&config.DownloadSegmentSize, "download_segment_size", 0, `Size (in bytes) of a single range request of a segmented download. Default: 33554432 (32 MiB)`)
+	flagSet.StringVar(&config.OriginStreaming, "origin_streaming", "", `How reads of large assets are served without a remote CAS. One of "off", "on_demand", "read_then_verify". Default: "on_demand"`)
+	flagSet.Func("preferred_host", "Host that is tried before all other mirrors (can be repeated)", func(host string) error {
+		config.PreferredHosts = append(config.PreferredHosts, host)
+		return nil
+	})
+	flagSet.StringVar(&config.Proxy, "proxy", "", `URL of the HTTP(S) proxy for all outgoing connections. Default: use HTTPS_PROXY, HTTP_PROXY and NO_PROXY from the environment`)
+	flagSet.Func("no_proxy", `Host that is contacted without a proxy (can be repeated). A leading "." matches all subdomains`, func(host string) error {
+		config.NoProxy = append(config.NoProxy, host)
+		return nil
+	})
+	flagSet.StringVar(&config.TLSCACertificates, "tls_ca_certificates", "", "Path to a PEM file with additional CA certificates that are trusted for TLS connections")
+	flagSet.StringVar(&config.TLSClientCertificate, "tls_client_certificate", "", "Path to a PEM encoded client certificate for mutual TLS")
+	flagSet.StringVar(&config.TLSClientKey, "tls_client_key", "", "Path to the PEM encoded private key of the client certificate")
 
 	if preset&FlagPresetDiskCache != 0 {
 		flagSet.StringVar(&config.DiskCachePath, "disk_cache", "", "Path to the local (disk) cache directory")
+		flagSet.IntVar(&config.ChecksumCacheMaxEntries, "checksum_cache_max_entries", 0, `Maximum number of entries in the persistent checksum cache (stored in the disk cache). A negative value disables persistence. Default: 250000`)
+		flagSet.StringVar(&config.FetchCacheMaxAge, "fetch_cache_max_age", "", `Time that results of direct downloads are remembered, so fetching the same URIs again needs no network access. "0s" disables the fetch cache. Default: "720h"`)
+		flagSet.StringVar(&config.ShutdownGracePeriod, "shutdown_grace_period", "", `Time that in-flight downloads are given to finish on shutdown before they are cancelled. Default: "30s"`)
 	}
 	if preset&FlagPresetRemote != 0 {
-		flagSet.StringVar(&config.Remote, "remote", "", "grpc(s) endpoint of the REAPI server")
+		flagSet.StringVar(&config.Remote, "remote", "", "grpc(s) or unix endpoint of the REAPI server (or http(s) URL of an HTTP cache)")
+		flagSet.StringVar(&config.RemoteCache, "remote_cache", "", "Endpoint of the remote CAS, if it differs from --remote (an http(s) URL selects the HTTP cache protocol)")
+		flagSet.StringVar(&config.RemoteDownloader, "remote_downloader", "", "Endpoint of the remote asset service, if it differs from --remote")
+		flagSet.StringVar(&config.RemoteInstanceName, "remote_instance_name", "", "REAPI instance name used for the remote CAS and the remote asset service")
+		flagSet.StringVar(&config.RemoteRefreshWindow, "remote_refresh_window", "", `Time that blobs of files whose digest was read via xattr are kept alive in the remote CAS. "0s" disables refreshing. Default: "6h"`)
+		flagSet.StringVar(&config.RemoteRefreshInterval, "remote_refresh_interval", "", `Time between checks that recently used blobs are still in the remote CAS. Default: "10m"`)
 		flagSet.BoolVar(&config.RemoteDownloaderPropagateCredentials, "remote_downloader_propagate_credentials", false, "Propagate credentials to the remote downloader")
 	}
 	if preset&FlagPresetFUSE != 0 {
@@ -91,11 +129,26 @@ func globalFlags(flagSet *flag.FlagSet, preset FlagPreset) *flagConfig {
 		flagSet.StringVar(&config.DigestXattrEncoding, "unix_digest_hash_attribute_encoding", "", `Encoding of the digest in the xattr. For Bazel, this is "raw". For Buck2, this is "hex". Default: "raw"`)
 		flagSet.BoolVar(&config.FailReads, "fail_reads", false, "Let any read operations on regular files fail with EBADF")
 		flagSet.BoolVar(&config.FUSEDebug, "fuse_debug", false, "Emits debug information about the FUSE filesystem")
+		flagSet.StringVar(&config.EntryTimeout, "entry_timeout", "", `Time that the kernel caches name lookups of files. Raise this for manifests that never change. Default: "60s"`)
+		flagSet.StringVar(&config.AttrTimeout, "attr_timeout", "", `Time that the kernel caches attributes of files. Default: "60s"`)
+		flagSet.StringVar(&config.DirentTimeout, "dirent_timeout", "", `Time that the kernel caches lookups and attributes of directories. Default: "24h"`)
+		flagSet.BoolVar(&config.Hardlinks, "hardlinks", false, "Expose files with identical content as hardlinks (same inode, nlink > 1)")
 	}
 	return config
 }
 
 func InjectGlobalFlagsAndConfigure(args []string, flagSet *flag.FlagSet, preset FlagPreset) (api.GlobalConfig, error) {
+	configure, err := InjectGlobalFlags(args, flagSet, preset)
+	if err != nil {
+		return api.GlobalConfig{}, err
+	}
+	return configure()
+}
+
+// InjectGlobalFlags parses the global flags and returns a function that reads the config file
+// and merges it with the flags.
+// Long-running commands can call the returned function again to reload the config file.
+func InjectGlobalFlags(args []string, flagSet *flag.FlagSet, preset FlagPreset) (configure func() (api.GlobalConfig, error), err error) {
 	var configPath string
 	ignoreMissing := true
 
@@ -111,10 +164,10 @@ func InjectGlobalFlagsAndConfigure(args []string, flagSet *flag.FlagSet, preset
 
 	flagConfig := globalFlags(flagSet, preset)
 	if err := flagSet.Parse(args); err != nil {
-		return api.GlobalConfig{}, err
+		return nil, err
 	}
 	// fixup any bool vars
-	flag.Visit(func(f *flag.Flag) {
+	flagSet.Visit(func(f *flag.Flag) {
 		if f.Name == "remote_downloader_propagate_credentials" {
 			flagConfig.GlobalConfig.RemoteDownloaderPropagateCredentials = &flagConfig.RemoteDownloaderPropagateCredentials
 		}
@@ -124,20 +177,25 @@ func InjectGlobalFlagsAndConfigure(args []string, flagSet *flag.FlagSet, preset
 		if f.Name == "fail_reads" {
 			flagConfig.GlobalConfig.FailReads = &flagConfig.FailReads
 		}
+		if f.Name == "hardlinks" {
+			flagConfig.GlobalConfig.Hardlinks = &flagConfig.Hardlinks
+		}
 	})
 
-	fileConfig, err := readConfigFileOrDefault(configPath, ignoreMissing)
-	if err != nil {
-		return api.GlobalConfig{}, err
-	}
+	return func() (api.GlobalConfig, error) {
+		fileConfig, err := readConfigFileOrDefault(configPath, ignoreMissing)
+		if err != nil {
+			return api.GlobalConfig{}, err
+		}
 
-	config, err := mergeConfigs(fileConfig, flagConfig.GlobalConfig)
-	if err != nil {
-		return api.GlobalConfig{}, err
-	}
+		config, err := mergeConfigs(fileConfig, flagConfig.GlobalConfig)
+		if err != nil {
+			return api.GlobalConfig{}, err
+		}
 
-	logging.SetLevel(logging.FromString(config.LogLevel))
-	return config, config.Validate()
+		logging.SetLevel(logging.FromString(config.LogLevel))
+		return config, config.Validate()
+	}, nil
 }
 
 func readConfigFileOrDefault(configPath string, ignoreMissing bool) (api.GlobalConfig, error) {
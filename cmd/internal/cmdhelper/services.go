@@ -0,0 +1,339 @@
+package cmdhelper
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/auth/credential"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/control"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/internal/transport"
+	"github.com/tweag/asset-fuse/service/asset"
+	"github.com/tweag/asset-fuse/service/cas"
+	"github.com/tweag/asset-fuse/service/downloader"
+	"github.com/tweag/asset-fuse/service/prefetcher"
+	"github.com/tweag/asset-fuse/service/retry"
+	uploaderpkg "github.com/tweag/asset-fuse/service/uploader"
+)
+
+// Services bundles the services that are needed to access assets.
+// A single instance can be shared by multiple mounts.
+type Services struct {
+	DigestFunction   integrity.Algorithm
+	DiskCache        *cas.Disk
+	CredentialHelper credential.Helper
+	HTTPClient       *http.Client
+	Downloader       *downloader.Downloader
+	// RemoteCache is nil when running in local mode.
+	RemoteCache cas.CAS
+	// RemoteAsset is nil when running in local mode.
+	RemoteAsset   asset.Asset
+	ChecksumCache *integrity.ChecksumCache
+	Prefetcher    *prefetcher.Prefetcher
+}
+
+// NewServices creates all services needed to access assets according to the global config.
+func NewServices(globalConfig api.GlobalConfig) (*Services, error) {
+	digestFunction, ok := integrity.AlgorithmFromString(globalConfig.DigestFunction)
+	if !ok {
+		return nil, fmt.Errorf("invalid digest function: %s", globalConfig.DigestFunction)
+	}
+	diskCache, err := cas.NewDisk(SubstituteHome(globalConfig.DiskCachePath))
+	if err != nil {
+		return nil, fmt.Errorf("creating disk cache at %s: %w", globalConfig.DiskCachePath, err)
+	}
+	credentialHelper, err := CredentialHelper(globalConfig)
+	if err != nil {
+		return nil, fmt.Errorf("configuring credentials: %w", err)
+	}
+	network, err := Transport(globalConfig)
+	if err != nil {
+		return nil, fmt.Errorf("configuring network: %w", err)
+	}
+	httpClient := &http.Client{Transport: credential.RoundTripper(credentialHelper, network)}
+	retryPolicy := RetryPolicy(globalConfig)
+	var fetchIndex *downloader.FetchIndex
+	if maxAge := globalConfig.FetchCacheMaxAgeDuration(); maxAge > 0 {
+		fetchIndexPath := filepath.Join(SubstituteHome(globalConfig.DiskCachePath), digestFunction.String(), "fetches")
+		fetchIndex, err = downloader.OpenFetchIndex(fetchIndexPath, maxAge)
+		if err != nil {
+			return nil, fmt.Errorf("opening fetch index at %s: %w", fetchIndexPath, err)
+		}
+	}
+	downloader := downloader.New(diskCache, httpClient, downloader.Options{
+		RetryPolicy:    retryPolicy,
+		HostHealth:     retry.NewHostHealth(globalConfig.HostFailureThreshold, globalConfig.HostCooldownDuration()),
+		MirrorStrategy: downloader.MirrorStrategy(globalConfig.MirrorStrategy),
+		PreferredHosts: globalConfig.PreferredHosts,
+		HedgeDelay:     globalConfig.MirrorHedgeDelayDuration(),
+		Connections:    globalConfig.DownloadConnections,
+		SegmentSize:    globalConfig.DownloadSegmentSize,
+		PartialDir:     diskCache.PartialDir(digestFunction),
+		StagingDir:     diskCache.StagingDir(digestFunction),
+		FetchIndex:     fetchIndex,
+
+		OriginStreaming: downloader.OriginStreaming(globalConfig.OriginStreaming),
+	})
+	var remoteCache cas.CAS
+	var remoteAsset asset.Asset
+	remoteCacheEndpoint := globalConfig.RemoteCacheEndpoint()
+	remoteDownloaderEndpoint := globalConfig.RemoteDownloaderEndpoint()
+	if api.IsHTTPCacheEndpoint(remoteCacheEndpoint) {
+		// the HTTP cache protocol has no capabilities to negotiate
+		// and blobs are only addressed by their sha256 hash
+		if digestFunction != integrity.SHA256 {
+			return nil, fmt.Errorf("HTTP cache at %s only supports digest function sha256, not %s", redactEndpoint(remoteCacheEndpoint), digestFunction.String())
+		}
+		remote, err := cas.NewHTTP(remoteCacheEndpoint, httpClient, retryPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("creating HTTP cache at %s: %w", redactEndpoint(remoteCacheEndpoint), err)
+		}
+		remoteCache = remote
+	} else if len(remoteCacheEndpoint) > 0 {
+		remote, err := cas.NewRemote(remoteCacheEndpoint, globalConfig.RemoteInstanceName, credentialHelper, network, retryPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("creating remote cache at %s: %w", remoteCacheEndpoint, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), negotiationTimeout)
+		capabilities, err := remote.Negotiate(ctx)
+		cancel()
+		if err != nil {
+			logging.Warningf("%v - assuming the remote CAS supports all features", err)
+		} else {
+			logging.Debugf("Remote CAS capabilities: digest functions %v, max batch size %d bytes, compressors %v",
+				capabilities.DigestFunctions, capabilities.MaxBatchTotalSizeBytes, capabilities.Compressors)
+		}
+		if !capabilities.SupportsDigestFunction(digestFunction) {
+			remote.Close()
+			return nil, fmt.Errorf("remote cache at %s doesn't support digest function %s (supported: %v)", remoteCacheEndpoint, digestFunction.String(), capabilities.DigestFunctions)
+		}
+		remoteCache = remote
+	}
+	if len(remoteDownloaderEndpoint) > 0 {
+		var propagateCredentials bool
+		if globalConfig.RemoteDownloaderPropagateCredentials != nil {
+			propagateCredentials = *globalConfig.RemoteDownloaderPropagateCredentials
+		}
+		remote, err := asset.NewRemote(remoteDownloaderEndpoint, globalConfig.RemoteInstanceName, credentialHelper, network, propagateCredentials, retryPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("creating remote asset service at %s: %w", remoteDownloaderEndpoint, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), negotiationTimeout)
+		capabilities, err := remote.Negotiate(ctx)
+		cancel()
+		switch {
+		case err != nil:
+			logging.Debugf("%v - assuming the remote downloader supports all features", err)
+			remoteAsset = remote
+		case !capabilities.SupportsDigestFunction(digestFunction):
+			// fetching assets locally still works, so we don't fail
+			logging.Warningf("Remote downloader at %s doesn't support digest function %s (supported: %v). Assets are only fetched directly.",
+				remoteDownloaderEndpoint, digestFunction.String(), capabilities.DigestFunctions)
+			remote.Close()
+			remoteDownloaderEndpoint = ""
+		default:
+			remoteAsset = remote
+		}
+	}
+	switch {
+	case len(remoteCacheEndpoint) == 0 && len(remoteDownloaderEndpoint) == 0:
+		logging.Warningf("No REAPI server specified. Running in local mode.")
+		// TODO: instead of nil, use an implementation that returns an error for all operations
+		// to make sure that the code is not accidentally using the remote cache.
+		// Additionally, we can signal to the prefetcher that it should not try to fetch anything.
+	case remoteCacheEndpoint == remoteDownloaderEndpoint:
+		logging.Basicf("REAPI server: %s", remoteCacheEndpoint)
+	default:
+		if len(remoteCacheEndpoint) > 0 {
+			logging.Basicf("Remote cache: %s", redactEndpoint(remoteCacheEndpoint))
+		}
+		if len(remoteDownloaderEndpoint) > 0 {
+			logging.Basicf("Remote downloader: %s", remoteDownloaderEndpoint)
+		}
+	}
+	var uploader *uploaderpkg.Uploader
+	if remoteCache != nil {
+		// remoteAsset is a nil interface without remote downloader, so assets are not pushed
+		var pusher asset.Push
+		if remoteAsset != nil {
+			pusher = remoteAsset
+		}
+		uploader = uploaderpkg.New(diskCache, remoteCache, pusher, digestFunction, retryPolicy)
+	}
+	checksumCache := integrity.NewCache()
+	if globalConfig.PersistentChecksumCacheEnable() {
+		checksumCachePath := filepath.Join(SubstituteHome(globalConfig.DiskCachePath), digestFunction.String(), "checksums")
+		checksumCache, err = integrity.NewPersistentCache(checksumCachePath, digestFunction, globalConfig.ChecksumCacheMaxEntries)
+		if err != nil {
+			return nil, fmt.Errorf("opening checksum cache at %s: %w", checksumCachePath, err)
+		}
+	}
+	return &Services{
+		DigestFunction:   digestFunction,
+		DiskCache:        diskCache,
+		CredentialHelper: credentialHelper,
+		HTTPClient:       httpClient,
+		Downloader:       downloader,
+		RemoteCache:      remoteCache,
+		RemoteAsset:      remoteAsset,
+		ChecksumCache:    checksumCache,
+		Prefetcher:       prefetcher.NewPrefetcher(diskCache, remoteCache, remoteAsset, downloader, uploader, checksumCache, digestFunction),
+	}, nil
+}
+
+// redactEndpoint hides the password of endpoints with user info (like HTTP caches with basic auth).
+func redactEndpoint(endpoint string) string {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.User == nil {
+		return endpoint
+	}
+	return parsed.Redacted()
+}
+
+// negotiationTimeout limits the time spent asking remote servers for their capabilities at startup.
+const negotiationTimeout = 5 * time.Second
+
+// RetryPolicy returns the retry policy for network requests according to the global config.
+func RetryPolicy(globalConfig api.GlobalConfig) retry.Policy {
+	return retry.Policy{
+		MaxAttempts:    max(globalConfig.RetryMaxAttempts, 1),
+		InitialBackoff: globalConfig.RetryInitialBackoffDuration(),
+		MaxBackoff:     globalConfig.RetryMaxBackoffDuration(),
+	}
+}
+
+// CredentialHelper returns the built-in credential providers and the external credential helpers
+// of the global config, chained in this order.
+func CredentialHelper(globalConfig api.GlobalConfig) (credential.Helper, error) {
+	var helpers []credential.Helper
+	for i, credentialConfig := range globalConfig.Credentials {
+		var helper credential.Helper
+		switch credentialConfig.Type {
+		case "netrc":
+			netrcPath := credentialConfig.Netrc
+			if len(netrcPath) == 0 {
+				netrcPath = "~/.netrc"
+			}
+			var err error
+			helper, err = credential.NewNetrc(SubstituteHome(netrcPath))
+			if err != nil {
+				return nil, fmt.Errorf("credentials[%d]: %w", i, err)
+			}
+		case "bearer":
+			helper = credential.Bearer(secret(credentialConfig.TokenEnv, credentialConfig.TokenFile))
+		case "basic":
+			helper = credential.Basic(credentialConfig.Username, secret(credentialConfig.PasswordEnv, credentialConfig.PasswordFile))
+		default:
+			return nil, fmt.Errorf("credentials[%d]: unknown type %q", i, credentialConfig.Type)
+		}
+		if len(credentialConfig.Hosts) > 0 {
+			helper = credential.Scoped(credentialConfig.Hosts, helper)
+		} else if credentialConfig.Type != "netrc" {
+			// credentials for all hosts are meant for the origins of assets, not for the REAPI servers
+			// (the netrc helper restricts its default entry itself)
+			helper = credential.HTTPOnly(helper)
+		}
+		helpers = append(helpers, helper)
+	}
+	helperOptions := credential.Options{
+		Timeout:     globalConfig.CredentialHelperTimeoutDuration(),
+		CacheKey:    credential.CacheKey(globalConfig.CredentialHelperCacheKey),
+		TTL:         globalConfig.CredentialHelperCacheTTLDuration(),
+		NegativeTTL: globalConfig.CredentialHelperNegativeCacheTTLDuration(),
+	}
+	var routes []credential.Route
+	for _, spec := range globalConfig.CredentialHelpers {
+		scope, path := credential.ParseHelperSpec(spec)
+		routes = append(routes, credential.Route{Scope: scope, Helper: credential.New(path, helperOptions)})
+	}
+	if len(globalConfig.CredentialHelper) > 0 {
+		routes = append(routes, credential.Route{Helper: credential.New(globalConfig.CredentialHelper, helperOptions)})
+	}
+	switch {
+	case len(routes) == 1 && len(routes[0].Scope) == 0:
+		helpers = append(helpers, routes[0].Helper)
+	case len(routes) > 0:
+		helpers = append(helpers, credential.Routed(routes))
+	}
+	if len(helpers) == 0 {
+		logging.Warningf("No credential helper specified. Authentication may be required for some URIs.")
+		return credential.NopHelper(), nil
+	}
+	return credential.Chain(helpers...), nil
+}
+
+func secret(env, path string) credential.Secret {
+	if len(env) > 0 {
+		return credential.SecretFromEnv(env)
+	}
+	return credential.SecretFromFile(SubstituteHome(path))
+}
+
+// Transport returns the proxy and TLS settings for outgoing connections according to the global config.
+func Transport(globalConfig api.GlobalConfig) (*transport.Transport, error) {
+	options := transport.Options{
+		Proxy:   globalConfig.Proxy,
+		NoProxy: globalConfig.NoProxy,
+		TLS:     tlsFiles(globalConfig.TLSCACertificates, globalConfig.TLSClientCertificate, globalConfig.TLSClientKey),
+	}
+	for _, host := range globalConfig.Hosts {
+		options.Hosts = append(options.Hosts, transport.HostOptions{
+			Host:  host.Host,
+			Proxy: host.Proxy,
+			TLS:   tlsFiles(host.TLSCACertificates, host.TLSClientCertificate, host.TLSClientKey),
+		})
+	}
+	return transport.New(options)
+}
+
+func tlsFiles(caCertificates, clientCertificate, clientKey string) transport.TLSFiles {
+	return transport.TLSFiles{
+		CACertificates:    SubstituteHome(caCertificates),
+		ClientCertificate: SubstituteHome(clientCertificate),
+		ClientKey:         SubstituteHome(clientKey),
+	}
+}
+
+// ControlBackend returns the services used by the control API of a mount.
+func (s *Services) ControlBackend() control.Backend {
+	return control.Backend{
+		Prefetcher:     s.Prefetcher,
+		Downloader:     s.Downloader,
+		DiskCache:      s.DiskCache,
+		ChecksumCache:  s.ChecksumCache,
+		RemoteCache:    s.RemoteCache,
+		DigestFunction: s.DigestFunction,
+	}
+}
+
+// Start starts the background workers of the services.
+// The returned stop function waits for in-flight work for up to the configured grace period.
+func (s *Services) Start(ctx context.Context, globalConfig api.GlobalConfig) (stopFunc func(), err error) {
+	stopPrefetcher, err := s.Prefetcher.Start(ctx, globalConfig.ShutdownGracePeriodDuration(), prefetcher.RemoteRefresh{
+		Window:   globalConfig.RemoteRefreshWindowDuration(),
+		Interval: globalConfig.RemoteRefreshIntervalDuration(),
+		Pins: func() ([]cas.RemotePin, error) {
+			return s.DiskCache.RemotePins(s.DigestFunction)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("starting prefetcher: %w", err)
+	}
+	return func() {
+		if err := stopPrefetcher(); err != nil {
+			logging.Warningf("stopping prefetcher: %v", err)
+		}
+		if err := s.ChecksumCache.Close(); err != nil {
+			logging.Warningf("closing checksum cache: %v", err)
+		}
+		if err := s.Downloader.Close(); err != nil {
+			logging.Warningf("closing downloader: %v", err)
+		}
+	}, nil
+}
@@ -100,6 +100,10 @@ func formatManifest(paths manifest.ManifestPaths) any {
 func formatBazelDownload(paths manifest.ManifestPaths) any {
 	var downloadList []bazelDownloadArgs
 	for output, manifestPath := range paths {
+		if manifestPath.Directory {
+			// repository_ctx.download only supports files
+			continue
+		}
 		rawIntegrityStrings, err := manifestPath.GetIntegrity()
 		if err != nil {
 			cmdhelper.FatalFmt("%s: %v", output, err)
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"math/rand"
 	"net/http"
@@ -18,6 +19,7 @@ import (
 	"github.com/tweag/asset-fuse/cmd/internal/cmdhelper"
 	"github.com/tweag/asset-fuse/fs/manifest"
 	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/compression"
 	"github.com/tweag/asset-fuse/internal/logging"
 )
 
@@ -93,15 +95,16 @@ func Run(ctx context.Context, args []string) {
 		cmdhelper.FatalFmt("parsing manifest: %v", err)
 	}
 
-	var credentialHelper credential.Helper
-	if len(globalConfig.CredentialHelper) > 0 {
-		credentialHelper = credential.New(globalConfig.CredentialHelper)
-	} else {
-		logging.Warningf("No credential helper specified. Authentication may be required for some URIs.")
-		credentialHelper = credential.NopHelper()
+	credentialHelper, err := cmdhelper.CredentialHelper(globalConfig)
+	if err != nil {
+		cmdhelper.FatalFmt("configuring credentials: %v", err)
 	}
 
-	httpClient := &http.Client{Transport: credential.RoundTripper(credentialHelper)}
+	network, err := cmdhelper.Transport(globalConfig)
+	if err != nil {
+		cmdhelper.FatalFmt("configuring network: %v", err)
+	}
+	httpClient := &http.Client{Transport: credential.RoundTripper(credentialHelper, network)}
 
 	updatedPaths, unchangedPaths, err := updateManifest(ctx, paths, targets, digestFunction, httpClient)
 	if err != nil {
@@ -120,18 +123,18 @@ func Run(ctx context.Context, args []string) {
 	}
 	for path, leaf := range updatedPaths {
 		entry := manifest.Paths[path]
-		sriList := leaf.Integrity.ToSRIList()
-		var sriMessage json.RawMessage
-		var marshalErr error
-		if len(sriList) == 1 {
-			sriMessage, marshalErr = json.Marshal(sriList[0])
-		} else {
-			sriMessage, marshalErr = json.Marshal(leaf.Integrity.ToSRIList())
-		}
-		if marshalErr != nil {
+		sriMessage, err := marshalIntegrity(leaf.Integrity)
+		if err != nil {
 			cmdhelper.FatalFmt("marshalling integrity: %v", err)
 		}
-		entry.Integrity = json.RawMessage(sriMessage)
+		entry.Integrity = sriMessage
+		if !leaf.CompressedIntegrity.Empty() {
+			compressedSRIMessage, err := marshalIntegrity(leaf.CompressedIntegrity)
+			if err != nil {
+				cmdhelper.FatalFmt("marshalling compressed integrity: %v", err)
+			}
+			entry.CompressedIntegrity = compressedSRIMessage
+		}
 		entry.Size = &leaf.SizeHint
 		manifest.Paths[path] = entry
 	}
@@ -148,6 +151,10 @@ func updateManifest(ctx context.Context, oldPaths manifest.ManifestPaths, target
 	if len(targets) == 0 {
 		// "--all" mode
 		for p, entry := range oldPaths {
+			if entry.Directory {
+				// directory assets have no content to hash
+				continue
+			}
 			targetMap[p], err = manifest.LeafFromEntry(entry)
 			if err != nil {
 				return nil, nil, fmt.Errorf("creating leaf from entry %s: %v", p, err)
@@ -159,6 +166,9 @@ func updateManifest(ctx context.Context, oldPaths manifest.ManifestPaths, target
 			if !ok {
 				return nil, nil, fmt.Errorf("target not found: %s", target)
 			}
+			if entry.Directory {
+				return nil, nil, fmt.Errorf("target is a directory asset: %s", target)
+			}
 			targetMap[target], err = manifest.LeafFromEntry(entry)
 			if err != nil {
 				return nil, nil, fmt.Errorf("creating leaf from entry %s: %v", target, err)
@@ -202,8 +212,21 @@ func updateLeaf(ctx context.Context, path string, leaf manifest.Leaf, digestFunc
 		return manifest.Leaf{}, false, fmt.Errorf("unexpected HTTP status code for %s: %d", uri, resp.StatusCode)
 	}
 
+	// The integrity and size describe the decompressed content of compressed assets.
+	content := io.Reader(resp.Body)
+	var compressedHasher hash.Hash
+	if len(leaf.Compression) > 0 {
+		compressedHasher = digestFunction.Hasher()
+		decompressed, err := compression.NewReader(leaf.Compression, io.TeeReader(resp.Body, compressedHasher))
+		if err != nil {
+			return manifest.Leaf{}, false, fmt.Errorf("decompressing %s: %w", uri, err)
+		}
+		defer decompressed.Close()
+		content = decompressed
+	}
+
 	// TODO: make digest functions configurable
-	updatedIntegrity, sizeBytes, err := integrity.IntegrityFromContent(resp.Body, digestFunction)
+	updatedIntegrity, sizeBytes, err := integrity.IntegrityFromContent(content, digestFunction)
 	if err != nil {
 		return manifest.Leaf{}, false, err
 	}
@@ -212,6 +235,20 @@ func updateLeaf(ctx context.Context, path string, leaf manifest.Leaf, digestFunc
 	oldIntegrity := leaf.Integrity
 	oldSize := leaf.SizeHint
 
+	// only update the compressed integrity if the manifest pins it
+	if compressedHasher != nil && !leaf.CompressedIntegrity.Empty() {
+		// the decompressor may stop before the end of the compressed stream
+		if _, err := io.Copy(compressedHasher, resp.Body); err != nil {
+			return manifest.Leaf{}, false, err
+		}
+		updatedCompressedIntegrity := integrity.IntegrityFromChecksums(integrity.Checksum{Algorithm: digestFunction, Hash: compressedHasher.Sum(nil)})
+		if !updatedCompressedIntegrity.Equivalent(leaf.CompressedIntegrity) {
+			changed = true
+			logging.Basicf("Updated compressed integrity for %s: %q → %q", path, leaf.CompressedIntegrity.ToSRIString(), updatedCompressedIntegrity.ToSRIString())
+			leaf.CompressedIntegrity = updatedCompressedIntegrity
+		}
+	}
+
 	// check if the new digest is different from the old one
 	if !updatedIntegrity.Equivalent(leaf.Integrity) {
 		changed = true
@@ -227,3 +264,12 @@ func updateLeaf(ctx context.Context, path string, leaf manifest.Leaf, digestFunc
 	}
 	return leaf, changed, nil
 }
+
+// marshalIntegrity returns the integrity as a single SRI string (or a list of SRI strings for multiple algorithms).
+func marshalIntegrity(leafIntegrity integrity.Integrity) (json.RawMessage, error) {
+	sriList := leafIntegrity.ToSRIList()
+	if len(sriList) == 1 {
+		return json.Marshal(sriList[0])
+	}
+	return json.Marshal(sriList)
+}
@@ -1,41 +1,31 @@
 package mount
 
 import (
-	"bytes"
 	"context"
 	"flag"
 	"fmt"
-	"maps"
-	"net/http"
 	"os"
-	"os/signal"
-	"slices"
-	"strings"
-	"sync"
-	"syscall"
+	"path/filepath"
 	"time"
 
-	goFUSEfs "github.com/hanwen/go-fuse/v2/fs"
-	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/tweag/asset-fuse/api"
-	"github.com/tweag/asset-fuse/auth/credential"
 	"github.com/tweag/asset-fuse/cmd/internal/cmdhelper"
+	"github.com/tweag/asset-fuse/fs/fsmount"
 	"github.com/tweag/asset-fuse/fs/manifest"
 	"github.com/tweag/asset-fuse/fs/mountinfo"
-	"github.com/tweag/asset-fuse/fs/watcher"
-	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/control"
+	"github.com/tweag/asset-fuse/internal/daemon"
 	"github.com/tweag/asset-fuse/internal/logging"
-	"github.com/tweag/asset-fuse/service/asset"
-	"github.com/tweag/asset-fuse/service/cas"
-	"github.com/tweag/asset-fuse/service/downloader"
-	"github.com/tweag/asset-fuse/service/prefetcher"
 )
 
 func Run(ctx context.Context, args []string) {
-	wg := &sync.WaitGroup{}
-	defer wg.Wait()
 	var viewName string
 	var check bool
+	var runAsDaemon bool
+	var pidFile string
+	var logFile string
+	var recordTrace string
+	var prefetchTrace string
 
 	flagSet := flag.NewFlagSet("mount", flag.ExitOnError)
 	flagSet.Usage = func() {
@@ -44,6 +34,8 @@ func Run(ctx context.Context, args []string) {
 		flagSet.PrintDefaults()
 		examples := []string{
 			"asset-fuse mount ./mnt",
+			"asset-fuse mount --daemon --log_file=/tmp/asset-fuse.log ./mnt",
+			"asset-fuse mount --record_trace=ci.trace --prefetch_trace=ci.trace ./mnt",
 		}
 		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
 		for _, example := range examples {
@@ -54,6 +46,11 @@ func Run(ctx context.Context, args []string) {
 	// TODO: validate viewName against the allowed values and print usage if needed
 	flagSet.StringVar(&viewName, "view", "default", "The view to use on the manifest. Can be used to display assets in different hierarchies. Allowed values: [default, bazel_repo, uri, repository_cache, bazel_disk_cache]")
 	flagSet.BoolVar(&check, "check", false, "Check an existing mountpoint and exit.")
+	flagSet.BoolVar(&runAsDaemon, "daemon", false, "Detach from the terminal and serve the mount in the background.")
+	flagSet.StringVar(&pidFile, "pidfile", "", "Write the pid of the serving process to this file. Default (with --daemon): a file in the asset-fuse state directory")
+	flagSet.StringVar(&logFile, "log_file", "", "Write logs of the daemon to this file (only used with --daemon). Default: a file in the asset-fuse state directory")
+	flagSet.StringVar(&recordTrace, "record_trace", "", "Append accesses to files (lookup, getxattr, open, read) to this trace file. The trace can be replayed with --prefetch_trace or \"asset-fuse download --from-trace\".")
+	flagSet.StringVar(&prefetchTrace, "prefetch_trace", "", "Prefetch the files in this trace file (in first-access order) after mounting.")
 	globalConfig, err := cmdhelper.InjectGlobalFlagsAndConfigure(args, flagSet, cmdhelper.FlagPresetRemote|cmdhelper.FlagPresetDiskCache|cmdhelper.FlagPresetFUSE)
 	if err != nil {
 		cmdhelper.FatalFmt("%v", err)
@@ -63,7 +60,10 @@ func Run(ctx context.Context, args []string) {
 		flagSet.Usage()
 	}
 
-	mountPoint := flagSet.Arg(0)
+	mountPoint, err := filepath.Abs(flagSet.Arg(0))
+	if err != nil {
+		cmdhelper.FatalFmt("resolving mount point %s: %v", flagSet.Arg(0), err)
+	}
 
 	mountStat, err := os.Stat(mountPoint)
 	if os.IsNotExist(err) {
@@ -90,127 +90,85 @@ func Run(ctx context.Context, args []string) {
 		return
 	}
 	if ok {
-		cmdhelper.FatalFmt("Mount point %s is already in use. Please ensure the mount point is ready by running:\n  $ umount %s", mountPoint, mountPoint)
+		cmdhelper.FatalFmt("Mount point %s is already in use. Please ensure the mount point is ready by running:\n  $ asset-fuse unmount %s", mountPoint, mountPoint)
 	}
 
-	digestFunction, ok := integrity.AlgorithmFromString(globalConfig.DigestFunction)
-	view, ok := manifest.ViewFromString(viewName)
-	if !ok {
-		cmdhelper.FatalFmt("invalid view: %s", viewName)
-	}
-	diskCache, err := cas.NewDisk(cmdhelper.SubstituteHome(globalConfig.DiskCachePath))
-	if err != nil {
-		cmdhelper.FatalFmt("creating disk cache at %s: %v", globalConfig.DiskCachePath, err)
-	}
-	if len(view.FakeLeafs) > 0 {
-		// hack: we inject some additional entries into the tree
-		data := cas.DigestsAndData{}
-		for name, content := range view.FakeLeafs {
-			digest, err := digestFunction.CalculateDigest(bytes.NewReader(content))
-			if err != nil {
-				cmdhelper.FatalFmt("calculating digest for fake leaf %s: %v", name, err)
-			}
-			data = append(data, cas.DigestAndData{Digest: digest, Data: content})
+	if runAsDaemon {
+		if len(pidFile) == 0 {
+			pidFile = daemon.DefaultPIDFile(mountPoint)
 		}
-		if _, err := diskCache.BatchUpdateBlobs(ctx, data, digestFunction); err != nil {
-			cmdhelper.FatalFmt("populating disk cache with fake leafs %s: %v", strings.Join(slices.Collect(maps.Keys(view.FakeLeafs)), ", "), err)
+		if len(logFile) == 0 {
+			logFile = daemon.DefaultLogFile(mountPoint)
 		}
 	}
-	var credentialHelper credential.Helper
-	if len(globalConfig.CredentialHelper) > 0 {
-		credentialHelper = credential.New(globalConfig.CredentialHelper)
-	} else {
-		logging.Warningf("No credential helper specified. Authentication may be required for some URIs.")
-		credentialHelper = credential.NopHelper()
-	}
-	httpClient := &http.Client{Transport: credential.RoundTripper(credentialHelper)}
-	downloader := downloader.New(diskCache, httpClient)
-	var remoteCache cas.CAS
-	var remoteAsset asset.Asset
-	if len(globalConfig.Remote) > 0 {
-		var err error
-		remoteCache, err = cas.NewRemote(globalConfig.Remote, credentialHelper)
+	if runAsDaemon && !daemon.IsChild() {
+		pid, err := daemon.Detach(logFile)
 		if err != nil {
-			cmdhelper.FatalFmt("creating remote cache at %s: %v", globalConfig.Remote, err)
+			cmdhelper.FatalFmt("starting daemon: %v", err)
 		}
-		var propagateCredentials bool
-		if globalConfig.RemoteDownloaderPropagateCredentials != nil {
-			propagateCredentials = *globalConfig.RemoteDownloaderPropagateCredentials
-		}
-		remoteAsset, err = asset.NewRemote(globalConfig.Remote, credentialHelper, propagateCredentials)
-		if err != nil {
-			cmdhelper.FatalFmt("creating remote asset service at %s: %v", globalConfig.Remote, err)
-		}
-		logging.Basicf("REAPI server: %s", globalConfig.Remote)
-	} else {
-		logging.Warningf("No REAPI server specified. Running in local mode.")
-		// TODO: instead of nil, use an implementation that returns an error for all operations
-		// to make sure that the code is not accidentally using the remote cache.
-		// Additionally, we can signal to the prefetcher that it should not try to fetch anything.
-	}
-	checksumCache := integrity.NewCache()
-	prefetcher := prefetcher.NewPrefetcher(diskCache, remoteCache, remoteAsset, downloader, checksumCache, digestFunction)
-	stopPrefetcher, err := prefetcher.Start(ctx)
-	if err != nil {
-		cmdhelper.FatalFmt("starting prefetcher: %v", err)
+		logging.Basicf("Mounted %s at %s (pid %d, logs: %s)", globalConfig.ManifestPath, mountPoint, pid, logFile)
+		return
 	}
-	defer stopPrefetcher()
 
-	logging.Basicf("Mounting %s at %s", globalConfig.ManifestPath, mountPoint)
-
-	watcher, root, err := watcher.New(view, globalConfig, checksumCache, prefetcher)
+	if _, ok := manifest.ViewFromString(viewName); !ok {
+		cmdhelper.FatalFmt("invalid view: %s", viewName)
+	}
+	services, err := cmdhelper.NewServices(globalConfig)
 	if err != nil {
-		cmdhelper.FatalFmt("creating manifest watcher: %v", err)
+		daemon.NotifyReady(err)
+		cmdhelper.FatalFmt("%v", err)
 	}
-
-	opts := goFUSEfs.Options{
-		// We probably want different timeouts, depending
-		// on whether we allow live-reloading of the manifest
-		// or not.
-		EntryTimeout: &defaultGoFUSETimeout,
-		AttrTimeout:  &defaultGoFUSETimeout,
-		MountOptions: fuse.MountOptions{
-			Debug:                globalConfig.FUSEDebugEnable(),
-			IgnoreSecurityLabels: true,
-			FsName:               "asset-fuse",
-			Name:                 api.FSTypeChild,
-		},
-	}
-	rawFS := goFUSEfs.NewNodeFS(root, &opts)
-	server, err := fuse.NewServer(rawFS, mountPoint, &opts.MountOptions)
+	stopServices, err := services.Start(ctx, globalConfig)
 	if err != nil {
-		logging.Errorf("%v", err)
-		cmdhelper.FatalFmt("Mounting the filesystem at %q failed.", mountPoint)
+		daemon.NotifyReady(err)
+		cmdhelper.FatalFmt("%v", err)
 	}
+	defer stopServices()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		// TODO: implement signal handler / context cancellation
-		server.Serve()
-	}()
-
-	if err := server.WaitMount(); err != nil {
-		cmdhelper.FatalFmt("mounting: %v", err)
+	mountConfig := api.MountConfig{
+		ManifestPath:  globalConfig.ManifestPath,
+		View:          viewName,
+		MountPoint:    mountPoint,
+		RecordTrace:   recordTrace,
+		PrefetchTrace: prefetchTrace,
+	}
+	mount, err := fsmount.Start(ctx, globalConfig, mountConfig, services.DiskCache, services.ChecksumCache, services.Prefetcher)
+	if err != nil {
+		daemon.NotifyReady(err)
+		cmdhelper.FatalFmt("%v", err)
 	}
 
-	stopChan := make(chan os.Signal, 1)
-	signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		stopSignal := <-stopChan
-		logging.Basicf("Received %v. Unmounting %s", stopSignal.String(), mountPoint)
-
-		watcher.Stop()
-		if err := server.Unmount(); err != nil {
-			logging.Errorf("Unmounting: %v", err)
+	controlSocket := daemon.DefaultControlSocket(mountPoint)
+	controlServer, err := control.Listen(controlSocket, mount, services.ControlBackend())
+	if err != nil {
+		logging.Warningf("starting control API: %v", err)
+		controlSocket = ""
+	} else {
+		defer controlServer.Close()
+	}
+
+	manifestPath, _ := filepath.Abs(globalConfig.ManifestPath)
+	record := daemon.Record{
+		PID:           os.Getpid(),
+		MountPoint:    mountPoint,
+		Manifest:      manifestPath,
+		View:          viewName,
+		LogFile:       logFile,
+		PIDFile:       pidFile,
+		StartedAt:     time.Now(),
+		ControlSocket: controlSocket,
+	}
+	if len(pidFile) > 0 {
+		if err := daemon.WritePIDFile(pidFile); err != nil {
+			logging.Warningf("writing pidfile %s: %v", pidFile, err)
 		}
-	}()
-
-	// Starts the manifest watcher in the background.
-	// Adds itself to the wait group.
-	watcher.Start(ctx, wg)
+		defer os.Remove(pidFile)
+	}
+	if err := daemon.WriteRecord(record); err != nil {
+		logging.Warningf("recording mount in %s: %v", daemon.StateDir(), err)
+	}
+	defer daemon.RemoveRecord(mountPoint)
+	daemon.NotifyReady(nil)
 
-	server.Wait()
+	mount.Wait()
 }
-
-var defaultGoFUSETimeout = 60 * time.Second
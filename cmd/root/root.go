@@ -4,12 +4,18 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/cmd/ctl"
 	"github.com/tweag/asset-fuse/cmd/download"
 	"github.com/tweag/asset-fuse/cmd/export"
 	"github.com/tweag/asset-fuse/cmd/manifest"
 	"github.com/tweag/asset-fuse/cmd/mount"
+	"github.com/tweag/asset-fuse/cmd/serve"
+	"github.com/tweag/asset-fuse/cmd/status"
+	"github.com/tweag/asset-fuse/cmd/unmount"
 	"github.com/tweag/asset-fuse/internal/logging"
 )
 
@@ -17,12 +23,26 @@ const usage = `Usage: asset-fuse [COMMAND] [ARGS...]
 
 Commands:
   mount     Mount the filesystem
+  unmount   Unmount the filesystem
+  serve     Serve all mounts from the config file in one process
+  status    List asset-fuse mounts and their health
+  ctl       Control a running mount (prefetch, evict, metrics, ...)
   manifest  Provides operations on the manifest
   download  Fetches assets to the disk cache (or remote cache)
   export    Exports the manifest to a directory or archive`
 
 func Run(ctx context.Context, args []string) {
 	setLogLevel()
+	// The root context is cancelled on SIGINT or SIGTERM.
+	// Commands use it to stop accepting new work and shut down gracefully.
+	// A second signal terminates the process immediately.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	if len(args) < 2 {
 		printUsage()
 	}
@@ -31,6 +51,14 @@ func Run(ctx context.Context, args []string) {
 	switch command {
 	case "mount":
 		mount.Run(ctx, args[2:])
+	case "unmount":
+		unmount.Run(ctx, args[2:])
+	case "serve":
+		serve.Run(ctx, args[2:])
+	case "status":
+		status.Run(ctx, args[2:])
+	case "ctl":
+		ctl.Run(ctx, args[2:])
 	case "manifest":
 		manifest.Run(ctx, args[2:])
 	case "download":
@@ -0,0 +1,300 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/cmd/internal/cmdhelper"
+	"github.com/tweag/asset-fuse/fs/fsmount"
+	"github.com/tweag/asset-fuse/fs/mountinfo"
+	"github.com/tweag/asset-fuse/internal/control"
+	"github.com/tweag/asset-fuse/internal/daemon"
+	"github.com/tweag/asset-fuse/internal/logging"
+)
+
+func Run(ctx context.Context, args []string) {
+	var runAsDaemon bool
+	var pidFile string
+	var logFile string
+
+	flagSet := flag.NewFlagSet("serve", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Serves all mounts listed in the config file from a single process.\n\n")
+		fmt.Fprintf(flagSet.Output(), "The mounts share the disk cache, remote connections, credentials and the prefetcher.\n")
+		fmt.Fprintf(flagSet.Output(), "Send SIGHUP to reload the list of mounts from the config file.\n")
+		fmt.Fprintf(flagSet.Output(), "Use \"asset-fuse unmount\" to remove a single mount.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: asset-fuse serve [ARGS...]\n")
+		flagSet.PrintDefaults()
+		examples := []string{
+			"asset-fuse serve --config=asset-fuse.json",
+			"asset-fuse serve --daemon --pidfile=/tmp/asset-fuse.pid",
+			"kill -HUP $(cat /tmp/asset-fuse.pid)",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+		os.Exit(1)
+	}
+	flagSet.BoolVar(&runAsDaemon, "daemon", false, "Detach from the terminal and serve the mounts in the background.")
+	flagSet.StringVar(&pidFile, "pidfile", "", "Write the pid of the serving process to this file. Default (with --daemon): a file in the asset-fuse state directory")
+	flagSet.StringVar(&logFile, "log_file", "", "Write logs of the daemon to this file (only used with --daemon). Default: a file in the asset-fuse state directory")
+	configure, err := cmdhelper.InjectGlobalFlags(args, flagSet, cmdhelper.FlagPresetRemote|cmdhelper.FlagPresetDiskCache|cmdhelper.FlagPresetFUSE)
+	if err != nil {
+		cmdhelper.FatalFmt("%v", err)
+	}
+	globalConfig, err := configure()
+	if err != nil {
+		cmdhelper.FatalFmt("%v", err)
+	}
+	if flagSet.NArg() != 0 {
+		flagSet.Usage()
+	}
+	if len(globalConfig.Mounts) == 0 {
+		cmdhelper.FatalFmt(`No mounts configured. Add a "mounts" list to the config file.`)
+	}
+
+	workDir, err := os.Getwd()
+	if err != nil {
+		cmdhelper.FatalFmt("getting working directory: %v", err)
+	}
+	if runAsDaemon {
+		if len(pidFile) == 0 {
+			pidFile = daemon.DefaultServePIDFile(workDir)
+		}
+		if len(logFile) == 0 {
+			logFile = daemon.DefaultServeLogFile(workDir)
+		}
+	}
+	if runAsDaemon && !daemon.IsChild() {
+		pid, err := daemon.Detach(logFile)
+		if err != nil {
+			cmdhelper.FatalFmt("starting daemon: %v", err)
+		}
+		logging.Basicf("Serving %d mounts (pid %d, logs: %s)", len(globalConfig.Mounts), pid, logFile)
+		return
+	}
+
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	defer signal.Stop(reloadSignal)
+
+	services, err := cmdhelper.NewServices(globalConfig)
+	if err != nil {
+		daemon.NotifyReady(err)
+		cmdhelper.FatalFmt("%v", err)
+	}
+	stopServices, err := services.Start(ctx, globalConfig)
+	if err != nil {
+		daemon.NotifyReady(err)
+		cmdhelper.FatalFmt("%v", err)
+	}
+	defer stopServices()
+
+	s := &server{
+		ctx:          ctx,
+		globalConfig: globalConfig,
+		services:     services,
+		logFile:      logFile,
+		pidFile:      pidFile,
+		mounts:       make(map[string]*fsmount.Mount),
+		controls:     make(map[string]*control.Server),
+		exited:       make(chan *fsmount.Mount),
+	}
+	s.reconcile(globalConfig.Mounts)
+	if len(s.mounts) == 0 {
+		err := errors.New("none of the configured mounts could be mounted")
+		daemon.NotifyReady(err)
+		cmdhelper.FatalFmt("%v", err)
+	}
+	if len(pidFile) > 0 {
+		if err := daemon.WritePIDFile(pidFile); err != nil {
+			logging.Warningf("writing pidfile %s: %v", pidFile, err)
+		}
+		defer os.Remove(pidFile)
+	}
+	daemon.NotifyReady(nil)
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-reloadSignal:
+			s.reload(configure)
+		case mount := <-s.exited:
+			mountPoint := mount.Config().MountPoint
+			if s.mounts[mountPoint] == mount {
+				logging.Warningf("%s was unmounted externally", mountPoint)
+				mount.Wait()
+				s.forget(mountPoint)
+			}
+		}
+	}
+
+	// every mount unmounts itself on cancellation of ctx
+	for mountPoint, mount := range s.mounts {
+		mount.Wait()
+		s.forget(mountPoint)
+	}
+}
+
+// server keeps track of the mounts served by this process.
+// It is only accessed from the main loop.
+type server struct {
+	ctx          context.Context
+	globalConfig api.GlobalConfig
+	services     *cmdhelper.Services
+	logFile      string
+	pidFile      string
+	mounts       map[string]*fsmount.Mount
+	controls     map[string]*control.Server
+	// exited receives mounts that are no longer served.
+	exited chan *fsmount.Mount
+}
+
+// reload reads the config file again and applies changes to the list of mounts.
+// Other settings are shared by all mounts and only take effect after a restart.
+func (s *server) reload(configure func() (api.GlobalConfig, error)) {
+	logging.Basicf("Reloading config")
+	newConfig, err := configure()
+	if err != nil {
+		logging.Errorf("reloading config - keeping current mounts: %v", err)
+		return
+	}
+	oldShared, newShared := s.globalConfig, newConfig
+	oldShared.Mounts, newShared.Mounts = nil, nil
+	if !reflect.DeepEqual(oldShared, newShared) {
+		logging.Warningf("config settings other than mounts changed - restart asset-fuse serve to apply them")
+	}
+	s.globalConfig.Mounts = newConfig.Mounts
+	s.reconcile(newConfig.Mounts)
+}
+
+// reconcile mounts and unmounts filesystems until the served mounts match the desired mounts.
+// Mounts with changed settings are remounted.
+func (s *server) reconcile(desired []api.MountConfig) {
+	wanted := make(map[string]api.MountConfig, len(desired))
+	for _, mountConfig := range desired {
+		mountConfig, err := absMountConfig(mountConfig)
+		if err != nil {
+			logging.Errorf("%v", err)
+			continue
+		}
+		wanted[mountConfig.MountPoint] = mountConfig
+	}
+
+	for mountPoint, mount := range s.mounts {
+		if mountConfig, ok := wanted[mountPoint]; ok && mountConfig == mount.Config() {
+			continue
+		}
+		logging.Basicf("Removing mount %s", mountPoint)
+		if err := mount.Unmount(); err != nil {
+			logging.Errorf("unmounting %s - keeping it: %v", mountPoint, err)
+			continue
+		}
+		mount.Wait()
+		s.forget(mountPoint)
+	}
+
+	mountPoints := make([]string, 0, len(wanted))
+	for mountPoint := range wanted {
+		mountPoints = append(mountPoints, mountPoint)
+	}
+	slices.Sort(mountPoints)
+	for _, mountPoint := range mountPoints {
+		if _, ok := s.mounts[mountPoint]; ok {
+			continue
+		}
+		if err := s.mount(wanted[mountPoint]); err != nil {
+			logging.Errorf("%v", err)
+		}
+	}
+}
+
+func (s *server) mount(mountConfig api.MountConfig) error {
+	mountPoint := mountConfig.MountPoint
+	mountStat, err := os.Stat(mountPoint)
+	if err != nil {
+		return fmt.Errorf("mount point %s: %w", mountPoint, err)
+	}
+	if !mountStat.IsDir() {
+		return fmt.Errorf("mount point %s is not a directory", mountPoint)
+	}
+	mounts, err := mountinfo.GetMounts()
+	if err != nil {
+		return fmt.Errorf("getting mountinfo: %w", err)
+	}
+	if _, ok := mounts.MountPoint(mountPoint); ok {
+		return fmt.Errorf("mount point %s is already in use", mountPoint)
+	}
+
+	mount, err := fsmount.Start(s.ctx, s.globalConfig, mountConfig, s.services.DiskCache, s.services.ChecksumCache, s.services.Prefetcher)
+	if err != nil {
+		return err
+	}
+	s.mounts[mountPoint] = mount
+	controlSocket := daemon.DefaultControlSocket(mountPoint)
+	if controlServer, err := control.Listen(controlSocket, mount, s.services.ControlBackend()); err != nil {
+		logging.Warningf("starting control API for %s: %v", mountPoint, err)
+		controlSocket = ""
+	} else {
+		s.controls[mountPoint] = controlServer
+	}
+	record := daemon.Record{
+		PID:           os.Getpid(),
+		MountPoint:    mountPoint,
+		Manifest:      mountConfig.ManifestPath,
+		View:          mountConfig.ViewOrDefault(),
+		LogFile:       s.logFile,
+		PIDFile:       s.pidFile,
+		StartedAt:     time.Now(),
+		Shared:        true,
+		ControlSocket: controlSocket,
+	}
+	if err := daemon.WriteRecord(record); err != nil {
+		logging.Warningf("recording mount in %s: %v", daemon.StateDir(), err)
+	}
+	go func() {
+		<-mount.Done()
+		select {
+		case s.exited <- mount:
+		case <-s.ctx.Done():
+		}
+	}()
+	return nil
+}
+
+func (s *server) forget(mountPoint string) {
+	if controlServer, ok := s.controls[mountPoint]; ok {
+		controlServer.Close()
+		delete(s.controls, mountPoint)
+	}
+	delete(s.mounts, mountPoint)
+	daemon.RemoveRecord(mountPoint)
+}
+
+func absMountConfig(mountConfig api.MountConfig) (api.MountConfig, error) {
+	manifestPath, err := filepath.Abs(mountConfig.ManifestPath)
+	if err != nil {
+		return api.MountConfig{}, fmt.Errorf("resolving manifest %s: %w", mountConfig.ManifestPath, err)
+	}
+	mountPoint, err := filepath.Abs(mountConfig.MountPoint)
+	if err != nil {
+		return api.MountConfig{}, fmt.Errorf("resolving mount point %s: %w", mountConfig.MountPoint, err)
+	}
+	mountConfig.ManifestPath = manifestPath
+	mountConfig.MountPoint = mountPoint
+	mountConfig.View = mountConfig.ViewOrDefault()
+	return mountConfig, nil
+}
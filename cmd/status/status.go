@@ -0,0 +1,147 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tweag/asset-fuse/cmd/internal/cmdhelper"
+	assetfs "github.com/tweag/asset-fuse/fs"
+	"github.com/tweag/asset-fuse/fs/mountinfo"
+	"github.com/tweag/asset-fuse/internal/daemon"
+)
+
+func Run(ctx context.Context, args []string) {
+	var outputJSON bool
+
+	flagSet := flag.NewFlagSet("status", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Lists all asset-fuse mounts and their health.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: asset-fuse status [ARGS...]\n")
+		flagSet.PrintDefaults()
+		examples := []string{
+			"asset-fuse status",
+			"asset-fuse status --json",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+		os.Exit(1)
+	}
+	flagSet.BoolVar(&outputJSON, "json", false, "Print the status as JSON")
+	flagSet.Parse(args)
+
+	if flagSet.NArg() != 0 {
+		flagSet.Usage()
+	}
+
+	mounts, err := mountinfo.GetMounts()
+	if err != nil {
+		cmdhelper.FatalFmt("getting mountinfo: %v", err)
+	}
+
+	statuses := []mountStatus{}
+	for _, mount := range mounts {
+		if !mount.IsAssetFuse() {
+			continue
+		}
+		statuses = append(statuses, statusForMount(ctx, mount))
+	}
+
+	if outputJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(statuses); err != nil {
+			cmdhelper.FatalFmt("encoding status as json: %v", err)
+		}
+		return
+	}
+	if len(statuses) == 0 {
+		fmt.Fprintln(os.Stderr, "No asset-fuse mounts found")
+		return
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "MOUNTPOINT\tMANIFEST\tVIEW\tPID\tHEALTH")
+	for _, s := range statuses {
+		pid := "-"
+		if s.PID > 0 {
+			pid = fmt.Sprintf("%d", s.PID)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", s.MountPoint, orDash(s.Manifest), orDash(s.View), pid, s.Health)
+	}
+	writer.Flush()
+}
+
+type mountStatus struct {
+	MountPoint string    `json:"mountpoint"`
+	Manifest   string    `json:"manifest,omitempty"`
+	View       string    `json:"view,omitempty"`
+	PID        int       `json:"pid,omitempty"`
+	LogFile    string    `json:"log_file,omitempty"`
+	StartedAt  time.Time `json:"started_at,omitzero"`
+	Health     string    `json:"health"`
+}
+
+func statusForMount(ctx context.Context, mount mountinfo.MountInfo) mountStatus {
+	status := mountStatus{MountPoint: mount.MountPoint}
+	record, ok, err := daemon.ReadRecord(mount.MountPoint)
+	if err != nil || !ok {
+		status.Health = healthUnknownOwner
+		return status
+	}
+	status.Manifest = record.Manifest
+	status.View = record.View
+	status.PID = record.PID
+	status.LogFile = record.LogFile
+	status.StartedAt = record.StartedAt
+	if !daemon.ProcessAlive(record.PID) {
+		status.Health = healthDead
+		return status
+	}
+	if !respondsInTime(ctx, mount.MountPoint) {
+		status.Health = healthUnresponsive
+		return status
+	}
+	status.Health = healthOK
+	return status
+}
+
+// respondsInTime stats the hidden watch file of the mount.
+// A stuck or dead FUSE server would block (or fail) this call.
+func respondsInTime(ctx context.Context, mountPoint string) bool {
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(filepath.Join(mountPoint, assetfs.SpecialHiddenWatchFile))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(healthCheckTimeout):
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+const (
+	healthOK           = "ok"
+	healthUnresponsive = "unresponsive"
+	healthDead         = "dead (run asset-fuse unmount)"
+	healthUnknownOwner = "unknown (no record)"
+)
+
+const healthCheckTimeout = 2 * time.Second
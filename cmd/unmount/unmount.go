@@ -0,0 +1,121 @@
+package unmount
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/tweag/asset-fuse/cmd/internal/cmdhelper"
+	"github.com/tweag/asset-fuse/fs/mountinfo"
+	"github.com/tweag/asset-fuse/internal/daemon"
+	"github.com/tweag/asset-fuse/internal/logging"
+)
+
+func Run(ctx context.Context, args []string) {
+	var timeout time.Duration
+	var lazy bool
+
+	flagSet := flag.NewFlagSet("unmount", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Unmounts an asset-fuse filesystem.\n\n")
+		fmt.Fprintf(flagSet.Output(), "The process serving the mount is asked to flush its queues and unmount cleanly.\n")
+		fmt.Fprintf(flagSet.Output(), "If this doesn't succeed in time, the mount is detached lazily.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: asset-fuse unmount [ARGS...] [mountpoint]\n")
+		flagSet.PrintDefaults()
+		examples := []string{
+			"asset-fuse unmount ./mnt",
+			"asset-fuse unmount --lazy ./mnt",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+		os.Exit(1)
+	}
+	flagSet.DurationVar(&timeout, "timeout", 30*time.Second, "Time to wait for the serving process to unmount cleanly before falling back to a lazy unmount.")
+	flagSet.BoolVar(&lazy, "lazy", false, "Skip the clean unmount and detach the mount immediately.")
+	flagSet.Parse(args)
+
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+	}
+	mountPoint, err := filepath.Abs(flagSet.Arg(0))
+	if err != nil {
+		cmdhelper.FatalFmt("resolving mount point %s: %v", flagSet.Arg(0), err)
+	}
+
+	if !isAssetFuseMount(mountPoint) {
+		// clean up leftovers of processes that died without unmounting
+		if record, ok, _ := daemon.ReadRecord(mountPoint); ok && !daemon.ProcessAlive(record.PID) {
+			daemon.RemoveRecord(mountPoint)
+		}
+		cmdhelper.FatalFmt("%s is not an asset-fuse mount", mountPoint)
+	}
+
+	record, hasRecord, err := daemon.ReadRecord(mountPoint)
+	if err != nil {
+		logging.Warningf("reading record of %s: %v", mountPoint, err)
+	}
+	if !lazy && hasRecord && record.Shared && daemon.ProcessAlive(record.PID) {
+		// The process serves other mounts, too. Unmount only this one.
+		// The serving process notices and forgets about the mount.
+		logging.Basicf("Unmounting %s (served by asset-fuse serve, pid %d)", mountPoint, record.PID)
+		if err := daemon.Unmount(mountPoint); err != nil {
+			logging.Warningf("unmounting %s: %v", mountPoint, err)
+		} else if waitForUnmount(ctx, mountPoint, timeout) {
+			logging.Basicf("Unmounted %s", mountPoint)
+			return
+		}
+		logging.Warningf("%s is still mounted - falling back to lazy unmount", mountPoint)
+	} else if !lazy && hasRecord && daemon.ProcessAlive(record.PID) {
+		logging.Basicf("Asking asset-fuse (pid %d) to unmount %s", record.PID, mountPoint)
+		if err := daemon.Signal(record.PID, syscall.SIGTERM); err != nil {
+			logging.Warningf("signalling pid %d: %v", record.PID, err)
+		} else if waitForUnmount(ctx, mountPoint, timeout) {
+			logging.Basicf("Unmounted %s", mountPoint)
+			return
+		} else {
+			logging.Warningf("%s is still mounted after %v - falling back to lazy unmount", mountPoint, timeout)
+		}
+	} else if !lazy {
+		logging.Warningf("no running asset-fuse process found for %s - falling back to lazy unmount", mountPoint)
+	}
+
+	if err := daemon.LazyUnmount(mountPoint); err != nil {
+		cmdhelper.FatalFmt("unmounting %s: %v", mountPoint, err)
+	}
+	if hasRecord && !daemon.ProcessAlive(record.PID) {
+		daemon.RemoveRecord(mountPoint)
+	}
+	logging.Basicf("Detached %s", mountPoint)
+}
+
+func isAssetFuseMount(mountPoint string) bool {
+	mounts, err := mountinfo.GetMounts()
+	if err != nil {
+		cmdhelper.FatalFmt("getting mountinfo: %v", err)
+	}
+	info, ok := mounts.MountPoint(mountPoint)
+	return ok && info.IsAssetFuse()
+}
+
+func waitForUnmount(ctx context.Context, mountPoint string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if !isAssetFuseMount(mountPoint) {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
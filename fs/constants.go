@@ -58,4 +58,5 @@ const (
 
 const FMODE_ACCESS = FMODE_READ | FMODE_WRITE | FMODE_EXEC
 
-const specialHiddenWatchFile = ".asset-fuse-hidden-watch-file"
+// SpecialHiddenWatchFile is present in every asset-fuse mount, but not listed in directory entries.
+const SpecialHiddenWatchFile = ".asset-fuse-hidden-watch-file"
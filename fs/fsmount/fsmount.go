@@ -0,0 +1,213 @@
+// Package fsmount manages the lifecycle of a single asset-fuse mount:
+// creating the filesystem tree from a manifest, serving it via FUSE,
+// and watching the manifest for changes.
+package fsmount
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	goFUSEfs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/fs/manifest"
+	"github.com/tweag/asset-fuse/fs/trace"
+	"github.com/tweag/asset-fuse/fs/watcher"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/service/cas"
+	"github.com/tweag/asset-fuse/service/prefetcher"
+)
+
+// Mount is a mounted and served asset-fuse filesystem.
+type Mount struct {
+	config  api.MountConfig
+	server  *fuse.Server
+	watcher *watcher.ManifestWatcher
+	wg      sync.WaitGroup
+	done    chan struct{}
+}
+
+// Start mounts the view of a manifest at the mountpoint described by mountConfig and serves it in the background.
+// It returns once the filesystem is mounted.
+// The filesystem is unmounted when ctx is cancelled.
+// Settings that are not specific to the mount (like the xattr name) are taken from globalConfig.
+func Start(ctx context.Context, globalConfig api.GlobalConfig, mountConfig api.MountConfig, diskCache *cas.Disk, checksumCache *integrity.ChecksumCache, prefetcher *prefetcher.Prefetcher) (*Mount, error) {
+	digestFunction, ok := integrity.AlgorithmFromString(globalConfig.DigestFunction)
+	if !ok {
+		return nil, fmt.Errorf("invalid digest function: %s", globalConfig.DigestFunction)
+	}
+	view, ok := manifest.ViewFromString(mountConfig.ViewOrDefault())
+	if !ok {
+		return nil, fmt.Errorf("invalid view: %s", mountConfig.View)
+	}
+	if len(view.FakeLeafs) > 0 {
+		// hack: we inject some additional entries into the tree
+		data := cas.DigestsAndData{}
+		for name, content := range view.FakeLeafs {
+			digest, err := digestFunction.CalculateDigest(bytes.NewReader(content))
+			if err != nil {
+				return nil, fmt.Errorf("calculating digest for fake leaf %s: %w", name, err)
+			}
+			data = append(data, cas.DigestAndData{Digest: digest, Data: content})
+		}
+		if _, err := diskCache.BatchUpdateBlobs(ctx, data, digestFunction); err != nil {
+			return nil, fmt.Errorf("populating disk cache with fake leafs %s: %w", strings.Join(slices.Collect(maps.Keys(view.FakeLeafs)), ", "), err)
+		}
+	}
+
+	logging.Basicf("Mounting %s at %s", mountConfig.ManifestPath, mountConfig.MountPoint)
+
+	var plan []trace.Access
+	if len(mountConfig.PrefetchTrace) > 0 {
+		var err error
+		plan, err = trace.PlanFromFile(mountConfig.PrefetchTrace)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var tracer *trace.Recorder
+	if len(mountConfig.RecordTrace) > 0 {
+		var err error
+		tracer, err = trace.NewRecorder(mountConfig.RecordTrace)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the watcher reads the manifest from the global config
+	watcherConfig := globalConfig
+	watcherConfig.ManifestPath = mountConfig.ManifestPath
+	manifestWatcher, root, err := watcher.New(view, watcherConfig, checksumCache, prefetcher, tracer)
+	if err != nil {
+		tracer.Close()
+		return nil, fmt.Errorf("creating manifest watcher: %w", err)
+	}
+
+	// Static manifests can use long timeouts.
+	// Live-reloaded manifests need short timeouts so that changes become visible.
+	entryTimeout := globalConfig.EntryTimeoutDuration()
+	attrTimeout := globalConfig.AttrTimeoutDuration()
+	opts := goFUSEfs.Options{
+		EntryTimeout: &entryTimeout,
+		AttrTimeout:  &attrTimeout,
+		MountOptions: fuse.MountOptions{
+			// READDIRPLUS returns the attributes of all entries together with the listing,
+			// so "ls -l" does not need a separate LOOKUP round trip per file.
+			// go-fuse fills in the attributes by calling Lookup for every entry,
+			// which takes them from the cached listing (see dirent.Readdir).
+			DisableReadDirPlus:   false,
+			Debug:                globalConfig.FUSEDebugEnable(),
+			IgnoreSecurityLabels: true,
+			FsName:               "asset-fuse",
+			Name:                 api.FSTypeChild,
+		},
+	}
+	rawFS := goFUSEfs.NewNodeFS(root, &opts)
+	server, err := fuse.NewServer(rawFS, mountConfig.MountPoint, &opts.MountOptions)
+	if err != nil {
+		manifestWatcher.Stop()
+		tracer.Close()
+		return nil, fmt.Errorf("mounting the filesystem at %q: %w", mountConfig.MountPoint, err)
+	}
+
+	m := &Mount{
+		config:  mountConfig,
+		server:  server,
+		watcher: manifestWatcher,
+		done:    make(chan struct{}),
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		// Shutdown is triggered by cancellation of ctx or by Unmount.
+		server.Serve()
+	}()
+	if err := server.WaitMount(); err != nil {
+		manifestWatcher.Stop()
+		server.Unmount()
+		tracer.Close()
+		return nil, fmt.Errorf("mounting: %w", err)
+	}
+
+	watcherCtx, cancelWatcher := context.WithCancel(ctx)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer cancelWatcher()
+		select {
+		case <-ctx.Done():
+			logging.Basicf("Received shutdown request. Unmounting %s", mountConfig.MountPoint)
+			if err := m.Unmount(); err != nil {
+				logging.Errorf("Unmounting %s: %v", mountConfig.MountPoint, err)
+			}
+		case <-m.done:
+			// unmounted via Unmount or externally (e.g. via a lazy unmount)
+		}
+	}()
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		server.Wait()
+		manifestWatcher.Stop()
+		if err := tracer.Close(); err != nil {
+			logging.Errorf("closing access trace %s: %v", mountConfig.RecordTrace, err)
+		}
+		close(m.done)
+	}()
+
+	// Starts the manifest watcher in the background.
+	// Adds itself to the wait group.
+	if err := manifestWatcher.Start(watcherCtx, &m.wg); err != nil {
+		logging.Warningf("watching %s for changes: %v", mountConfig.ManifestPath, err)
+	}
+	if len(plan) > 0 {
+		logging.Basicf("Prefetching %d assets from trace %s", len(plan), mountConfig.PrefetchTrace)
+		// enqueueing blocks while the work queues are full, which must not delay the mount
+		go trace.Enqueue(plan, prefetcher, func(asset api.Asset, _ integrity.Digest, err error) {
+			if err != nil {
+				logging.Warningf("prefetching %v from trace: %v", asset.URIs, err)
+			}
+		})
+	}
+	return m, nil
+}
+
+// Config returns the configuration of the mount.
+func (m *Mount) Config() api.MountConfig {
+	return m.config
+}
+
+// Reload reads the manifest and updates the filesystem if the manifest changed.
+// It reports whether the filesystem was updated.
+func (m *Mount) Reload() (bool, error) {
+	return m.watcher.Reload()
+}
+
+// Leafs returns the files at or below the given path (relative to the mountpoint).
+func (m *Mount) Leafs(leafPath string) map[string]*manifest.Leaf {
+	return m.watcher.Leafs(leafPath)
+}
+
+// Unmount stops watching the manifest and unmounts the filesystem.
+func (m *Mount) Unmount() error {
+	m.watcher.Stop()
+	return m.server.Unmount()
+}
+
+// Done returns a channel that is closed once the filesystem is no longer served.
+// This happens after Unmount, or if the filesystem was unmounted externally.
+func (m *Mount) Done() <-chan struct{} {
+	return m.done
+}
+
+// Wait blocks until the filesystem is no longer served and all background goroutines have returned.
+func (m *Mount) Wait() {
+	<-m.done
+	m.wg.Wait()
+}
@@ -45,12 +45,13 @@ type streamingFileHandle struct {
 }
 
 // NewStreamingFileHandle creates a new streaming file handle.
-func NewStreamingFileHandle(cas cas.CAS, digest integrity.Digest, algorithm integrity.Algorithm, offset int64) FileHandle {
+// The handle may outlive the request that opened it, so ctx should be bound to the lifetime of the service.
+func NewStreamingFileHandle(ctx context.Context, cas cas.CAS, digest integrity.Digest, algorithm integrity.Algorithm, offset int64) FileHandle {
 	source := byteStreamReadSeekCloser{
 		offset: offset,
 		size:   digest.SizeBytes,
 		reconnectAtOffset: func(offset int64) (io.Reader, context.CancelFunc, error) {
-			ctx, cancel := context.WithCancel(context.TODO())
+			ctx, cancel := context.WithCancel(ctx)
 			r, err := cas.ReadStream(ctx, digest, algorithm, offset, max(0, digest.SizeBytes-offset))
 			return r, cancel, err
 		},
@@ -0,0 +1,102 @@
+package fs
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/tweag/asset-fuse/fs/manifest"
+)
+
+// Inode numbers are derived from the manifest, so they are stable across remounts.
+// This allows tools to cache on (dev, ino).
+//
+// - Directories: hash of the path.
+// - Leafs: hash of the integrity and the path.
+// - Leafs in hardlink mode: hash of the integrity and the mode.
+//   Leafs with identical content and mode share a single inode (with nlink > 1).
+
+// direntIno returns the inode number of the directory at the given path.
+func direntIno(direntPath string) uint64 {
+	return inoFromKey("dirent", direntPath)
+}
+
+// leafIno returns the inode number of the leaf at the given path.
+func (r *root) leafIno(leafPath string, leafNode *manifest.Leaf) uint64 {
+	if key, ok := hardlinkKey(leafNode); r.hardlinks && ok {
+		return inoFromKey("leaf", key)
+	}
+	return inoFromKey("leaf", leafNode.Integrity.ToSRIString(), leafPath)
+}
+
+// hardlinkKey identifies the leafs that share an inode in hardlink mode.
+// Leafs without integrity never share an inode.
+func hardlinkKey(leafNode *manifest.Leaf) (string, bool) {
+	integrity := leafNode.Integrity.ToSRIString()
+	if len(integrity) == 0 {
+		return "", false
+	}
+	// an inode has a single mode, so executable and non-executable copies need separate inodes
+	return fmt.Sprintf("%s:%o", integrity, leafNode.Mode()), true
+}
+
+// leafNlink returns the number of links to the inode of the given leaf.
+func (r *root) leafNlink(leafNode *manifest.Leaf) uint32 {
+	if !r.hardlinks {
+		return 1
+	}
+	linkCounts := r.linkCounts.Load()
+	if linkCounts == nil {
+		return 1
+	}
+	key, ok := hardlinkKey(leafNode)
+	if !ok {
+		return 1
+	}
+	if count, ok := (*linkCounts)[key]; ok {
+		return count
+	}
+	return 1
+}
+
+// updateLinkCounts counts leafs with identical content in the tree.
+func (r *root) updateLinkCounts(manifestRoot *manifest.Directory) {
+	if !r.hardlinks {
+		return
+	}
+	linkCounts := make(map[string]uint32)
+	var walk func(directory *manifest.Directory)
+	walk = func(directory *manifest.Directory) {
+		for _, child := range directory.Children {
+			switch child := child.(type) {
+			case *manifest.Directory:
+				walk(child)
+			case *manifest.Leaf:
+				if key, ok := hardlinkKey(child); ok {
+					linkCounts[key]++
+				}
+			}
+		}
+	}
+	walk(manifestRoot)
+	r.linkCounts.Store(&linkCounts)
+}
+
+func inoFromKey(parts ...string) uint64 {
+	hash := fnv.New64a()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	ino := hash.Sum64()
+	if ino <= reservedIno {
+		// 0 means "unknown" and 1 is the root inode
+		ino += reservedIno + 1
+	} else if ino == ^uint64(0) {
+		// some tools use -1 as a sentinel for "no inode"
+		ino--
+	}
+	return ino
+}
+
+// reservedIno is the highest inode number reserved by go-fuse.
+const reservedIno = 1
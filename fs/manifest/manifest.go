@@ -6,12 +6,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/url"
 	"path"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
 
+	"github.com/tweag/asset-fuse/api"
 	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/compression"
 	"github.com/tweag/asset-fuse/internal/logging"
 )
 
@@ -85,13 +90,41 @@ func (m ManifestPaths) validate() error {
 		integrity, err := entry.GetIntegrity()
 		if err != nil {
 			issuesForPath = append(issuesForPath, err.Error())
-		} else if len(integrity) == 0 {
-			issuesForPath = append(issuesForPath, `"integrity" may not be empty`)
+		}
+		compressedIntegrity, err := entry.GetCompressedIntegrity()
+		if err != nil {
+			issuesForPath = append(issuesForPath, err.Error())
+		}
+		if entry.Directory {
+			// directories are resolved by the remote asset service,
+			// so the integrity (if any) refers to the source (like an archive)
+			if len(integrity) == 0 && len(entry.Qualifiers) == 0 {
+				issuesForPath = append(issuesForPath, `directories need "integrity" or "qualifiers" (like "vcs.commit") to be reproducible`)
+			}
+			if len(entry.Compression) > 0 || len(compressedIntegrity) > 0 || entry.Size != nil || entry.Executable {
+				issuesForPath = append(issuesForPath, `directories may not have "compression", "compressed_integrity", "size" or "executable"`)
+			}
+		} else if len(entry.Qualifiers) > 0 {
+			issuesForPath = append(issuesForPath, `"qualifiers" are only supported for directories`)
+		} else if len(entry.Compression) > 0 {
+			if !compression.Valid(entry.Compression) {
+				issuesForPath = append(issuesForPath, fmt.Sprintf(`"compression" must be one of %s`, strings.Join(compression.Codecs, ", ")))
+			}
+			if len(integrity) == 0 && len(compressedIntegrity) == 0 {
+				issuesForPath = append(issuesForPath, `"integrity" or "compressed_integrity" must be provided`)
+			}
+		} else {
+			if len(integrity) == 0 {
+				issuesForPath = append(issuesForPath, `"integrity" may not be empty`)
+			}
+			if len(compressedIntegrity) > 0 {
+				issuesForPath = append(issuesForPath, `"compressed_integrity" requires "compression"`)
+			}
 		}
 		if entry.Size != nil && *entry.Size < 0 {
 			issuesForPath = append(issuesForPath, `"size" must be a non-negative integer`)
 		}
-		if entry.Size == nil {
+		if entry.Size == nil && !entry.Directory {
 			warningsForPath = append(warningsForPath, `"size" was not provided - this may cause performance issues`)
 		}
 		if len(issuesForPath) > 0 {
@@ -120,7 +153,7 @@ type ManifestEntry struct {
 	// When a list is used, only only one digest per algorithm is allowed.
 	// The digests must all be of the same data.
 	// The digest algorithm used by the CAS must be provided (default is sha256).
-	Integrity json.RawMessage `json:"integrity"`
+	Integrity json.RawMessage `json:"integrity,omitempty"`
 	// Size is the (optional) size of the artifact in bytes.
 	// If provided, the size can be returned to the client before the artifact is fetched.
 	// Otherwise, the size can be determined after fetching the artifact.
@@ -128,17 +161,42 @@ type ManifestEntry struct {
 	Size *int64 `json:"size,omitempty"`
 	// Executable marks the file as executable.
 	Executable bool `json:"executable,omitempty"`
+	// Compression is the (optional) codec that the artifact is compressed with at its URIs ("gzip", "zstd", or "xz").
+	// The artifact is served decompressed, so "integrity" and "size" describe the decompressed content.
+	// If "integrity" is not provided, "compressed_integrity" must be.
+	Compression string `json:"compression,omitempty"`
+	// CompressedIntegrity is a string or a list of strings containing the expected SRI digests
+	// of the compressed artifact (as served by the URIs).
+	CompressedIntegrity json.RawMessage `json:"compressed_integrity,omitempty"`
+	// Directory marks the artifact as a directory (like a git repository or an extracted archive).
+	// Directories are resolved with the FetchDirectory rpc of the remote asset service
+	// and served from the remote CAS as a read-only subtree.
+	Directory bool `json:"directory,omitempty"`
+	// Qualifiers are (optional) additional qualifiers for the remote asset service (only for directories).
+	// Example: {"vcs.commit": "0123abc", "resource_type": "application/x-git"}
+	Qualifiers map[string]string `json:"qualifiers,omitempty"`
 }
 
 func (e *ManifestEntry) GetIntegrity() ([]string, error) {
+	return parseIntegrityStrings(e.Integrity, "integrity")
+}
+
+func (e *ManifestEntry) GetCompressedIntegrity() ([]string, error) {
+	return parseIntegrityStrings(e.CompressedIntegrity, "compressed_integrity")
+}
+
+func parseIntegrityStrings(raw json.RawMessage, fieldName string) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
 	var integrity []string
 	var singleIntegrity string
-	if err := json.Unmarshal(e.Integrity, &integrity); err == nil {
+	if err := json.Unmarshal(raw, &integrity); err == nil {
 		// do nothing - the integrity is already parsed
-	} else if err := json.Unmarshal(e.Integrity, &singleIntegrity); err == nil {
+	} else if err := json.Unmarshal(raw, &singleIntegrity); err == nil {
 		integrity = []string{singleIntegrity}
 	} else {
-		return nil, errors.New(`"integrity" must be a string or a list of strings`)
+		return nil, fmt.Errorf(`"%s" must be a string or a list of strings`, fieldName)
 	}
 	return integrity, nil
 }
@@ -162,6 +220,10 @@ type Leaf struct {
 	// A negative value indicates that the size is unknown.
 	SizeHint   int64
 	Executable bool
+	// Compression is the codec that the artifact is compressed with at its URIs (empty if not compressed).
+	// Integrity and SizeHint describe the decompressed content.
+	Compression         string
+	CompressedIntegrity integrity.Integrity
 }
 
 func LeafFromEntry(entry ManifestEntry) (Leaf, error) {
@@ -173,18 +235,40 @@ func LeafFromEntry(entry ManifestEntry) (Leaf, error) {
 	if err != nil {
 		return Leaf{}, err
 	}
+	compressedIntegrityStrings, err := entry.GetCompressedIntegrity()
+	if err != nil {
+		return Leaf{}, err
+	}
+	compressedIntegrity, err := integrity.IntegrityFromString(compressedIntegrityStrings...)
+	if err != nil {
+		return Leaf{}, err
+	}
 	sizeHint := int64(-1)
 	if entry.Size != nil {
 		sizeHint = *entry.Size
 	}
 	return Leaf{
-		URIs:       entry.URIs,
-		Integrity:  leafIntegrity,
-		SizeHint:   sizeHint,
-		Executable: entry.Executable,
+		URIs:                entry.URIs,
+		Integrity:           leafIntegrity,
+		SizeHint:            sizeHint,
+		Executable:          entry.Executable,
+		Compression:         entry.Compression,
+		CompressedIntegrity: compressedIntegrity,
 	}, nil
 }
 
+// Asset returns the asset that the leaf refers to, including its compression.
+func (l *Leaf) Asset() api.Asset {
+	// TODO: make Qualifiers configurable
+	return api.Asset{
+		URIs:      l.URIs,
+		Integrity: l.Integrity,
+
+		Compression:         l.Compression,
+		CompressedIntegrity: l.CompressedIntegrity,
+	}
+}
+
 func (l *Leaf) Mode() uint32 {
 	var mode uint32 = modeRegularReadonly
 	if l.Executable {
@@ -193,23 +277,88 @@ func (l *Leaf) Mode() uint32 {
 	return mode
 }
 
+// RemoteDirectory is a directory asset that is resolved to a tree in the remote CAS
+// when it is first accessed.
+type RemoteDirectory struct {
+	URIs []string
+	// Integrity (which may be empty) describes the source of the directory (like an archive).
+	Integrity  integrity.Integrity
+	Qualifiers map[string]string
+}
+
+func RemoteDirectoryFromEntry(entry ManifestEntry) (RemoteDirectory, error) {
+	integrityStrings, err := entry.GetIntegrity()
+	if err != nil {
+		return RemoteDirectory{}, err
+	}
+	directoryIntegrity, err := integrity.IntegrityFromString(integrityStrings...)
+	if err != nil {
+		return RemoteDirectory{}, err
+	}
+	return RemoteDirectory{
+		URIs:       entry.URIs,
+		Integrity:  directoryIntegrity,
+		Qualifiers: entry.Qualifiers,
+	}, nil
+}
+
+func (d *RemoteDirectory) Mode() uint32 {
+	return modeDirReadonly
+}
+
+// Equal reports whether both describe the same directory asset.
+func (d *RemoteDirectory) Equal(other *RemoteDirectory) bool {
+	return slices.Equal(d.URIs, other.URIs) &&
+		d.Integrity.ToSRIString() == other.Integrity.ToSRIString() &&
+		maps.Equal(d.Qualifiers, other.Qualifiers)
+}
+
 type Directory struct {
 	// Children is a map from the name of the child to the child node.
 	// The name must be a valid directory entry name (no "/" or "\0").
-	// The child node can be a directory or a leaf.
+	// The child node can be a directory, a remote directory or a leaf.
 	Children map[string]any
+
+	// sortedNames caches the sorted names of the children.
+	// Trees are never modified after they are built (reloads build a new tree),
+	// so the cache is valid for the lifetime of the Directory.
+	sortedNames     []string
+	sortedNamesOnce sync.Once
 }
 
 func (d *Directory) Mode() uint32 {
 	return syscall.S_IFDIR | 0o555
 }
 
+// SortedNames returns the names of the children in lexical order.
+// The result is computed once and must not be modified.
+// It must only be called after the tree is fully built.
+func (d *Directory) SortedNames() []string {
+	d.sortedNamesOnce.Do(func() {
+		d.sortedNames = slices.Sorted(maps.Keys(d.Children))
+	})
+	return d.sortedNames
+}
+
 type ManifestTree struct {
 	Root  *Directory
 	Leafs map[string]*Leaf
 }
 
 func (t ManifestTree) Insert(leafPath string, leaf Leaf) error {
+	if err := t.insert(leafPath, &leaf); err != nil {
+		return err
+	}
+	t.Leafs[leafPath] = &leaf
+	return nil
+}
+
+// InsertRemoteDirectory inserts a directory that is resolved when it is first accessed.
+func (t ManifestTree) InsertRemoteDirectory(directoryPath string, directory RemoteDirectory) error {
+	return t.insert(directoryPath, &directory)
+}
+
+func (t ManifestTree) insert(leafPath string, node any) error {
 	if leafPath == "" || leafPath[0] == '/' {
 		return errors.New("path must be a non-empty path to the artifact, relative to the mount point")
 	}
@@ -249,7 +398,7 @@ func (t ManifestTree) Insert(leafPath string, leaf Leaf) error {
 
 	leafName := segments[len(segments)-1]
 	if _, ok := current.Children[leafName]; ok {
-		if _, ok := current.Children[leafName].(*Leaf); ok {
+		if _, ok := current.Children[leafName].(*Directory); !ok {
 			// This should be unreachable because we read paths from the a map,
 			// where each key is a unqique leaf path (at least for the default view)
 			// If we ever get here, the canonicalization of paths is broken (or we have a non-unique view).
@@ -257,8 +406,7 @@ func (t ManifestTree) Insert(leafPath string, leaf Leaf) error {
 		}
 		return insertingPathConflictAndKindError
 	}
-	current.Children[leafName] = &leaf
-	t.Leafs[leafPath] = &leaf
+	current.Children[leafName] = node
 	return nil
 }
 
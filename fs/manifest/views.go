@@ -48,6 +48,16 @@ func (v View) Tree(paths ManifestPaths, digestFunction integrity.Algorithm) (Man
 func defaultTreeView(paths ManifestPaths, _ integrity.Algorithm) (ManifestTree, error) {
 	tree := NewTree()
 	for path, entry := range paths {
+		if entry.Directory {
+			directory, err := RemoteDirectoryFromEntry(entry)
+			if err != nil {
+				return ManifestTree{}, fmt.Errorf("building directory node %s for tree from manifest: %w", path, err)
+			}
+			if err := tree.InsertRemoteDirectory(path, directory); err != nil {
+				return ManifestTree{}, fmt.Errorf("inserting %s from manifest into tree: %w", path, err)
+			}
+			continue
+		}
 		leaf, err := LeafFromEntry(entry)
 		if err != nil {
 			return ManifestTree{}, fmt.Errorf("building leaf node %s for tree from manifest: %w", path, err)
@@ -72,6 +82,10 @@ func bazelRepoTreeView(paths ManifestPaths, digestFunction integrity.Algorithm)
 func uriTreeView(paths ManifestPaths, _ integrity.Algorithm) (ManifestTree, error) {
 	tree := NewTree()
 	for path, entry := range paths {
+		if entry.Directory {
+			// directories have no single content that could be served at their URIs
+			continue
+		}
 		for _, uri := range entry.URIs {
 			leaf, err := LeafFromEntry(entry)
 			if err != nil {
@@ -111,6 +125,10 @@ func casView(paths ManifestPaths, templateStr string, onlyPrimaryAlgorithm bool,
 	tree := NewTree()
 	pathsToCreateWithURIs := map[integrity.Algorithm]map[integrity.Digest]casViewLeafInfo{}
 	for path, entry := range paths {
+		if entry.Directory {
+			// the integrity of directories refers to their source, not to a blob
+			continue
+		}
 		sriList, err := entry.GetIntegrity()
 		if err != nil {
 			return ManifestTree{}, fmt.Errorf("building leaf node %s for tree from manifest: %w", path, err)
@@ -132,6 +150,7 @@ func casView(paths ManifestPaths, templateStr string, onlyPrimaryAlgorithm bool,
 		if entry.Size != nil {
 			sizeBytes = *entry.Size
 		}
+		compressedIntegrity := compressedIntegrityOf(entry)
 		for checksum := range leafIntegrity.Items() {
 			// technically, the digest is incorrect, because we fake the size
 			// We only need it as a key to group paths, so it's fine.
@@ -140,11 +159,21 @@ func casView(paths ManifestPaths, templateStr string, onlyPrimaryAlgorithm bool,
 				pathsToCreateWithURIs[checksum.Algorithm] = map[integrity.Digest]casViewLeafInfo{}
 			}
 			leafInfo, ok := pathsToCreateWithURIs[checksum.Algorithm][digest]
+			if ok && (leafInfo.Compression != entry.Compression || leafInfo.CompressedIntegrity.ToSRIString() != compressedIntegrity.ToSRIString()) {
+				// URIs of differently compressed content cannot be mixed:
+				// prefer URIs that serve the content directly
+				if len(entry.Compression) > 0 {
+					continue
+				}
+				ok = false
+			}
 			if !ok {
-				pathsToCreateWithURIs[checksum.Algorithm][digest] = casViewLeafInfo{
-					URIs:       []string{},
-					SizeHint:   sizeBytes,
-					Executable: entry.Executable,
+				leafInfo = casViewLeafInfo{
+					URIs:                []string{},
+					SizeHint:            sizeBytes,
+					Executable:          entry.Executable,
+					Compression:         entry.Compression,
+					CompressedIntegrity: compressedIntegrity,
 				}
 			}
 			leafInfo.URIs = append(leafInfo.URIs, entry.URIs...)
@@ -160,6 +189,9 @@ func casView(paths ManifestPaths, templateStr string, onlyPrimaryAlgorithm bool,
 				Integrity:  integrity.IntegrityFromChecksums(integrity.ChecksumFromDigest(digest, algorithm)),
 				SizeHint:   casViewLeafInfo.SizeHint,
 				Executable: casViewLeafInfo.Executable,
+
+				Compression:         casViewLeafInfo.Compression,
+				CompressedIntegrity: casViewLeafInfo.CompressedIntegrity,
 			}
 			var pathBuilder strings.Builder
 			tpl.Execute(&pathBuilder, casViewTemplateData{
@@ -179,6 +211,23 @@ type casViewLeafInfo struct {
 	URIs       []string
 	SizeHint   int64
 	Executable bool
+
+	Compression         string
+	CompressedIntegrity integrity.Integrity
+}
+
+// compressedIntegrityOf returns the integrity of the compressed content of an entry.
+// Invalid integrity strings are ignored (the integrity is only used to look up cached digests).
+func compressedIntegrityOf(entry ManifestEntry) integrity.Integrity {
+	sriList, err := entry.GetCompressedIntegrity()
+	if err != nil {
+		return integrity.Integrity{}
+	}
+	compressedIntegrity, err := integrity.IntegrityFromString(sriList...)
+	if err != nil {
+		return integrity.Integrity{}
+	}
+	return compressedIntegrity
 }
 
 type casViewTemplateData struct {
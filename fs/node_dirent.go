@@ -3,49 +3,100 @@ package fs
 import (
 	"context"
 	"path"
-	"slices"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/tweag/asset-fuse/fs/manifest"
+	"github.com/tweag/asset-fuse/fs/trace"
 	"github.com/tweag/asset-fuse/internal/logging"
 )
 
 type dirent struct {
 	fs.Inode
 	manifestNode *manifest.Directory
+
+	// remote is set for directories that are resolved via the remote asset service.
+	// Their manifestNode is nil until the directory is first accessed.
+	remote *manifest.RemoteDirectory
+	// resolveMux guards manifestNode, remote, generation and resolving.
+	// It is never held while a remote directory is fetched.
+	resolveMux sync.Mutex
+	// generation changes whenever a manifest reload replaces the directory,
+	// so the result of a resolution that started before is discarded.
+	generation uint64
+	// resolving is the running resolution of remote (nil if none is running).
+	// Concurrent accesses wait for it instead of fetching the directory again.
+	resolving *direntResolution
+
+	// listing caches the entries returned by Readdir
+	// for the current generation of manifestNode.
+	listing atomic.Pointer[direntListing]
+}
+
+// direntResolution is a running (or finished) resolution of a remote directory.
+type direntResolution struct {
+	done         chan struct{}
+	manifestNode *manifest.Directory
+	err          error
+	// stale is set if the manifest replaced the directory while it was resolved.
+	stale bool
+}
+
+// direntListing is the cached result of Readdir for a single manifest.Directory.
+type direntListing struct {
+	manifestNode *manifest.Directory
+	entries      []fuse.DirEntry
+	// sizes holds the sizes of leafs that were known when the listing was created.
+	// For READDIRPLUS, go-fuse calls Lookup for every entry of the listing,
+	// which takes the sizes from here instead of resolving the digest of every leaf again.
+	sizes map[string]int64
+}
+
+// listedSize returns the size of a leaf from the cached listing of manifestNode.
+func (n *dirent) listedSize(manifestNode *manifest.Directory, name string) (int64, bool) {
+	listing := n.listing.Load()
+	if listing == nil || listing.manifestNode != manifestNode {
+		return 0, false
+	}
+	size, ok := listing.sizes[name]
+	return size, ok
 }
 
 func (n *dirent) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	// TODO: decide how to handle TTLs for attributes of leaf nodes
-	// - out.SetAttrTimeout()
-	// - out.SetEntryTimeout()
-	//
-	// in theory, the information in the manifest is static
+	// TTLs for leaf nodes are taken from the mount options ("entry_timeout" and "attr_timeout").
+	// In theory, the information in the manifest is static
 	// so we could set a very long TTL.
 	// However, we want to know periodically if a leaf is still being used,
-	// so we can ensure it is still available in the CAS.
+	// so we can ensure it is still available in the CAS (see Prefetcher.Touch).
 
 	root := n.Root().Operations().(*root)
 
-	if name == specialHiddenWatchFile {
+	if name == SpecialHiddenWatchFile {
 		// special hidden file that can be used to watch for mount / unmount events
 		out.Size = uint64(len(root.mtime.String()))
 		out.Blocks = (out.Size + 511) / 512
 		out.Mode = syscall.S_IFREG | 0o444
 		return n.NewInode(ctx, &watcherfile{}, fs.StableAttr{
 			Mode: syscall.S_IFREG,
+			Ino:  inoFromKey(SpecialHiddenWatchFile),
 		}), 0
 	}
 
-	child, ok := n.manifestNode.Children[name]
+	manifestNode, errno := n.directory(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	child, ok := manifestNode.Children[name]
 	if !ok {
 		// child not found
 		return nil, syscall.ENOENT
 	}
 
+	childPath := path.Join(n.Path(n.Root()), name)
 	var ops fs.InodeEmbedder
 	var stableAttr fs.StableAttr
 	switch child := child.(type) {
@@ -54,23 +105,43 @@ func (n *dirent) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*
 		ops = &dirent{manifestNode: child}
 		out.Mode = child.Mode()
 		stableAttr.Mode = syscall.S_IFDIR
-		out.SetAttrTimeout(direntTTL)
-		out.SetEntryTimeout(direntTTL)
+		stableAttr.Ino = direntIno(childPath)
+		out.SetAttrTimeout(root.direntTTL)
+		out.SetEntryTimeout(root.direntTTL)
+	case *manifest.RemoteDirectory:
+		// child is a readonly directory that is resolved on first access
+		ops = &dirent{remote: child}
+		out.Mode = child.Mode()
+		stableAttr.Mode = syscall.S_IFDIR
+		stableAttr.Ino = direntIno(childPath)
+		out.SetAttrTimeout(root.direntTTL)
+		out.SetEntryTimeout(root.direntTTL)
 	case *manifest.Leaf:
 		// child is a readonly leaf
 		ops = &leaf{
 			manifestNode: child,
 		}
-		size, ok := leafSize(ctx, child, root)
+		root.prefetcher.Touch(child.Asset())
+		size, ok := n.listedSize(manifestNode, name)
+		if !ok {
+			size, ok = leafSize(ctx, child, root)
+		}
 		if !ok {
-			logging.Warningf("%s: reporting unknown size - consider adding the size to the manifest if it is known", path.Join(n.Path(n.Root()), name))
+			// Lookup runs for every entry of a READDIRPLUS listing,
+			// so only warn once per path.
+			if _, warned := root.unknownSizeWarned.LoadOrStore(childPath, struct{}{}); !warned {
+				logging.Warningf("%s: reporting unknown size - consider adding the size to the manifest if it is known", childPath)
+			}
 			size = 0
 		}
 		out.Size = uint64(size)
 		out.Blocks = (out.Size + 511) / 512
 		out.Mode = child.Mode()
+		out.Nlink = root.leafNlink(child)
+		root.traceLeaf(trace.OpLookup, childPath, child, trace.Event{})
 
 		stableAttr.Mode = syscall.S_IFREG
+		stableAttr.Ino = root.leafIno(childPath, child)
 	default:
 		return nil, syscall.EIO
 	}
@@ -78,31 +149,61 @@ func (n *dirent) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*
 	// TODO: should ctime be the same as mtime?
 	out.SetTimes(nil, &root.mtime, &root.mtime)
 
+	// Inode numbers are stable, so the kernel may still know this child
+	// from before a manifest reload. Reuse the existing node with updated contents.
+	if existing := n.GetChild(name); existing != nil && existing.StableAttr() == stableAttr {
+		switch existingOps := existing.Operations().(type) {
+		case *dirent:
+			switch child := child.(type) {
+			case *manifest.Directory:
+				existingOps.UpdateManifest(child)
+			case *manifest.RemoteDirectory:
+				existingOps.UpdateRemote(child)
+			}
+		case *leaf:
+			existingOps.UpdateManifest(child.(*manifest.Leaf))
+		}
+		return existing, 0
+	}
 	return n.NewInode(ctx, ops, stableAttr), 0
 }
 
 func (n *dirent) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	manifestNode, errno := n.directory(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	if listing := n.listing.Load(); listing != nil && listing.manifestNode == manifestNode {
+		return fs.NewListDirStream(listing.entries), 0
+	}
+
 	// preallocate the slice to contain all children, plus "." and ".."
-	var entries []fuse.DirEntry = make([]fuse.DirEntry, 0, len(n.manifestNode.Children)+2)
+	var entries []fuse.DirEntry = make([]fuse.DirEntry, 0, len(manifestNode.Children)+2)
 	entries = append(entries,
-		fuse.DirEntry{Name: ".", Mode: n.Mode()},
-		fuse.DirEntry{Name: "..", Mode: n.Mode()},
+		fuse.DirEntry{Name: ".", Mode: manifestNode.Mode()},
+		fuse.DirEntry{Name: "..", Mode: manifestNode.Mode()},
 	)
 
-	// sort the names to ensure a deterministic order
-	names := make([]string, 0, len(n.manifestNode.Children))
-	for name := range n.manifestNode.Children {
-		names = append(names, name)
-	}
-	slices.Sort(names)
-
-	for _, name := range names {
+	root := n.Root().Operations().(*root)
+	direntPath := n.Path(n.Root())
+	sizes := make(map[string]int64)
+	// the names are sorted to ensure a deterministic order
+	for _, name := range manifestNode.SortedNames() {
 		var mode uint32
-		switch child := n.manifestNode.Children[name].(type) {
+		var ino uint64
+		switch child := manifestNode.Children[name].(type) {
 		case *manifest.Directory:
 			mode = child.Mode()
+			ino = direntIno(path.Join(direntPath, name))
+		case *manifest.RemoteDirectory:
+			mode = child.Mode()
+			ino = direntIno(path.Join(direntPath, name))
 		case *manifest.Leaf:
 			mode = child.Mode()
+			ino = root.leafIno(path.Join(direntPath, name), child)
+			if size, ok := knownLeafSize(child, root); ok {
+				sizes[name] = size
+			}
 		default:
 			return nil, syscall.EIO
 		}
@@ -110,16 +211,21 @@ func (n *dirent) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 		entries = append(entries, fuse.DirEntry{
 			Name: name,
 			Mode: mode,
+			Ino:  ino,
 		})
 	}
+	// The entries are never modified by the DirStream, so they can be shared by concurrent listings.
+	n.listing.Store(&direntListing{manifestNode: manifestNode, entries: entries, sizes: sizes})
 	return fs.NewListDirStream(entries), 0
 }
 
 func (n *dirent) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
 	root := n.Root().Operations().(*root)
-	out.Mode = n.manifestNode.Mode()
+	// Resolved and remote directories share the same mode,
+	// so there is no need to read manifestNode (which is guarded by resolveMux).
+	out.Mode = syscall.S_IFDIR | 0o555
 	out.SetTimes(nil, &root.mtime, &root.mtime)
-	out.SetTimeout(direntTTL)
+	out.SetTimeout(root.direntTTL)
 	return 0
 }
 
@@ -135,13 +241,93 @@ func (n *dirent) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Er
 
 // This function is used during manifest reloads.
 func (n *dirent) UpdateManifest(manifestNode *manifest.Directory) {
+	n.resolveMux.Lock()
+	defer n.resolveMux.Unlock()
+	n.remote = nil
+	n.manifestNode = manifestNode
+	n.generation++
+	n.resolving = nil
+}
+
+// UpdateRemote is used during manifest reloads for directories that are resolved via the remote asset service.
+// The resolved tree is kept if the directory asset didn't change.
+func (n *dirent) UpdateRemote(remote *manifest.RemoteDirectory) {
+	n.resolveMux.Lock()
+	defer n.resolveMux.Unlock()
+	if n.remote == nil || !n.remote.Equal(remote) {
+		n.manifestNode = nil
+		n.generation++
+		n.resolving = nil
+	}
+	n.remote = remote
+}
+
+// directory returns the manifest node of the directory.
+// Remote directories are resolved on first access.
+// Concurrent accesses share a single resolution, which runs without holding resolveMux,
+// so manifest reloads are not blocked by a slow remote.
+// If resolving fails, the error is reported to the caller and resolving is retried on the next access.
+func (n *dirent) directory(ctx context.Context) (*manifest.Directory, syscall.Errno) {
+	for {
+		n.resolveMux.Lock()
+		if n.manifestNode != nil || n.remote == nil {
+			manifestNode := n.manifestNode
+			n.resolveMux.Unlock()
+			return manifestNode, 0
+		}
+		resolution := n.resolving
+		if resolution == nil {
+			resolution = &direntResolution{done: make(chan struct{})}
+			n.resolving = resolution
+			go n.resolve(resolution, n.remote, n.generation)
+		}
+		n.resolveMux.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, syscall.EINTR
+		case <-resolution.done:
+		}
+		if resolution.stale {
+			// the manifest changed the directory in the meantime
+			continue
+		}
+		if resolution.err != nil {
+			return nil, syscall.EIO
+		}
+		return resolution.manifestNode, 0
+	}
+}
+
+// resolve fetches the remote directory and stores the result, unless the manifest replaced the directory in the meantime.
+// It doesn't use the context of the first caller, since the result is shared with every waiting caller.
+func (n *dirent) resolve(resolution *direntResolution, remote *manifest.RemoteDirectory, generation uint64) {
+	defer close(resolution.done)
+	ctx, cancel := context.WithTimeout(context.Background(), remoteDirectoryTimeout)
+	defer cancel()
+	root := n.Root().Operations().(*root)
+	manifestNode, err := resolveRemoteDirectory(ctx, root, remote)
+
+	n.resolveMux.Lock()
+	defer n.resolveMux.Unlock()
+	if n.resolving == resolution {
+		n.resolving = nil
+	}
+	if n.generation != generation {
+		resolution.stale = true
+		return
+	}
+	if err != nil {
+		logging.Errorf("%s: resolving directory: %v", n.Path(n.Root()), err)
+		resolution.err = err
+		return
+	}
+	resolution.manifestNode = manifestNode
 	n.manifestNode = manifestNode
 }
 
-// directory entries are completely virtual and
-// depend only on information in the manifest
-// so we can set a long TTL
-const direntTTL = 24 * time.Hour
+// remoteDirectoryTimeout bounds the time to fetch the tree of a remote directory.
+const remoteDirectoryTimeout = 5 * time.Minute
 
 // ensure dirent type embeds fs.Inode
 var _ = (fs.InodeEmbedder)((*dirent)(nil))
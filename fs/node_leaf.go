@@ -11,6 +11,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/tweag/asset-fuse/api"
 	"github.com/tweag/asset-fuse/fs/manifest"
+	"github.com/tweag/asset-fuse/fs/trace"
 	"github.com/tweag/asset-fuse/integrity"
 	"github.com/tweag/asset-fuse/internal/logging"
 )
@@ -41,6 +42,7 @@ func (l *leaf) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 	}
 	out.Size = uint64(size)
 	out.Blocks = (out.Size + 511) / 512
+	out.Nlink = root.leafNlink(l.manifestNode)
 
 	return 0
 }
@@ -70,12 +72,16 @@ func (l *leaf) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 	if err != nil {
 		return 0, syscall.ENODATA
 	}
+	root.traceLeaf(trace.OpGetxattr, l.Path(l.Root()), l.manifestNode, trace.Event{Attribute: attr})
 
 	// Someone is trying to read the digest hash via xattr.
 	// We can infer that they are coming from Bazel, Buck2, or a similar tool.
 	// Performance hack: we will use this opportunity to prefetch the asset into the remote cache.
 	// This way, remote execution can magically use this file as an action input (without us uploading it to the remote cache).
-	root.prefetcher.EnqueueRemoteDownload(l.toAsset())
+	// The digest may be used long after this, so the prefetcher keeps the asset alive in the remote cache.
+	asset := l.toAsset()
+	root.prefetcher.Advertise(asset)
+	root.prefetcher.EnqueueRemoteDownload(asset)
 
 	var destSizeBytes uint32 = uint32(algorithm.SizeBytes())
 	if root.digestHashXattrEncoding == XattrEncodingHex {
@@ -168,6 +174,7 @@ func (l *leaf) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 	}
 
 	asset := l.toAsset()
+	root.traceLeaf(trace.OpOpen, l.Path(l.Root()), l.manifestNode, trace.Event{})
 
 	// TODO: We are about the read the file, so it would be a good place to prefetch the file into the local cache (in the background).
 
@@ -183,6 +190,7 @@ func (l *leaf) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		failReads: root.failReads,
 		reader:    reader,
 		inode:     l,
+		root:      root,
 	}, 0, 0
 }
 
@@ -192,8 +200,7 @@ func (n *leaf) UpdateManifest(manifestNode *manifest.Leaf) {
 }
 
 func (l *leaf) toAsset() api.Asset {
-	// TODO: make Qualifiers configurable
-	return leafToAsset(l.manifestNode)
+	return l.manifestNode.Asset()
 }
 
 // checksum returns the checksum for the leaf node.
@@ -208,16 +215,8 @@ func (l *leaf) size(ctx context.Context) (int64, bool) {
 	return leafSize(ctx, l.manifestNode, root)
 }
 
-func leafToAsset(leafNode *manifest.Leaf) api.Asset {
-	// TODO: make Qualifiers configurable
-	return api.Asset{
-		URIs:      leafNode.URIs,
-		Integrity: leafNode.Integrity,
-	}
-}
-
 func leafDigest(ctx context.Context, manifestLeaf *manifest.Leaf, root *root) (integrity.Digest, error) {
-	asset := leafToAsset(manifestLeaf)
+	asset := manifestLeaf.Asset()
 	digest, err := root.prefetcher.AssetDigest(ctx, asset)
 	if err != nil {
 		return integrity.Digest{}, err
@@ -240,6 +239,18 @@ func leafChecksum(ctx context.Context, manifestLeaf *manifest.Leaf, algorithm in
 	return integrity.Checksum{}, syscall.ENODATA
 }
 
+// knownLeafSize returns the size of the leaf if it is known without fetching the asset.
+func knownLeafSize(manifestLeaf *manifest.Leaf, root *root) (int64, bool) {
+	if manifestLeaf.SizeHint >= 0 {
+		return manifestLeaf.SizeHint, true
+	}
+	digest, ok := root.prefetcher.CachedDigest(manifestLeaf.Asset())
+	if !ok {
+		return 0, false
+	}
+	return digest.SizeBytes, true
+}
+
 func leafSize(ctx context.Context, manifestLeaf *manifest.Leaf, root *root) (int64, bool) {
 	if manifestLeaf.SizeHint >= 0 {
 		return manifestLeaf.SizeHint, true
@@ -261,6 +272,7 @@ type leafHandle struct {
 
 	// the leaf inode that this handle belongs to
 	inode *leaf
+	root  *root
 }
 
 func (h *leafHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
@@ -279,6 +291,8 @@ func (h *leafHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.Rea
 		return nil, syscall.EBADF
 	}
 
+	h.root.traceLeaf(trace.OpRead, h.inode.Path(h.inode.Root()), h.inode.manifestNode, trace.Event{Offset: off, Length: int64(len(dest))})
+
 	// TODO: handle blocking and non-blocking reads (for now, we assume that reads are blocking)
 	n, err := h.reader.ReadAt(dest, off)
 	if err != nil && err != io.EOF {
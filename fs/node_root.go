@@ -1,10 +1,13 @@
 package fs
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/tweag/asset-fuse/fs/manifest"
+	"github.com/tweag/asset-fuse/fs/trace"
 	"github.com/tweag/asset-fuse/integrity"
 	"github.com/tweag/asset-fuse/internal/logging"
 	"github.com/tweag/asset-fuse/service/prefetcher"
@@ -38,14 +41,29 @@ type root struct {
 	failReads bool
 
 	prefetcher *prefetcher.Prefetcher
+
+	// records accesses to leafs (nil if tracing is disabled)
+	tracer *trace.Recorder
+
+	// whether leafs with identical content are exposed as hardlinks
+	hardlinks bool
+	// number of leafs per integrity (only used with hardlinks)
+	linkCounts atomic.Pointer[map[string]uint32]
+
+	// time that the kernel may cache lookups and attributes of directories
+	direntTTL time.Duration
+
+	// paths of leafs that were already reported with an unknown size
+	// (the warning is only logged once per path)
+	unknownSizeWarned sync.Map
 }
 
 func Root(
 	manifestTree manifest.ManifestTree,
 	digestAlgorithm integrity.Algorithm, mtime time.Time, digestHashAttributeName string, xattrEncoding xattrEncoding, failReads bool,
-	prefetcher *prefetcher.Prefetcher,
+	prefetcher *prefetcher.Prefetcher, tracer *trace.Recorder, hardlinks bool, direntTTL time.Duration,
 ) *root {
-	return &root{
+	r := &root{
 		dirent: dirent{
 			manifestNode: manifestTree.Root,
 		},
@@ -55,13 +73,39 @@ func Root(
 		digestHashXattrEncoding: xattrEncoding,
 		failReads:               failReads,
 		prefetcher:              prefetcher,
+		tracer:                  tracer,
+		hardlinks:               hardlinks,
+		direntTTL:               direntTTL,
 	}
+	r.updateLinkCounts(manifestTree.Root)
+	return r
+}
+
+// UpdateManifest replaces the tree of the filesystem during manifest reloads.
+func (r *root) UpdateManifest(manifestNode *manifest.Directory) {
+	r.updateLinkCounts(manifestNode)
+	r.dirent.UpdateManifest(manifestNode)
 }
 
 func (r *root) UpdateMtime(mtime time.Time) {
 	r.mtime = mtime
 }
 
+// traceLeaf records an access to a leaf if tracing is enabled.
+func (r *root) traceLeaf(op trace.Op, leafPath string, leafNode *manifest.Leaf, event trace.Event) {
+	if r.tracer == nil {
+		return
+	}
+	event.Op = op
+	event.Path = leafPath
+	event.URIs = leafNode.URIs
+	event.Integrity = leafNode.Integrity.ToSRIString()
+	event.Compression = leafNode.Compression
+	event.CompressedIntegrity = leafNode.CompressedIntegrity.ToSRIString()
+	event.Size = leafNode.SizeHint
+	r.tracer.Record(event)
+}
+
 type xattrEncoding int
 
 const (
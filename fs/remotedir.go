@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"context"
+	"strings"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/fs/manifest"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/service/cas"
+	"github.com/tweag/asset-fuse/service/prefetcher"
+)
+
+// resolveRemoteDirectory fetches the tree of a directory asset and grafts it into the manifest as a read-only subtree.
+// Every file of the tree becomes a leaf that is identified by its digest,
+// so it is served through the same read path as the leafs of the manifest.
+func resolveRemoteDirectory(ctx context.Context, root *root, remote *manifest.RemoteDirectory) (*manifest.Directory, error) {
+	tree, err := root.prefetcher.FetchDirectory(ctx, api.Asset{
+		URIs:       remote.URIs,
+		Integrity:  remote.Integrity,
+		Qualifiers: remote.Qualifiers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return directoryFromTree(tree, root.digestAlgorithm), nil
+}
+
+// directoryFromTree converts a tree of the CAS into a manifest subtree.
+// Identical directories of the tree share a single manifest node.
+// Symlinks are not supported and left out.
+func directoryFromTree(tree cas.Tree, digestFunction integrity.Algorithm) *manifest.Directory {
+	converted := make(map[string]*manifest.Directory)
+	var convert func(digest integrity.Digest) *manifest.Directory
+	convert = func(digest integrity.Digest) *manifest.Directory {
+		key := digest.Hex(digestFunction)
+		if directory, ok := converted[key]; ok {
+			return directory
+		}
+		directory := &manifest.Directory{Children: map[string]any{}}
+		converted[key] = directory
+		treeDirectory := tree.Directories[key]
+		for _, file := range treeDirectory.Files {
+			if !validName(file.Name) {
+				continue
+			}
+			directory.Children[file.Name] = &manifest.Leaf{
+				Integrity:  prefetcher.FileIntegrity(file.Digest, digestFunction),
+				SizeHint:   file.Digest.SizeBytes,
+				Executable: file.IsExecutable,
+			}
+		}
+		for _, child := range treeDirectory.Directories {
+			if !validName(child.Name) {
+				continue
+			}
+			directory.Children[child.Name] = convert(child.Digest)
+		}
+		for _, symlink := range treeDirectory.Symlinks {
+			logging.Warningf("directory %s: skipping symlink %s -> %s (symlinks are not supported)", tree.Root.Hex(digestFunction), symlink.Name, symlink.Target)
+		}
+		return directory
+	}
+	return convert(tree.Root)
+}
+
+// validName reports whether name can be used as a directory entry.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
@@ -0,0 +1,77 @@
+package fs
+
+import (
+	"testing"
+
+	"github.com/tweag/asset-fuse/fs/manifest"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/service/cas"
+)
+
+func TestDirectoryFromTree(t *testing.T) {
+	file := integrity.NewDigest(make([]byte, 32), 42, integrity.SHA256)
+	root := integrity.NewDigest(append(make([]byte, 31), 1), 100, integrity.SHA256)
+	sub := integrity.NewDigest(append(make([]byte, 31), 2), 50, integrity.SHA256)
+	tree := cas.Tree{Root: root, Directories: map[string]cas.Directory{
+		root.Hex(integrity.SHA256): {
+			Files: []cas.FileNode{
+				{Name: "file", Digest: file},
+				{Name: "..", Digest: file},
+				{Name: "a/b", Digest: file},
+			},
+			Directories: []cas.DirectoryNode{{Name: "sub", Digest: sub}, {Name: "copy", Digest: sub}, {Name: ".", Digest: sub}},
+			Symlinks:    []cas.SymlinkNode{{Name: "link", Target: "file"}},
+		},
+		sub.Hex(integrity.SHA256): {
+			Files: []cas.FileNode{{Name: "tool", Digest: file, IsExecutable: true}},
+		},
+	}}
+
+	directory := directoryFromTree(tree, integrity.SHA256)
+	if len(directory.Children) != 3 {
+		t.Fatalf("expected the children file, sub and copy, got %v", directory.Children)
+	}
+	leaf, ok := directory.Children["file"].(*manifest.Leaf)
+	if !ok {
+		t.Fatalf("expected file to be a leaf, got %T", directory.Children["file"])
+	}
+	if leaf.SizeHint != file.SizeBytes || leaf.Executable {
+		t.Fatalf("unexpected leaf %+v", leaf)
+	}
+	// the digest of the file is derived from the integrity and the size of the leaf
+	checksum, ok := leaf.Integrity.ChecksumForAlgorithm(integrity.SHA256)
+	if !ok || !integrity.NewDigest(checksum.Hash, leaf.SizeHint, integrity.SHA256).Equals(file, integrity.SHA256) {
+		t.Fatalf("the leaf doesn't describe digest %s", file.Hex(integrity.SHA256))
+	}
+	subDirectory, ok := directory.Children["sub"].(*manifest.Directory)
+	if !ok {
+		t.Fatalf("expected sub to be a directory, got %T", directory.Children["sub"])
+	}
+	if directory.Children["copy"] != subDirectory {
+		t.Fatal("identical directories should share a manifest node")
+	}
+	if tool, ok := subDirectory.Children["tool"].(*manifest.Leaf); !ok || !tool.Executable {
+		t.Fatalf("expected an executable leaf, got %+v", subDirectory.Children["tool"])
+	}
+}
+
+func TestValidName(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		valid bool
+	}{
+		{name: "file", valid: true},
+		{name: ".hidden", valid: true},
+		{name: "...", valid: true},
+		{name: ""},
+		{name: "."},
+		{name: ".."},
+		{name: "a/b"},
+		{name: "/"},
+		{name: "nul\x00"},
+	} {
+		if got := validName(tc.name); got != tc.valid {
+			t.Errorf("validName(%q) = %v, expected %v", tc.name, got, tc.valid)
+		}
+	}
+}
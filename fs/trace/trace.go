@@ -0,0 +1,238 @@
+// Package trace records accesses to files in the filesystem
+// and turns recorded traces into prefetch plans.
+//
+// A trace is a file with one JSON object (Event) per line.
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/service/prefetcher"
+)
+
+// Op is the kind of access to a file.
+type Op string
+
+const (
+	OpLookup   Op = "lookup"
+	OpGetxattr Op = "getxattr"
+	OpOpen     Op = "open"
+	OpRead     Op = "read"
+)
+
+// Event is a single recorded access to a file.
+type Event struct {
+	Time time.Time `json:"time"`
+	Op   Op        `json:"op"`
+	// Path of the file relative to the root of the mount.
+	// It depends on the view that was used.
+	Path string `json:"path"`
+	// URIs and integrity (as SRI strings separated by whitespace) identify the asset independently of the view.
+	URIs      []string `json:"uris,omitempty"`
+	Integrity string   `json:"integrity,omitempty"`
+	// Compression and CompressedIntegrity describe assets that are compressed at their URIs.
+	Compression         string `json:"compression,omitempty"`
+	CompressedIntegrity string `json:"compressed_integrity,omitempty"`
+	// Size is the size hint from the manifest (-1 if unknown).
+	Size int64 `json:"size"`
+	// Offset and Length describe the requested range of a read.
+	Offset int64 `json:"offset,omitempty"`
+	Length int64 `json:"length,omitempty"`
+	// Attribute is the name of the extended attribute of a getxattr.
+	Attribute string `json:"attribute,omitempty"`
+}
+
+// Recorder appends events to a trace file.
+// It is safe for concurrent use.
+// A nil *Recorder discards all events.
+type Recorder struct {
+	mux       sync.Mutex
+	file      *os.File
+	writer    *bufio.Writer
+	encoder   *json.Encoder
+	lastFlush time.Time
+	err       error
+}
+
+// NewRecorder creates a Recorder that appends to the file at path.
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening trace file: %w", err)
+	}
+	writer := bufio.NewWriter(file)
+	return &Recorder{
+		file:      file,
+		writer:    writer,
+		encoder:   json.NewEncoder(writer),
+		lastFlush: time.Now(),
+	}, nil
+}
+
+// Record appends an event.
+// The time of the event is set to the current time.
+func (r *Recorder) Record(event Event) {
+	if r == nil {
+		return
+	}
+	event.Time = time.Now()
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.err != nil {
+		return
+	}
+	if err := r.encoder.Encode(event); err != nil {
+		r.fail(err)
+		return
+	}
+	// Flush regularly, so the trace is useful even if the process is killed.
+	if time.Since(r.lastFlush) > flushInterval {
+		if err := r.writer.Flush(); err != nil {
+			r.fail(err)
+		}
+		r.lastFlush = event.Time
+	}
+}
+
+// Close flushes buffered events and closes the trace file.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return errors.Join(r.writer.Flush(), r.file.Close())
+}
+
+func (r *Recorder) fail(err error) {
+	// Tracing is best effort: we stop recording instead of failing filesystem operations.
+	logging.Errorf("recording access trace to %s - stopped recording: %v", r.file.Name(), err)
+	r.err = err
+}
+
+// ReadEvents parses a trace.
+func ReadEvents(reader io.Reader) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			return nil, fmt.Errorf("parsing trace line %d: %w", lineNumber, err)
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// ReadEventsFromFile parses the trace file at path.
+func ReadEventsFromFile(path string) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadEvents(file)
+}
+
+// Access describes how an asset should be prefetched, based on recorded events.
+type Access struct {
+	Asset    api.Asset
+	SizeHint int64
+	// Local is true if the contents of the file were read (or the file was opened).
+	// Otherwise, only the digest was read (via xattr), so the asset only needs to be available in the remote CAS.
+	Local bool
+}
+
+// Plan derives a prefetch plan from recorded events.
+// Each asset appears once, in the order of its first access.
+// Assets that were only looked up (without reading the digest or contents) are skipped.
+func Plan(events []Event) ([]Access, error) {
+	var order []string
+	accesses := make(map[string]*Access)
+	for _, event := range events {
+		switch event.Op {
+		case OpGetxattr, OpOpen, OpRead:
+		default:
+			continue
+		}
+		key := event.Integrity
+		if len(key) == 0 && len(event.CompressedIntegrity) > 0 {
+			key = event.Compression + " " + event.CompressedIntegrity
+		}
+		if len(key) == 0 {
+			// assets without integrity are identified by their uris
+			key = strings.Join(event.URIs, " ")
+		}
+		access, ok := accesses[key]
+		if !ok {
+			assetIntegrity, err := integrity.IntegrityFromString(event.Integrity)
+			if err != nil {
+				return nil, fmt.Errorf("parsing integrity of %s: %w", event.Path, err)
+			}
+			compressedIntegrity, err := integrity.IntegrityFromString(event.CompressedIntegrity)
+			if err != nil {
+				return nil, fmt.Errorf("parsing compressed integrity of %s: %w", event.Path, err)
+			}
+			access = &Access{
+				Asset: api.Asset{
+					URIs:                event.URIs,
+					Integrity:           assetIntegrity,
+					Compression:         event.Compression,
+					CompressedIntegrity: compressedIntegrity,
+				},
+				SizeHint: event.Size,
+			}
+			accesses[key] = access
+			order = append(order, key)
+		}
+		if event.Op != OpGetxattr {
+			access.Local = true
+		}
+	}
+	plan := make([]Access, 0, len(order))
+	for _, key := range order {
+		plan = append(plan, *accesses[key])
+	}
+	return plan, nil
+}
+
+// Enqueue schedules prefetching of all assets in the plan (in order).
+// Assets that were read are materialized locally.
+// Assets whose digest was only read via xattr are fetched into the remote CAS.
+func Enqueue(plan []Access, prefetcher *prefetcher.Prefetcher, callbacks ...func(api.Asset, integrity.Digest, error)) {
+	for _, access := range plan {
+		if access.Local {
+			prefetcher.EnqueueLocalDownload(access.Asset, callbacks...)
+		} else {
+			prefetcher.EnqueueRemoteDownload(access.Asset, callbacks...)
+		}
+	}
+}
+
+// PlanFromFile reads the trace file at path and derives a prefetch plan.
+func PlanFromFile(path string) ([]Access, error) {
+	events, err := ReadEventsFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading trace %s: %w", path, err)
+	}
+	return Plan(events)
+}
+
+const flushInterval = time.Second
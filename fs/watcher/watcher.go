@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -16,6 +17,7 @@ import (
 	"github.com/tweag/asset-fuse/api"
 	"github.com/tweag/asset-fuse/fs"
 	"github.com/tweag/asset-fuse/fs/manifest"
+	"github.com/tweag/asset-fuse/fs/trace"
 	"github.com/tweag/asset-fuse/integrity"
 	"github.com/tweag/asset-fuse/internal/logging"
 	"github.com/tweag/asset-fuse/service/prefetcher"
@@ -33,10 +35,14 @@ type ManifestWatcher struct {
 	digestFunction integrity.Algorithm
 	notifyWatcher  *fsnotify.Watcher
 	closeOnce      sync.Once
+	// updateMux serializes updates of the tree (triggered by fsnotify or Reload)
+	// and protects manifestTree.
+	updateMux sync.Mutex
 }
 
 // New creates a new ManifestWatcher.
-func New(view manifest.View, config api.GlobalConfig, checksumCache *integrity.ChecksumCache, prefetcher *prefetcher.Prefetcher) (*ManifestWatcher, goFUSEfs.InodeEmbedder, error) {
+// If tracer is not nil, accesses to files are recorded.
+func New(view manifest.View, config api.GlobalConfig, checksumCache *integrity.ChecksumCache, prefetcher *prefetcher.Prefetcher, tracer *trace.Recorder) (*ManifestWatcher, goFUSEfs.InodeEmbedder, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, nil, err
@@ -66,7 +72,7 @@ func New(view manifest.View, config api.GlobalConfig, checksumCache *integrity.C
 	if config.FailReads != nil {
 		failReads = *config.FailReads
 	}
-	root := fs.Root(initialManifest, digestFunction, time.Now(), config.DigestXattrName, fs.XattrEncodingFromString(config.DigestXattrEncoding), failReads, prefetcher)
+	root := fs.Root(initialManifest, digestFunction, time.Now(), config.DigestXattrName, fs.XattrEncodingFromString(config.DigestXattrEncoding), failReads, prefetcher, tracer, config.HardlinksEnable(), config.DirentTimeoutDuration())
 
 	return &ManifestWatcher{
 		manifestPath:   config.ManifestPath,
@@ -131,13 +137,41 @@ func (w *ManifestWatcher) Stop() (closeErr error) {
 	return closeErr
 }
 
+// Reload reads the manifest and updates the tree if the manifest changed.
+// It reports whether the tree was updated.
+func (w *ManifestWatcher) Reload() (bool, error) {
+	return w.updateFilesystemTree()
+}
+
+// Leafs returns the leafs of the current tree at or below the given path.
+// The empty path refers to the root of the tree.
+func (w *ManifestWatcher) Leafs(leafPath string) map[string]*manifest.Leaf {
+	w.updateMux.Lock()
+	defer w.updateMux.Unlock()
+	leafPath = strings.Trim(filepath.ToSlash(filepath.Clean("/"+leafPath)), "/")
+	leafs := make(map[string]*manifest.Leaf)
+	for candidate, leaf := range w.manifestTree.Leafs {
+		if leafPath == "" || candidate == leafPath || strings.HasPrefix(candidate, leafPath+"/") {
+			leafs[candidate] = leaf
+		}
+	}
+	return leafs
+}
+
 func (w *ManifestWatcher) updateFilesystemTreeOnChange() error {
+	_, err := w.updateFilesystemTree()
+	return err
+}
+
+func (w *ManifestWatcher) updateFilesystemTree() (bool, error) {
+	w.updateMux.Lock()
+	defer w.updateMux.Unlock()
 	newManifestTree, shouldUpdate, err := w.reloadManifestTreeIfChanged()
 	if err != nil {
-		return err
+		return false, err
 	}
 	if !shouldUpdate {
-		return nil
+		return false, nil
 	}
 
 	logging.Basicf("manifest was changed, updating tree (%v)", w.manifestDigest.Hex(w.digestFunction))
@@ -166,7 +200,7 @@ func (w *ManifestWatcher) updateFilesystemTreeOnChange() error {
 			w.fsRoot.NotifyEntry(name)
 		}
 	}
-	return nil
+	return true, nil
 }
 
 func (w *ManifestWatcher) reloadManifestTreeIfChanged() (newTree *manifest.ManifestTree, shouldUpdate bool, err error) {
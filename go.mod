@@ -6,6 +6,9 @@ require (
 	github.com/bazelbuild/remote-apis v0.0.0-20250211041012-7f922028fcfa
 	github.com/fsnotify/fsnotify v1.8.0
 	github.com/hanwen/go-fuse/v2 v2.7.2
+	github.com/klauspost/compress v1.17.11
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/net v0.33.0
 	golang.org/x/sys v0.28.0
 	google.golang.org/genproto/googleapis/bytestream v0.0.0-20250303144028-a0af3efb3deb
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240814211410-ddb44dafa142
@@ -15,7 +18,6 @@ require (
 
 require (
 	cloud.google.com/go/longrunning v0.5.12 // indirect
-	golang.org/x/net v0.33.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20240814211410-ddb44dafa142 // indirect
 )
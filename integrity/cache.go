@@ -13,6 +13,8 @@ type ChecksumCache struct {
 	shards [shardCount]map[uint64]Digest
 	muxs   [shardCount]sync.RWMutex
 	seed   maphash.Seed
+	// store persists entries across restarts (nil for in-memory caches).
+	store *checksumStore
 }
 
 func NewCache() *ChecksumCache {
@@ -44,8 +46,15 @@ func (c *ChecksumCache) GetSlice(hash []byte, identifier byte) (Digest, bool) {
 }
 
 func (c *ChecksumCache) PutSlice(hash []byte, identifier byte, digest Digest) {
+	if changed := c.putSlice(hash, identifier, digest); changed && c.store != nil {
+		c.store.append(identifier, hash, digest)
+	}
+}
+
+// putSlice stores the digest in memory and reports whether the entry is new or changed.
+func (c *ChecksumCache) putSlice(hash []byte, identifier byte, digest Digest) bool {
 	if len(hash) == 0 {
-		return
+		return false
 	}
 	shard := hash[0] & shardMask
 	c.muxs[shard].Lock()
@@ -56,7 +65,11 @@ func (c *ChecksumCache) PutSlice(hash []byte, identifier byte, digest Digest) {
 	key.Write(hash)
 	key.WriteByte(identifier)
 
+	if existing, ok := c.shards[shard][key.Sum64()]; ok && existing == digest {
+		return false
+	}
 	c.shards[shard][key.Sum64()] = digest
+	return true
 }
 
 func (c *ChecksumCache) FromIntegrity(integrity Integrity) map[Algorithm]Digest {
@@ -91,6 +104,15 @@ func (c *ChecksumCache) PutIntegrity(integrity Integrity, digest Digest) {
 	}
 }
 
+// PutIntegrityInMemory is like PutIntegrity, but the entries are never persisted.
+// It is meant for associations that are cheap to derive again,
+// so they don't take the place of other entries in the persistent cache.
+func (c *ChecksumCache) PutIntegrityInMemory(integrity Integrity, digest Digest) {
+	for checksum := range integrity.Items() {
+		c.putSlice(checksum.Hash, checksum.Algorithm.Identifier(), digest)
+	}
+}
+
 const (
 	shardCount = 2 << 7
 	shardMask  = shardCount - 1
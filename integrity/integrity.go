@@ -92,13 +92,13 @@ func (d Digest) ZeroSized(algorithm Algorithm) bool {
 	}
 	switch algorithm {
 	case SHA256:
-		return bytes.Equal(d.hash[:], zeroSizedChecksumSHA256[:])
+		return bytes.Equal(d.hash[:algorithm.SizeBytes()], zeroSizedChecksumSHA256[:])
 	case SHA384:
-		return bytes.Equal(d.hash[:], zeroSizedChecksumSHA384[:])
+		return bytes.Equal(d.hash[:algorithm.SizeBytes()], zeroSizedChecksumSHA384[:])
 	case SHA512:
-		return bytes.Equal(d.hash[:], zeroSizedChecksumSHA512[:])
+		return bytes.Equal(d.hash[:algorithm.SizeBytes()], zeroSizedChecksumSHA512[:])
 	case Blake3:
-		return bytes.Equal(d.hash[:], zeroSizedChecksumBlake3[:])
+		return bytes.Equal(d.hash[:algorithm.SizeBytes()], zeroSizedChecksumBlake3[:])
 	}
 	// Should be unreachable.
 	return false
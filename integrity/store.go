@@ -0,0 +1,385 @@
+package integrity
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/tweag/asset-fuse/internal/logging"
+	"golang.org/x/sys/unix"
+)
+
+// checksumStore is an append-only file that persists the contents of a ChecksumCache.
+//
+// File format (all integers are big endian):
+//
+//	header: magic "AFCS" | version (1 byte) | identifier of the digest function (1 byte)
+//	record: identifier of the checksum algorithm (1 byte) | checksum hash | digest hash | size (8 bytes) | CRC-32 (IEEE) of the preceding bytes (4 bytes)
+//
+// The length of the hashes follows from the algorithms, so every record has a fixed size.
+// A torn or corrupted record at the end of the file (from a crash during a write)
+// is detected by its checksum and truncated on the next start.
+// Later records for the same checksum replace earlier ones.
+//
+// The file may be shared by several processes that use the same disk cache.
+// They serialize reads and writes with an flock on a lock file next to it,
+// and compaction replaces the file, so every process reopens it when the inode changed.
+type checksumStore struct {
+	path           string
+	digestFunction Algorithm
+	maxEntries     int
+
+	// mux serializes access within the process, lockFile across processes.
+	mux      sync.Mutex
+	lockFile *os.File
+	// file is opened with O_APPEND, so records of concurrent processes don't overwrite each other.
+	file *os.File
+	// number of records in the file (including records that were replaced by later ones)
+	records int
+}
+
+// NewPersistentCache creates a ChecksumCache that is backed by a file at path.
+// Entries in the file are loaded into the cache and every new or changed entry is appended.
+// The file is compacted to at most maxEntries entries (keeping the most recent ones) when it grows
+// beyond twice that number.
+// Files written by another version or for another digest function are discarded.
+func NewPersistentCache(path string, digestFunction Algorithm, maxEntries int) (*ChecksumCache, error) {
+	if maxEntries <= 0 {
+		return nil, fmt.Errorf("invalid number of entries for checksum cache: %d", maxEntries)
+	}
+	store := &checksumStore{
+		path:           path,
+		digestFunction: digestFunction,
+		maxEntries:     maxEntries,
+	}
+	entries, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	cache := NewCache()
+	for _, entry := range entries {
+		cache.putSlice(entry.hash, entry.identifier, entry.digest)
+	}
+	cache.store = store
+	return cache, nil
+}
+
+// Close closes the backing file of a persistent cache.
+// The cache keeps working in memory.
+func (c *ChecksumCache) Close() error {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.close()
+}
+
+type storeEntry struct {
+	identifier byte
+	hash       []byte
+	digest     Digest
+}
+
+func (s *checksumStore) header() []byte {
+	return append([]byte(checksumStoreMagic), checksumStoreVersion, s.digestFunction.Identifier())
+}
+
+// load reads all valid entries, repairs or discards the file if needed
+// and leaves the file open for appending.
+func (s *checksumStore) load() ([]storeEntry, error) {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return nil, err
+	}
+	lockFile, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening checksum cache lock: %w", err)
+	}
+	s.lockFile = lockFile
+	if err := s.lock(); err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	defer s.unlock()
+
+	entries, err := s.open()
+	if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	if s.records > 2*s.maxEntries {
+		entries = s.newest(entries)
+		if err := s.rewrite(entries); err != nil {
+			s.file.Close()
+			lockFile.Close()
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// lock acquires the lock that serializes access to the file across processes.
+func (s *checksumStore) lock() error {
+	if err := unix.Flock(int(s.lockFile.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("locking checksum cache: %w", err)
+	}
+	return nil
+}
+
+func (s *checksumStore) unlock() {
+	unix.Flock(int(s.lockFile.Fd()), unix.LOCK_UN)
+}
+
+// open opens the file and reads all valid entries.
+// Incomplete records at the end are truncated and files with an unsupported header are discarded.
+// The caller must hold the file lock.
+func (s *checksumStore) open() ([]storeEntry, error) {
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening checksum cache: %w", err)
+	}
+
+	entries, validBytes, err := s.readEntries(file)
+	if err != nil {
+		logging.Warningf("discarding checksum cache %s: %v", s.path, err)
+		entries, validBytes = nil, 0
+	}
+	if validBytes == 0 {
+		// new or discarded file: start over with a fresh header
+		if err := file.Truncate(0); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("resetting checksum cache: %w", err)
+		}
+		if _, err := file.Write(s.header()); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("writing checksum cache header: %w", err)
+		}
+		validBytes = int64(len(s.header()))
+	} else if info, err := file.Stat(); err == nil && info.Size() > validBytes {
+		logging.Warningf("checksum cache %s: truncating %d bytes of incomplete records", s.path, info.Size()-validBytes)
+		if err := file.Truncate(validBytes); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("repairing checksum cache: %w", err)
+		}
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	s.records = len(entries)
+	return entries, nil
+}
+
+// reopenIfReplaced reopens the file if another process replaced it (by compacting it).
+// Otherwise, records would be appended to a file that is no longer visible.
+// The caller must hold mux and the file lock.
+func (s *checksumStore) reopenIfReplaced() error {
+	opened, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if current, err := os.Stat(s.path); err == nil && os.SameFile(opened, current) {
+		return nil
+	}
+	_, err = s.open()
+	return err
+}
+
+// readEntries reads records from the start of the file.
+// It returns the entries and the number of bytes that contain a valid header and complete records.
+// An error is returned if the header does not match.
+func (s *checksumStore) readEntries(file *os.File) ([]storeEntry, int64, error) {
+	reader := bufio.NewReader(file)
+	header := make([]byte, len(s.header()))
+	if _, err := io.ReadFull(reader, header); err == io.EOF {
+		// empty file
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, errors.New("incomplete header")
+	}
+	if !bytes.Equal(header, s.header()) {
+		return nil, 0, errors.New("unsupported version or digest function")
+	}
+
+	var entries []storeEntry
+	validBytes := int64(len(header))
+	digestSize := s.digestFunction.SizeBytes()
+	for {
+		identifier, err := reader.ReadByte()
+		if err != nil {
+			break
+		}
+		algorithm, ok := algorithmFromIdentifier(identifier)
+		if !ok {
+			break
+		}
+		record := make([]byte, recordSize(algorithm, s.digestFunction))
+		record[0] = identifier
+		if _, err := io.ReadFull(reader, record[1:]); err != nil {
+			break
+		}
+		body, sum := record[:len(record)-4], record[len(record)-4:]
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+			break
+		}
+		hashSize := algorithm.SizeBytes()
+		entries = append(entries, storeEntry{
+			identifier: identifier,
+			hash:       body[1 : 1+hashSize],
+			digest: NewDigest(
+				body[1+hashSize:1+hashSize+digestSize],
+				int64(binary.BigEndian.Uint64(body[1+hashSize+digestSize:])),
+				s.digestFunction,
+			),
+		})
+		validBytes += int64(len(record))
+	}
+	return entries, validBytes, nil
+}
+
+// newest deduplicates entries (later entries win) and keeps at most maxEntries of the most recently written ones.
+func (s *checksumStore) newest(entries []storeEntry) []storeEntry {
+	seen := make(map[string]bool, len(entries))
+	var kept []storeEntry
+	for i := len(entries) - 1; i >= 0 && len(kept) < s.maxEntries; i-- {
+		key := string(append([]byte{entries[i].identifier}, entries[i].hash...))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, entries[i])
+	}
+	// restore the original order
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	return kept
+}
+
+// rewrite atomically replaces the file with the given entries.
+// The caller must hold mux (or have exclusive access during load) and the file lock.
+func (s *checksumStore) rewrite(entries []storeEntry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+"-")
+	if err != nil {
+		return fmt.Errorf("compacting checksum cache: %w", err)
+	}
+	writer := bufio.NewWriter(tmp)
+	writer.Write(s.header())
+	for _, entry := range entries {
+		writer.Write(s.encode(entry))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("compacting checksum cache: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("compacting checksum cache: %w", err)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("compacting checksum cache: %w", err)
+	}
+	// the temporary file is now the store
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("compacting checksum cache: %w", err)
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	s.records = len(entries)
+	return nil
+}
+
+func (s *checksumStore) encode(entry storeEntry) []byte {
+	algorithm, _ := algorithmFromIdentifier(entry.identifier)
+	record := make([]byte, 0, recordSize(algorithm, s.digestFunction))
+	record = append(record, entry.identifier)
+	record = append(record, entry.hash...)
+	record = append(record, entry.digest.hash[:s.digestFunction.SizeBytes()]...)
+	record = binary.BigEndian.AppendUint64(record, uint64(entry.digest.SizeBytes))
+	return binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(record))
+}
+
+// append persists a single entry.
+// Errors are logged, since the cache remains usable in memory.
+func (s *checksumStore) append(identifier byte, hash []byte, digest Digest) {
+	algorithm, ok := algorithmFromIdentifier(identifier)
+	if !ok || len(hash) != algorithm.SizeBytes() {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.file == nil {
+		return
+	}
+	if err := s.lock(); err != nil {
+		logging.Warningf("writing to checksum cache %s: %v", s.path, err)
+		return
+	}
+	defer s.unlock()
+	if err := s.reopenIfReplaced(); err != nil {
+		logging.Warningf("writing to checksum cache %s: %v", s.path, err)
+		return
+	}
+	// Each record is written with a single write call.
+	// A crash can only leave an incomplete record at the end, which is truncated on the next start.
+	if _, err := s.file.Write(s.encode(storeEntry{identifier: identifier, hash: hash, digest: digest})); err != nil {
+		logging.Warningf("writing to checksum cache %s: %v", s.path, err)
+		return
+	}
+	s.records++
+	if s.records <= 2*s.maxEntries {
+		return
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		logging.Warningf("compacting checksum cache %s: %v", s.path, err)
+		return
+	}
+	entries, _, err := s.readEntries(s.file)
+	if err == nil {
+		err = s.rewrite(s.newest(entries))
+	}
+	if err != nil {
+		logging.Warningf("compacting checksum cache %s: %v", s.path, err)
+	}
+}
+
+func (s *checksumStore) close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := errors.Join(s.file.Close(), s.lockFile.Close())
+	s.file = nil
+	return err
+}
+
+func recordSize(algorithm, digestFunction Algorithm) int {
+	return 1 + algorithm.SizeBytes() + digestFunction.SizeBytes() + 8 + 4
+}
+
+func algorithmFromIdentifier(identifier byte) (Algorithm, bool) {
+	for algorithm := range SupportedAlgorithms() {
+		if algorithm.Identifier() == identifier {
+			return algorithm, true
+		}
+	}
+	return Algorithm{}, false
+}
+
+const (
+	checksumStoreMagic   = "AFCS"
+	checksumStoreVersion = 1
+)
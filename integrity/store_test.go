@@ -0,0 +1,229 @@
+package integrity_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tweag/asset-fuse/integrity"
+)
+
+func TestPersistentCacheSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checksums")
+	integrityValue, digest := testAsset(t, "hello")
+
+	c, err := integrity.NewPersistentCache(path, integrity.SHA256, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PutIntegrity(integrityValue, digest)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = integrity.NewPersistentCache(path, integrity.SHA256, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for checksum := range integrityValue.Items() {
+		gotDigest, ok := c.FromChecksum(checksum)
+		if !ok {
+			t.Fatalf("cache should contain %s after restart", checksum.Algorithm)
+		}
+		if !digest.Equals(gotDigest, integrity.SHA256) {
+			t.Fatalf("expected %v, got %v", digest, gotDigest)
+		}
+	}
+}
+
+func TestPersistentCacheInMemoryEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checksums")
+	integrityValue, digest := testAsset(t, "derived")
+
+	c, err := integrity.NewPersistentCache(path, integrity.SHA256, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PutIntegrityInMemory(integrityValue, digest)
+	if _, ok := c.FromIntegrityWithAlgorithm(integrityValue, integrity.SHA256); !ok {
+		t.Fatal("cache should contain the in-memory entry")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = integrity.NewPersistentCache(path, integrity.SHA256, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.FromIntegrityWithAlgorithm(integrityValue, integrity.SHA256); ok {
+		t.Fatal("in-memory entries should not be persisted")
+	}
+}
+
+func TestPersistentCacheTruncatesTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checksums")
+	first, firstDigest := testAsset(t, "first")
+	second, secondDigest := testAsset(t, "second")
+
+	c, err := integrity.NewPersistentCache(path, integrity.SHA256, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PutIntegrity(first, firstDigest)
+	c.Close()
+	sizeAfterFirst := fileSize(t, path)
+	c, err = integrity.NewPersistentCache(path, integrity.SHA256, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PutIntegrity(second, secondDigest)
+	c.Close()
+
+	// simulate a crash in the middle of writing the last record
+	if err := os.Truncate(path, fileSize(t, path)-3); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = integrity.NewPersistentCache(path, integrity.SHA256, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.FromIntegrityWithAlgorithm(first, integrity.SHA256); !ok {
+		t.Fatal("complete records should be loaded")
+	}
+	// the sha256 record of the second asset was written first and is still complete,
+	// but the sha512 record was torn
+	checksum, _ := second.ChecksumForAlgorithm(integrity.SHA512)
+	if _, ok := c.FromChecksum(checksum); ok {
+		t.Fatal("torn record should not be loaded")
+	}
+	if size := fileSize(t, path); size <= sizeAfterFirst || size >= sizeAfterFirst+2*recordSize(integrity.SHA512) {
+		t.Fatalf("torn record should be truncated, got file size %d", size)
+	}
+}
+
+func TestPersistentCacheDiscardsOtherDigestFunction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checksums")
+	integrityValue, digest := testAsset(t, "hello")
+
+	c, err := integrity.NewPersistentCache(path, integrity.SHA256, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PutIntegrity(integrityValue, digest)
+	c.Close()
+
+	c, err = integrity.NewPersistentCache(path, integrity.SHA512, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if digests := c.FromIntegrity(integrityValue); len(digests) != 0 {
+		t.Fatalf("entries for another digest function should be discarded, got %v", digests)
+	}
+}
+
+func TestPersistentCacheIsBounded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checksums")
+	const maxEntries = 4
+
+	c, err := integrity.NewPersistentCache(path, integrity.SHA256, maxEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var integrities []integrity.Integrity
+	for i := range 20 {
+		integrityValue, digest := testAsset(t, fmt.Sprintf("asset-%d", i))
+		c.PutIntegrity(integrityValue, digest)
+		// storing the same value again must not grow the file
+		c.PutIntegrity(integrityValue, digest)
+		integrities = append(integrities, integrityValue)
+	}
+	c.Close()
+
+	// every asset has two checksums (sha256 and sha512), so the file holds at most 2*maxEntries records
+	if size := fileSize(t, path); size > 6+2*maxEntries*recordSize(integrity.SHA512) {
+		t.Fatalf("file should be compacted, got size %d", size)
+	}
+
+	c, err = integrity.NewPersistentCache(path, integrity.SHA256, maxEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.FromIntegrityWithAlgorithm(integrities[len(integrities)-1], integrity.SHA256); !ok {
+		t.Fatal("the most recent entry should be kept")
+	}
+	if _, ok := c.FromIntegrityWithAlgorithm(integrities[0], integrity.SHA256); ok {
+		t.Fatal("the oldest entry should be evicted")
+	}
+}
+
+func TestPersistentCacheSharedByProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checksums")
+	const maxEntries = 4
+
+	// two caches on the same file behave like two processes using the same disk cache
+	first, err := integrity.NewPersistentCache(path, integrity.SHA256, maxEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := integrity.NewPersistentCache(path, integrity.SHA256, maxEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var firstIntegrity, secondIntegrity integrity.Integrity
+	for i := range 6 {
+		// both caches compact (replace) the file at some point, while the other one keeps appending
+		var digest integrity.Digest
+		firstIntegrity, digest = testAsset(t, fmt.Sprintf("first-%d", i))
+		first.PutIntegrity(firstIntegrity, digest)
+		secondIntegrity, digest = testAsset(t, fmt.Sprintf("second-%d", i))
+		second.PutIntegrity(secondIntegrity, digest)
+	}
+	first.Close()
+	second.Close()
+
+	c, err := integrity.NewPersistentCache(path, integrity.SHA256, maxEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, integrityValue := range []integrity.Integrity{firstIntegrity, secondIntegrity} {
+		if _, ok := c.FromIntegrityWithAlgorithm(integrityValue, integrity.SHA256); !ok {
+			t.Fatalf("the most recent record of every process should be kept (%s)", integrityValue.ToSRIString())
+		}
+	}
+}
+
+// testAsset returns the integrity (sha256 and sha512) and the sha256 digest of content.
+func testAsset(t *testing.T, content string) (integrity.Integrity, integrity.Digest) {
+	t.Helper()
+	sha256Sum := sha256.Sum256([]byte(content))
+	integrityValue, _, err := integrity.IntegrityFromContent(bytes.NewReader([]byte(content)), integrity.SHA256, integrity.SHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return integrityValue, integrity.NewDigest(sha256Sum[:], int64(len(content)), integrity.SHA256)
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// recordSize is the size of a record for a checksum of the given algorithm in a sha256 store.
+func recordSize(algorithm integrity.Algorithm) int64 {
+	return int64(1 + algorithm.SizeBytes() + 32 + 8 + 4)
+}
@@ -0,0 +1,48 @@
+// Package compression implements the codecs that assets can be compressed with at their origin.
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+	Xz   = "xz"
+)
+
+// Codecs are the names of all supported codecs.
+var Codecs = []string{Gzip, Zstd, Xz}
+
+// Valid reports whether codec is the name of a supported codec.
+func Valid(codec string) bool {
+	return slices.Contains(Codecs, codec)
+}
+
+// NewReader returns a reader that decompresses r with the given codec.
+// The caller is responsible for closing the reader (this doesn't close r).
+func NewReader(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case Xz:
+		reader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(reader), nil
+	}
+	return nil, fmt.Errorf("unsupported compression codec %q", codec)
+}
@@ -0,0 +1,96 @@
+// Package control implements the control API of a running mount.
+//
+// The API is served as JSON over HTTP on a unix socket (usually next to the mountpoint).
+// Paths in requests are relative to the mountpoint and may refer to directories,
+// in which case all files below the directory are affected.
+package control
+
+import (
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/service/downloader"
+	"github.com/tweag/asset-fuse/service/prefetcher"
+)
+
+const (
+	EndpointReload   = "/v1/reload"
+	EndpointPrefetch = "/v1/prefetch"
+	EndpointUnpin    = "/v1/unpin"
+	EndpointEvict    = "/v1/evict"
+	EndpointState    = "/v1/state"
+	EndpointMetrics  = "/v1/metrics"
+	// EndpointEvents streams prefetcher.Event values as newline-delimited JSON.
+	EndpointEvents = "/v1/events"
+)
+
+// ReloadResponse is the response of EndpointReload.
+type ReloadResponse struct {
+	// Updated is true if the manifest changed since it was last read.
+	Updated bool `json:"updated"`
+}
+
+// PrefetchRequest is the request of EndpointPrefetch.
+type PrefetchRequest struct {
+	Paths []string `json:"paths"`
+	// Destination is "disk" (default) or "remote".
+	Destination string `json:"destination,omitempty"`
+	// Pin protects the fetched blobs from eviction in the disk cache,
+	// or keeps them alive in the remote cache (for the "remote" destination).
+	// Pins are stored in the disk cache directory and survive restarts.
+	Pin bool `json:"pin,omitempty"`
+	// Wait blocks the request until all files are fetched.
+	Wait bool `json:"wait,omitempty"`
+}
+
+// PathsRequest is the request of EndpointUnpin and EndpointEvict.
+type PathsRequest struct {
+	Paths []string `json:"paths"`
+}
+
+// PathResult is the outcome of an operation on a single file.
+type PathResult struct {
+	Path   string `json:"path"`
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Evicted is set by EndpointEvict if the blob was removed from the disk cache.
+	Evicted bool `json:"evicted,omitempty"`
+}
+
+// PathsResponse is the response of EndpointPrefetch, EndpointUnpin and EndpointEvict.
+type PathsResponse struct {
+	// Queued is the number of files queued for prefetching (only if the request didn't wait).
+	Queued  int          `json:"queued,omitempty"`
+	Results []PathResult `json:"results,omitempty"`
+}
+
+// PathState describes the cache state of a single file.
+type PathState struct {
+	Path      string `json:"path"`
+	Digest    string `json:"digest,omitempty"`
+	SizeBytes int64  `json:"size_bytes"`
+	// Local is true if the blob is in the disk cache.
+	Local bool `json:"local"`
+	// Remote is true if the blob is in the remote cache (nil without remote cache or if the digest is unknown).
+	Remote *bool `json:"remote,omitempty"`
+	Pinned bool  `json:"pinned"`
+	// PinnedRemote is true if the blob is kept alive in the remote cache.
+	PinnedRemote bool   `json:"pinned_remote"`
+	Error        string `json:"error,omitempty"`
+}
+
+// StateResponse is the response of EndpointState.
+type StateResponse struct {
+	Paths []PathState `json:"paths"`
+}
+
+// MetricsResponse is the response of EndpointMetrics.
+type MetricsResponse struct {
+	Mount      api.MountConfig  `json:"mount"`
+	Prefetcher prefetcher.Stats `json:"prefetcher"`
+	// Mirrors contains the statistics of the hosts used by the local downloader.
+	Mirrors []downloader.MirrorStat `json:"mirrors,omitempty"`
+}
+
+// ErrorResponse is returned with a non-2xx status code.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
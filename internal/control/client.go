@@ -0,0 +1,141 @@
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/tweag/asset-fuse/service/prefetcher"
+)
+
+// Client talks to the control API of a mount.
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient creates a client for the control API served on the unix socket at socketPath.
+func NewClient(socketPath string) *Client {
+	dialer := net.Dialer{}
+	return &Client{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// Reload asks the mount to read the manifest again.
+func (c *Client) Reload(ctx context.Context) (ReloadResponse, error) {
+	var resp ReloadResponse
+	err := c.do(ctx, http.MethodPost, EndpointReload, struct{}{}, &resp)
+	return resp, err
+}
+
+// Prefetch fetches (and optionally pins) files.
+func (c *Client) Prefetch(ctx context.Context, req PrefetchRequest) (PathsResponse, error) {
+	var resp PathsResponse
+	err := c.do(ctx, http.MethodPost, EndpointPrefetch, req, &resp)
+	return resp, err
+}
+
+// Unpin allows eviction of files.
+func (c *Client) Unpin(ctx context.Context, paths []string) (PathsResponse, error) {
+	var resp PathsResponse
+	err := c.do(ctx, http.MethodPost, EndpointUnpin, PathsRequest{Paths: paths}, &resp)
+	return resp, err
+}
+
+// Evict removes files from the disk cache.
+func (c *Client) Evict(ctx context.Context, paths []string) (PathsResponse, error) {
+	var resp PathsResponse
+	err := c.do(ctx, http.MethodPost, EndpointEvict, PathsRequest{Paths: paths}, &resp)
+	return resp, err
+}
+
+// State returns the cache state of files.
+// Without paths, the state of all files is returned.
+func (c *Client) State(ctx context.Context, paths []string) (StateResponse, error) {
+	query := url.Values{"path": paths}
+	var resp StateResponse
+	err := c.do(ctx, http.MethodGet, EndpointState+"?"+query.Encode(), nil, &resp)
+	return resp, err
+}
+
+// Metrics returns a snapshot of queues and counters.
+func (c *Client) Metrics(ctx context.Context) (MetricsResponse, error) {
+	var resp MetricsResponse
+	err := c.do(ctx, http.MethodGet, EndpointMetrics, nil, &resp)
+	return resp, err
+}
+
+// Events calls onEvent for every event until ctx is cancelled or the server closes the stream.
+func (c *Client) Events(ctx context.Context, onEvent func(prefetcher.Event)) error {
+	httpResp, err := c.send(ctx, http.MethodGet, EndpointEvents, nil)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	scanner := bufio.NewScanner(httpResp.Body)
+	for scanner.Scan() {
+		var event prefetcher.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("decoding event: %w", err)
+		}
+		onEvent(event)
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, method, endpoint string, req, resp any) error {
+	httpResp, err := c.send(ctx, method, endpoint, req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+func (c *Client) send(ctx context.Context, method, endpoint string, req any) (*http.Response, error) {
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	// the host is ignored when dialing the unix socket
+	httpReq, err := http.NewRequestWithContext(ctx, method, "http://asset-fuse"+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if req != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if httpResp.StatusCode/100 != 2 {
+		defer httpResp.Body.Close()
+		var errResp ErrorResponse
+		if err := json.NewDecoder(httpResp.Body).Decode(&errResp); err != nil || len(errResp.Error) == 0 {
+			return nil, fmt.Errorf("control API returned %s", httpResp.Status)
+		}
+		return nil, errors.New(errResp.Error)
+	}
+	return httpResp, nil
+}
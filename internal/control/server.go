@@ -0,0 +1,371 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/fs/manifest"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/service/cas"
+	"github.com/tweag/asset-fuse/service/downloader"
+	"github.com/tweag/asset-fuse/service/prefetcher"
+)
+
+// Target is the mount that is controlled.
+type Target interface {
+	Config() api.MountConfig
+	Reload() (bool, error)
+	Leafs(leafPath string) map[string]*manifest.Leaf
+}
+
+// Backend holds the services used to implement the control API.
+type Backend struct {
+	Prefetcher    *prefetcher.Prefetcher
+	Downloader    *downloader.Downloader
+	DiskCache     *cas.Disk
+	ChecksumCache *integrity.ChecksumCache
+	// RemoteCache is nil when running in local mode.
+	RemoteCache    cas.CAS
+	DigestFunction integrity.Algorithm
+}
+
+// Server serves the control API for a single mount.
+type Server struct {
+	socketPath string
+	target     Target
+	backend    Backend
+	httpServer *http.Server
+	listener   net.Listener
+	wg         sync.WaitGroup
+}
+
+// Listen starts serving the control API on the unix socket at socketPath.
+// An existing socket at the same path is replaced.
+func Listen(socketPath string, target Target, backend Backend) (*Server, error) {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("removing stale control socket: %w", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("listening on control socket: %w", err)
+	}
+	// only the owner may control the mount
+	if err := os.Chmod(socketPath, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("restricting access to control socket: %w", err)
+	}
+	s := &Server{
+		socketPath: socketPath,
+		target:     target,
+		backend:    backend,
+		listener:   listener,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+EndpointReload, s.handleReload)
+	mux.HandleFunc("POST "+EndpointPrefetch, s.handlePrefetch)
+	mux.HandleFunc("POST "+EndpointUnpin, s.handleUnpin)
+	mux.HandleFunc("POST "+EndpointEvict, s.handleEvict)
+	mux.HandleFunc("GET "+EndpointState, s.handleState)
+	mux.HandleFunc("GET "+EndpointMetrics, s.handleMetrics)
+	mux.HandleFunc("GET "+EndpointEvents, s.handleEvents)
+	s.httpServer = &http.Server{Handler: mux}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Errorf("serving control API on %s: %v", socketPath, err)
+		}
+	}()
+	return s, nil
+}
+
+// SocketPath returns the path of the unix socket.
+func (s *Server) SocketPath() string {
+	return s.socketPath
+}
+
+// Close stops serving the control API and removes the socket.
+func (s *Server) Close() error {
+	// event streams never finish on their own, so we don't wait for active connections
+	err := s.httpServer.Close()
+	s.wg.Wait()
+	os.Remove(s.socketPath)
+	return err
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	updated, err := s.target.Reload()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, ReloadResponse{Updated: updated})
+}
+
+func (s *Server) handlePrefetch(w http.ResponseWriter, r *http.Request) {
+	var req PrefetchRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	var local bool
+	switch req.Destination {
+	case "", "disk":
+		local = true
+	case "remote":
+		if req.Pin && s.backend.RemoteCache == nil {
+			writeError(w, http.StatusBadRequest, errors.New("pinning in the remote cache requires a remote cache"))
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid destination %q", req.Destination))
+		return
+	}
+	leafs, ok := s.resolve(w, req.Paths)
+	if !ok {
+		return
+	}
+
+	results := make(chan PathResult, len(leafs))
+	for leafPath, leaf := range leafs {
+		asset := leaf.Asset()
+		callback := func(_ api.Asset, digest integrity.Digest, err error) {
+			result := PathResult{Path: leafPath}
+			if err == nil {
+				result.Digest = digest.Hex(s.backend.DigestFunction)
+				if req.Pin && local {
+					err = s.backend.DiskCache.Pin(digest, s.backend.DigestFunction)
+				} else if req.Pin {
+					err = s.backend.DiskCache.PinRemote(asset, digest, s.backend.DigestFunction)
+				}
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			results <- result
+		}
+		if local {
+			s.backend.Prefetcher.EnqueueLocalDownload(asset, callback)
+		} else {
+			s.backend.Prefetcher.EnqueueRemoteDownload(asset, callback)
+		}
+	}
+	if !req.Wait {
+		writeJSON(w, PathsResponse{Queued: len(leafs)})
+		return
+	}
+	resp := PathsResponse{Results: make([]PathResult, 0, len(leafs))}
+	for range leafs {
+		select {
+		case result := <-results:
+			resp.Results = append(resp.Results, result)
+		case <-r.Context().Done():
+			return
+		}
+	}
+	sortResults(resp.Results)
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleUnpin(w http.ResponseWriter, r *http.Request) {
+	var req PathsRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	leafs, ok := s.resolve(w, req.Paths)
+	if !ok {
+		return
+	}
+	resp := PathsResponse{Results: make([]PathResult, 0, len(leafs))}
+	for leafPath, leaf := range leafs {
+		result := PathResult{Path: leafPath}
+		if digest, ok := s.knownDigest(r.Context(), leaf); ok {
+			result.Digest = digest.Hex(s.backend.DigestFunction)
+			if err := errors.Join(
+				s.backend.DiskCache.Unpin(digest, s.backend.DigestFunction),
+				s.backend.DiskCache.UnpinRemote(digest, s.backend.DigestFunction),
+			); err != nil {
+				result.Error = err.Error()
+			}
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	sortResults(resp.Results)
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleEvict(w http.ResponseWriter, r *http.Request) {
+	var req PathsRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	leafs, ok := s.resolve(w, req.Paths)
+	if !ok {
+		return
+	}
+	resp := PathsResponse{Results: make([]PathResult, 0, len(leafs))}
+	for leafPath, leaf := range leafs {
+		result := PathResult{Path: leafPath}
+		digest, ok := s.knownDigest(r.Context(), leaf)
+		if ok {
+			result.Digest = digest.Hex(s.backend.DigestFunction)
+			evicted, err := s.backend.DiskCache.Evict(digest, s.backend.DigestFunction)
+			if err != nil {
+				result.Error = err.Error()
+			}
+			result.Evicted = evicted
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	sortResults(resp.Results)
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleState(w http.ResponseWriter, r *http.Request) {
+	paths := r.URL.Query()["path"]
+	if len(paths) == 0 {
+		// the whole mount
+		paths = []string{""}
+	}
+	leafs, ok := s.resolve(w, paths)
+	if !ok {
+		return
+	}
+	resp := StateResponse{Paths: make([]PathState, 0, len(leafs))}
+	for leafPath, leaf := range leafs {
+		state := PathState{Path: leafPath, SizeBytes: leaf.SizeHint}
+		digest, ok := s.knownDigest(r.Context(), leaf)
+		if ok {
+			state.Digest = digest.Hex(s.backend.DigestFunction)
+			state.SizeBytes = digest.SizeBytes
+			state.Pinned = s.backend.DiskCache.Pinned(digest, s.backend.DigestFunction)
+			state.PinnedRemote = s.backend.DiskCache.RemotePinned(digest, s.backend.DigestFunction)
+			missing, err := s.backend.DiskCache.FindMissingBlobs(r.Context(), []integrity.Digest{digest}, s.backend.DigestFunction)
+			if err != nil {
+				state.Error = err.Error()
+			}
+			state.Local = err == nil && len(missing) == 0
+			if s.backend.RemoteCache != nil {
+				missing, err := s.backend.RemoteCache.FindMissingBlobs(r.Context(), []integrity.Digest{digest}, s.backend.DigestFunction)
+				if err != nil {
+					state.Error = err.Error()
+				} else {
+					remote := len(missing) == 0
+					state.Remote = &remote
+				}
+			}
+		}
+		resp.Paths = append(resp.Paths, state)
+	}
+	slices.SortFunc(resp.Paths, func(a, b PathState) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, MetricsResponse{
+		Mount:      s.target.Config(),
+		Prefetcher: s.backend.Prefetcher.Stats(),
+		Mirrors:    s.backend.Downloader.MirrorStats(),
+	})
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	events, unsubscribe := s.backend.Prefetcher.Subscribe()
+	defer unsubscribe()
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// resolve maps the requested paths to files of the mount.
+func (s *Server) resolve(w http.ResponseWriter, paths []string) (map[string]*manifest.Leaf, bool) {
+	if len(paths) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("no paths given"))
+		return nil, false
+	}
+	leafs := make(map[string]*manifest.Leaf)
+	for _, requested := range paths {
+		matches := s.target.Leafs(requested)
+		if len(matches) == 0 {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no files found at %q", requested))
+			return nil, false
+		}
+		for leafPath, leaf := range matches {
+			leafs[leafPath] = leaf
+		}
+	}
+	return leafs, true
+}
+
+// knownDigest returns the digest of the file without fetching it.
+func (s *Server) knownDigest(ctx context.Context, leaf *manifest.Leaf) (integrity.Digest, bool) {
+	asset := leaf.Asset()
+	if digest, ok := s.backend.ChecksumCache.FromIntegrityWithAlgorithm(asset.IntegrityKey(), s.backend.DigestFunction); ok {
+		return digest, true
+	}
+	digest, ok, err := s.backend.DiskCache.FindAssetWithAlgorithm(ctx, asset, s.backend.DigestFunction)
+	if err != nil || !ok {
+		return integrity.Digest{}, false
+	}
+	return digest, true
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decoding request: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Debugf("writing control API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, statusCode int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+}
+
+func sortResults(results []PathResult) {
+	slices.SortFunc(results, func(a, b PathResult) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+}
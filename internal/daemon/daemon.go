@@ -0,0 +1,180 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Record describes a running asset-fuse mount.
+// It is written by the process serving the mount and
+// read by other invocations of asset-fuse (unmount, status).
+type Record struct {
+	PID        int       `json:"pid"`
+	MountPoint string    `json:"mountpoint"`
+	Manifest   string    `json:"manifest"`
+	View       string    `json:"view"`
+	LogFile    string    `json:"log_file,omitempty"`
+	PIDFile    string    `json:"pid_file,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	// ControlSocket is the unix socket of the control API (see "asset-fuse ctl").
+	ControlSocket string `json:"control_socket,omitempty"`
+	// Shared is set if the process serves multiple mounts ("asset-fuse serve").
+	// Such a process must not be terminated to unmount a single mountpoint.
+	Shared bool `json:"shared,omitempty"`
+}
+
+// StateDir returns the directory used to store records of running mounts.
+// It uses $XDG_RUNTIME_DIR if available and falls back to a per-user directory in the system temp dir.
+func StateDir() string {
+	if runtimeDir, ok := os.LookupEnv("XDG_RUNTIME_DIR"); ok && len(runtimeDir) > 0 {
+		return filepath.Join(runtimeDir, "asset-fuse")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("asset-fuse-%d", os.Getuid()))
+}
+
+// DefaultPIDFile returns the default location of the pidfile for the given mountpoint.
+func DefaultPIDFile(mountPoint string) string {
+	return filepath.Join(StateDir(), mountKey(mountPoint)+".pid")
+}
+
+// DefaultLogFile returns the default location of the log file for the given mountpoint.
+func DefaultLogFile(mountPoint string) string {
+	return filepath.Join(StateDir(), mountKey(mountPoint)+".log")
+}
+
+// DefaultControlSocket returns the default location of the control socket for the given mountpoint.
+// The socket is placed next to the mountpoint, unless the path would be too long for a unix socket.
+func DefaultControlSocket(mountPoint string) string {
+	if abs, err := filepath.Abs(mountPoint); err == nil {
+		mountPoint = abs
+	}
+	socketPath := filepath.Join(filepath.Dir(mountPoint), "."+filepath.Base(mountPoint)+".asset-fuse.sock")
+	if len(socketPath) < maxSocketPathLength {
+		return socketPath
+	}
+	return filepath.Join(StateDir(), mountKey(mountPoint)+".sock")
+}
+
+// DefaultServePIDFile returns the default location of the pidfile for "asset-fuse serve" started in workDir.
+func DefaultServePIDFile(workDir string) string {
+	return filepath.Join(StateDir(), serveKey(workDir)+".pid")
+}
+
+// DefaultServeLogFile returns the default location of the log file for "asset-fuse serve" started in workDir.
+func DefaultServeLogFile(workDir string) string {
+	return filepath.Join(StateDir(), serveKey(workDir)+".log")
+}
+
+// WriteRecord atomically stores the record for the mountpoint of r.
+func WriteRecord(r Record) error {
+	if err := os.MkdirAll(StateDir(), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	target := recordPath(r.MountPoint)
+	tmpFile, err := os.CreateTemp(StateDir(), "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), target)
+}
+
+// ReadRecord returns the record for the given mountpoint.
+func ReadRecord(mountPoint string) (Record, bool, error) {
+	data, err := os.ReadFile(recordPath(mountPoint))
+	if os.IsNotExist(err) {
+		return Record{}, false, nil
+	} else if err != nil {
+		return Record{}, false, err
+	}
+	var r Record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return Record{}, false, fmt.Errorf("parsing record for %s: %w", mountPoint, err)
+	}
+	return r, true, nil
+}
+
+// RemoveRecord removes the record for the given mountpoint.
+// Only the process that owns the record should remove it.
+func RemoveRecord(mountPoint string) error {
+	err := os.Remove(recordPath(mountPoint))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// WritePIDFile writes the pid of the current process to the given path.
+func WritePIDFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0o644)
+}
+
+// ReadPIDFile reads a pid from the given path.
+func ReadPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var pid int
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(data)), "%d", &pid); err != nil {
+		return 0, fmt.Errorf("parsing pidfile %s: %w", path, err)
+	}
+	return pid, nil
+}
+
+// ProcessAlive reports whether a process with the given pid exists.
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Signal sends sig to the process with the given pid.
+func Signal(pid int, sig syscall.Signal) error {
+	return syscall.Kill(pid, sig)
+}
+
+// maxSocketPathLength is the maximum length of a unix socket path (including the null byte) on Linux.
+const maxSocketPathLength = 108
+
+func recordPath(mountPoint string) string {
+	return filepath.Join(StateDir(), mountKey(mountPoint)+".json")
+}
+
+// mountKey derives a stable file name from the (absolute) mountpoint.
+func mountKey(mountPoint string) string {
+	if abs, err := filepath.Abs(mountPoint); err == nil {
+		mountPoint = abs
+	}
+	sum := sha256.Sum256([]byte(mountPoint))
+	return "mount-" + hex.EncodeToString(sum[:8])
+}
+
+func serveKey(workDir string) string {
+	sum := sha256.Sum256([]byte(workDir))
+	return "serve-" + hex.EncodeToString(sum[:8])
+}
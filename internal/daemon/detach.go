@@ -0,0 +1,97 @@
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/tweag/asset-fuse/api"
+)
+
+// IsChild reports whether the current process was started by Detach.
+func IsChild() bool {
+	_, ok := os.LookupEnv(api.DaemonReadyFDEnv)
+	return ok
+}
+
+// Detach starts the current executable (with the same arguments) as a background process.
+// The child runs in a new session and writes its output to logFile.
+// Detach blocks until the child reports readiness via NotifyReady (or exits).
+// It returns the pid of the child.
+func Detach(logFile string) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(logFile), 0o755); err != nil {
+		return 0, err
+	}
+	logOutput, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("opening log file: %w", err)
+	}
+	defer logOutput.Close()
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyReader.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), api.DaemonReadyFDEnv+"=3")
+	cmd.Stdin = nil
+	cmd.Stdout = logOutput
+	cmd.Stderr = logOutput
+	// the write end of the pipe becomes fd 3 in the child
+	cmd.ExtraFiles = []*os.File{readyWriter}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		readyWriter.Close()
+		return 0, err
+	}
+	// only the child should hold the write end from now on
+	readyWriter.Close()
+	pid := cmd.Process.Pid
+	// we never wait for the child - it is reparented once we exit
+	cmd.Process.Release()
+
+	line, err := bufio.NewReader(readyReader).ReadString('\n')
+	if errors.Is(err, io.EOF) && len(line) == 0 {
+		return pid, fmt.Errorf("daemon exited before becoming ready - see %s", logFile)
+	} else if err != nil && !errors.Is(err, io.EOF) {
+		return pid, err
+	}
+	line = strings.TrimSpace(line)
+	if message, ok := strings.CutPrefix(line, "error: "); ok {
+		return pid, errors.New(message)
+	}
+	if line != "ok" {
+		return pid, fmt.Errorf("unexpected readiness message from daemon: %q", line)
+	}
+	return pid, nil
+}
+
+// NotifyReady reports the result of the startup to the parent that called Detach.
+// It is a no-op if the process was not started by Detach.
+// It must be called at most once.
+func NotifyReady(startupErr error) {
+	if !IsChild() {
+		return
+	}
+	readyFile := os.NewFile(3, "ready")
+	if readyFile == nil {
+		return
+	}
+	defer readyFile.Close()
+	if startupErr != nil {
+		fmt.Fprintf(readyFile, "error: %s\n", strings.ReplaceAll(startupErr.Error(), "\n", " "))
+		return
+	}
+	fmt.Fprintln(readyFile, "ok")
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package daemon
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// LazyUnmount forcibly unmounts the filesystem at mountPoint.
+func LazyUnmount(mountPoint string) error {
+	output, err := exec.Command("umount", "-f", mountPoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("umount: %v: %s", err, output)
+	}
+	return nil
+}
+
+// Unmount unmounts the filesystem at mountPoint.
+// Unlike LazyUnmount, it fails if the filesystem is busy.
+func Unmount(mountPoint string) error {
+	output, err := exec.Command("umount", mountPoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("umount: %v: %s", err, output)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"golang.org/x/sys/unix"
+)
+
+// LazyUnmount detaches the filesystem at mountPoint, even if it is busy or the serving process is stuck.
+// It prefers fusermount (which works for unprivileged users) and falls back to umount2(MNT_DETACH).
+func LazyUnmount(mountPoint string) error {
+	var errs []error
+	for _, helper := range []string{"fusermount3", "fusermount"} {
+		path, err := exec.LookPath(helper)
+		if err != nil {
+			continue
+		}
+		output, err := exec.Command(path, "-u", "-z", mountPoint).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %v: %s", helper, err, output))
+	}
+	if err := unix.Unmount(mountPoint, unix.MNT_DETACH); err != nil {
+		errs = append(errs, fmt.Errorf("umount2: %w", err))
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// Unmount unmounts the filesystem at mountPoint.
+// Unlike LazyUnmount, it fails if the filesystem is busy.
+func Unmount(mountPoint string) error {
+	var errs []error
+	for _, helper := range []string{"fusermount3", "fusermount"} {
+		path, err := exec.LookPath(helper)
+		if err != nil {
+			continue
+		}
+		output, err := exec.Command(path, "-u", mountPoint).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %v: %s", helper, err, output))
+	}
+	if err := unix.Unmount(mountPoint, 0); err != nil {
+		errs = append(errs, fmt.Errorf("umount2: %w", err))
+		return errors.Join(errs...)
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+// Package transport configures proxies and TLS for outgoing HTTP and gRPC connections.
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"google.golang.org/grpc"
+)
+
+// DirectProxy is the proxy setting that disables proxying for a host.
+const DirectProxy = "direct"
+
+// TLSFiles are paths to PEM encoded files used for TLS connections.
+type TLSFiles struct {
+	// CACertificates are trusted in addition to the system's certificates.
+	CACertificates string
+	// ClientCertificate and ClientKey are presented to servers that request a client certificate.
+	ClientCertificate string
+	ClientKey         string
+}
+
+// Options configure how servers are reached.
+type Options struct {
+	// Proxy is the URL of the proxy for all connections.
+	// If empty, the environment variables HTTPS_PROXY, HTTP_PROXY and NO_PROXY are respected.
+	Proxy string
+	// NoProxy lists hosts that are contacted without a proxy (using the syntax of NO_PROXY).
+	NoProxy []string
+	TLS     TLSFiles
+	// Hosts override the settings for individual hosts. The first matching entry is used.
+	Hosts []HostOptions
+}
+
+// HostOptions override the options for connections to matching hosts.
+// Empty fields inherit the global options.
+type HostOptions struct {
+	// Host is a host name (without port).
+	// A leading "." or "*." matches the domain and all of its subdomains.
+	Host string
+	// Proxy is the URL of the proxy for this host or DirectProxy.
+	Proxy string
+	TLS   TLSFiles
+}
+
+// Transport is an http.RoundTripper that applies the proxy and TLS settings of the destination host.
+// It also provides the settings for gRPC connections.
+type Transport struct {
+	global profile
+	hosts  []hostProfile
+}
+
+type profile struct {
+	proxy     func(*url.URL) (*url.URL, error)
+	tlsConfig *tls.Config
+	http      *http.Transport
+}
+
+type hostProfile struct {
+	pattern string
+	profile
+}
+
+// New loads the certificates referenced by the options and creates a Transport.
+func New(options Options) (*Transport, error) {
+	global, err := newProfile(globalProxyFunc(options.Proxy, options.NoProxy), options.TLS)
+	if err != nil {
+		return nil, err
+	}
+	t := &Transport{global: global}
+	for _, host := range options.Hosts {
+		proxy := global.proxy
+		if len(host.Proxy) > 0 {
+			proxy, err = hostProxyFunc(host.Proxy)
+			if err != nil {
+				return nil, fmt.Errorf("host %s: %w", host.Host, err)
+			}
+		}
+		files := options.TLS
+		if len(host.TLS.CACertificates) > 0 {
+			files.CACertificates = host.TLS.CACertificates
+		}
+		if len(host.TLS.ClientCertificate) > 0 {
+			files.ClientCertificate = host.TLS.ClientCertificate
+			files.ClientKey = host.TLS.ClientKey
+		}
+		hostProfile := hostProfile{pattern: strings.ToLower(host.Host)}
+		hostProfile.profile, err = newProfile(proxy, files)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %w", host.Host, err)
+		}
+		t.hosts = append(t.hosts, hostProfile)
+	}
+	return t, nil
+}
+
+// RoundTrip sends the request using the settings of the request's host.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.profileFor(req.URL.Hostname()).http.RoundTrip(req)
+}
+
+// CloseIdleConnections closes idle connections of all hosts.
+func (t *Transport) CloseIdleConnections() {
+	t.global.http.CloseIdleConnections()
+	for _, host := range t.hosts {
+		host.http.CloseIdleConnections()
+	}
+}
+
+// TLSConfig returns the TLS configuration for connections to host.
+// A nil result means the default configuration.
+func (t *Transport) TLSConfig(host string) *tls.Config {
+	tlsConfig := t.profileFor(host).tlsConfig
+	if tlsConfig == nil {
+		return nil
+	}
+	return tlsConfig.Clone()
+}
+
+// GRPCDialOptions returns the gRPC target and dial options to connect to address (host:port).
+// If a proxy is used, the proxy resolves the host name.
+func (t *Transport) GRPCDialOptions(address string) (target string, opts []grpc.DialOption, err error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		// grpc defaults to port 443
+		host, port = address, "443"
+	}
+	profile := t.profileFor(host)
+	proxyURL, err := profile.proxy(&url.URL{Scheme: "https", Host: address})
+	if err != nil {
+		return "", nil, err
+	}
+	if proxyURL == nil {
+		return "dns:" + address, []grpc.DialOption{grpc.WithNoProxy()}, nil
+	}
+	proxyTLSConfig := t.proxyTLSConfig(proxyURL.Hostname())
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return dialThroughProxy(ctx, proxyURL, net.JoinHostPort(host, port), proxyTLSConfig)
+	}
+	return "passthrough:///" + address, []grpc.DialOption{grpc.WithContextDialer(dialer)}, nil
+}
+
+// proxyTLSConfig returns the TLS configuration for connections to an https proxy.
+// It trusts the CA certificates configured for the proxy host, but never presents a client certificate,
+// since client certificates are meant for the destination of the tunnel.
+func (t *Transport) proxyTLSConfig(proxyHost string) *tls.Config {
+	proxyTLSConfig := &tls.Config{ServerName: proxyHost}
+	if tlsConfig := t.profileFor(proxyHost).tlsConfig; tlsConfig != nil {
+		proxyTLSConfig.RootCAs = tlsConfig.RootCAs
+	}
+	return proxyTLSConfig
+}
+
+func (t *Transport) profileFor(host string) profile {
+	host = strings.ToLower(host)
+	for _, hostProfile := range t.hosts {
+		if MatchHost(hostProfile.pattern, host) {
+			return hostProfile.profile
+		}
+	}
+	return t.global
+}
+
+// MatchHost reports whether host matches pattern, which is a host name or a domain.
+// A domain is written with a leading "." or "*." and matches the domain itself and all of its subdomains.
+// Both arguments must be lower case.
+func MatchHost(pattern, host string) bool {
+	if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+		pattern = "." + domain
+	}
+	if domain, ok := strings.CutPrefix(pattern, "."); ok {
+		return host == domain || strings.HasSuffix(host, pattern)
+	}
+	return host == pattern
+}
+
+func newProfile(proxy func(*url.URL) (*url.URL, error), files TLSFiles) (profile, error) {
+	tlsConfig, err := loadTLSConfig(files)
+	if err != nil {
+		return profile{}, err
+	}
+	httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+	httpTransport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+	httpTransport.TLSClientConfig = tlsConfig
+	return profile{proxy: proxy, tlsConfig: tlsConfig, http: httpTransport}, nil
+}
+
+func globalProxyFunc(proxy string, noProxy []string) func(*url.URL) (*url.URL, error) {
+	var config httpproxy.Config
+	if len(proxy) > 0 {
+		config = httpproxy.Config{HTTPProxy: proxy, HTTPSProxy: proxy}
+	} else {
+		config = *httpproxy.FromEnvironment()
+	}
+	if len(noProxy) > 0 {
+		config.NoProxy = strings.Join(append([]string{config.NoProxy}, noProxy...), ",")
+	}
+	return config.ProxyFunc()
+}
+
+func hostProxyFunc(proxy string) (func(*url.URL) (*url.URL, error), error) {
+	if proxy == DirectProxy {
+		return func(*url.URL) (*url.URL, error) { return nil, nil }, nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", proxy, err)
+	}
+	return func(*url.URL) (*url.URL, error) { return proxyURL, nil }, nil
+}
+
+func loadTLSConfig(files TLSFiles) (*tls.Config, error) {
+	if len(files.CACertificates) == 0 && len(files.ClientCertificate) == 0 {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	if len(files.CACertificates) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(files.CACertificates)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificates: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificates found in %s", files.CACertificates)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(files.ClientCertificate) > 0 {
+		certificate, err := tls.LoadX509KeyPair(files.ClientCertificate, files.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// dialThroughProxy opens a tunnel to address with an HTTP CONNECT request.
+// proxyTLSConfig is used for the connection to proxies with the https scheme.
+func dialThroughProxy(ctx context.Context, proxyURL *url.URL, address string, proxyTLSConfig *tls.Config) (net.Conn, error) {
+	proxyAddress := proxyURL.Host
+	if len(proxyURL.Port()) == 0 {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddress = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("dialing proxy %s: %w", proxyAddress, err)
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, proxyTLSConfig)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sending CONNECT to proxy %s: %w", proxyAddress, err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading CONNECT response of proxy %s: %w", proxyAddress, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", proxyAddress, address, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		// the server already sent data after the CONNECT response
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+var _ http.RoundTripper = &Transport{}
@@ -0,0 +1,107 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMatchHost(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, host string
+		expected      bool
+	}{
+		{pattern: "example.com", host: "example.com", expected: true},
+		{pattern: "example.com", host: "www.example.com"},
+		{pattern: ".example.com", host: "example.com", expected: true},
+		{pattern: ".example.com", host: "a.b.example.com", expected: true},
+		{pattern: "*.example.com", host: "www.example.com", expected: true},
+		{pattern: "*.example.com", host: "example.com", expected: true},
+		{pattern: "*.example.com", host: "badexample.com"},
+		{pattern: ".example.com", host: "example.com.evil"},
+	} {
+		if got := MatchHost(tc.pattern, tc.host); got != tc.expected {
+			t.Errorf("MatchHost(%q, %q) = %v", tc.pattern, tc.host, got)
+		}
+	}
+}
+
+func TestGRPCDialOptions(t *testing.T) {
+	transport, err := New(Options{
+		Proxy: "http://proxy.example.com:3128",
+		Hosts: []HostOptions{{Host: ".internal", Proxy: DirectProxy}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		address, expectedTarget string
+	}{
+		{address: "cache.internal:443", expectedTarget: "dns:cache.internal:443"},
+		{address: "cache.example.com:443", expectedTarget: "passthrough:///cache.example.com:443"},
+		{address: "cache.example.com", expectedTarget: "passthrough:///cache.example.com"},
+	} {
+		target, _, err := transport.GRPCDialOptions(tc.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != tc.expectedTarget {
+			t.Errorf("expected target %q for %s, got %q", tc.expectedTarget, tc.address, target)
+		}
+	}
+}
+
+func TestDialThroughHTTPSProxy(t *testing.T) {
+	connects := make(chan string, 1)
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			http.Error(w, "unexpected client certificate", http.StatusForbidden)
+			return
+		}
+		connects <- r.Host
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		// echo the first line of the tunnel
+		line, _ := buffered.ReadString('\n')
+		io.WriteString(conn, line)
+	}))
+	proxy.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(proxy.Certificate())
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a client certificate of the destination must not be presented to the proxy
+	destinationTLSConfig := &tls.Config{RootCAs: pool, Certificates: proxy.TLS.Certificates}
+	transport := &Transport{global: profile{
+		proxy:     func(*url.URL) (*url.URL, error) { return proxyURL, nil },
+		tlsConfig: destinationTLSConfig,
+	}}
+	conn, err := dialThroughProxy(context.Background(), proxyURL, "cache.example.com:443", transport.proxyTLSConfig(proxyURL.Hostname()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if host := <-connects; host != "cache.example.com:443" {
+		t.Fatalf("expected CONNECT to cache.example.com:443, got %q", host)
+	}
+	io.WriteString(conn, "ping\n")
+	echo := make([]byte, 5)
+	if _, err := io.ReadFull(conn, echo); err != nil || !strings.HasPrefix(string(echo), "ping") {
+		t.Fatalf("expected the tunnel to echo, got %q (%v)", echo, err)
+	}
+}
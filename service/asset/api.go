@@ -12,7 +12,7 @@ import (
 // Asset is the interface for a (remote) asset service.
 type Asset interface {
 	Fetch
-	// This may be extended to also support the Push service in the future.
+	Push
 }
 
 // Fetch is equivalent to the Fetch service in the remote asset API.
@@ -21,7 +21,22 @@ type Fetch interface {
 		ctx context.Context, timeout time.Duration, oldestContentAccepted time.Time,
 		asset api.Asset, digestFunction integrity.Algorithm,
 	) (FetchBlobResponse, error)
-	// This may be extended to also support the FetchDirectory rpc in the future.
+	// FetchDirectory resolves the asset to a directory tree in the CAS (like a git repository or an extracted archive).
+	FetchDirectory(
+		ctx context.Context, timeout time.Duration, oldestContentAccepted time.Time,
+		asset api.Asset, digestFunction integrity.Algorithm,
+	) (FetchDirectoryResponse, error)
+}
+
+// Push is equivalent to the Push service in the remote asset API.
+type Push interface {
+	// PushBlob associates the URIs and qualifiers of the asset with a blob that is already in the CAS,
+	// so later FetchBlob requests for the asset are served from the CAS.
+	// A zero expireAt means that the association doesn't expire.
+	PushBlob(
+		ctx context.Context, expireAt time.Time,
+		asset api.Asset, blobDigest integrity.Digest, digestFunction integrity.Algorithm,
+	) error
 }
 
 type FetchBlobResponse struct {
@@ -31,4 +46,18 @@ type FetchBlobResponse struct {
 	ExpiresAt      time.Time
 	BlobDigest     integrity.Digest
 	DigestFunction integrity.Algorithm
+	// CompressedBlobDigest is the digest of the compressed content of an asset with compression
+	// (BlobDigest refers to the decompressed content).
+	// It is only set by services that decompress assets and may be empty for cached responses.
+	CompressedBlobDigest integrity.Digest
+}
+
+type FetchDirectoryResponse struct {
+	Status     status.Status
+	URI        string
+	Qualifiers map[string]string
+	ExpiresAt  time.Time
+	// RootDirectoryDigest is the digest of the root Directory message of the tree.
+	RootDirectoryDigest integrity.Digest
+	DigestFunction      integrity.Algorithm
 }
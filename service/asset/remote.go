@@ -5,16 +5,21 @@ import (
 	"errors"
 	"fmt"
 	"maps"
+	"slices"
 	"strings"
 	"time"
 
 	remoteasset_proto "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
+	remoteexecution_proto "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/tweag/asset-fuse/api"
 	"github.com/tweag/asset-fuse/auth/credential"
 	"github.com/tweag/asset-fuse/integrity"
 	integritypkg "github.com/tweag/asset-fuse/integrity"
 	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/internal/transport"
 	"github.com/tweag/asset-fuse/service/internal/protohelper"
+	"github.com/tweag/asset-fuse/service/retry"
+	"github.com/tweag/asset-fuse/service/status"
 	"google.golang.org/grpc"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -23,21 +28,31 @@ import (
 // RemoteAssetService uses the remote asset API to access assets via gRPC.
 // See also: https://raw.githubusercontent.com/bazelbuild/remote-apis/refs/tags/v2.11.0-rc2/build/bazel/remote/asset/v1/remote_asset.proto
 type RemoteAssetService struct {
+	conn                 *grpc.ClientConn
 	client               remoteasset_proto.FetchClient
+	pushClient           remoteasset_proto.PushClient
+	instanceName         string
 	helper               credential.Helper
 	propagateCredentials bool
+	retryPolicy          retry.Policy
 }
 
-func NewRemote(target string, helper credential.Helper, propagateCredentials bool, opts ...grpc.DialOption) (*RemoteAssetService, error) {
-	conn, err := protohelper.Client(target, helper, opts...)
+// NewRemote connects to the remote asset service at target.
+// The instance name (which may be empty) is sent with every request.
+func NewRemote(target, instanceName string, helper credential.Helper, network *transport.Transport, propagateCredentials bool, retryPolicy retry.Policy, opts ...grpc.DialOption) (*RemoteAssetService, error) {
+	conn, err := protohelper.Client(target, helper, network, opts...)
 	if err != nil {
 		return nil, err
 	}
 
 	return &RemoteAssetService{
+		conn:                 conn,
 		client:               remoteasset_proto.NewFetchClient(conn),
+		pushClient:           remoteasset_proto.NewPushClient(conn),
+		instanceName:         instanceName,
 		helper:               helper,
 		propagateCredentials: propagateCredentials,
+		retryPolicy:          retryPolicy,
 	}, nil
 }
 
@@ -45,13 +60,23 @@ func (r *RemoteAssetService) FetchBlob(
 	ctx context.Context, timeout time.Duration, oldestContentAccepted time.Time,
 	asset api.Asset, digestFunction integrity.Algorithm,
 ) (FetchBlobResponse, error) {
+	if len(asset.Compression) > 0 {
+		// the remote asset API has no way to request decompression
+		return FetchBlobResponse{}, fmt.Errorf("remote asset api: cannot fetch decompressed content of %v (compression: %s)", asset.URIs, asset.Compression)
+	}
 	if r.propagateCredentials {
 		asset.Qualifiers = r.authenticate(ctx, asset)
 	}
 
-	resp, err := r.client.FetchBlob(ctx, protoFetchBlobRequest(
-		timeout, oldestContentAccepted, asset.URIs, asset.Integrity, asset.Qualifiers, digestFunction,
-	))
+	req := protoFetchBlobRequest(
+		r.instanceName, timeout, oldestContentAccepted, asset.URIs, asset.Integrity, asset.Qualifiers, digestFunction,
+	)
+	var resp *remoteasset_proto.FetchBlobResponse
+	err := r.retryPolicy.Do(ctx, "FetchBlob", func(ctx context.Context) error {
+		var err error
+		resp, err = r.client.FetchBlob(ctx, req)
+		return err
+	})
 	if err != nil {
 		return FetchBlobResponse{}, err
 	}
@@ -73,6 +98,80 @@ func (r *RemoteAssetService) FetchBlob(
 	return out, nil
 }
 
+// FetchDirectory resolves the asset to a directory tree in the remote CAS.
+// The integrity of the asset (if any) refers to the source of the directory (like an archive).
+// Qualifiers identify the directory further (like "vcs.commit" or "resource_type").
+func (r *RemoteAssetService) FetchDirectory(
+	ctx context.Context, timeout time.Duration, oldestContentAccepted time.Time,
+	asset api.Asset, digestFunction integrity.Algorithm,
+) (FetchDirectoryResponse, error) {
+	if r.propagateCredentials {
+		asset.Qualifiers = r.authenticate(ctx, asset)
+	}
+
+	req := protoFetchDirectoryRequest(
+		r.instanceName, timeout, oldestContentAccepted, asset.URIs, asset.Integrity, asset.Qualifiers, digestFunction,
+	)
+	var resp *remoteasset_proto.FetchDirectoryResponse
+	err := r.retryPolicy.Do(ctx, "FetchDirectory", func(ctx context.Context) error {
+		var err error
+		resp, err = r.client.FetchDirectory(ctx, req)
+		return err
+	})
+	if err != nil {
+		return FetchDirectoryResponse{}, err
+	}
+	return fromProtoFetchDirectoryResponse(resp, digestFunction)
+}
+
+// PushBlob associates the asset with a blob of the remote CAS.
+// The qualifiers are the same ones FetchBlob sends (without propagated credentials),
+// so FetchBlob requests of other clients for the same asset match the association.
+func (r *RemoteAssetService) PushBlob(
+	ctx context.Context, expireAt time.Time,
+	asset api.Asset, blobDigest integrity.Digest, digestFunction integrity.Algorithm,
+) error {
+	if len(asset.Compression) > 0 {
+		// the URIs refer to the compressed content
+		return fmt.Errorf("remote asset api: cannot push decompressed content of %v (compression: %s)", asset.URIs, asset.Compression)
+	}
+	req := protoPushBlobRequest(r.instanceName, expireAt, asset.URIs, asset.Integrity, asset.Qualifiers, blobDigest, digestFunction)
+	return r.retryPolicy.Do(ctx, "PushBlob", func(ctx context.Context) error {
+		_, err := r.pushClient.PushBlob(ctx, req)
+		return err
+	})
+}
+
+// Capabilities describe what the remote asset service supports, as reported by GetCapabilities.
+type Capabilities struct {
+	// DigestFunctions supported by the server.
+	// If empty, the server didn't report any and the configured digest function is assumed to work.
+	DigestFunctions []integrity.Algorithm
+}
+
+// SupportsDigestFunction reports whether the server supports the digest function.
+func (c Capabilities) SupportsDigestFunction(digestFunction integrity.Algorithm) bool {
+	return len(c.DigestFunctions) == 0 || slices.Contains(c.DigestFunctions, digestFunction)
+}
+
+// Negotiate asks the server for its capabilities.
+// The remote asset API has no capabilities of its own, so this relies on the Capabilities service
+// of the REAPI server that provides the remote asset service.
+func (r *RemoteAssetService) Negotiate(ctx context.Context) (Capabilities, error) {
+	resp, err := protohelper.GetCapabilities(ctx, r.conn, r.instanceName, r.retryPolicy)
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("getting capabilities of remote asset service: %w", err)
+	}
+	return Capabilities{
+		DigestFunctions: protohelper.FromProtoDigestFunctions(resp.GetCacheCapabilities().GetDigestFunctions()),
+	}, nil
+}
+
+// Close closes the connection to the remote asset service.
+func (r *RemoteAssetService) Close() error {
+	return r.conn.Close()
+}
+
 func (r *RemoteAssetService) authenticate(ctx context.Context, asset api.Asset) map[string]string {
 	updatedQualifiers := maps.Clone(asset.Qualifiers)
 
@@ -97,11 +196,12 @@ func (r *RemoteAssetService) authenticate(ctx context.Context, asset api.Asset)
 }
 
 func protoFetchBlobRequest(
-	timeout time.Duration, oldestContentAccepted time.Time,
+	instanceName string, timeout time.Duration, oldestContentAccepted time.Time,
 	uris []string, integrity integrity.Integrity, qualifiers map[string]string,
 	digestFunction integrity.Algorithm,
 ) *remoteasset_proto.FetchBlobRequest {
 	req := &remoteasset_proto.FetchBlobRequest{
+		InstanceName:   instanceName,
 		Uris:           uris,
 		DigestFunction: protohelper.ProtoDigestFunction(digestFunction),
 	}
@@ -112,6 +212,53 @@ func protoFetchBlobRequest(
 		req.OldestContentAccepted = timestamppb.New(oldestContentAccepted)
 	}
 
+	req.Qualifiers = protoQualifiers(integrity, qualifiers, digestFunction)
+	return req
+}
+
+func protoFetchDirectoryRequest(
+	instanceName string, timeout time.Duration, oldestContentAccepted time.Time,
+	uris []string, integrity integrity.Integrity, qualifiers map[string]string,
+	digestFunction integrity.Algorithm,
+) *remoteasset_proto.FetchDirectoryRequest {
+	req := &remoteasset_proto.FetchDirectoryRequest{
+		InstanceName:   instanceName,
+		Uris:           uris,
+		DigestFunction: protohelper.ProtoDigestFunction(digestFunction),
+	}
+	if timeout != 0 {
+		req.Timeout = durationpb.New(timeout)
+	}
+	if !oldestContentAccepted.IsZero() {
+		req.OldestContentAccepted = timestamppb.New(oldestContentAccepted)
+	}
+
+	req.Qualifiers = protoQualifiers(integrity, qualifiers, digestFunction)
+	return req
+}
+
+func protoPushBlobRequest(
+	instanceName string, expireAt time.Time,
+	uris []string, integrity integrity.Integrity, qualifiers map[string]string,
+	blobDigest integrity.Digest, digestFunction integrity.Algorithm,
+) *remoteasset_proto.PushBlobRequest {
+	req := &remoteasset_proto.PushBlobRequest{
+		InstanceName: instanceName,
+		Uris:         uris,
+		Qualifiers:   protoQualifiers(integrity, qualifiers, digestFunction),
+		BlobDigest: &remoteexecution_proto.Digest{
+			Hash:      blobDigest.Hex(digestFunction),
+			SizeBytes: blobDigest.SizeBytes,
+		},
+		DigestFunction: protohelper.ProtoDigestFunction(digestFunction),
+	}
+	if !expireAt.IsZero() {
+		req.ExpireAt = timestamppb.New(expireAt)
+	}
+	return req
+}
+
+func protoQualifiers(integrity integrity.Integrity, qualifiers map[string]string, digestFunction integrity.Algorithm) []*remoteasset_proto.Qualifier {
 	// we need to merge integrity and qualifiers a list of unique qualifiers
 	uniqueQualifiers := make(map[string]string)
 	maps.Copy(uniqueQualifiers, qualifiers)
@@ -122,25 +269,28 @@ func protoFetchBlobRequest(
 	// After looking at concrete implementations of the remote asset API,
 	// it seems that sending only the sri for the digest function is most widely supported.
 	// If that's not available, we try them all (with hardcoded preference).
-	checksum, ok := integrity.BestSingleChecksum(digestFunction)
-	if !ok {
-		// we should never get here.
-		// if we do, fix the bug.
-		// TODO: maybe handle this gracefully before v1.0.0.
-		// TODO: it may even be fine to allow this case,
-		//       as long as we the user explicitly doesn't care about determinism via some flag.
-		panic("no checksum found in integrity")
+	// Only directories may have no integrity (they are identified by other qualifiers, like "vcs.commit").
+	if !integrity.Empty() {
+		checksum, ok := integrity.BestSingleChecksum(digestFunction)
+		if !ok {
+			// we should never get here.
+			// if we do, fix the bug.
+			// TODO: maybe handle this gracefully before v1.0.0.
+			// TODO: it may even be fine to allow this case,
+			//       as long as we the user explicitly doesn't care about determinism via some flag.
+			panic("no checksum found in integrity")
+		}
+		uniqueQualifiers["checksum.sri"] = checksum.ToSRI()
 	}
-	uniqueQualifiers["checksum.sri"] = checksum.ToSRI()
 
+	var out []*remoteasset_proto.Qualifier
 	for k, v := range uniqueQualifiers {
-		req.Qualifiers = append(req.Qualifiers, &remoteasset_proto.Qualifier{
+		out = append(out, &remoteasset_proto.Qualifier{
 			Name:  k,
 			Value: v,
 		})
 	}
-
-	return req
+	return out
 }
 
 func fromProtoFetchBlobResponse(resp *remoteasset_proto.FetchBlobResponse) (FetchBlobResponse, error) {
@@ -151,14 +301,49 @@ func fromProtoFetchBlobResponse(resp *remoteasset_proto.FetchBlobResponse) (Fetc
 	if err != nil {
 		return FetchBlobResponse{}, err
 	}
-	return FetchBlobResponse{
+	out := FetchBlobResponse{
 		Status:         protohelper.FromProtoStatus(resp.Status),
 		URI:            resp.Uri,
 		Qualifiers:     fromProtoQualifiers(resp.Qualifiers),
-		ExpiresAt:      resp.ExpiresAt.AsTime(),
 		BlobDigest:     digest,
 		DigestFunction: protohelper.FromProtoDigestFunction(resp.DigestFunction),
-	}, nil
+	}
+	if resp.ExpiresAt != nil {
+		// a missing expiry means the blob doesn't expire (as far as the server knows)
+		out.ExpiresAt = resp.ExpiresAt.AsTime()
+	}
+	return out, nil
+}
+
+// fromProtoFetchDirectoryResponse converts the response to a request for requestedDigestFunction.
+// Servers may leave the digest function unset, which means the requested one was used.
+// The root digest is only decoded for successful responses.
+func fromProtoFetchDirectoryResponse(resp *remoteasset_proto.FetchDirectoryResponse, requestedDigestFunction integrity.Algorithm) (FetchDirectoryResponse, error) {
+	if resp == nil {
+		return FetchDirectoryResponse{}, errors.New("FetchDirectoryResponse is nil")
+	}
+	digestFunction := requestedDigestFunction
+	if resp.DigestFunction != remoteexecution_proto.DigestFunction_UNKNOWN {
+		digestFunction = protohelper.FromProtoDigestFunction(resp.DigestFunction)
+	}
+	out := FetchDirectoryResponse{
+		Status:         protohelper.FromProtoStatus(resp.Status),
+		URI:            resp.Uri,
+		Qualifiers:     fromProtoQualifiers(resp.Qualifiers),
+		DigestFunction: digestFunction,
+	}
+	if resp.ExpiresAt != nil {
+		out.ExpiresAt = resp.ExpiresAt.AsTime()
+	}
+	if out.Status.Code != status.Status_OK {
+		return out, nil
+	}
+	digest, err := integrity.DigestFromHex(resp.GetRootDirectoryDigest().GetHash(), resp.GetRootDirectoryDigest().GetSizeBytes(), digestFunction)
+	if err != nil {
+		return FetchDirectoryResponse{}, err
+	}
+	out.RootDirectoryDigest = digest
+	return out, nil
 }
 
 func fromProtoQualifiers(qualifiers []*remoteasset_proto.Qualifier) map[string]string {
@@ -34,7 +34,9 @@ type Checker interface {
 type Reader interface {
 	BatchReadBlobs(ctx context.Context, blobDigests []integrity.Digest, digestFunction integrity.Algorithm) (BatchReadBlobsResponse, error)
 	ReadStream(ctx context.Context, blobDigest integrity.Digest, digestFunction integrity.Algorithm, offset, limit int64) (io.ReadCloser, error)
-	// GetTree is not supported for now
+	// GetTree returns all directories of the tree below the root directory.
+	// The directories are stored in the CAS as serialized REAPI Directory messages.
+	GetTree(ctx context.Context, rootDigest integrity.Digest, digestFunction integrity.Algorithm) (Tree, error)
 }
 
 type Writer interface {
@@ -61,21 +63,35 @@ type WriterAtCloser interface {
 	io.Closer
 }
 
+// Aborter is implemented by writers that can discard partially written data.
+type Aborter interface {
+	Abort() error
+}
+
+// AbortWrite discards the data written to w (if supported) and closes it.
+// Writers that don't support aborting are simply closed.
+func AbortWrite(w io.WriteCloser) error {
+	if aborter, ok := w.(Aborter); ok {
+		return aborter.Abort()
+	}
+	return w.Close()
+}
+
 type BatchReadBlobsResponse []ReadBlobsResponse
 
 type ReadBlobsResponse struct {
 	Digest integrity.Digest
+	// Data is always uncompressed (implementations handle compressed transfers themselves).
 	Data   []byte
 	Status status.Status
-	// TODO: handle compression (for now we just assume that the data is not compressed)
 }
 
 type BatchUpdateBlobsRequest []UpdateBlobsRequest
 
 type UpdateBlobsRequest struct {
 	Digest integrity.Digest
-	Data   []byte
-	// TODO: handle compression (for now we just assume that the data is not compressed)
+	// Data is always uncompressed (implementations handle compressed transfers themselves).
+	Data []byte
 }
 
 type BatchUpdateBlobsResponse []UpdateBlobsResponse
@@ -85,6 +101,37 @@ type UpdateBlobsResponse struct {
 	Status status.Status
 }
 
+// Tree is a directory tree stored in the CAS.
+type Tree struct {
+	// Root is the digest of the root directory.
+	Root integrity.Digest
+	// Directories maps the (hex) digests of all directories of the tree to their contents.
+	Directories map[string]Directory
+}
+
+// Directory is equivalent to the Directory message of the remote execution API.
+type Directory struct {
+	Files       []FileNode
+	Directories []DirectoryNode
+	Symlinks    []SymlinkNode
+}
+
+type FileNode struct {
+	Name         string
+	Digest       integrity.Digest
+	IsExecutable bool
+}
+
+type DirectoryNode struct {
+	Name   string
+	Digest integrity.Digest
+}
+
+type SymlinkNode struct {
+	Name   string
+	Target string
+}
+
 type DigestAndData struct {
 	Digest integrity.Digest
 	Data   []byte
@@ -0,0 +1,122 @@
+package cas
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/service/internal/protohelper"
+)
+
+// Capabilities describe what a remote CAS supports, as reported by GetCapabilities.
+type Capabilities struct {
+	// DigestFunctions supported by the server.
+	// If empty, the server didn't report any and the configured digest function is assumed to work.
+	DigestFunctions []integrity.Algorithm
+	// MaxBatchTotalSizeBytes is the maximum total size of a single batch request (0 means no limit).
+	MaxBatchTotalSizeBytes int64
+	// Compressors that can be used for ByteStream transfers and batch reads (like "zstd").
+	Compressors []string
+	// BatchUpdateCompressors can be used for batch updates.
+	BatchUpdateCompressors []string
+}
+
+// SupportsDigestFunction reports whether the server supports the digest function.
+func (c Capabilities) SupportsDigestFunction(digestFunction integrity.Algorithm) bool {
+	return len(c.DigestFunctions) == 0 || slices.Contains(c.DigestFunctions, digestFunction)
+}
+
+// BatchLimiter is implemented by CAS implementations that limit the total size of batch requests.
+type BatchLimiter interface {
+	// MaxBatchTotalSizeBytes returns the maximum total size of a batch request (0 means no limit).
+	MaxBatchTotalSizeBytes() int64
+}
+
+// Negotiate asks the server for its capabilities.
+// The capabilities are remembered and used for all later requests, so Negotiate must be called
+// before the Remote is used. Without negotiation, no limits are assumed.
+func (r *Remote) Negotiate(ctx context.Context) (Capabilities, error) {
+	resp, err := protohelper.GetCapabilities(ctx, r.conn, r.instanceName, r.retryPolicy)
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("getting capabilities of remote CAS: %w", err)
+	}
+	cacheCapabilities := resp.GetCacheCapabilities()
+	capabilities := Capabilities{
+		DigestFunctions:        protohelper.FromProtoDigestFunctions(cacheCapabilities.GetDigestFunctions()),
+		MaxBatchTotalSizeBytes: cacheCapabilities.GetMaxBatchTotalSizeBytes(),
+	}
+	for _, compressor := range cacheCapabilities.GetSupportedCompressors() {
+		capabilities.Compressors = append(capabilities.Compressors, strings.ToLower(compressor.String()))
+	}
+	for _, compressor := range cacheCapabilities.GetSupportedBatchUpdateCompressors() {
+		capabilities.BatchUpdateCompressors = append(capabilities.BatchUpdateCompressors, strings.ToLower(compressor.String()))
+	}
+	r.capabilities = capabilities
+	return capabilities, nil
+}
+
+// MaxBatchTotalSizeBytes returns the negotiated maximum size of batch requests (0 means no limit).
+func (r *Remote) MaxBatchTotalSizeBytes() int64 {
+	return r.capabilities.MaxBatchTotalSizeBytes
+}
+
+// BatchThreshold returns the size at which blobs are streamed instead of transferred with batch requests.
+// It is ByteStreamThreshold, lowered to respect the batch size limit of the CAS (if any).
+func BatchThreshold(c CAS) int64 {
+	threshold := int64(ByteStreamThreshold)
+	if limiter, ok := c.(BatchLimiter); ok {
+		if limit := limiter.MaxBatchTotalSizeBytes(); limit > 0 {
+			// leave room for the overhead of the request
+			threshold = min(threshold, limit/2)
+		}
+	}
+	return threshold
+}
+
+// splitBatch splits the blobs of a batch request into batches that respect the negotiated size limit.
+// It returns the end index (exclusive) of each batch.
+func (r *Remote) splitBatch(sizes []int64) ([]int, error) {
+	if len(sizes) == 0 {
+		return nil, nil
+	}
+	limit := r.capabilities.MaxBatchTotalSizeBytes
+	if limit <= 0 {
+		return []int{len(sizes)}, nil
+	}
+	// Leave room for the fields of the request itself.
+	// The overheads are upper bounds, so they are clamped for servers with tiny limits.
+	// Otherwise, such servers would not accept any blob, not even those below the batch threshold (half of the limit).
+	requestOverhead := min(batchRequestOverhead, limit/4)
+	blobOverhead := min(batchBlobOverhead, limit/4)
+	limit -= requestOverhead
+	var ends []int
+	var batchSize int64
+	for i, size := range sizes {
+		size += blobOverhead
+		if size > limit {
+			return nil, fmt.Errorf("blob of %d bytes exceeds the maximum batch size of the remote CAS (%d bytes)", size-blobOverhead, r.capabilities.MaxBatchTotalSizeBytes)
+		}
+		if batchSize+size > limit {
+			ends = append(ends, i)
+			batchSize = 0
+		}
+		batchSize += size
+	}
+	return append(ends, len(sizes)), nil
+}
+
+const (
+	// ByteStreamThreshold is the size at which blobs are streamed instead of transferred
+	// with batch requests (1 MiB), unless the CAS has a smaller batch size limit (see BatchThreshold).
+	//
+	// This value was chosen arbitrarily.
+	// TODO: make this configurable.
+	ByteStreamThreshold = 1 << 20
+	// batchRequestOverhead is an upper bound for the encoded size of a batch request without its blobs.
+	batchRequestOverhead = 1 << 10
+	// batchBlobOverhead is an upper bound for the encoded size of a single blob in a batch request besides its data
+	// (the digest, status and framing).
+	batchBlobOverhead = 1 << 8
+)
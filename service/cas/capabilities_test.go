@@ -0,0 +1,41 @@
+package cas
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitBatch(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		limit        int64
+		sizes        []int64
+		expectedEnds []int
+		expectError  bool
+	}{
+		{name: "no limit", sizes: []int64{1 << 30, 1 << 30}, expectedEnds: []int{2}},
+		{name: "single batch", limit: 1 << 20, sizes: []int64{100, 200, 300}, expectedEnds: []int{3}},
+		{name: "split at the limit", limit: 1 << 20, sizes: []int64{400 << 10, 400 << 10, 400 << 10}, expectedEnds: []int{2, 3}},
+		{name: "blob too large", limit: 1 << 20, sizes: []int64{1 << 20}, expectError: true},
+		// the overhead is larger than the limit: blobs below half of the limit must still fit
+		{name: "tiny limit", limit: 1000, sizes: []int64{499, 499}, expectedEnds: []int{1, 2}},
+		{name: "empty request", limit: 1000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &Remote{capabilities: Capabilities{MaxBatchTotalSizeBytes: tc.limit}}
+			ends, err := r.splitBatch(tc.sizes)
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("expected an error for a blob that exceeds the limit")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(ends, tc.expectedEnds) {
+				t.Fatalf("expected batches ending at %v, got %v", tc.expectedEnds, ends)
+			}
+		})
+	}
+}
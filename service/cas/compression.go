@@ -0,0 +1,230 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+
+	remoteexecution_proto "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/compression"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/service/retry"
+	"github.com/tweag/asset-fuse/service/status"
+	bytestream_proto "google.golang.org/genproto/googleapis/bytestream"
+)
+
+// The remote CAS transparently uses zstd compression (REAPI "compressed-blobs") if the server supports it.
+// Callers always read and write uncompressed data.
+
+var (
+	// zstdBatchEncoder and zstdBatchDecoder compress and decompress the inlined data of batch requests.
+	// EncodeAll and DecodeAll are safe for concurrent use.
+	zstdBatchEncoder, _ = zstd.NewWriter(nil)
+	zstdBatchDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// streamCompression reports whether ByteStream transfers and batch reads use zstd.
+func (r *Remote) streamCompression() bool {
+	return slices.Contains(r.capabilities.Compressors, compression.Zstd)
+}
+
+// batchUpdateCompression reports whether batch updates use zstd.
+func (r *Remote) batchUpdateCompression() bool {
+	return slices.Contains(r.capabilities.BatchUpdateCompressors, compression.Zstd)
+}
+
+// encodedBlob is a blob of a batch update request in the form it is sent.
+type encodedBlob struct {
+	digest     integrity.Digest
+	data       []byte
+	compressor remoteexecution_proto.Compressor_Value
+}
+
+// encodeBatchUpdate compresses the blobs of a batch update (if the server supports it).
+// Blobs that don't get smaller are sent uncompressed.
+func (r *Remote) encodeBatchUpdate(blobData DigestsAndData) []encodedBlob {
+	encoded := make([]encodedBlob, len(blobData))
+	compress := r.batchUpdateCompression()
+	for i, blob := range blobData {
+		encoded[i] = encodedBlob{digest: blob.Digest, data: blob.Data}
+		if !compress || len(blob.Data) == 0 {
+			continue
+		}
+		if compressed := zstdBatchEncoder.EncodeAll(blob.Data, nil); len(compressed) < len(blob.Data) {
+			encoded[i].data = compressed
+			encoded[i].compressor = remoteexecution_proto.Compressor_ZSTD
+		}
+	}
+	return encoded
+}
+
+// decodeBatchReadResponse decompresses the data of a batch read response and verifies it against the digest.
+func decodeBatchReadResponse(blobDigest integrity.Digest, digestFunction integrity.Algorithm, data []byte, compressor remoteexecution_proto.Compressor_Value) ([]byte, status.Status) {
+	if compressor != remoteexecution_proto.Compressor_ZSTD {
+		return nil, status.Status{Code: status.Status_INTERNAL, Message: fmt.Sprintf("unsupported compressor %s", compressor.String())}
+	}
+	decompressed, err := zstdBatchDecoder.DecodeAll(data, make([]byte, 0, blobDigest.SizeBytes))
+	if err != nil {
+		return nil, status.Status{Code: status.Status_DATA_LOSS, Message: fmt.Sprintf("decompressing blob: %v", err)}
+	}
+	if err := blobDigest.CheckContent(bytes.NewReader(decompressed), digestFunction); err != nil {
+		return nil, status.Status{Code: status.Status_DATA_LOSS, Message: err.Error()}
+	}
+	return decompressed, status.Status{Code: status.Status_OK}
+}
+
+// readCompressedStream reads a blob from offset to its end using the zstd compressed-blobs resource.
+func (r *Remote) readCompressedStream(ctx context.Context, blobDigest integrity.Digest, digestFunction integrity.Algorithm, offset int64) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	reader := &compressedReadCloser{
+		ctx:            ctx,
+		cancel:         cancel,
+		remote:         r,
+		blobDigest:     blobDigest,
+		digestFunction: digestFunction,
+		offset:         offset,
+	}
+	if offset == 0 {
+		// only complete blobs can be verified
+		reader.hasher = digestFunction.Hasher()
+	}
+	if err := reader.open(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// compressedReadCloser decompresses a compressed ByteStream read on the fly.
+// Transient errors resume the read at the current uncompressed offset with a fresh stream.
+type compressedReadCloser struct {
+	ctx            context.Context
+	cancel         context.CancelFunc
+	remote         *Remote
+	blobDigest     integrity.Digest
+	digestFunction integrity.Algorithm
+	offset         int64
+
+	decoder *zstd.Decoder
+	// hasher is nil if the read doesn't start at the beginning of the blob
+	hasher hash.Hash
+	// number of uncompressed bytes returned so far
+	decompressed int64
+	// number of consecutive failed attempts to receive data
+	failures int
+}
+
+func (c *compressedReadCloser) open() error {
+	var stream bytestream_proto.ByteStream_ReadClient
+	err := c.remote.retryPolicy.Do(c.ctx, "ByteStream.Read", func(ctx context.Context) error {
+		var err error
+		stream, err = c.remote.byteStreamClient.Read(ctx, protoCompressedReadRequest(c.remote.instanceName, c.blobDigest, c.digestFunction, c.offset+c.decompressed))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// the raw stream is never resumed by itself, since offsets of compressed reads refer to the uncompressed data
+	raw := &byteStreamReadCloser{stream: stream, retryPolicy: c.remote.retryPolicy, ctx: c.ctx, cancel: func() {}}
+	if c.decoder == nil {
+		c.decoder, err = zstd.NewReader(raw, zstd.WithDecoderConcurrency(1))
+		return err
+	}
+	return c.decoder.Reset(raw)
+}
+
+func (c *compressedReadCloser) Read(p []byte) (int, error) {
+	for {
+		n, err := c.decoder.Read(p)
+		c.decompressed += int64(n)
+		if c.hasher != nil {
+			c.hasher.Write(p[:n])
+		}
+		if c.offset+c.decompressed > c.blobDigest.SizeBytes {
+			return n, fmt.Errorf("compressed blob %s decompresses to more than %d bytes", c.blobDigest.Hex(c.digestFunction), c.blobDigest.SizeBytes)
+		}
+		if err == io.EOF {
+			if verifyErr := c.verify(); verifyErr != nil {
+				return n, verifyErr
+			}
+			return n, io.EOF
+		}
+		if err == nil {
+			c.failures = 0
+			return n, nil
+		}
+		c.failures++
+		if !retry.Retryable(err) || c.failures >= c.remote.retryPolicy.MaxAttempts {
+			return n, err
+		}
+		if !retry.Sleep(c.ctx, c.remote.retryPolicy.Backoff(c.failures)) {
+			return n, err
+		}
+		logging.Debugf("ByteStream.Read: resuming compressed read at offset %d after error: %v", c.offset+c.decompressed, err)
+		if reopenErr := c.open(); reopenErr != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// verify checks the decompressed data once the stream is complete.
+func (c *compressedReadCloser) verify() error {
+	if size := c.offset + c.decompressed; size != c.blobDigest.SizeBytes {
+		return fmt.Errorf("compressed blob %s decompresses to %d bytes, expected %d", c.blobDigest.Hex(c.digestFunction), size, c.blobDigest.SizeBytes)
+	}
+	if c.hasher == nil {
+		return nil
+	}
+	gotDigest := integrity.NewDigest(c.hasher.Sum(nil), c.decompressed, c.digestFunction)
+	if !gotDigest.Equals(c.blobDigest, c.digestFunction) {
+		return fmt.Errorf("compressed blob does not match digest: expected %s, got %s", c.blobDigest.Hex(c.digestFunction), gotDigest.Hex(c.digestFunction))
+	}
+	return nil
+}
+
+func (c *compressedReadCloser) Close() error {
+	c.cancel()
+	c.decoder.Close()
+	return nil
+}
+
+// compressedWriteCloser compresses data on the fly before it is written to a compressed ByteStream upload.
+type compressedWriteCloser struct {
+	encoder *zstd.Encoder
+	raw     *byteStreamWriteCloser
+}
+
+func (c *compressedWriteCloser) Write(p []byte) (int, error) {
+	return c.encoder.Write(p)
+}
+
+func (c *compressedWriteCloser) Close() error {
+	if err := c.encoder.Close(); err != nil {
+		c.raw.Abort()
+		return err
+	}
+	return c.raw.Close()
+}
+
+// Abort cancels the upload.
+func (c *compressedWriteCloser) Abort() error {
+	c.raw.Abort()
+	c.encoder.Close()
+	return nil
+}
+
+func protoCompressedReadRequest(instanceName string, blobDigest integrity.Digest, digestFunction integrity.Algorithm, offset int64) *bytestream_proto.ReadRequest {
+	// compressed reads never have a limit
+	return &bytestream_proto.ReadRequest{
+		ReadOffset:   offset,
+		ResourceName: withInstanceName(instanceName, fmt.Sprintf("compressed-blobs/%s/%s/%d", compression.Zstd, blobDigest.Hex(digestFunction), blobDigest.SizeBytes)),
+	}
+}
@@ -0,0 +1,171 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/service/retry"
+	bytestream_proto "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCompressedReadStream(t *testing.T) {
+	content := testContent(1 << 16)
+	digest := testDigest(content)
+
+	for _, tc := range []struct {
+		name string
+		// breakAfter is the number of compressed bytes that the first stream sends before it breaks (0: never)
+		breakAfter     int
+		breakWith      error
+		maxAttempts    int
+		expectError    bool
+		expectRequests int
+	}{
+		{name: "complete stream", expectRequests: 1},
+		{name: "resumed after a transient error", breakAfter: 512, breakWith: status.Error(codes.Unavailable, "connection reset"), expectRequests: 2},
+		{name: "permanent error", breakAfter: 512, breakWith: status.Error(codes.PermissionDenied, "denied"), expectError: true, expectRequests: 1},
+		{name: "attempts exhausted", breakAfter: 512, breakWith: status.Error(codes.Unavailable, "connection reset"), maxAttempts: 1, expectError: true, expectRequests: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := &fakeByteStream{content: content, breakAfter: tc.breakAfter, breakWith: tc.breakWith}
+			remote := testCompressingRemote(server, tc.maxAttempts, time.Millisecond)
+			reader, err := remote.ReadStream(context.Background(), digest, integrity.SHA256, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			got, err := io.ReadAll(reader)
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(got, content) {
+				t.Fatalf("expected %d bytes of content, got %d bytes", len(content), len(got))
+			}
+			if requests := server.offsets(); len(requests) != tc.expectRequests {
+				t.Fatalf("expected %d requests, got offsets %v", tc.expectRequests, requests)
+			}
+		})
+	}
+}
+
+func TestCompressedReadStreamCancelledDuringBackoff(t *testing.T) {
+	content := testContent(1 << 16)
+	server := &fakeByteStream{content: content, breakAfter: 512, breakWith: status.Error(codes.Unavailable, "connection reset")}
+	remote := testCompressingRemote(server, 5, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err := remote.ReadStream(ctx, testDigest(content), integrity.SHA256, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	time.AfterFunc(10*time.Millisecond, cancel)
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(reader)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected an error after cancellation")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read kept waiting for the backoff after the context was cancelled")
+	}
+}
+
+func testCompressingRemote(server *fakeByteStream, maxAttempts int, backoff time.Duration) *Remote {
+	if maxAttempts == 0 {
+		maxAttempts = 3
+	}
+	return &Remote{
+		byteStreamClient: server,
+		retryPolicy:      retry.Policy{MaxAttempts: maxAttempts, InitialBackoff: backoff, MaxBackoff: backoff},
+		capabilities:     Capabilities{Compressors: []string{"zstd"}},
+	}
+}
+
+// testContent returns pseudo-random (incompressible) content, so a stream can break in the middle of a frame.
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	source := rand.New(rand.NewPCG(1, 2))
+	for i := range content {
+		content[i] = byte(source.Uint32())
+	}
+	return content
+}
+
+func testDigest(content []byte) integrity.Digest {
+	hasher := integrity.SHA256.Hasher()
+	hasher.Write(content)
+	return integrity.NewDigest(hasher.Sum(nil), int64(len(content)), integrity.SHA256)
+}
+
+// fakeByteStream serves zstd compressed reads of content.
+// Only the first stream breaks (after breakAfter compressed bytes).
+type fakeByteStream struct {
+	bytestream_proto.ByteStreamClient
+	content    []byte
+	breakAfter int
+	breakWith  error
+
+	mux      sync.Mutex
+	requests []int64
+}
+
+func (f *fakeByteStream) Read(ctx context.Context, req *bytestream_proto.ReadRequest, opts ...grpc.CallOption) (bytestream_proto.ByteStream_ReadClient, error) {
+	f.mux.Lock()
+	first := len(f.requests) == 0
+	f.requests = append(f.requests, req.ReadOffset)
+	f.mux.Unlock()
+	encoder, _ := zstd.NewWriter(nil)
+	compressed := encoder.EncodeAll(f.content[req.ReadOffset:], nil)
+	stream := &fakeReadStream{ctx: ctx, data: compressed}
+	if first && f.breakAfter > 0 {
+		stream.data = compressed[:f.breakAfter]
+		stream.err = f.breakWith
+	}
+	return stream, nil
+}
+
+func (f *fakeByteStream) offsets() []int64 {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.requests
+}
+
+type fakeReadStream struct {
+	grpc.ClientStream
+	ctx  context.Context
+	data []byte
+	// err is returned after data (io.EOF if nil)
+	err error
+}
+
+func (s *fakeReadStream) Recv() (*bytestream_proto.ReadResponse, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	if len(s.data) == 0 {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	chunk := s.data[:min(256, len(s.data))]
+	s.data = s.data[len(chunk):]
+	return &bytestream_proto.ReadResponse{Data: chunk}, nil
+}
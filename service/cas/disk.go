@@ -2,14 +2,18 @@ package cas
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/tweag/asset-fuse/api"
 	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
 	"github.com/tweag/asset-fuse/service/status"
 )
 
@@ -102,11 +106,13 @@ func (d *Disk) BatchReadBlobs(ctx context.Context, blobDigests []integrity.Diges
 				Digest: digest,
 				Status: status.Status{Code: status.Status_NOT_FOUND},
 			})
+			continue
 		} else if err != nil {
 			responses = append(responses, ReadBlobsResponse{
 				Digest: digest,
 				Status: status.Status{Code: status.Status_UNKNOWN},
 			})
+			continue
 		}
 		responses = append(responses, ReadBlobsResponse{
 			Digest: digest,
@@ -137,11 +143,11 @@ func (d *Disk) BatchUpdateBlobs(ctx context.Context, blobData DigestsAndData, di
 
 		_, writeErr := staging.Write(item.Data)
 		if writeErr != nil && os.IsPermission(writeErr) {
-			staging.Close()
+			AbortWrite(staging)
 			responses = append(responses, UpdateBlobsResponse{item.Digest, status.Status{Code: status.Status_PERMISSION_DENIED, Message: writeErr.Error()}})
 			continue
 		} else if writeErr != nil {
-			staging.Close()
+			AbortWrite(staging)
 			responses = append(responses, UpdateBlobsResponse{item.Digest, status.Status{Code: status.Status_INTERNAL, Message: writeErr.Error()}})
 			continue
 		}
@@ -248,6 +254,169 @@ func (d *Disk) ImportBlob(ctx context.Context, prevalidatedIntegrity integrity.I
 	return integrity.NewDigest(knownChecksum.Hash, sizeBytes, digestFunction), nil
 }
 
+// Pin protects the blob with the given digest from eviction.
+// Pins are stored in the cache directory, so they survive restarts and are shared by all processes using the cache.
+func (d *Disk) Pin(blobDigest integrity.Digest, digestFunction integrity.Algorithm) error {
+	return os.WriteFile(d.pinPath(blobDigest, digestFunction), nil, 0o644)
+}
+
+// Unpin allows eviction of the blob with the given digest.
+func (d *Disk) Unpin(blobDigest integrity.Digest, digestFunction integrity.Algorithm) error {
+	if err := os.Remove(d.pinPath(blobDigest, digestFunction)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Pinned reports whether the blob with the given digest is protected from eviction.
+func (d *Disk) Pinned(blobDigest integrity.Digest, digestFunction integrity.Algorithm) bool {
+	_, err := os.Stat(d.pinPath(blobDigest, digestFunction))
+	return err == nil
+}
+
+// RemotePin is an asset that is kept alive in the remote cache.
+type RemotePin struct {
+	Asset  api.Asset
+	Digest integrity.Digest
+}
+
+// remotePinRecord is the serialization of a RemotePin.
+type remotePinRecord struct {
+	URIs                []string          `json:"uris"`
+	Integrity           string            `json:"integrity,omitempty"`
+	Qualifiers          map[string]string `json:"qualifiers,omitempty"`
+	Compression         string            `json:"compression,omitempty"`
+	CompressedIntegrity string            `json:"compressed_integrity,omitempty"`
+	SizeBytes           int64             `json:"size_bytes"`
+}
+
+// PinRemote records that the asset with the given digest should be kept alive in the remote cache.
+// The asset is stored with the pin, so it can be fetched again if the remote cache evicts the blob.
+func (d *Disk) PinRemote(asset api.Asset, blobDigest integrity.Digest, digestFunction integrity.Algorithm) error {
+	data, err := json.Marshal(remotePinRecord{
+		URIs:                asset.URIs,
+		Integrity:           asset.Integrity.ToSRIString(),
+		Qualifiers:          asset.Qualifiers,
+		Compression:         asset.Compression,
+		CompressedIntegrity: asset.CompressedIntegrity.ToSRIString(),
+		SizeBytes:           blobDigest.SizeBytes,
+	})
+	if err != nil {
+		return err
+	}
+	staging, err := os.CreateTemp(d.remotePinDir(digestFunction), ".pin-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staging.Name())
+	if _, err := staging.Write(data); err != nil {
+		staging.Close()
+		return err
+	}
+	if err := staging.Close(); err != nil {
+		return err
+	}
+	return os.Rename(staging.Name(), d.remotePinPath(blobDigest, digestFunction))
+}
+
+// UnpinRemote stops keeping the blob with the given digest alive in the remote cache.
+func (d *Disk) UnpinRemote(blobDigest integrity.Digest, digestFunction integrity.Algorithm) error {
+	if err := os.Remove(d.remotePinPath(blobDigest, digestFunction)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RemotePinned reports whether the blob with the given digest is kept alive in the remote cache.
+func (d *Disk) RemotePinned(blobDigest integrity.Digest, digestFunction integrity.Algorithm) bool {
+	_, err := os.Stat(d.remotePinPath(blobDigest, digestFunction))
+	return err == nil
+}
+
+// RemotePins returns all assets that are kept alive in the remote cache.
+// Unreadable pins are skipped.
+func (d *Disk) RemotePins(digestFunction integrity.Algorithm) ([]RemotePin, error) {
+	entries, err := os.ReadDir(d.remotePinDir(digestFunction))
+	if err != nil {
+		return nil, err
+	}
+	pins := make([]RemotePin, 0, len(entries))
+	for _, entry := range entries {
+		hexDigest, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		pin, err := d.readRemotePin(filepath.Join(d.remotePinDir(digestFunction), entry.Name()), hexDigest, digestFunction)
+		if err != nil {
+			logging.Warningf("reading remote pin %s: %v", entry.Name(), err)
+			continue
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+func (d *Disk) readRemotePin(path, hexDigest string, digestFunction integrity.Algorithm) (RemotePin, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RemotePin{}, err
+	}
+	var record remotePinRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return RemotePin{}, err
+	}
+	blobDigest, err := integrity.DigestFromHex(hexDigest, record.SizeBytes, digestFunction)
+	if err != nil {
+		return RemotePin{}, err
+	}
+	asset := api.Asset{URIs: record.URIs, Qualifiers: record.Qualifiers, Compression: record.Compression}
+	if len(record.Integrity) > 0 {
+		if asset.Integrity, err = integrity.IntegrityFromString(record.Integrity); err != nil {
+			return RemotePin{}, err
+		}
+	}
+	if len(record.CompressedIntegrity) > 0 {
+		if asset.CompressedIntegrity, err = integrity.IntegrityFromString(record.CompressedIntegrity); err != nil {
+			return RemotePin{}, err
+		}
+	}
+	return RemotePin{Asset: asset, Digest: blobDigest}, nil
+}
+
+// Evict removes the blob with the given digest from the disk cache.
+// It returns false if the blob was not present.
+// Pinned blobs are not evicted (ErrPinned).
+// Open readers of the blob are not affected.
+func (d *Disk) Evict(blobDigest integrity.Digest, digestFunction integrity.Algorithm) (bool, error) {
+	if d.Pinned(blobDigest, digestFunction) {
+		return false, ErrPinned
+	}
+	err := os.Remove(d.blobPath(integrity.ChecksumFromDigest(blobDigest, digestFunction)))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ErrPinned is returned when trying to evict a pinned blob.
+var ErrPinned = errors.New("blob is pinned")
+
+// pinPath returns the marker file that protects the blob with the given digest from eviction.
+func (d *Disk) pinPath(blobDigest integrity.Digest, digestFunction integrity.Algorithm) string {
+	return filepath.Join(d.rootDir, digestFunction.String(), "pins", blobDigest.Hex(digestFunction))
+}
+
+func (d *Disk) remotePinDir(digestFunction integrity.Algorithm) string {
+	return filepath.Join(d.rootDir, digestFunction.String(), "pins", "remote")
+}
+
+// remotePinPath returns the file that stores the asset of a remote pin.
+func (d *Disk) remotePinPath(blobDigest integrity.Digest, digestFunction integrity.Algorithm) string {
+	return filepath.Join(d.remotePinDir(digestFunction), blobDigest.Hex(digestFunction)+".json")
+}
+
 // blobPath returns the path to the blob with the given digest.
 // The directory structure used here is very similar to the one used by Bazel's local cache.
 // The only difference is that we allow for different digest functions, by using a subdirectory for each digest function.
@@ -282,6 +451,8 @@ func (d *Disk) initializeCacheDir() error {
 	// initialize the cache directory
 	// <rootDir>/cas/<digestFunction>/<first 2 hex>/
 	// <rootDir>/staging/<digestFunction>/
+	// <rootDir>/partial/<digestFunction>/
+	// <rootDir>/pins/<digestFunction>/
 	if err := os.MkdirAll(d.rootDir, 0o755); err != nil {
 		return err
 	}
@@ -302,14 +473,35 @@ func (d *Disk) initializeCacheDir() error {
 			return err
 		}
 		// try to clean up the staging directory from any leftover files
-		// (this assumes that the directory is only used by this process)
+		// (other processes using the same cache may still be writing recent files)
 		files, err := os.ReadDir(filepath.Join(digestPrefix, "staging"))
 		if err != nil {
 			return err
 		}
 		for _, file := range files {
-			if err := os.Remove(filepath.Join(digestPrefix, "staging", file.Name())); err != nil {
-				return err
+			if info, err := file.Info(); err == nil && time.Since(info.ModTime()) > stagingFileExpiry {
+				if err := os.Remove(filepath.Join(digestPrefix, "staging", file.Name())); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+		// <rootDir>/<digestFunction>/pins/ holds a marker file per pinned blob
+		// and pins/remote/ the assets that are kept alive in the remote cache.
+		if err := os.MkdirAll(filepath.Join(digestPrefix, "pins", "remote"), 0o755); err != nil {
+			return err
+		}
+		// Partial downloads survive restarts (so they can be resumed),
+		// but are removed once they are abandoned for a while.
+		if err := os.Mkdir(filepath.Join(digestPrefix, "partial"), 0o755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		files, err = os.ReadDir(filepath.Join(digestPrefix, "partial"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if info, err := file.Info(); err == nil && time.Since(info.ModTime()) > partialDownloadExpiry {
+				os.Remove(filepath.Join(digestPrefix, "partial", file.Name()))
 			}
 		}
 	}
@@ -317,6 +509,23 @@ func (d *Disk) initializeCacheDir() error {
 	return nil
 }
 
+// PartialDir returns the directory that holds resumable partial downloads.
+func (d *Disk) PartialDir(digestFunction integrity.Algorithm) string {
+	return filepath.Join(d.rootDir, digestFunction.String(), "partial")
+}
+
+// StagingDir returns the directory for temporary files that are imported into the cache later.
+// It is on the same filesystem as the cache, so imports don't need to copy the data.
+func (d *Disk) StagingDir(digestFunction integrity.Algorithm) string {
+	return filepath.Join(d.rootDir, digestFunction.String(), "staging")
+}
+
+// stagingFileExpiry is the time after which leftover files in the staging directory are removed.
+const stagingFileExpiry = 24 * time.Hour
+
+// partialDownloadExpiry is the time after which abandoned partial downloads are removed.
+const partialDownloadExpiry = 7 * 24 * time.Hour
+
 type blobFinalizer struct {
 	*os.File
 	stagingPath string
@@ -326,6 +535,12 @@ type blobFinalizer struct {
 	digestFunction integrity.Algorithm
 }
 
+// Abort discards the staging file without moving it into the CAS.
+func (b *blobFinalizer) Abort() error {
+	b.File.Close()
+	return os.Remove(b.stagingPath)
+}
+
 func (b *blobFinalizer) Close() error {
 	b.File.Close()
 	defer os.Remove(b.stagingPath)
@@ -394,4 +609,7 @@ func hardlinkOrCopy(source io.Reader, target string) (fileSize int64, err error)
 	return 0, nil
 }
 
-var _ LocalCAS = (*Disk)(nil)
+var (
+	_ LocalCAS = (*Disk)(nil)
+	_ Aborter  = (*blobFinalizer)(nil)
+)
@@ -0,0 +1,63 @@
+package cas
+
+import (
+	"testing"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+)
+
+func TestDiskPinsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	digest := integrity.NewDigest(make([]byte, integrity.SHA256.SizeBytes()), 42, integrity.SHA256)
+	assetIntegrity, err := integrity.IntegrityFromString("sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset := api.Asset{URIs: []string{"https://example.com/file"}, Integrity: assetIntegrity}
+
+	disk, err := NewDisk(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.Pin(digest, integrity.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.PinRemote(asset, digest, integrity.SHA256); err != nil {
+		t.Fatal(err)
+	}
+
+	disk, err = NewDisk(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !disk.Pinned(digest, integrity.SHA256) || !disk.RemotePinned(digest, integrity.SHA256) {
+		t.Fatal("pins should survive a restart")
+	}
+	if _, err := disk.Evict(digest, integrity.SHA256); err != ErrPinned {
+		t.Fatalf("expected ErrPinned, got %v", err)
+	}
+	pins, err := disk.RemotePins(integrity.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 1 || !pins[0].Digest.Equals(digest, integrity.SHA256) || pins[0].Digest.SizeBytes != 42 {
+		t.Fatalf("unexpected remote pins %+v", pins)
+	}
+	if pins[0].Asset.URIs[0] != asset.URIs[0] || pins[0].Asset.Integrity.ToSRIString() != asset.Integrity.ToSRIString() {
+		t.Fatalf("remote pin should store the asset, got %+v", pins[0].Asset)
+	}
+
+	if err := disk.Unpin(digest, integrity.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.UnpinRemote(digest, integrity.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if disk.Pinned(digest, integrity.SHA256) || disk.RemotePinned(digest, integrity.SHA256) {
+		t.Fatal("unpinned blob is still pinned")
+	}
+	if pins, _ := disk.RemotePins(integrity.SHA256); len(pins) != 0 {
+		t.Fatalf("expected no remote pins, got %d", len(pins))
+	}
+}
@@ -0,0 +1,472 @@
+package cas
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/service/retry"
+	"github.com/tweag/asset-fuse/service/status"
+)
+
+// HTTP uses the HTTP cache protocol of Bazel to store and retrieve blobs.
+// Blobs are stored at <base>/cas/<hash> and accessed with GET, PUT and HEAD requests.
+// There is no batch API, so batch requests are split into concurrent requests for single blobs.
+// See also: https://bazel.build/remote/caching#http-caching
+type HTTP struct {
+	baseURL     *url.URL
+	client      *http.Client
+	retryPolicy retry.Policy
+}
+
+// NewHTTP creates a client for the HTTP cache at baseURL (http:// or https://).
+// The client is expected to handle credentials (user info in baseURL is sent as basic auth).
+func NewHTTP(baseURL string, client *http.Client, retryPolicy retry.Policy) (*HTTP, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url for HTTP cache: %w", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("invalid url for HTTP cache: %s", baseURL)
+	}
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+	parsed.RawPath = ""
+	return &HTTP{
+		baseURL:     parsed,
+		client:      client,
+		retryPolicy: retryPolicy,
+	}, nil
+}
+
+// FindMissingBlobs checks the presence of every blob with a HEAD request.
+func (h *HTTP) FindMissingBlobs(ctx context.Context, blobDigests []integrity.Digest, digestFunction integrity.Algorithm) ([]integrity.Digest, error) {
+	present := make([]bool, len(blobDigests))
+	errs := make([]error, len(blobDigests))
+	concurrently(len(blobDigests), func(i int) {
+		if blobDigests[i].ZeroSized(digestFunction) {
+			// the empty blob is always available
+			present[i] = true
+			return
+		}
+		present[i], errs[i] = h.head(ctx, blobDigests[i], digestFunction)
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	var missing []integrity.Digest
+	for i, digest := range blobDigests {
+		if !present[i] {
+			missing = append(missing, digest)
+		}
+	}
+	return missing, nil
+}
+
+// BatchReadBlobs downloads the blobs with concurrent GET requests.
+func (h *HTTP) BatchReadBlobs(ctx context.Context, blobDigests []integrity.Digest, digestFunction integrity.Algorithm) (BatchReadBlobsResponse, error) {
+	responses := make(BatchReadBlobsResponse, len(blobDigests))
+	concurrently(len(blobDigests), func(i int) {
+		responses[i].Digest = blobDigests[i]
+		data, err := h.get(ctx, blobDigests[i], digestFunction)
+		if err != nil {
+			responses[i].Status = httpStatus(err)
+			return
+		}
+		responses[i].Data = data
+		responses[i].Status = status.Status{Code: status.Status_OK}
+	})
+	for _, response := range responses {
+		if response.Status.Code != status.Status_OK {
+			return responses, BatchResponseHasNonZeroStatus
+		}
+	}
+	return responses, nil
+}
+
+// ReadStream downloads a blob (or a part of it, using a range request).
+// Transient errors resume the download with a range request for the remaining bytes.
+func (h *HTTP) ReadStream(ctx context.Context, blobDigest integrity.Digest, digestFunction integrity.Algorithm, offset, limit int64) (io.ReadCloser, error) {
+	if offset < 0 || offset > blobDigest.SizeBytes {
+		return nil, fmt.Errorf("HTTP cache: offset %d out of range for blob %s of size %d", offset, blobDigest.Hex(digestFunction), blobDigest.SizeBytes)
+	}
+	end := blobDigest.SizeBytes
+	if limit > 0 {
+		end = min(end, offset+limit)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	reader := &httpReadCloser{
+		ctx:            ctx,
+		cancel:         cancel,
+		cache:          h,
+		blobDigest:     blobDigest,
+		digestFunction: digestFunction,
+		position:       offset,
+		end:            end,
+	}
+	if offset == 0 && end == blobDigest.SizeBytes {
+		// only complete blobs can be verified
+		reader.hasher = digestFunction.Hasher()
+	}
+	if err := reader.open(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// BatchUpdateBlobs uploads the blobs with concurrent PUT requests.
+func (h *HTTP) BatchUpdateBlobs(ctx context.Context, blobData DigestsAndData, digestFunction integrity.Algorithm) (BatchUpdateBlobsResponse, error) {
+	responses := make(BatchUpdateBlobsResponse, len(blobData))
+	concurrently(len(blobData), func(i int) {
+		responses[i].Digest = blobData[i].Digest
+		responses[i].Status = status.Status{Code: status.Status_OK}
+		if blobData[i].Digest.ZeroSized(digestFunction) {
+			return
+		}
+		err := h.retryPolicy.Do(ctx, "HTTP cache PUT", func(ctx context.Context) error {
+			return h.put(ctx, blobData[i].Digest, digestFunction, bytes.NewReader(blobData[i].Data))
+		})
+		if err != nil {
+			responses[i].Status = httpStatus(err)
+		}
+	})
+	for _, response := range responses {
+		if response.Status.Code != status.Status_OK {
+			return responses, BatchResponseHasNonZeroStatus
+		}
+	}
+	return responses, nil
+}
+
+// WriteStream uploads a blob with a single PUT request.
+// Uploads are not resumed after errors, so callers need to retry the whole upload.
+func (h *HTTP) WriteStream(ctx context.Context, blobDigest integrity.Digest, digestFunction integrity.Algorithm) (io.WriteCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	pipeReader, pipeWriter := io.Pipe()
+	writer := &httpWriteCloser{
+		pipe:   pipeWriter,
+		cancel: cancel,
+		size:   blobDigest.SizeBytes,
+		done:   make(chan error, 1),
+	}
+	go func() {
+		err := h.put(ctx, blobDigest, digestFunction, pipeReader)
+		// unblock pending writes if the server responded early
+		pipeReader.CloseWithError(cmp.Or(err, io.ErrClosedPipe))
+		writer.done <- err
+	}()
+	return writer, nil
+}
+
+func (h *HTTP) head(ctx context.Context, blobDigest integrity.Digest, digestFunction integrity.Algorithm) (bool, error) {
+	var present bool
+	err := h.retryPolicy.Do(ctx, "HTTP cache HEAD", func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, h.blobURL(blobDigest, digestFunction), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := h.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			present = true
+		case http.StatusNotFound:
+			present = false
+		default:
+			return retry.NewHTTPStatusError(resp)
+		}
+		return nil
+	})
+	return present, err
+}
+
+func (h *HTTP) get(ctx context.Context, blobDigest integrity.Digest, digestFunction integrity.Algorithm) ([]byte, error) {
+	if blobDigest.ZeroSized(digestFunction) {
+		return []byte{}, nil
+	}
+	var data []byte
+	err := h.retryPolicy.Do(ctx, "HTTP cache GET", func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.blobURL(blobDigest, digestFunction), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := h.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return retry.NewHTTPStatusError(resp)
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, blobDigest.SizeBytes))
+		// read one byte more than expected to detect oversized responses
+		if _, err := io.Copy(buf, io.LimitReader(resp.Body, blobDigest.SizeBytes+1)); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := blobDigest.CheckContent(bytes.NewReader(data), digestFunction); err != nil {
+		return nil, errDataLoss{err}
+	}
+	return data, nil
+}
+
+func (h *HTTP) put(ctx context.Context, blobDigest integrity.Digest, digestFunction integrity.Algorithm, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, h.blobURL(blobDigest, digestFunction), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = blobDigest.SizeBytes
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return retry.NewHTTPStatusError(resp)
+	}
+	return nil
+}
+
+func (h *HTTP) blobURL(blobDigest integrity.Digest, digestFunction integrity.Algorithm) string {
+	return h.baseURL.JoinPath("cas", blobDigest.Hex(digestFunction)).String()
+}
+
+// httpReadCloser reads a range of a blob.
+// Transient errors resume the read at the current position with a new range request.
+type httpReadCloser struct {
+	ctx            context.Context
+	cancel         context.CancelFunc
+	cache          *HTTP
+	blobDigest     integrity.Digest
+	digestFunction integrity.Algorithm
+	// position is the offset of the next byte to read, end is the offset after the last byte to read.
+	position, end int64
+
+	body io.ReadCloser
+	// hasher is nil if the read doesn't cover the whole blob
+	hasher hash.Hash
+	// number of consecutive failed attempts to receive data
+	failures int
+}
+
+func (r *httpReadCloser) open() error {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	if r.position == r.end {
+		r.body = io.NopCloser(bytes.NewReader(nil))
+		return nil
+	}
+	return r.cache.retryPolicy.Do(r.ctx, "HTTP cache GET", func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.cache.blobURL(r.blobDigest, r.digestFunction), nil)
+		if err != nil {
+			return err
+		}
+		partial := r.position > 0 || r.end < r.blobDigest.SizeBytes
+		if partial {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.position, r.end-1))
+		}
+		resp, err := r.cache.client.Do(req)
+		if err != nil {
+			return err
+		}
+		switch {
+		case resp.StatusCode == http.StatusPartialContent && partial:
+		case resp.StatusCode == http.StatusOK:
+			// the server ignored the range request (or none was sent)
+			if _, err := io.CopyN(io.Discard, resp.Body, r.position); err != nil {
+				resp.Body.Close()
+				return err
+			}
+		default:
+			resp.Body.Close()
+			return retry.NewHTTPStatusError(resp)
+		}
+		r.body = readCloser{io.LimitReader(resp.Body, r.end-r.position), resp.Body}
+		return nil
+	})
+}
+
+func (r *httpReadCloser) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.position += int64(n)
+		if r.hasher != nil {
+			r.hasher.Write(p[:n])
+		}
+		if err == io.EOF {
+			if r.position < r.end {
+				err = io.ErrUnexpectedEOF
+			} else if verifyErr := r.verify(); verifyErr != nil {
+				return n, verifyErr
+			} else {
+				return n, io.EOF
+			}
+		}
+		if err == nil {
+			r.failures = 0
+			return n, nil
+		}
+		r.failures++
+		if !retry.Retryable(err) || r.failures >= r.cache.retryPolicy.MaxAttempts {
+			return n, err
+		}
+		if !retry.Sleep(r.ctx, r.cache.retryPolicy.Backoff(r.failures)) {
+			return n, err
+		}
+		logging.Debugf("HTTP cache GET: resuming read at offset %d after error: %v", r.position, err)
+		if reopenErr := r.open(); reopenErr != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// verify checks the hash of the blob once it was read completely.
+func (r *httpReadCloser) verify() error {
+	if r.hasher == nil {
+		return nil
+	}
+	gotDigest := integrity.NewDigest(r.hasher.Sum(nil), r.position, r.digestFunction)
+	if !gotDigest.Equals(r.blobDigest, r.digestFunction) {
+		return errDataLoss{fmt.Errorf("blob from HTTP cache does not match digest: expected %s, got %s", r.blobDigest.Hex(r.digestFunction), gotDigest.Hex(r.digestFunction))}
+	}
+	return nil
+}
+
+func (r *httpReadCloser) Close() error {
+	r.cancel()
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// httpWriteCloser streams data into the body of a PUT request.
+type httpWriteCloser struct {
+	pipe    *io.PipeWriter
+	cancel  context.CancelFunc
+	size    int64
+	written int64
+	// done receives the result of the request
+	done     chan error
+	finished bool
+	result   error
+}
+
+func (w *httpWriteCloser) Write(p []byte) (int, error) {
+	if w.written+int64(len(p)) > w.size {
+		return 0, fmt.Errorf("HTTP cache PUT: writing more than %d bytes", w.size)
+	}
+	n, err := w.pipe.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *httpWriteCloser) Close() error {
+	defer w.cancel()
+	if w.written != w.size {
+		w.Abort()
+		return fmt.Errorf("HTTP cache PUT: wrote %d bytes, expected %d", w.written, w.size)
+	}
+	w.pipe.Close()
+	return w.wait()
+}
+
+// Abort cancels the upload.
+func (w *httpWriteCloser) Abort() error {
+	w.cancel()
+	w.pipe.CloseWithError(errUploadAborted)
+	w.wait()
+	return nil
+}
+
+// wait returns the result of the request once it is done.
+func (w *httpWriteCloser) wait() error {
+	if !w.finished {
+		w.result = <-w.done
+		w.finished = true
+	}
+	return w.result
+}
+
+// readCloser combines a reader with the closer of an underlying reader.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// errDataLoss is returned for blobs that don't match their digest.
+type errDataLoss struct {
+	err error
+}
+
+func (e errDataLoss) Error() string { return e.err.Error() }
+
+func (e errDataLoss) Unwrap() error { return e.err }
+
+// httpStatus converts an error of the HTTP cache into the status of a batch response.
+func httpStatus(err error) status.Status {
+	var dataLoss errDataLoss
+	if errors.As(err, &dataLoss) {
+		return status.Status{Code: status.Status_DATA_LOSS, Message: err.Error()}
+	}
+	var httpErr *retry.HTTPStatusError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusNotFound:
+			return status.Status{Code: status.Status_NOT_FOUND, Message: err.Error()}
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return status.Status{Code: status.Status_PERMISSION_DENIED, Message: err.Error()}
+		case http.StatusInsufficientStorage, http.StatusRequestEntityTooLarge:
+			return status.Status{Code: status.Status_RESOURCE_EXHAUSTED, Message: err.Error()}
+		}
+	}
+	return status.Status{Code: status.Status_UNKNOWN, Message: err.Error()}
+}
+
+// concurrently calls fn for 0..n-1 with at most httpConcurrency calls at a time.
+func concurrently(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, httpConcurrency)
+	for i := range n {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
+
+var errUploadAborted = errors.New("upload aborted")
+
+// httpConcurrency is the number of concurrent requests for batch operations.
+const httpConcurrency = 16
+
+var _ CAS = &HTTP{}
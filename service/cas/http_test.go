@@ -0,0 +1,316 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/service/retry"
+	"github.com/tweag/asset-fuse/service/status"
+)
+
+func TestHTTPFindMissingBlobs(t *testing.T) {
+	present, missing := testContent(100), testContent(200)
+	server := newFakeHTTPCache(t)
+	server.blobs[testDigest(present).Hex(integrity.SHA256)] = present
+	cache := testHTTPCache(t, server)
+
+	got, err := cache.FindMissingBlobs(context.Background(), []integrity.Digest{testDigest(present), testDigest(missing)}, integrity.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !got[0].Equals(testDigest(missing), integrity.SHA256) {
+		t.Fatalf("expected only the second blob to be missing, got %v", got)
+	}
+
+	server.status = http.StatusForbidden
+	if _, err := cache.FindMissingBlobs(context.Background(), []integrity.Digest{testDigest(present)}, integrity.SHA256); err == nil {
+		t.Fatal("expected an error for a forbidden HEAD request")
+	}
+}
+
+func TestHTTPBatchReadBlobs(t *testing.T) {
+	content := testContent(1000)
+	for _, tc := range []struct {
+		name   string
+		stored []byte
+		status int
+		expect status.StatusCode
+	}{
+		{name: "found", stored: content, expect: status.Status_OK},
+		{name: "not found", expect: status.Status_NOT_FOUND},
+		{name: "corrupted", stored: corrupted(content), expect: status.Status_DATA_LOSS},
+		{name: "unauthorized", stored: content, status: http.StatusUnauthorized, expect: status.Status_PERMISSION_DENIED},
+		{name: "server error", stored: content, status: http.StatusInternalServerError, expect: status.Status_UNKNOWN},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newFakeHTTPCache(t)
+			server.status = tc.status
+			if tc.stored != nil {
+				server.blobs[testDigest(content).Hex(integrity.SHA256)] = tc.stored
+			}
+			cache := testHTTPCache(t, server)
+			responses, err := cache.BatchReadBlobs(context.Background(), []integrity.Digest{testDigest(content)}, integrity.SHA256)
+			if got := responses[0].Status.Code; got != tc.expect {
+				t.Fatalf("expected status %v, got %v (%v)", tc.expect, got, err)
+			}
+			if tc.expect == status.Status_OK {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(responses[0].Data, content) {
+					t.Fatal("unexpected content")
+				}
+			} else if !errors.Is(err, BatchResponseHasNonZeroStatus) {
+				t.Fatalf("expected BatchResponseHasNonZeroStatus, got %v", err)
+			}
+		})
+	}
+}
+
+func TestHTTPReadStream(t *testing.T) {
+	content := testContent(1 << 16)
+	for _, tc := range []struct {
+		name          string
+		offset, limit int64
+		ignoreRanges  bool
+		// dropAfter is the number of bytes that the first GET response sends before the connection drops (0: never)
+		dropAfter      int
+		corrupt        bool
+		expectError    bool
+		expectRequests int
+	}{
+		{name: "complete blob", expectRequests: 1},
+		{name: "range", offset: 1000, limit: 5000, expectRequests: 1},
+		{name: "range ignored by the server", offset: 1000, limit: 5000, ignoreRanges: true, expectRequests: 1},
+		{name: "resumed after a dropped body", dropAfter: 4096, expectRequests: 2},
+		{name: "range resumed after a dropped body", offset: 1000, dropAfter: 4096, expectRequests: 2},
+		{name: "corrupted blob", corrupt: true, expectError: true, expectRequests: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newFakeHTTPCache(t)
+			server.ignoreRanges = tc.ignoreRanges
+			server.dropAfter = tc.dropAfter
+			stored := content
+			if tc.corrupt {
+				stored = corrupted(content)
+			}
+			server.blobs[testDigest(content).Hex(integrity.SHA256)] = stored
+			cache := testHTTPCache(t, server)
+
+			reader, err := cache.ReadStream(context.Background(), testDigest(content), integrity.SHA256, tc.offset, tc.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			got, err := io.ReadAll(reader)
+			if tc.expectError {
+				var dataLoss errDataLoss
+				if !errors.As(err, &dataLoss) {
+					t.Fatalf("expected a data loss error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				end := int64(len(content))
+				if tc.limit > 0 {
+					end = tc.offset + tc.limit
+				}
+				if !bytes.Equal(got, content[tc.offset:end]) {
+					t.Fatalf("expected bytes %d-%d of the content, got %d bytes", tc.offset, end, len(got))
+				}
+			}
+			if requests := server.getRequests(); requests != tc.expectRequests {
+				t.Fatalf("expected %d GET requests, got %d", tc.expectRequests, requests)
+			}
+		})
+	}
+}
+
+func TestHTTPWriteStream(t *testing.T) {
+	content := testContent(1 << 16)
+	digest := testDigest(content)
+
+	t.Run("close", func(t *testing.T) {
+		server := newFakeHTTPCache(t)
+		cache := testHTTPCache(t, server)
+		writer, err := cache.WriteStream(context.Background(), digest, integrity.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(server.blob(digest), content) {
+			t.Fatal("the uploaded blob doesn't match the content")
+		}
+	})
+
+	t.Run("close incomplete", func(t *testing.T) {
+		server := newFakeHTTPCache(t)
+		cache := testHTTPCache(t, server)
+		writer, err := cache.WriteStream(context.Background(), digest, integrity.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(content[:1000]); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err == nil {
+			t.Fatal("expected an error for an incomplete upload")
+		}
+		if server.blob(digest) != nil {
+			t.Fatal("an incomplete upload was stored")
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		server := newFakeHTTPCache(t)
+		cache := testHTTPCache(t, server)
+		writer, err := cache.WriteStream(context.Background(), digest, integrity.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(content[:1000]); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.(interface{ Abort() error }).Abort(); err != nil {
+			t.Fatal(err)
+		}
+		if server.blob(digest) != nil {
+			t.Fatal("an aborted upload was stored")
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		server := newFakeHTTPCache(t)
+		server.status = http.StatusInsufficientStorage
+		cache := testHTTPCache(t, server)
+		responses, err := cache.BatchUpdateBlobs(context.Background(), DigestsAndData{{Digest: digest, Data: content}}, integrity.SHA256)
+		if !errors.Is(err, BatchResponseHasNonZeroStatus) {
+			t.Fatalf("expected BatchResponseHasNonZeroStatus, got %v", err)
+		}
+		if got := responses[0].Status.Code; got != status.Status_RESOURCE_EXHAUSTED {
+			t.Fatalf("expected status RESOURCE_EXHAUSTED, got %v", got)
+		}
+	})
+}
+
+func testHTTPCache(t *testing.T, server *fakeHTTPCache) *HTTP {
+	t.Helper()
+	cache, err := NewHTTP(server.URL+"/cache/", server.Client(), retry.Policy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+// corrupted returns a copy of content with a single flipped bit.
+func corrupted(content []byte) []byte {
+	data := bytes.Clone(content)
+	data[len(data)/2] ^= 1
+	return data
+}
+
+// fakeHTTPCache implements the HTTP cache protocol for blobs under /cache/cas/.
+type fakeHTTPCache struct {
+	*httptest.Server
+	// status is returned for every request instead of serving it (0: serve requests)
+	status       int
+	ignoreRanges bool
+	dropAfter    int
+
+	mux   sync.Mutex
+	blobs map[string][]byte
+	gets  int
+}
+
+func newFakeHTTPCache(t *testing.T) *fakeHTTPCache {
+	f := &fakeHTTPCache{blobs: make(map[string][]byte)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeHTTPCache) serve(w http.ResponseWriter, r *http.Request) {
+	hash, ok := strings.CutPrefix(r.URL.Path, "/cache/cas/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		f.mux.Lock()
+		f.blobs[hash] = data
+		f.mux.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodHead, http.MethodGet:
+		f.mux.Lock()
+		data, found := f.blobs[hash]
+		first := r.Method == http.MethodGet && f.gets == 0
+		if r.Method == http.MethodGet {
+			f.gets++
+		}
+		f.mux.Unlock()
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		status := http.StatusOK
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && !f.ignoreRanges {
+			var start, end int
+			if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data = data[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodHead {
+			return
+		}
+		if first && f.dropAfter > 0 {
+			w.Write(data[:f.dropAfter])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Write(data)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeHTTPCache) getRequests() int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.gets
+}
+
+func (f *fakeHTTPCache) blob(digest integrity.Digest) []byte {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.blobs[digest.Hex(integrity.SHA256)]
+}
@@ -3,13 +3,20 @@ package cas
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 
 	remoteexecution_proto "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/klauspost/compress/zstd"
 	"github.com/tweag/asset-fuse/auth/credential"
 	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/compression"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/internal/transport"
 	"github.com/tweag/asset-fuse/service/internal/protohelper"
+	"github.com/tweag/asset-fuse/service/retry"
 	"github.com/tweag/asset-fuse/service/status"
 	bytestream_proto "google.golang.org/genproto/googleapis/bytestream"
 	"google.golang.org/grpc"
@@ -20,69 +27,210 @@ import (
 //
 // TODO: this implementation is incomplete and doesn't correctly handle well-defined cases mentioned in the proto file. This needs to be addressed before v1.0.0.
 type Remote struct {
+	conn             *grpc.ClientConn
 	casClient        remoteexecution_proto.ContentAddressableStorageClient
 	byteStreamClient bytestream_proto.ByteStreamClient
+	instanceName     string
+	retryPolicy      retry.Policy
+	// capabilities are set by Negotiate
+	capabilities Capabilities
 }
 
-func NewRemote(target string, helper credential.Helper, opts ...grpc.DialOption) (*Remote, error) {
-	conn, err := protohelper.Client(target, helper, opts...)
+// NewRemote connects to the remote CAS at target.
+// The instance name (which may be empty) is sent with every request.
+func NewRemote(target, instanceName string, helper credential.Helper, network *transport.Transport, retryPolicy retry.Policy, opts ...grpc.DialOption) (*Remote, error) {
+	conn, err := protohelper.Client(target, helper, network, opts...)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Remote{
+		conn:             conn,
 		casClient:        remoteexecution_proto.NewContentAddressableStorageClient(conn),
 		byteStreamClient: bytestream_proto.NewByteStreamClient(conn),
+		instanceName:     instanceName,
+		retryPolicy:      retryPolicy,
 	}, nil
 }
 
+// Close closes the connection to the remote CAS.
+func (r *Remote) Close() error {
+	return r.conn.Close()
+}
+
 func (r *Remote) FindMissingBlobs(ctx context.Context, blobDigests []integrity.Digest, digestFunction integrity.Algorithm) ([]integrity.Digest, error) {
-	resp, err := r.casClient.FindMissingBlobs(ctx, protoFindMissingBlobsRequest(blobDigests, digestFunction))
+	var resp *remoteexecution_proto.FindMissingBlobsResponse
+	err := r.retryPolicy.Do(ctx, "FindMissingBlobs", func(ctx context.Context) error {
+		var err error
+		resp, err = r.casClient.FindMissingBlobs(ctx, protoFindMissingBlobsRequest(r.instanceName, blobDigests, digestFunction))
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return fromProtoFindMissingBlobsResponse(resp, digestFunction)
 }
 
+// BatchReadBlobs reads the blobs with as few requests as the negotiated batch size limit allows.
 func (r *Remote) BatchReadBlobs(ctx context.Context, blobDigests []integrity.Digest, digestFunction integrity.Algorithm) (BatchReadBlobsResponse, error) {
-	resp, err := r.casClient.BatchReadBlobs(ctx, protoBatchReadBlobsRequest(blobDigests, digestFunction))
+	sizes := make([]int64, len(blobDigests))
+	for i, blobDigest := range blobDigests {
+		sizes[i] = blobDigest.SizeBytes
+	}
+	ends, err := r.splitBatch(sizes)
+	if err != nil {
+		return nil, err
+	}
+	var out BatchReadBlobsResponse
+	var statusErr error
+	start := 0
+	for _, end := range ends {
+		responses, err := r.batchReadBlobs(ctx, blobDigests[start:end], digestFunction)
+		if err == BatchResponseHasNonZeroStatus {
+			statusErr = err
+		} else if err != nil {
+			return nil, err
+		}
+		out = append(out, responses...)
+		start = end
+	}
+	return out, statusErr
+}
+
+func (r *Remote) batchReadBlobs(ctx context.Context, blobDigests []integrity.Digest, digestFunction integrity.Algorithm) (BatchReadBlobsResponse, error) {
+	var resp *remoteexecution_proto.BatchReadBlobsResponse
+	err := r.retryPolicy.Do(ctx, "BatchReadBlobs", func(ctx context.Context) error {
+		var err error
+		resp, err = r.casClient.BatchReadBlobs(ctx, protoBatchReadBlobsRequest(r.instanceName, blobDigests, digestFunction, r.streamCompression()))
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return fromProtoBatchReadBlobsResponse(resp, digestFunction)
 }
 
+// BatchUpdateBlobs uploads the blobs with as few requests as the negotiated batch size limit allows.
+// The blobs are split into batches after compression.
 func (r *Remote) BatchUpdateBlobs(ctx context.Context, blobData DigestsAndData, digestFunction integrity.Algorithm) (BatchUpdateBlobsResponse, error) {
-	// TODO: for now, we only fill the remote CAS by using the remote asset API.
-	// implement BatchUpdateBlobs if we ever need to write to the remote CAS directly.
-	return nil, fmt.Errorf("asset-fuse does not yet implement BatchUpdateBlobs - please implement me if you need me :)")
+	encoded := r.encodeBatchUpdate(blobData)
+	sizes := make([]int64, len(encoded))
+	for i, blob := range encoded {
+		sizes[i] = int64(len(blob.data))
+	}
+	ends, err := r.splitBatch(sizes)
+	if err != nil {
+		return nil, err
+	}
+	var out BatchUpdateBlobsResponse
+	var statusErr error
+	start := 0
+	for _, end := range ends {
+		responses, err := r.batchUpdateBlobs(ctx, encoded[start:end], digestFunction)
+		if err == BatchResponseHasNonZeroStatus {
+			statusErr = err
+		} else if err != nil {
+			return nil, err
+		}
+		out = append(out, responses...)
+		start = end
+	}
+	return out, statusErr
+}
+
+func (r *Remote) batchUpdateBlobs(ctx context.Context, blobData []encodedBlob, digestFunction integrity.Algorithm) (BatchUpdateBlobsResponse, error) {
+	var resp *remoteexecution_proto.BatchUpdateBlobsResponse
+	err := r.retryPolicy.Do(ctx, "BatchUpdateBlobs", func(ctx context.Context) error {
+		var err error
+		resp, err = r.casClient.BatchUpdateBlobs(ctx, protoBatchUpdateBlobsRequest(r.instanceName, blobData, digestFunction))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fromProtoBatchUpdateBlobsResponse(resp, digestFunction)
 }
 
+// ReadStream reads a blob using the ByteStream API.
+// Reads up to the end of the blob are compressed if the server supports it.
 func (r *Remote) ReadStream(ctx context.Context, blobDigest integrity.Digest, digestFunction integrity.Algorithm, offset, limit int64) (io.ReadCloser, error) {
+	if r.streamCompression() && offset < blobDigest.SizeBytes && (limit == 0 || offset+limit >= blobDigest.SizeBytes) {
+		return r.readCompressedStream(ctx, blobDigest, digestFunction, offset)
+	}
 	ctx, cancel := context.WithCancel(ctx)
 
-	stream, err := r.byteStreamClient.Read(ctx, protoReadRequest(blobDigest, digestFunction, offset, limit))
+	// open (re)starts the stream after the bytes that were already received.
+	open := func(alreadyRead int64) (bytestream_proto.ByteStream_ReadClient, error) {
+		remainingLimit := limit
+		if limit > 0 {
+			remainingLimit = limit - alreadyRead
+		}
+		var stream bytestream_proto.ByteStream_ReadClient
+		err := r.retryPolicy.Do(ctx, "ByteStream.Read", func(ctx context.Context) error {
+			var err error
+			stream, err = r.byteStreamClient.Read(ctx, protoReadRequest(r.instanceName, blobDigest, digestFunction, offset+alreadyRead, remainingLimit))
+			return err
+		})
+		return stream, err
+	}
+	stream, err := open(0)
 	if err != nil {
 		cancel()
 		return nil, err
 	}
 	return &byteStreamReadCloser{
-		stream: stream,
-		cancel: cancel,
-		limit:  limit,
+		stream:      stream,
+		reopen:      open,
+		retryPolicy: r.retryPolicy,
+		ctx:         ctx,
+		cancel:      cancel,
+		limit:       limit,
 	}, nil
 }
 
+// WriteStream uploads a blob using the ByteStream API.
+// The data is compressed if the server supports it.
+// Uploads are not resumed after errors, so callers need to retry the whole upload.
 func (r *Remote) WriteStream(ctx context.Context, blobDigest integrity.Digest, digestFunction integrity.Algorithm) (io.WriteCloser, error) {
-	// TODO: for now, we only fill the remote CAS by using the remote asset API.
-	// implement WriteStream if we ever need to write to the remote CAS directly.
-	return nil, fmt.Errorf("asset-fuse does not yet implement WriteStream - please implement me if you need me :)")
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := r.byteStreamClient.Write(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	writer := &byteStreamWriteCloser{
+		stream: stream,
+		cancel: cancel,
+		size:   blobDigest.SizeBytes,
+	}
+	blob := fmt.Sprintf("%s/%d", blobDigest.Hex(digestFunction), blobDigest.SizeBytes)
+	if !r.streamCompression() || blobDigest.SizeBytes == 0 {
+		writer.resourceName = withInstanceName(r.instanceName, fmt.Sprintf("uploads/%s/blobs/%s", newUploadID(), blob))
+		return writer, nil
+	}
+	writer.resourceName = withInstanceName(r.instanceName, fmt.Sprintf("uploads/%s/compressed-blobs/%s/%s", newUploadID(), compression.Zstd, blob))
+	writer.compressed = true
+	encoder, err := zstd.NewWriter(writer, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &compressedWriteCloser{encoder: encoder, raw: writer}, nil
 }
 
 type byteStreamReadCloser struct {
 	stream bytestream_proto.ByteStream_ReadClient
-	buf    bytes.Buffer
-	eof    bool
+	// reopen restarts the stream after a transient error,
+	// skipping the given number of bytes.
+	// If reopen is nil, errors are returned to the caller.
+	reopen      func(alreadyRead int64) (bytestream_proto.ByteStream_ReadClient, error)
+	retryPolicy retry.Policy
+	// number of consecutive failed attempts to receive data
+	failures int
+	buf      bytes.Buffer
+	eof      bool
+	// ctx is cancelled on Close (and ends waits between attempts).
+	ctx    context.Context
 	cancel context.CancelFunc
 
 	limit          int64
@@ -122,7 +270,7 @@ func (b *byteStreamReadCloser) Read(p []byte) (n int, err error) {
 	}
 
 	// read from the stream
-	resp, err := b.stream.Recv()
+	resp, err := b.recv()
 	var readFromRemoteNow int
 	if resp != nil {
 		readFromRemoteNow = len(resp.Data)
@@ -152,6 +300,31 @@ func (b *byteStreamReadCloser) Read(p []byte) (n int, err error) {
 	return copiedToOutTotal, b.nilOrEOF()
 }
 
+// recv receives the next message.
+// If the stream breaks with a transient error, it is resumed at the current offset.
+func (b *byteStreamReadCloser) recv() (*bytestream_proto.ReadResponse, error) {
+	for {
+		resp, err := b.stream.Recv()
+		if err == nil || err == io.EOF {
+			b.failures = 0
+			return resp, err
+		}
+		b.failures++
+		if b.reopen == nil || !retry.Retryable(err) || b.failures >= b.retryPolicy.MaxAttempts {
+			return nil, err
+		}
+		if !retry.Sleep(b.ctx, b.retryPolicy.Backoff(b.failures)) {
+			return nil, err
+		}
+		logging.Debugf("ByteStream.Read: resuming at offset %d after error: %v", b.readFromRemote, err)
+		stream, reopenErr := b.reopen(b.readFromRemote)
+		if reopenErr != nil {
+			return nil, err
+		}
+		b.stream = stream
+	}
+}
+
 func (b *byteStreamReadCloser) Close() error {
 	// cancel the context to
 	// stop the stream from our side
@@ -166,8 +339,123 @@ func (b *byteStreamReadCloser) nilOrEOF() error {
 	return nil
 }
 
-func protoFindMissingBlobsRequest(blobDigests []integrity.Digest, digestFunction integrity.Algorithm) *remoteexecution_proto.FindMissingBlobsRequest {
+type byteStreamWriteCloser struct {
+	stream       bytestream_proto.ByteStream_WriteClient
+	cancel       context.CancelFunc
+	resourceName string
+	size         int64
+	compressed   bool
+
+	// buf holds data that was not sent yet
+	buf []byte
+	// offset of the next request (the number of bytes sent so far)
+	offset int64
+	// done is set once the upload is finished (or aborted)
+	// all data written afterwards is discarded
+	done bool
+	err  error
+}
+
+func (b *byteStreamWriteCloser) Write(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.done {
+		return len(p), nil
+	}
+	written := 0
+	for len(p) > written {
+		if b.buf == nil {
+			b.buf = make([]byte, 0, byteStreamChunkSize)
+		}
+		n := min(len(p)-written, cap(b.buf)-len(b.buf))
+		b.buf = append(b.buf, p[written:written+n]...)
+		written += n
+		if len(b.buf) == cap(b.buf) {
+			if err := b.send(false); err != nil {
+				return written, err
+			}
+			if b.done {
+				// the server already has the blob
+				return len(p), nil
+			}
+		}
+	}
+	return written, nil
+}
+
+// send sends the buffered data.
+func (b *byteStreamWriteCloser) send(finish bool) error {
+	req := &bytestream_proto.WriteRequest{
+		WriteOffset: b.offset,
+		Data:        b.buf,
+		FinishWrite: finish,
+	}
+	if b.offset == 0 {
+		req.ResourceName = b.resourceName
+	}
+	err := b.stream.Send(req)
+	if err == io.EOF {
+		// The server ended the stream early.
+		// This happens if the blob already exists or if the upload failed.
+		return b.finish()
+	} else if err != nil {
+		b.abort(err)
+		return err
+	}
+	b.offset += int64(len(b.buf))
+	// the sent message may still be referenced by gRPC, so we don't reuse the buffer
+	b.buf = nil
+	if finish {
+		return b.finish()
+	}
+	return nil
+}
+
+// finish receives the response of the server and checks that the blob was committed.
+func (b *byteStreamWriteCloser) finish() error {
+	defer b.cancel()
+	b.done = true
+	resp, err := b.stream.CloseAndRecv()
+	if err != nil {
+		b.err = err
+		return err
+	}
+	committed := resp.GetCommittedSize()
+	// Compressed uploads report -1 if the blob already existed, and otherwise the number of bytes sent.
+	// Uncompressed uploads always report the size of the blob.
+	if committed == b.size || (b.compressed && (committed == -1 || committed == b.offset)) {
+		return nil
+	}
+	b.err = fmt.Errorf("ByteStream.Write: server committed %d bytes of %s, expected %d", committed, b.resourceName, b.size)
+	return b.err
+}
+
+func (b *byteStreamWriteCloser) abort(err error) {
+	b.done = true
+	b.err = err
+	b.cancel()
+}
+
+func (b *byteStreamWriteCloser) Close() error {
+	if b.done {
+		return b.err
+	}
+	return b.send(true)
+}
+
+// Abort cancels the upload.
+// The server discards the partially uploaded data.
+func (b *byteStreamWriteCloser) Abort() error {
+	if !b.done {
+		b.abort(errors.New("ByteStream.Write: upload was aborted"))
+	}
+	return nil
+}
+
+func protoFindMissingBlobsRequest(instanceName string, blobDigests []integrity.Digest, digestFunction integrity.Algorithm) *remoteexecution_proto.FindMissingBlobsRequest {
 	req := &remoteexecution_proto.FindMissingBlobsRequest{
+		InstanceName:   instanceName,
 		BlobDigests:    make([]*remoteexecution_proto.Digest, len(blobDigests)),
 		DigestFunction: protohelper.ProtoDigestFunction(digestFunction),
 	}
@@ -192,10 +480,14 @@ func fromProtoFindMissingBlobsResponse(resp *remoteexecution_proto.FindMissingBl
 	return missingDigests, nil
 }
 
-func protoBatchReadBlobsRequest(blobDigests []integrity.Digest, digestFunction integrity.Algorithm) *remoteexecution_proto.BatchReadBlobsRequest {
+func protoBatchReadBlobsRequest(instanceName string, blobDigests []integrity.Digest, digestFunction integrity.Algorithm, compressed bool) *remoteexecution_proto.BatchReadBlobsRequest {
 	req := &remoteexecution_proto.BatchReadBlobsRequest{
+		InstanceName:   instanceName,
 		DigestFunction: protohelper.ProtoDigestFunction(digestFunction),
 	}
+	if compressed {
+		req.AcceptableCompressors = []remoteexecution_proto.Compressor_Value{remoteexecution_proto.Compressor_ZSTD}
+	}
 	for _, blobDigest := range blobDigests {
 		req.Digests = append(req.Digests, &remoteexecution_proto.Digest{
 			Hash:      blobDigest.Hex(digestFunction),
@@ -214,6 +506,10 @@ func fromProtoBatchReadBlobsResponse(resp *remoteexecution_proto.BatchReadBlobsR
 			return nil, fmt.Errorf("failed to decode digest %d: %w", i, decodeErr)
 		}
 		readResponses[i].Status = protohelper.FromProtoStatus(protoResponse.Status)
+		if protoResponse.Compressor != remoteexecution_proto.Compressor_IDENTITY && readResponses[i].Status.Code == status.Status_OK {
+			readResponses[i].Data, readResponses[i].Status = decodeBatchReadResponse(readResponses[i].Digest, digestFunction, protoResponse.Data, protoResponse.Compressor)
+			continue
+		}
 		// we create a new slice to avoid sharing the underlying buffer
 		// TODO: check if proto / gRPC in Go actually recycles the buffer
 		// or if we can avoid this copy
@@ -234,12 +530,73 @@ func fromProtoBatchReadBlobsResponse(resp *remoteexecution_proto.BatchReadBlobsR
 	return readResponses, nil
 }
 
-func protoReadRequest(blobDigest integrity.Digest, digestFunction integrity.Algorithm, offset, limit int64) *bytestream_proto.ReadRequest {
+func protoBatchUpdateBlobsRequest(instanceName string, blobData []encodedBlob, digestFunction integrity.Algorithm) *remoteexecution_proto.BatchUpdateBlobsRequest {
+	req := &remoteexecution_proto.BatchUpdateBlobsRequest{
+		InstanceName:   instanceName,
+		DigestFunction: protohelper.ProtoDigestFunction(digestFunction),
+	}
+	for _, blob := range blobData {
+		req.Requests = append(req.Requests, &remoteexecution_proto.BatchUpdateBlobsRequest_Request{
+			Digest: &remoteexecution_proto.Digest{
+				Hash:      blob.digest.Hex(digestFunction),
+				SizeBytes: blob.digest.SizeBytes,
+			},
+			Data:       blob.data,
+			Compressor: blob.compressor,
+		})
+	}
+	return req
+}
+
+func fromProtoBatchUpdateBlobsResponse(resp *remoteexecution_proto.BatchUpdateBlobsResponse, digestFunction integrity.Algorithm) (BatchUpdateBlobsResponse, error) {
+	updateResponses := make(BatchUpdateBlobsResponse, len(resp.Responses))
+	var issues int
+	for i, protoResponse := range resp.Responses {
+		var decodeErr error
+		updateResponses[i].Digest, decodeErr = integrity.DigestFromHex(protoResponse.GetDigest().GetHash(), protoResponse.GetDigest().GetSizeBytes(), digestFunction)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("failed to decode digest %d: %w", i, decodeErr)
+		}
+		updateResponses[i].Status = status.Status{
+			Code:    status.StatusCode(protoResponse.GetStatus().GetCode()),
+			Message: protoResponse.GetStatus().GetMessage(),
+		}
+		if updateResponses[i].Status.Code != status.Status_OK {
+			issues++
+		}
+	}
+	if issues > 0 {
+		return updateResponses, BatchResponseHasNonZeroStatus
+	}
+	return updateResponses, nil
+}
+
+func protoReadRequest(instanceName string, blobDigest integrity.Digest, digestFunction integrity.Algorithm, offset, limit int64) *bytestream_proto.ReadRequest {
 	return &bytestream_proto.ReadRequest{
 		ReadOffset:   offset,
 		ReadLimit:    limit,
-		ResourceName: fmt.Sprintf("blobs/%s/%d", blobDigest.Hex(digestFunction), blobDigest.SizeBytes),
+		ResourceName: withInstanceName(instanceName, fmt.Sprintf("blobs/%s/%d", blobDigest.Hex(digestFunction), blobDigest.SizeBytes)),
 	}
 }
 
+// newUploadID returns a random (version 4) UUID for a ByteStream upload.
+func newUploadID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// withInstanceName prefixes a ByteStream resource name with the instance name (if any).
+func withInstanceName(instanceName, resourceName string) string {
+	if len(instanceName) == 0 {
+		return resourceName
+	}
+	return instanceName + "/" + resourceName
+}
+
+// byteStreamChunkSize is the size of the messages of ByteStream uploads.
+const byteStreamChunkSize = 1 << 20
+
 var _ CAS = (*Remote)(nil)
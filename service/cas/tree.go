@@ -0,0 +1,162 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	remoteexecution_proto "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/service/internal/protohelper"
+	"github.com/tweag/asset-fuse/service/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// GetTree uses the GetTree rpc to fetch all directories of a tree in a single (paged) stream.
+// The rpc doesn't return the digests of the directories, so they are computed from the (canonical) serialization.
+// Directories that can't be matched this way are read individually.
+func (r *Remote) GetTree(ctx context.Context, rootDigest integrity.Digest, digestFunction integrity.Algorithm) (Tree, error) {
+	tree := Tree{Root: rootDigest, Directories: make(map[string]Directory)}
+	var pageToken string
+	for {
+		var nextPageToken string
+		err := r.retryPolicy.Do(ctx, "GetTree", func(ctx context.Context) error {
+			stream, err := r.casClient.GetTree(ctx, &remoteexecution_proto.GetTreeRequest{
+				InstanceName: r.instanceName,
+				RootDigest: &remoteexecution_proto.Digest{
+					Hash:      rootDigest.Hex(digestFunction),
+					SizeBytes: rootDigest.SizeBytes,
+				},
+				PageToken:      pageToken,
+				DigestFunction: protohelper.ProtoDigestFunction(digestFunction),
+			})
+			if err != nil {
+				return err
+			}
+			for {
+				resp, err := stream.Recv()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				for _, protoDirectory := range resp.Directories {
+					digest, directory, err := fromProtoDirectory(protoDirectory, digestFunction)
+					if err != nil {
+						return err
+					}
+					tree.Directories[digest.Hex(digestFunction)] = directory
+				}
+				nextPageToken = resp.NextPageToken
+			}
+		})
+		if err != nil {
+			return Tree{}, err
+		}
+		if len(nextPageToken) == 0 {
+			break
+		}
+		pageToken = nextPageToken
+	}
+	if err := completeTree(ctx, r, &tree, digestFunction); err != nil {
+		return Tree{}, err
+	}
+	return tree, nil
+}
+
+// GetTree reads the directories of the tree from the disk cache.
+func (d *Disk) GetTree(ctx context.Context, rootDigest integrity.Digest, digestFunction integrity.Algorithm) (Tree, error) {
+	tree := Tree{Root: rootDigest, Directories: make(map[string]Directory)}
+	return tree, completeTree(ctx, d, &tree, digestFunction)
+}
+
+// GetTree reads the directories of the tree from the HTTP cache (one request per directory).
+func (h *HTTP) GetTree(ctx context.Context, rootDigest integrity.Digest, digestFunction integrity.Algorithm) (Tree, error) {
+	tree := Tree{Root: rootDigest, Directories: make(map[string]Directory)}
+	return tree, completeTree(ctx, h, &tree, digestFunction)
+}
+
+// completeTree reads the directories of the tree that are referenced, but missing in tree.Directories.
+// The tree is traversed level by level, so every level is read with a single batch request.
+func completeTree(ctx context.Context, reader Reader, tree *Tree, digestFunction integrity.Algorithm) error {
+	pending := []integrity.Digest{tree.Root}
+	visited := make(map[string]bool)
+	for len(pending) > 0 {
+		var missing []integrity.Digest
+		for _, digest := range pending {
+			if _, ok := tree.Directories[digest.Hex(digestFunction)]; !ok {
+				missing = append(missing, digest)
+			}
+		}
+		if len(missing) > 0 {
+			logging.Debugf("reading %d directories of tree %s", len(missing), tree.Root.Hex(digestFunction))
+			responses, err := reader.BatchReadBlobs(ctx, missing, digestFunction)
+			if err != nil && !errors.Is(err, BatchResponseHasNonZeroStatus) {
+				return fmt.Errorf("reading directories: %w", err)
+			}
+			for _, response := range responses {
+				if response.Status.Code != status.Status_OK {
+					return fmt.Errorf("reading directory %s: %s (code %d)", response.Digest.Hex(digestFunction), response.Status.Message, response.Status.Code)
+				}
+				var protoDirectory remoteexecution_proto.Directory
+				if err := proto.Unmarshal(response.Data, &protoDirectory); err != nil {
+					return fmt.Errorf("decoding directory %s: %w", response.Digest.Hex(digestFunction), err)
+				}
+				_, directory, err := fromProtoDirectory(&protoDirectory, digestFunction)
+				if err != nil {
+					return err
+				}
+				tree.Directories[response.Digest.Hex(digestFunction)] = directory
+			}
+		}
+
+		var next []integrity.Digest
+		for _, digest := range pending {
+			key := digest.Hex(digestFunction)
+			if visited[key] {
+				continue
+			}
+			visited[key] = true
+			for _, child := range tree.Directories[key].Directories {
+				next = append(next, child.Digest)
+			}
+		}
+		pending = next
+	}
+	return nil
+}
+
+// fromProtoDirectory converts a Directory message and computes its digest.
+func fromProtoDirectory(protoDirectory *remoteexecution_proto.Directory, digestFunction integrity.Algorithm) (integrity.Digest, Directory, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(protoDirectory)
+	if err != nil {
+		return integrity.Digest{}, Directory{}, err
+	}
+	digest, err := digestFunction.CalculateDigest(bytes.NewReader(data))
+	if err != nil {
+		return integrity.Digest{}, Directory{}, err
+	}
+	var directory Directory
+	for _, file := range protoDirectory.Files {
+		fileDigest, err := integrity.DigestFromHex(file.GetDigest().GetHash(), file.GetDigest().GetSizeBytes(), digestFunction)
+		if err != nil {
+			return integrity.Digest{}, Directory{}, fmt.Errorf("decoding digest of file %q: %w", file.Name, err)
+		}
+		directory.Files = append(directory.Files, FileNode{Name: file.Name, Digest: fileDigest, IsExecutable: file.IsExecutable})
+	}
+	for _, child := range protoDirectory.Directories {
+		childDigest, err := integrity.DigestFromHex(child.GetDigest().GetHash(), child.GetDigest().GetSizeBytes(), digestFunction)
+		if err != nil {
+			return integrity.Digest{}, Directory{}, fmt.Errorf("decoding digest of directory %q: %w", child.Name, err)
+		}
+		directory.Directories = append(directory.Directories, DirectoryNode{Name: child.Name, Digest: childDigest})
+	}
+	for _, symlink := range protoDirectory.Symlinks {
+		directory.Symlinks = append(directory.Symlinks, SymlinkNode{Name: symlink.Name, Target: symlink.Target})
+	}
+	return digest, directory, nil
+}
@@ -0,0 +1,255 @@
+package cas
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	remoteexecution_proto "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/service/retry"
+	gstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGetTree(t *testing.T) {
+	fixture := newTestTree(t)
+
+	for _, tc := range []struct {
+		name string
+		// pageSize is the number of directories per GetTree page
+		pageSize int
+		// omit is the set of directories that GetTree doesn't return
+		omit               map[string]bool
+		expectBatchReads   int
+		expectTreeRequests int
+	}{
+		{name: "single page", pageSize: 10, expectTreeRequests: 1},
+		{name: "multiple pages", pageSize: 1, expectTreeRequests: 3},
+		{name: "directories read individually", pageSize: 10, omit: map[string]bool{"leaf": true}, expectTreeRequests: 1, expectBatchReads: 1},
+		{name: "tree not supported", pageSize: 10, omit: map[string]bool{"root": true, "sub": true, "leaf": true}, expectTreeRequests: 1, expectBatchReads: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := &fakeCASClient{directories: fixture.directories, pageSize: tc.pageSize}
+			for name := range tc.omit {
+				server.omit = append(server.omit, fixture.digests[name].Hex(integrity.SHA256))
+			}
+			remote := &Remote{
+				casClient:   server,
+				retryPolicy: retry.Policy{MaxAttempts: 1},
+			}
+			tree, err := remote.GetTree(context.Background(), fixture.digests["root"], integrity.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fixture.check(t, tree)
+			if server.treeRequests != tc.expectTreeRequests {
+				t.Fatalf("expected %d GetTree requests, got %d", tc.expectTreeRequests, server.treeRequests)
+			}
+			if server.batchReads != tc.expectBatchReads {
+				t.Fatalf("expected %d BatchReadBlobs requests, got %d", tc.expectBatchReads, server.batchReads)
+			}
+		})
+	}
+}
+
+func TestCompleteTree(t *testing.T) {
+	fixture := newTestTree(t)
+
+	t.Run("missing directory", func(t *testing.T) {
+		server := &fakeCASClient{directories: map[string][]byte{}}
+		remote := &Remote{casClient: server, retryPolicy: retry.Policy{MaxAttempts: 1}}
+		tree := Tree{Root: fixture.digests["root"], Directories: map[string]Directory{}}
+		if err := completeTree(context.Background(), remote, &tree, integrity.SHA256); err == nil {
+			t.Fatal("expected an error for a missing directory")
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		// a directory can't contain itself in a well-formed tree,
+		// but a broken server response must not make the traversal loop forever
+		root := fixture.digests["root"]
+		tree := Tree{Root: root, Directories: map[string]Directory{
+			root.Hex(integrity.SHA256): {Directories: []DirectoryNode{{Name: "self", Digest: root}}},
+		}}
+		server := &fakeCASClient{directories: map[string][]byte{}}
+		remote := &Remote{casClient: server, retryPolicy: retry.Policy{MaxAttempts: 1}}
+		if err := completeTree(context.Background(), remote, &tree, integrity.SHA256); err != nil {
+			t.Fatal(err)
+		}
+		if server.batchReads != 0 {
+			t.Fatalf("expected no BatchReadBlobs requests, got %d", server.batchReads)
+		}
+	})
+}
+
+func TestFromProtoDirectory(t *testing.T) {
+	fixture := newTestTree(t)
+	for name, digest := range fixture.digests {
+		var protoDirectory remoteexecution_proto.Directory
+		if err := proto.Unmarshal(fixture.directories[digest.Hex(integrity.SHA256)], &protoDirectory); err != nil {
+			t.Fatal(err)
+		}
+		gotDigest, _, err := fromProtoDirectory(&protoDirectory, integrity.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !gotDigest.Equals(digest, integrity.SHA256) {
+			t.Fatalf("directory %s: expected digest %s, got %s", name, digest.Hex(integrity.SHA256), gotDigest.Hex(integrity.SHA256))
+		}
+	}
+
+	_, _, err := fromProtoDirectory(&remoteexecution_proto.Directory{
+		Files: []*remoteexecution_proto.FileNode{{Name: "broken", Digest: &remoteexecution_proto.Digest{Hash: "not hex", SizeBytes: 1}}},
+	}, integrity.SHA256)
+	if err == nil {
+		t.Fatal("expected an error for an invalid file digest")
+	}
+}
+
+// testTree is a tree with a root directory that contains the same subdirectory twice:
+// root/{file, sub/, copy/} with sub/{leaf/} and leaf/{executable, link}.
+type testTree struct {
+	directories map[string][]byte
+	digests     map[string]integrity.Digest
+	file        integrity.Digest
+}
+
+func newTestTree(t *testing.T) testTree {
+	t.Helper()
+	fixture := testTree{
+		directories: make(map[string][]byte),
+		digests:     make(map[string]integrity.Digest),
+		file:        testDigest([]byte("content")),
+	}
+	protoFile := &remoteexecution_proto.Digest{Hash: fixture.file.Hex(integrity.SHA256), SizeBytes: fixture.file.SizeBytes}
+	add := func(name string, directory *remoteexecution_proto.Directory) *remoteexecution_proto.Digest {
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(directory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := testDigest(data)
+		fixture.directories[digest.Hex(integrity.SHA256)] = data
+		fixture.digests[name] = digest
+		return &remoteexecution_proto.Digest{Hash: digest.Hex(integrity.SHA256), SizeBytes: digest.SizeBytes}
+	}
+	leaf := add("leaf", &remoteexecution_proto.Directory{
+		Files:    []*remoteexecution_proto.FileNode{{Name: "executable", Digest: protoFile, IsExecutable: true}},
+		Symlinks: []*remoteexecution_proto.SymlinkNode{{Name: "link", Target: "executable"}},
+	})
+	sub := add("sub", &remoteexecution_proto.Directory{
+		Directories: []*remoteexecution_proto.DirectoryNode{{Name: "leaf", Digest: leaf}},
+	})
+	add("root", &remoteexecution_proto.Directory{
+		Files:       []*remoteexecution_proto.FileNode{{Name: "file", Digest: protoFile}},
+		Directories: []*remoteexecution_proto.DirectoryNode{{Name: "copy", Digest: sub}, {Name: "sub", Digest: sub}},
+	})
+	return fixture
+}
+
+// check verifies that tree contains every directory of the fixture.
+func (f testTree) check(t *testing.T, tree Tree) {
+	t.Helper()
+	if len(tree.Directories) != len(f.digests) {
+		t.Fatalf("expected %d directories, got %d", len(f.digests), len(tree.Directories))
+	}
+	root := tree.Directories[f.digests["root"].Hex(integrity.SHA256)]
+	if len(root.Files) != 1 || root.Files[0].Name != "file" || !root.Files[0].Digest.Equals(f.file, integrity.SHA256) {
+		t.Fatalf("unexpected files of the root directory: %+v", root.Files)
+	}
+	if len(root.Directories) != 2 || !root.Directories[0].Digest.Equals(f.digests["sub"], integrity.SHA256) {
+		t.Fatalf("unexpected subdirectories of the root directory: %+v", root.Directories)
+	}
+	leaf := tree.Directories[f.digests["leaf"].Hex(integrity.SHA256)]
+	if len(leaf.Files) != 1 || !leaf.Files[0].IsExecutable {
+		t.Fatalf("unexpected files of the leaf directory: %+v", leaf.Files)
+	}
+	if len(leaf.Symlinks) != 1 || leaf.Symlinks[0].Target != "executable" {
+		t.Fatalf("unexpected symlinks of the leaf directory: %+v", leaf.Symlinks)
+	}
+}
+
+// fakeCASClient serves GetTree (in pages of pageSize directories) and BatchReadBlobs requests for directories.
+type fakeCASClient struct {
+	remoteexecution_proto.ContentAddressableStorageClient
+	directories map[string][]byte
+	pageSize    int
+	// omit lists directories that are only available with BatchReadBlobs
+	omit []string
+
+	mux          sync.Mutex
+	treeRequests int
+	batchReads   int
+}
+
+func (f *fakeCASClient) GetTree(ctx context.Context, req *remoteexecution_proto.GetTreeRequest, opts ...grpc.CallOption) (remoteexecution_proto.ContentAddressableStorage_GetTreeClient, error) {
+	f.mux.Lock()
+	f.treeRequests++
+	f.mux.Unlock()
+
+	// pages are returned in a fixed order (by hash)
+	var hashes []string
+	for hash := range f.directories {
+		if !slices.Contains(f.omit, hash) {
+			hashes = append(hashes, hash)
+		}
+	}
+	slices.Sort(hashes)
+	start := 0
+	if req.PageToken != "" {
+		var err error
+		if start, err = strconv.Atoi(req.PageToken); err != nil {
+			return nil, err
+		}
+	}
+	end := min(start+f.pageSize, len(hashes))
+	resp := &remoteexecution_proto.GetTreeResponse{}
+	for _, hash := range hashes[start:end] {
+		var directory remoteexecution_proto.Directory
+		if err := proto.Unmarshal(f.directories[hash], &directory); err != nil {
+			return nil, err
+		}
+		resp.Directories = append(resp.Directories, &directory)
+	}
+	if end < len(hashes) {
+		resp.NextPageToken = strconv.Itoa(end)
+	}
+	return &fakeTreeStream{responses: []*remoteexecution_proto.GetTreeResponse{resp}}, nil
+}
+
+func (f *fakeCASClient) BatchReadBlobs(ctx context.Context, req *remoteexecution_proto.BatchReadBlobsRequest, opts ...grpc.CallOption) (*remoteexecution_proto.BatchReadBlobsResponse, error) {
+	f.mux.Lock()
+	f.batchReads++
+	f.mux.Unlock()
+
+	resp := &remoteexecution_proto.BatchReadBlobsResponse{}
+	for _, digest := range req.Digests {
+		response := &remoteexecution_proto.BatchReadBlobsResponse_Response{Digest: digest, Status: &gstatus.Status{}}
+		if data, ok := f.directories[digest.Hash]; ok {
+			response.Data = data
+		} else {
+			response.Status = &gstatus.Status{Code: int32(codes.NotFound), Message: "not found"}
+		}
+		resp.Responses = append(resp.Responses, response)
+	}
+	return resp, nil
+}
+
+type fakeTreeStream struct {
+	grpc.ClientStream
+	responses []*remoteexecution_proto.GetTreeResponse
+}
+
+func (s *fakeTreeStream) Recv() (*remoteexecution_proto.GetTreeResponse, error) {
+	if len(s.responses) == 0 {
+		return nil, io.EOF
+	}
+	resp := s.responses[0]
+	s.responses = s.responses[1:]
+	return resp, nil
+}
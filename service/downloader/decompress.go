@@ -0,0 +1,92 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/compression"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/service/asset"
+)
+
+// fetchDecompressed downloads the compressed content of the asset into the local CAS,
+// decompresses it, and imports the decompressed content into the local CAS as well.
+// The response describes the decompressed content.
+// If only one of the two forms has a known integrity, the other form is validated indirectly:
+// the compressed content is only accepted if it decompresses to the expected content,
+// and the decompressed content is trusted if the compressed content was validated.
+func (d *Downloader) fetchDecompressed(
+	ctx context.Context, timeout time.Duration, oldestContentAccepted time.Time,
+	apiAsset api.Asset, digestFunction integrity.Algorithm,
+) (asset.FetchBlobResponse, error) {
+	if !compression.Valid(apiAsset.Compression) {
+		return asset.FetchBlobResponse{}, fmt.Errorf("downloading blob: unsupported compression codec %q", apiAsset.Compression)
+	}
+	if apiAsset.Integrity.Empty() && apiAsset.CompressedIntegrity.Empty() {
+		return asset.FetchBlobResponse{}, errors.New("downloading blob: no digests to validate")
+	}
+	fetchedAt := time.Now()
+	compressedAsset := apiAsset.Compressed()
+	resp, ok := d.cachedFetch(ctx, compressedAsset, oldestContentAccepted, digestFunction)
+	if !ok {
+		var err error
+		if resp, err = d.fetchBlob(ctx, timeout, compressedAsset, digestFunction); err != nil {
+			return asset.FetchBlobResponse{}, err
+		}
+	}
+	digest, err := d.decompressBlob(ctx, resp.URI, resp.BlobDigest, apiAsset, digestFunction)
+	if err != nil {
+		return asset.FetchBlobResponse{}, err
+	}
+	logging.Debugf("decompressed asset from %s (%s: %s; %d bytes -> %s; %d bytes)", resp.URI,
+		digestFunction.String(), resp.BlobDigest.Hex(digestFunction), resp.BlobDigest.SizeBytes, digest.Hex(digestFunction), digest.SizeBytes)
+	d.fetchIndex.put(apiAsset, resp.URI, digest, digestFunction, fetchedAt)
+
+	resp.CompressedBlobDigest = resp.BlobDigest
+	resp.BlobDigest = digest
+	resp.ExpiresAt = d.fetchIndex.expiresAt(fetchedAt)
+	return resp, nil
+}
+
+// decompressBlob decompresses a blob of the local CAS and imports the result into the local CAS.
+// The decompressed content is validated against the integrity of the asset.
+func (d *Downloader) decompressBlob(ctx context.Context, uri string, compressedDigest integrity.Digest, apiAsset api.Asset, digestFunction integrity.Algorithm) (integrity.Digest, error) {
+	compressed, err := d.localCAS.ReadStream(ctx, compressedDigest, digestFunction, 0, 0)
+	if err != nil {
+		return integrity.Digest{}, err
+	}
+	defer compressed.Close()
+	decompressed, err := compression.NewReader(apiAsset.Compression, compressed)
+	if err != nil {
+		return integrity.Digest{}, fmt.Errorf("decompressing blob from %s: %w", uri, err)
+	}
+	defer decompressed.Close()
+
+	// The decompressed size is unknown in advance, so we always stage the content in a file.
+	tmpFile, err := os.CreateTemp(d.stagingDir, "asset-fuse-decompress-")
+	if err != nil {
+		return integrity.Digest{}, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	verifier := newChecksumVerifier(uri, apiAsset.Integrity, digestFunction)
+	n, err := io.Copy(io.MultiWriter(tmpFile, verifier), decompressed)
+	if err != nil {
+		return integrity.Digest{}, fmt.Errorf("decompressing blob from %s: %w", uri, err)
+	}
+	knownDigest, err := verifier.verify(n)
+	if err != nil {
+		return integrity.Digest{}, err
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return integrity.Digest{}, err
+	}
+	return d.localCAS.ImportBlob(ctx, apiAsset.Integrity, knownDigest, digestFunction, tmpFile)
+}
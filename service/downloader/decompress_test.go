@@ -0,0 +1,41 @@
+package downloader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/compression"
+)
+
+func TestFetchDecompressed(t *testing.T) {
+	content := []byte("decompressed content")
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(content)
+	writer.Close()
+	server := newTestServer(t, serveRanges(compressed.Bytes(), nil))
+
+	d, disk := testDownloader(t, Options{})
+	asset := api.Asset{URIs: []string{server.URL + "/file.gz"}, Integrity: testIntegrity(t, content), Compression: compression.Gzip}
+	resp, err := d.FetchBlob(context.Background(), 0, time.Time{}, asset, integrity.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBlob(t, disk, resp.BlobDigest, content)
+	expectBlob(t, disk, resp.CompressedBlobDigest, compressed.Bytes())
+
+	// the decompressed content is staged next to the local CAS and removed after the import
+	staged, err := os.ReadDir(d.stagingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(staged) != 0 {
+		t.Fatalf("expected an empty staging directory, got %d files", len(staged))
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/tweag/asset-fuse/api"
@@ -19,20 +20,78 @@ import (
 	"github.com/tweag/asset-fuse/internal/logging"
 	"github.com/tweag/asset-fuse/service/asset"
 	casService "github.com/tweag/asset-fuse/service/cas"
+	"github.com/tweag/asset-fuse/service/retry"
 	"github.com/tweag/asset-fuse/service/status"
 )
 
 // Downloader is a service that downloads files directly into the local CAS.
 // It performs HTTP requests locally and never invokes the remote asset API or the remote CAS.
 type Downloader struct {
-	localCAS   casService.LocalCAS
-	httpClient *http.Client
+	localCAS    casService.LocalCAS
+	httpClient  *http.Client
+	retryPolicy retry.Policy
+	hostHealth  *retry.HostHealth
+	mirrors     *mirrors
+	hedgeDelay  time.Duration
+	segments    segmentOptions
+	partialDir  string
+	stagingDir  string
+	fetchIndex  *FetchIndex
+
+	originStreaming OriginStreaming
+	// rangedMux protects ranged (blobs that are currently streamed from their origin).
+	rangedMux sync.Mutex
+	ranged    map[string]*rangedBlob
+}
+
+// Options configures the network behaviour of the Downloader.
+type Options struct {
+	RetryPolicy retry.Policy
+	// HostHealth is used to skip unhealthy mirrors (nil disables skipping).
+	HostHealth *retry.HostHealth
+	// MirrorStrategy decides the order in which the URIs of an asset are tried.
+	// Default: MirrorStrategyOrdered
+	MirrorStrategy MirrorStrategy
+	// PreferredHosts are always tried first (in this order), regardless of the strategy.
+	PreferredHosts []string
+	// HedgeDelay is the time after which MirrorStrategyRace starts a request to the next mirror.
+	HedgeDelay time.Duration
+	// Connections is the maximum number of concurrent range requests for a single blob.
+	// Values below 2 disable segmented downloads.
+	Connections int
+	// SegmentSize is the size of a single range request.
+	SegmentSize int64
+	// PartialDir is the directory that holds partial downloads,
+	// which are resumed by later attempts (even from other processes).
+	// If empty, interrupted downloads start from scratch.
+	PartialDir string
+	// StagingDir is the directory for temporary files that are imported into the local CAS.
+	// It should be on the same filesystem as the local CAS, so imports don't need to copy the data.
+	// If empty, the default directory for temporary files is used.
+	StagingDir string
+	// FetchIndex answers repeated fetches of the same asset from the local CAS (nil disables caching of fetches).
+	FetchIndex *FetchIndex
+	// OriginStreaming decides if reads may be served with range requests against the URIs of an asset
+	// (see OpenRange).
+	// Default: OriginStreamingOff
+	OriginStreaming OriginStreaming
 }
 
-func New(localCAS casService.LocalCAS, httpClient *http.Client) *Downloader {
+func New(localCAS casService.LocalCAS, httpClient *http.Client, opts Options) *Downloader {
 	return &Downloader{
-		localCAS:   localCAS,
-		httpClient: httpClient,
+		localCAS:    localCAS,
+		httpClient:  httpClient,
+		retryPolicy: opts.RetryPolicy,
+		hostHealth:  opts.HostHealth,
+		mirrors:     newMirrors(opts.MirrorStrategy, opts.PreferredHosts, opts.HostHealth),
+		hedgeDelay:  opts.HedgeDelay,
+		segments:    newSegmentOptions(opts.Connections, opts.SegmentSize),
+		partialDir:  opts.PartialDir,
+		stagingDir:  opts.StagingDir,
+		fetchIndex:  opts.FetchIndex,
+
+		originStreaming: opts.OriginStreaming,
+		ranged:          make(map[string]*rangedBlob),
 	}
 }
 
@@ -43,82 +102,271 @@ func (d *Downloader) FetchBlob(
 	ctx context.Context, timeout time.Duration, oldestContentAccepted time.Time,
 	apiAsset api.Asset, digestFunction integrity.Algorithm,
 ) (asset.FetchBlobResponse, error) {
+	if resp, ok := d.cachedFetch(ctx, apiAsset, oldestContentAccepted, digestFunction); ok {
+		return resp, nil
+	}
+	if len(apiAsset.Compression) > 0 {
+		return d.fetchDecompressed(ctx, timeout, oldestContentAccepted, apiAsset, digestFunction)
+	}
+	if apiAsset.Integrity.Empty() {
+		return asset.FetchBlobResponse{}, errors.New("downloading blob: no digests to validate")
+	}
+	return d.fetchBlob(ctx, timeout, apiAsset, digestFunction)
+}
+
+// fetchBlob downloads the asset from one of its URIs into the local CAS.
+// The content is validated against the integrity of the asset (if any).
+func (d *Downloader) fetchBlob(ctx context.Context, timeout time.Duration, apiAsset api.Asset, digestFunction integrity.Algorithm) (asset.FetchBlobResponse, error) {
 	logging.Debugf("downloading asset specified by %v", apiAsset.URIs)
-	// TODO: caching based on URI, integrity, and qualifiers (while respecting oldestContentAccepted)
 	// TODO: errors returned here should follow the remote asset API's error model (i.e, by setting meaningful status codes)
-	sharedHeaders, perURIHeaders, err := headersFromQualifiers(apiAsset.Qualifiers, len(apiAsset.URIs))
+	fetchedAt := time.Now()
+	allSources, err := assetSources(apiAsset)
 	if err != nil {
 		return asset.FetchBlobResponse{}, err
 	}
+	candidates := d.mirrors.order(apiAsset.URIs)
+
+	// attempt downloads the asset from a single uri (with retries).
+	// Segments of large assets may also be fetched from the other candidates.
+	attempt := func(ctx context.Context, i int) (integrity.Digest, error) {
+		uri := apiAsset.URIs[i]
+		sources := []source{allSources[i]}
+		for _, other := range candidates {
+			if other != i {
+				sources = append(sources, allSources[other])
+			}
+		}
+		var digest integrity.Digest
+		err := d.retryPolicy.Do(ctx, "downloading "+uri, func(ctx context.Context) error {
+			release := d.hostHealth.Reserve(uri)
+			defer release()
+			start := time.Now()
+			var err error
+			digest, err = d.downloadBlob(ctx, timeout, sources, apiAsset.Integrity, digestFunction)
+			if ctx.Err() != nil {
+				// cancelled by the caller (or a faster mirror): this says nothing about the host
+				return err
+			}
+			d.mirrors.record(uri, digest.SizeBytes, time.Since(start), err)
+			if err != nil {
+				d.hostHealth.Failure(uri, err)
+			} else {
+				d.hostHealth.Success(uri)
+			}
+			return err
+		})
+		return digest, err
+	}
+
 	var digest integrity.Digest
 	var uriUsed string
 	var uriIssues []string
-	for i, uri := range apiAsset.URIs {
-		var requestHeaders map[string][]string
-		if len(perURIHeaders[i]) > 0 {
-			// merge the shared headers with the per-uri headers
-			requestHeaders = maps.Clone(sharedHeaders)
-			maps.Copy(requestHeaders, perURIHeaders[i])
-		} else {
-			// no per-uri headers - use the shared headers
-			requestHeaders = sharedHeaders
+	if d.mirrors.strategy == MirrorStrategyRace {
+		var winner int
+		var errs []error
+		digest, winner, errs = race(ctx, candidates, d.hedgeDelay, attempt)
+		if winner >= 0 {
+			uriUsed = apiAsset.URIs[winner]
+		}
+		for i, err := range errs {
+			if err != nil {
+				uriIssues = append(uriIssues, fmt.Sprintf("%s: %v", apiAsset.URIs[candidates[i]], err))
+			}
 		}
-		digestForURI, err := d.downloadBlobFromURI(ctx, timeout, uri, requestHeaders, apiAsset.Integrity, digestFunction)
-		if err == nil {
-			digest = digestForURI
-			uriUsed = uri
-			break
+	} else {
+		for _, i := range candidates {
+			digestForURI, err := attempt(ctx, i)
+			if err == nil {
+				digest = digestForURI
+				uriUsed = apiAsset.URIs[i]
+				break
+			}
+			uriIssues = append(uriIssues, fmt.Sprintf("%s: %v", apiAsset.URIs[i], err))
 		}
-		uriIssues = append(uriIssues, fmt.Sprintf("%s: %v", uri, err))
+	}
+	if skipped := len(apiAsset.URIs) - len(candidates); skipped > 0 {
+		uriIssues = append(uriIssues, fmt.Sprintf("%d uri(s) skipped (host is unhealthy)", skipped))
 	}
 	if digest.Uninitialized() {
 		return asset.FetchBlobResponse{}, fmt.Errorf("unable to download asset from any uri:\n  %v", strings.Join(uriIssues, "\n  "))
 	}
 	logging.Debugf("successfully downloaded asset from %s (%s: %s; %d bytes)", uriUsed, digestFunction.String(), digest.Hex(digestFunction), digest.SizeBytes)
+	if !apiAsset.Integrity.Empty() {
+		// unvalidated content (the compressed content of an asset) is not answered from the index
+		d.fetchIndex.put(apiAsset, uriUsed, digest, digestFunction, fetchedAt)
+	}
 
 	// form a well-specified response
 	return asset.FetchBlobResponse{
-		Status:     status.Status{Code: status.Status_OK},
-		URI:        uriUsed,
-		Qualifiers: apiAsset.Qualifiers,
-		// TODO: set ExpiresAt?
+		Status:         status.Status{Code: status.Status_OK},
+		URI:            uriUsed,
+		Qualifiers:     apiAsset.Qualifiers,
+		ExpiresAt:      d.fetchIndex.expiresAt(fetchedAt),
 		BlobDigest:     digest,
 		DigestFunction: digestFunction,
 	}, nil
 }
 
+// cachedFetch answers FetchBlob from the fetch index if the asset was fetched after oldestContentAccepted
+// and the blob is still in the local CAS.
+func (d *Downloader) cachedFetch(ctx context.Context, apiAsset api.Asset, oldestContentAccepted time.Time, digestFunction integrity.Algorithm) (asset.FetchBlobResponse, bool) {
+	entry, digest, ok := d.fetchIndex.lookup(apiAsset, oldestContentAccepted, digestFunction)
+	if !ok {
+		return asset.FetchBlobResponse{}, false
+	}
+	missing, err := d.localCAS.FindMissingBlobs(ctx, []integrity.Digest{digest}, digestFunction)
+	if err != nil || len(missing) > 0 {
+		// evicted from the disk cache
+		return asset.FetchBlobResponse{}, false
+	}
+	logging.Debugf("answering fetch of %v from the fetch index (%s: %s; %d bytes)", apiAsset.URIs, digestFunction.String(), digest.Hex(digestFunction), digest.SizeBytes)
+	return asset.FetchBlobResponse{
+		Status:         status.Status{Code: status.Status_OK},
+		URI:            entry.URI,
+		Qualifiers:     apiAsset.Qualifiers,
+		ExpiresAt:      d.fetchIndex.expiresAt(time.Unix(entry.FetchedAt, 0)),
+		BlobDigest:     digest,
+		DigestFunction: digestFunction,
+	}, true
+}
+
+// Close releases the resources of the downloader (like the fetch index).
+func (d *Downloader) Close() error {
+	return d.fetchIndex.Close()
+}
+
+// MirrorStats returns the statistics of all hosts that were used by the downloader.
+func (d *Downloader) MirrorStats() []MirrorStat {
+	return d.mirrors.snapshot()
+}
+
 func (d *Downloader) Client() *http.Client {
 	return d.httpClient
 }
 
-func (d *Downloader) downloadBlobFromURI(ctx context.Context, timeout time.Duration,
-	uri string, headers map[string][]string, expectedContent integrity.Integrity, digestFunction integrity.Algorithm,
+// downloadBlob downloads the blob from sources[0].
+// If the server supports range requests and the blob is larger than a single segment,
+// the remaining segments are downloaded concurrently from all sources.
+// Large downloads are staged as partial downloads, so an interrupted download
+// can be resumed by the next attempt.
+// An empty expectedContent disables validation (the caller must validate the content in a different way).
+func (d *Downloader) downloadBlob(ctx context.Context, timeout time.Duration,
+	sources []source, expectedContent integrity.Integrity, digestFunction integrity.Algorithm,
 ) (integrity.Digest, error) {
-	if expectedContent.Empty() {
-		return integrity.Digest{}, errors.New("downloading blob: no digests to validate")
-	}
+	primary := sources[0]
 
 	if timeout != 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, timeout)
 		defer cancel()
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, http.NoBody)
-	if err != nil {
-		return integrity.Digest{}, err
+	partial := d.openPartial(expectedContent, digestFunction)
+	defer partial.close()
+
+	get := func(rangeSpec, ifRange string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, primary.uri, http.NoBody)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(req.Header, primary.headers)
+		if len(rangeSpec) > 0 {
+			req.Header.Set("Range", rangeSpec)
+		}
+		if len(ifRange) > 0 {
+			req.Header.Set("If-Range", ifRange)
+		}
+		return d.httpClient.Do(req)
+	}
+
+	if resumeFrom := partial.resumableFrom(primary.uri); resumeFrom > 0 {
+		verifier := newChecksumVerifier(primary.uri, expectedContent, digestFunction)
+		if err := partial.restore(verifier); err != nil {
+			logging.Warningf("resuming download of %s: %v", primary.uri, err)
+		} else {
+			resp, err := get(fmt.Sprintf("bytes=%d-", resumeFrom), partial.validator())
+			if err != nil {
+				return integrity.Digest{}, err
+			}
+			defer resp.Body.Close()
+			switch resp.StatusCode {
+			case http.StatusPartialContent:
+				start, _, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+				if ok && start == resumeFrom && (partial.state.TotalSize < 0 || total == partial.state.TotalSize) {
+					logging.Debugf("resuming download of %s at byte %d", primary.uri, resumeFrom)
+					return d.downloadToPartial(ctx, partial, verifier, resp.Body, resumeFrom, total, expectedContent, digestFunction)
+				}
+			case http.StatusOK:
+				// the validator doesn't match (the resource changed): start over with the full response
+				return d.importBody(ctx, primary.uri, resp, resp.ContentLength, partial, expectedContent, digestFunction)
+			}
+			// the server does not support resuming this download
+			resp.Body.Close()
+		}
+	}
+
+	segmented := d.segments.connections > 1
+	// When downloading segments, the response to the first request tells us
+	// if the server supports ranges and the total size of the blob.
+	firstSegment := fmt.Sprintf("bytes=0-%d", d.segments.size-1)
+	var resp *http.Response
+	var err error
+	if segmented {
+		resp, err = get(firstSegment, "")
+	} else {
+		resp, err = get("", "")
 	}
-	maps.Copy(req.Header, headers)
-	resp, err := d.httpClient.Do(req)
 	if err != nil {
 		return integrity.Digest{}, err
 	}
+	if segmented && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// empty blobs have no satisfiable range
+		resp.Body.Close()
+		segmented = false
+		if resp, err = get("", ""); err != nil {
+			return integrity.Digest{}, err
+		}
+	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return integrity.Digest{}, fmt.Errorf("downloading blob: unexpected status code %d", resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		// The server ignored the range (or we didn't ask for one): single-stream download.
+		return d.importBody(ctx, primary.uri, resp, resp.ContentLength, partial, expectedContent, digestFunction)
+	case segmented && resp.StatusCode == http.StatusPartialContent:
+		start, end, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != 0 {
+			return integrity.Digest{}, fmt.Errorf("downloading blob: unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+		if end+1 == total {
+			// the first segment is the whole blob
+			return d.importBody(ctx, primary.uri, resp, total, partial, expectedContent, digestFunction)
+		}
+		return d.downloadSegments(ctx, sources, resp, end+1, total, partial, expectedContent, digestFunction)
+	default:
+		return integrity.Digest{}, fmt.Errorf("downloading blob: %w", retry.NewHTTPStatusError(resp))
 	}
+}
+
+// importBody verifies the checksums of the response body while staging it and imports it into the local CAS.
+// Bodies that don't fit in memory are staged in the partial download (if any).
+func (d *Downloader) importBody(ctx context.Context, uri string, resp *http.Response, contentLength int64,
+	partial *partialDownload, expectedContent integrity.Integrity, digestFunction integrity.Algorithm,
+) (integrity.Digest, error) {
+	body := resp.Body
 	// Check if the body is known to fit in memory.
-	canDownloadInMemory := resp.ContentLength >= 0 && resp.ContentLength <= maxInMemoryDownloadSize
+	canDownloadInMemory := contentLength >= 0 && contentLength <= maxInMemoryDownloadSize
+	if partial != nil {
+		if canDownloadInMemory {
+			// small enough to simply download again if interrupted
+			partial.discard()
+		} else {
+			if err := partial.reset(uri, resp, contentLength); err != nil {
+				return integrity.Digest{}, err
+			}
+			verifier := newChecksumVerifier(uri, expectedContent, digestFunction)
+			return d.downloadToPartial(ctx, partial, verifier, body, 0, contentLength, expectedContent, digestFunction)
+		}
+	}
 
 	var bodyStagingArea io.ReadWriter
 	var bodyRewinder func() error
@@ -138,27 +386,8 @@ func (d *Downloader) downloadBlobFromURI(ctx context.Context, timeout time.Durat
 		}
 	}
 
-	// calculate all digests at once
-	digestWriters := []hash.Hash{}
-	writers := []io.Writer{bodyStagingArea}
-	var needHasherForSingleDigest bool = true
-	for checksum := range expectedContent.Items() {
-		if checksum.Algorithm == digestFunction {
-			needHasherForSingleDigest = false
-		}
-		hasher := checksum.Algorithm.Hasher()
-		digestWriters = append(digestWriters, hasher)
-		writers = append(writers, hasher)
-	}
-	var hasherForSingleDigest hash.Hash
-	if needHasherForSingleDigest {
-		logging.Warningf("downloading blob from %s: no known %s checksum, calculating it manually", uri, digestFunction)
-		hasherForSingleDigest = digestFunction.Hasher()
-		writers = append(writers, hasherForSingleDigest)
-	}
-
-	multiWriter := io.MultiWriter(writers...)
-	n, err := io.Copy(multiWriter, resp.Body)
+	verifier := newChecksumVerifier(uri, expectedContent, digestFunction)
+	n, err := io.Copy(io.MultiWriter(bodyStagingArea, verifier), body)
 	if err != nil {
 		return integrity.Digest{}, err
 	}
@@ -169,16 +398,96 @@ func (d *Downloader) downloadBlobFromURI(ctx context.Context, timeout time.Durat
 		}
 	}
 
-	if resp.ContentLength >= 0 && n != resp.ContentLength {
-		return integrity.Digest{}, fmt.Errorf("downloading blob: unexpected content length %d bytes expected, got %d", resp.ContentLength, n)
+	if contentLength >= 0 && n != contentLength {
+		return integrity.Digest{}, fmt.Errorf("downloading blob: unexpected content length %d bytes expected, got %d", contentLength, n)
+	}
+	knownDigest, err := verifier.verify(n)
+	if err != nil {
+		return integrity.Digest{}, err
+	}
+	return d.localCAS.ImportBlob(ctx, expectedContent, knownDigest, digestFunction, bodyStagingArea)
+}
+
+// downloadToPartial appends body to the data of the partial download, starting at offset,
+// and imports the blob into the local CAS once it is complete.
+// The verifier must have seen the first offset bytes of the blob.
+// If the body breaks off, the progress is saved for the next attempt.
+func (d *Downloader) downloadToPartial(ctx context.Context, partial *partialDownload, verifier *checksumVerifier,
+	body io.Reader, offset, totalSize int64, expectedContent integrity.Integrity, digestFunction integrity.Algorithm,
+) (integrity.Digest, error) {
+	if err := partial.file.Truncate(offset); err != nil {
+		return integrity.Digest{}, err
+	}
+	if _, err := partial.file.Seek(offset, io.SeekStart); err != nil {
+		return integrity.Digest{}, err
+	}
+	writer := &checkpointWriter{partial: partial, verifier: verifier, written: offset, lastCheckpoint: offset}
+	if _, err := io.Copy(writer, body); err != nil {
+		if writer.written > writer.lastCheckpoint {
+			if err := partial.checkpoint(writer.written, verifier); err != nil {
+				logging.Warningf("saving progress of partial download: %v", err)
+			}
+		}
+		return integrity.Digest{}, err
+	}
+	if totalSize >= 0 && writer.written != totalSize {
+		partial.discard()
+		return integrity.Digest{}, fmt.Errorf("downloading blob: unexpected content length %d bytes expected, got %d", totalSize, writer.written)
+	}
+	knownDigest, err := verifier.verify(writer.written)
+	if err != nil {
+		partial.discard()
+		return integrity.Digest{}, err
+	}
+	if _, err := partial.file.Seek(0, io.SeekStart); err != nil {
+		return integrity.Digest{}, err
+	}
+	digest, err := d.localCAS.ImportBlob(ctx, expectedContent, knownDigest, digestFunction, partial.file)
+	if err == nil {
+		partial.discard()
+	}
+	return digest, err
+}
+
+// checksumVerifier calculates all checksums of a blob at once.
+type checksumVerifier struct {
+	io.Writer
+	uri            string
+	expected       integrity.Integrity
+	digestFunction integrity.Algorithm
+	hashers        []hash.Hash
+	// hasherForSingleDigest is set if the digest function is not part of the expected integrity.
+	hasherForSingleDigest hash.Hash
+}
+
+func newChecksumVerifier(uri string, expectedContent integrity.Integrity, digestFunction integrity.Algorithm) *checksumVerifier {
+	v := &checksumVerifier{uri: uri, expected: expectedContent, digestFunction: digestFunction}
+	writers := []io.Writer{}
+	var needHasherForSingleDigest bool = true
+	for checksum := range expectedContent.Items() {
+		if checksum.Algorithm == digestFunction {
+			needHasherForSingleDigest = false
+		}
+		hasher := checksum.Algorithm.Hasher()
+		v.hashers = append(v.hashers, hasher)
+		writers = append(writers, hasher)
+	}
+	if needHasherForSingleDigest {
+		logging.Warningf("downloading blob from %s: no known %s checksum, calculating it manually", uri, digestFunction)
+		v.hasherForSingleDigest = digestFunction.Hasher()
+		writers = append(writers, v.hasherForSingleDigest)
 	}
+	v.Writer = io.MultiWriter(writers...)
+	return v
+}
 
-	// validate all digests
+// verify validates all checksums and returns the digest of the n bytes that were written.
+func (v *checksumVerifier) verify(n int64) (integrity.Digest, error) {
 	var knownDigest integrity.Digest
 	var checksumValidationErrors []error
 	var i int
-	for expectedChecksum := range expectedContent.Items() {
-		hasher := digestWriters[i]
+	for expectedChecksum := range v.expected.Items() {
+		hasher := v.hashers[i]
 		gotChecksum := integrity.Checksum{
 			Algorithm: expectedChecksum.Algorithm,
 			Hash:      hasher.Sum(nil),
@@ -186,22 +495,42 @@ func (d *Downloader) downloadBlobFromURI(ctx context.Context, timeout time.Durat
 		if !expectedChecksum.Equals(gotChecksum) {
 			checksumValidationErrors = append(checksumValidationErrors, fmt.Errorf("invalid %s: expected %x, got %x", expectedChecksum.Algorithm, expectedChecksum.Hash, gotChecksum.Hash))
 		}
-		if expectedChecksum.Algorithm == digestFunction {
-			knownDigest = integrity.NewDigest(gotChecksum.Hash, n, digestFunction)
+		if expectedChecksum.Algorithm == v.digestFunction {
+			knownDigest = integrity.NewDigest(gotChecksum.Hash, n, v.digestFunction)
 		}
 		i++
 	}
-	if needHasherForSingleDigest {
-		learnedHash := hasherForSingleDigest.Sum(nil)
-		learnedChecksum := integrity.Checksum{Algorithm: digestFunction, Hash: learnedHash}
-		logging.Basicf("downloading blob from %s: learned %s: %s", uri, digestFunction, learnedChecksum.ToSRI())
-		knownDigest = integrity.NewDigest(learnedHash, n, digestFunction)
+	if v.hasherForSingleDigest != nil {
+		learnedHash := v.hasherForSingleDigest.Sum(nil)
+		learnedChecksum := integrity.Checksum{Algorithm: v.digestFunction, Hash: learnedHash}
+		logging.Basicf("downloading blob from %s: learned %s: %s", v.uri, v.digestFunction, learnedChecksum.ToSRI())
+		knownDigest = integrity.NewDigest(learnedHash, n, v.digestFunction)
 	}
 	if len(checksumValidationErrors) > 0 {
 		return integrity.Digest{}, fmt.Errorf("downloading blob: %v", checksumValidationErrors)
 	}
+	return knownDigest, nil
+}
 
-	return d.localCAS.ImportBlob(ctx, expectedContent, knownDigest, digestFunction, bodyStagingArea)
+// assetSources returns a source for every uri of the asset (in the same order).
+func assetSources(apiAsset api.Asset) ([]source, error) {
+	sharedHeaders, perURIHeaders, err := headersFromQualifiers(apiAsset.Qualifiers, len(apiAsset.URIs))
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]source, len(apiAsset.URIs))
+	for i, uri := range apiAsset.URIs {
+		if len(perURIHeaders[i]) == 0 {
+			// no per-uri headers - use the shared headers
+			sources[i] = source{uri: uri, headers: sharedHeaders}
+			continue
+		}
+		// merge the shared headers with the per-uri headers
+		requestHeaders := maps.Clone(sharedHeaders)
+		maps.Copy(requestHeaders, perURIHeaders[i])
+		sources[i] = source{uri: uri, headers: requestHeaders}
+	}
+	return sources, nil
 }
 
 func headersFromQualifiers(qualifiers map[string]string, numberOfURIs int) (shared http.Header, perUri []http.Header, err error) {
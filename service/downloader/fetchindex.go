@@ -0,0 +1,333 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"golang.org/x/sys/unix"
+)
+
+// FetchIndex remembers the results of FetchBlob across restarts,
+// mirroring the caching semantics of the remote asset API:
+// a fetch of the same URIs (with the same qualifiers and integrity) is answered from the disk cache,
+// as long as the content was fetched after oldestContentAccepted and the blob is still present.
+//
+// The index is stored as an append-only file with one JSON object per line.
+// Later lines for the same key replace earlier ones.
+// The file is compacted (dropping replaced and expired entries) when it contains
+// more than twice the number of live entries.
+//
+// The file may be shared by several processes that use the same disk cache.
+// They serialize writes with an flock on a lock file next to it,
+// and compaction replaces the file, so every process reopens it when the inode changed.
+type FetchIndex struct {
+	path   string
+	maxAge time.Duration
+	now    func() time.Time
+
+	// mux serializes access within the process, lockFile across processes.
+	mux      sync.Mutex
+	lockFile *os.File
+	// file is opened with O_APPEND, so lines of concurrent processes don't overwrite each other.
+	file    *os.File
+	entries map[string]fetchIndexEntry
+	// number of lines in the file (including replaced and expired entries)
+	records int
+}
+
+type fetchIndexEntry struct {
+	Key       string `json:"key"`
+	URI       string `json:"uri"`
+	Hash      string `json:"hash"`
+	SizeBytes int64  `json:"size"`
+	// FetchedAt is the time of the download (unix seconds).
+	FetchedAt int64 `json:"fetched_at"`
+}
+
+// OpenFetchIndex opens (or creates) the fetch index at path.
+// Entries are used for at most maxAge after they were fetched.
+func OpenFetchIndex(path string, maxAge time.Duration) (*FetchIndex, error) {
+	if maxAge <= 0 {
+		return nil, fmt.Errorf("invalid maximum age for fetch index: %v", maxAge)
+	}
+	index := &FetchIndex{
+		path:    path,
+		maxAge:  maxAge,
+		now:     time.Now,
+		entries: make(map[string]fetchIndexEntry),
+	}
+	lockFile, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening fetch index lock: %w", err)
+	}
+	index.lockFile = lockFile
+	if err := index.lock(); err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	defer index.unlock()
+
+	if err := index.openLocked(); err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	index.expireLocked()
+	if index.records > 2*len(index.entries) {
+		if err := index.compactLocked(); err != nil {
+			index.file.Close()
+			lockFile.Close()
+			return nil, err
+		}
+	}
+	return index, nil
+}
+
+// lock acquires the lock that serializes access to the file across processes.
+func (i *FetchIndex) lock() error {
+	if err := unix.Flock(int(i.lockFile.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("locking fetch index: %w", err)
+	}
+	return nil
+}
+
+func (i *FetchIndex) unlock() {
+	unix.Flock(int(i.lockFile.Fd()), unix.LOCK_UN)
+}
+
+// openLocked opens the file and merges its entries into the index
+// (picking up fetches of other processes).
+// The caller must hold the file lock.
+func (i *FetchIndex) openLocked() error {
+	file, err := os.OpenFile(i.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	raw, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	records := 0
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		var entry fetchIndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || len(entry.Key) == 0 {
+			// torn write at the end of the file (or garbage): dropped by the next compaction
+			continue
+		}
+		if known, ok := i.entries[entry.Key]; !ok || entry.FetchedAt >= known.FetchedAt {
+			i.entries[entry.Key] = entry
+		}
+		records++
+	}
+	if len(raw) > 0 && raw[len(raw)-1] != '\n' {
+		// make sure that the next record starts on a new line
+		records = max(records, 2*len(i.entries)+1)
+	}
+	if i.file != nil {
+		i.file.Close()
+	}
+	i.file = file
+	i.records = records
+	return nil
+}
+
+// reopenIfReplacedLocked reopens the file if another process replaced it (by compacting it).
+// Otherwise, lines would be appended to a file that is no longer visible.
+// The caller must hold mux and the file lock.
+func (i *FetchIndex) reopenIfReplacedLocked() error {
+	opened, err := i.file.Stat()
+	if err != nil {
+		return err
+	}
+	if current, err := os.Stat(i.path); err == nil && os.SameFile(opened, current) {
+		return nil
+	}
+	return i.openLocked()
+}
+
+// lookup returns the digest of a fetch of the asset that happened after oldestContentAccepted.
+func (i *FetchIndex) lookup(apiAsset api.Asset, oldestContentAccepted time.Time, digestFunction integrity.Algorithm) (fetchIndexEntry, integrity.Digest, bool) {
+	if i == nil {
+		return fetchIndexEntry{}, integrity.Digest{}, false
+	}
+	key := fetchIndexKey(apiAsset, digestFunction)
+	i.mux.Lock()
+	entry, ok := i.entries[key]
+	i.mux.Unlock()
+	if !ok {
+		return fetchIndexEntry{}, integrity.Digest{}, false
+	}
+	fetchedAt := time.Unix(entry.FetchedAt, 0)
+	if fetchedAt.Before(oldestContentAccepted) || i.now().After(fetchedAt.Add(i.maxAge)) {
+		return fetchIndexEntry{}, integrity.Digest{}, false
+	}
+	hash, err := hex.DecodeString(entry.Hash)
+	if err != nil || len(hash) != digestFunction.SizeBytes() {
+		return fetchIndexEntry{}, integrity.Digest{}, false
+	}
+	return entry, integrity.NewDigest(hash, entry.SizeBytes, digestFunction), true
+}
+
+// put records a successful fetch of the asset.
+func (i *FetchIndex) put(apiAsset api.Asset, uri string, digest integrity.Digest, digestFunction integrity.Algorithm, fetchedAt time.Time) {
+	if i == nil {
+		return
+	}
+	entry := fetchIndexEntry{
+		Key:       fetchIndexKey(apiAsset, digestFunction),
+		URI:       uri,
+		Hash:      digest.Hex(digestFunction),
+		SizeBytes: digest.SizeBytes,
+		FetchedAt: fetchedAt.Unix(),
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logging.Warningf("writing fetch index: %v", err)
+		return
+	}
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	i.entries[entry.Key] = entry
+	if i.file == nil {
+		// closed
+		return
+	}
+	if err := i.lock(); err != nil {
+		logging.Warningf("writing fetch index: %v", err)
+		return
+	}
+	defer i.unlock()
+	if err := i.reopenIfReplacedLocked(); err != nil {
+		logging.Warningf("writing fetch index: %v", err)
+		return
+	}
+	if _, err := i.file.Write(append(line, '\n')); err != nil {
+		logging.Warningf("writing fetch index: %v", err)
+		return
+	}
+	i.records++
+	if i.records > 2*len(i.entries)+fetchIndexSlack {
+		// pick up the fetches of other processes, so the compaction doesn't drop them
+		if err := i.openLocked(); err != nil {
+			logging.Warningf("compacting fetch index: %v", err)
+			return
+		}
+		i.expireLocked()
+		if err := i.compactLocked(); err != nil {
+			logging.Warningf("compacting fetch index: %v", err)
+		}
+	}
+}
+
+// expiresAt returns the time after which a fetch is no longer answered from the index.
+func (i *FetchIndex) expiresAt(fetchedAt time.Time) time.Time {
+	if i == nil {
+		return time.Time{}
+	}
+	return fetchedAt.Add(i.maxAge)
+}
+
+// Close closes the index file. It is safe to call Close on a nil FetchIndex.
+func (i *FetchIndex) Close() error {
+	if i == nil {
+		return nil
+	}
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	if i.file == nil {
+		return nil
+	}
+	err := errors.Join(i.file.Close(), i.lockFile.Close())
+	i.file = nil
+	return err
+}
+
+func (i *FetchIndex) expireLocked() {
+	oldest := i.now().Add(-i.maxAge).Unix()
+	for key, entry := range i.entries {
+		if entry.FetchedAt < oldest {
+			delete(i.entries, key)
+		}
+	}
+}
+
+// compactLocked rewrites the file with the live entries only.
+// The caller must hold the file lock.
+func (i *FetchIndex) compactLocked() error {
+	tmp, err := os.CreateTemp(filepath.Dir(i.path), filepath.Base(i.path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range i.entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), i.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(i.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if i.file != nil {
+		i.file.Close()
+	}
+	i.file = file
+	i.records = len(i.entries)
+	return nil
+}
+
+// fetchIndexKey identifies a fetch by everything that influences its result.
+// The order of the URIs doesn't matter (like in the remote asset API).
+func fetchIndexKey(apiAsset api.Asset, digestFunction integrity.Algorithm) string {
+	hasher := sha256.New()
+	uris := slices.Clone(apiAsset.URIs)
+	slices.Sort(uris)
+	for _, uri := range uris {
+		fmt.Fprintf(hasher, "uri\x00%s\x00", uri)
+	}
+	qualifierNames := make([]string, 0, len(apiAsset.Qualifiers))
+	for name := range apiAsset.Qualifiers {
+		qualifierNames = append(qualifierNames, name)
+	}
+	slices.Sort(qualifierNames)
+	for _, name := range qualifierNames {
+		fmt.Fprintf(hasher, "qualifier\x00%s\x00%s\x00", name, apiAsset.Qualifiers[name])
+	}
+	fmt.Fprintf(hasher, "integrity\x00%s\x00digest_function\x00%s", apiAsset.Integrity.ToSRIString(), digestFunction)
+	if len(apiAsset.Compression) > 0 {
+		fmt.Fprintf(hasher, "\x00compression\x00%s\x00compressed_integrity\x00%s", apiAsset.Compression, apiAsset.CompressedIntegrity.ToSRIString())
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// fetchIndexSlack avoids compacting small indices after every write.
+const fetchIndexSlack = 1000
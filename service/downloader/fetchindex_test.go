@@ -0,0 +1,99 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+)
+
+func TestFetchIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fetches")
+	now := time.Now().Truncate(time.Second)
+	asset := api.Asset{URIs: []string{"https://b.example.com/file", "https://a.example.com/file"}}
+	digest := integrity.NewDigest(make([]byte, integrity.SHA256.SizeBytes()), 42, integrity.SHA256)
+
+	index, err := OpenFetchIndex(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.put(asset, asset.URIs[0], digest, integrity.SHA256, now)
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a torn write
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"key":"abc`)
+	file.Close()
+
+	index, err = OpenFetchIndex(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	index.now = func() time.Time { return now.Add(time.Minute) }
+
+	// the order of the URIs doesn't matter
+	reordered := api.Asset{URIs: []string{asset.URIs[1], asset.URIs[0]}}
+	entry, got, ok := index.lookup(reordered, time.Unix(0, 0), integrity.SHA256)
+	if !ok || !got.Equals(digest, integrity.SHA256) || entry.URI != asset.URIs[0] {
+		t.Fatalf("expected cached digest after reopening, got %v (%v)", got, ok)
+	}
+	if _, _, ok := index.lookup(reordered, now.Add(time.Second), integrity.SHA256); ok {
+		t.Fatal("content older than oldestContentAccepted must not be returned")
+	}
+	qualified := api.Asset{URIs: asset.URIs, Qualifiers: map[string]string{"http_header:Accept": "*/*"}}
+	if _, _, ok := index.lookup(qualified, time.Unix(0, 0), integrity.SHA256); ok {
+		t.Fatal("qualifiers must be part of the key")
+	}
+	index.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if _, _, ok := index.lookup(asset, time.Unix(0, 0), integrity.SHA256); ok {
+		t.Fatal("expired entries must not be returned")
+	}
+}
+
+func TestFetchIndexSharedByProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fetches")
+	now := time.Now().Truncate(time.Second)
+	digest := integrity.NewDigest(make([]byte, integrity.SHA256.SizeBytes()), 42, integrity.SHA256)
+	first := api.Asset{URIs: []string{"https://example.com/first"}}
+	second := api.Asset{URIs: []string{"https://example.com/second"}}
+	busy := api.Asset{URIs: []string{"https://example.com/busy"}}
+
+	a, err := OpenFetchIndex(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := OpenFetchIndex(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	a.put(first, first.URIs[0], digest, integrity.SHA256, now)
+	// b compacts the file, which must keep the entry of a
+	for range fetchIndexSlack + 10 {
+		b.put(busy, busy.URIs[0], digest, integrity.SHA256, now)
+	}
+	// a must append to the compacted file
+	a.put(second, second.URIs[0], digest, integrity.SHA256, now)
+
+	reopened, err := OpenFetchIndex(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for _, asset := range []api.Asset{first, second, busy} {
+		if _, _, ok := reopened.lookup(asset, time.Unix(0, 0), integrity.SHA256); !ok {
+			t.Fatalf("fetch of %s was lost", asset.URIs[0])
+		}
+	}
+}
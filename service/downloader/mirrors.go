@@ -0,0 +1,254 @@
+package downloader
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/service/retry"
+)
+
+// MirrorStrategy decides in which order the URIs (mirrors) of an asset are tried.
+type MirrorStrategy string
+
+const (
+	// MirrorStrategyOrdered tries the URIs in the order of the manifest.
+	MirrorStrategyOrdered MirrorStrategy = "ordered"
+	// MirrorStrategyRandom tries the URIs in random order, spreading the load across mirrors.
+	MirrorStrategyRandom MirrorStrategy = "random"
+	// MirrorStrategyWeighted prefers mirrors with a high observed throughput and few errors.
+	// Mirrors without observations are tried optimistically.
+	MirrorStrategyWeighted MirrorStrategy = "weighted"
+	// MirrorStrategyRace starts with the best mirror (like weighted) and sends a hedged request
+	// to the next mirror whenever a request fails or takes longer than the hedge delay.
+	// The first successful download wins and the others are cancelled.
+	MirrorStrategyRace MirrorStrategy = "race"
+)
+
+// MirrorStrategies lists all valid strategies.
+var MirrorStrategies = []MirrorStrategy{MirrorStrategyOrdered, MirrorStrategyRandom, MirrorStrategyWeighted, MirrorStrategyRace}
+
+// MirrorStat contains the statistics of a single host, collected during the lifetime of the process.
+type MirrorStat struct {
+	Host      string `json:"host"`
+	Successes int64  `json:"successes"`
+	Failures  int64  `json:"failures"`
+	// BytesPerSecond is a moving average of the throughput of successful downloads
+	// (including the time to the first byte).
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// ErrorRate is a moving average of the fraction of failed downloads.
+	ErrorRate float64 `json:"error_rate"`
+	Preferred bool    `json:"preferred,omitempty"`
+}
+
+// mirrors orders the URIs of assets and keeps per-host statistics.
+type mirrors struct {
+	strategy       MirrorStrategy
+	preferredHosts []string
+	hostHealth     *retry.HostHealth
+
+	mux   sync.Mutex
+	stats map[string]*MirrorStat
+}
+
+func newMirrors(strategy MirrorStrategy, preferredHosts []string, hostHealth *retry.HostHealth) *mirrors {
+	if len(strategy) == 0 {
+		strategy = MirrorStrategyOrdered
+	}
+	return &mirrors{
+		strategy:       strategy,
+		preferredHosts: preferredHosts,
+		hostHealth:     hostHealth,
+		stats:          make(map[string]*MirrorStat),
+	}
+}
+
+// order returns the indices of uris in the order they should be tried.
+// Preferred hosts come first (in the order of the config), followed by the other URIs
+// ordered by the strategy. Unhealthy hosts are left out, unless all hosts are unhealthy.
+func (m *mirrors) order(uris []string) []int {
+	var preferred, others []int
+	for i, uri := range uris {
+		if slices.Contains(m.preferredHosts, retry.HostOf(uri)) {
+			preferred = append(preferred, i)
+		} else {
+			others = append(others, i)
+		}
+	}
+	slices.SortStableFunc(preferred, func(a, b int) int {
+		return slices.Index(m.preferredHosts, retry.HostOf(uris[a])) - slices.Index(m.preferredHosts, retry.HostOf(uris[b]))
+	})
+
+	switch m.strategy {
+	case MirrorStrategyRandom:
+		rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	case MirrorStrategyWeighted, MirrorStrategyRace:
+		others = m.weightedShuffle(uris, others)
+	}
+
+	candidates := append(preferred, others...)
+	// Allow only inspects the health of a host. The probe of a host that recovers from a cooldown
+	// is reserved by the request that is actually sent (see HostHealth.Reserve).
+	healthy := slices.DeleteFunc(slices.Clone(candidates), func(i int) bool {
+		return !m.hostHealth.Allow(uris[i])
+	})
+	if len(healthy) == 0 {
+		return candidates
+	}
+	return healthy
+}
+
+// weightedShuffle orders the candidates by weighted random sampling without replacement.
+// The weight of a host is its throughput, penalized by its error rate.
+// Hosts without successful downloads get the weight of the best known host,
+// so that they are explored.
+func (m *mirrors) weightedShuffle(uris []string, candidates []int) []int {
+	m.mux.Lock()
+	weights := make([]float64, len(candidates))
+	var best float64
+	for i, candidate := range candidates {
+		if stat, ok := m.stats[retry.HostOf(uris[candidate])]; ok && stat.Successes > 0 {
+			weights[i] = stat.BytesPerSecond * (1 - stat.ErrorRate) * (1 - stat.ErrorRate)
+		} else {
+			weights[i] = -1
+		}
+		best = max(best, weights[i])
+	}
+	m.mux.Unlock()
+	if best <= 0 {
+		best = 1
+	}
+	for i := range weights {
+		if weights[i] < 0 {
+			weights[i] = best
+		}
+		// never starve a host completely
+		weights[i] = max(weights[i], best/1000)
+	}
+
+	ordered := make([]int, 0, len(candidates))
+	candidates = slices.Clone(candidates)
+	for len(candidates) > 0 {
+		var total float64
+		for _, weight := range weights {
+			total += weight
+		}
+		pick := rand.Float64() * total
+		chosen := len(candidates) - 1
+		for i, weight := range weights {
+			if pick < weight {
+				chosen = i
+				break
+			}
+			pick -= weight
+		}
+		ordered = append(ordered, candidates[chosen])
+		candidates = slices.Delete(candidates, chosen, chosen+1)
+		weights = slices.Delete(weights, chosen, chosen+1)
+	}
+	return ordered
+}
+
+// record updates the statistics of the host of uri after a download attempt.
+func (m *mirrors) record(uri string, sizeBytes int64, duration time.Duration, err error) {
+	host := retry.HostOf(uri)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	stat, ok := m.stats[host]
+	if !ok {
+		stat = &MirrorStat{Host: host}
+		m.stats[host] = stat
+	}
+	if err != nil {
+		stat.Failures++
+		stat.ErrorRate = movingAverage(stat.ErrorRate, 1, stat.Successes+stat.Failures)
+		return
+	}
+	stat.Successes++
+	stat.ErrorRate = movingAverage(stat.ErrorRate, 0, stat.Successes+stat.Failures)
+	if seconds := duration.Seconds(); seconds > 0 {
+		stat.BytesPerSecond = movingAverage(stat.BytesPerSecond, float64(sizeBytes)/seconds, stat.Successes)
+	}
+}
+
+// snapshot returns the statistics of all hosts that were used.
+func (m *mirrors) snapshot() []MirrorStat {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	out := make([]MirrorStat, 0, len(m.stats))
+	for _, stat := range m.stats {
+		copied := *stat
+		copied.Preferred = slices.Contains(m.preferredHosts, stat.Host)
+		out = append(out, copied)
+	}
+	slices.SortFunc(out, func(a, b MirrorStat) int {
+		return strings.Compare(a.Host, b.Host)
+	})
+	return out
+}
+
+// race tries the candidates concurrently with hedged requests:
+// the next candidate is started when the previous one fails or after hedgeDelay.
+// It returns the result of the first successful attempt.
+func race(
+	ctx context.Context, candidates []int, hedgeDelay time.Duration,
+	attempt func(ctx context.Context, candidate int) (integrity.Digest, error),
+) (integrity.Digest, int, []error) {
+	ctx, cancel := context.WithCancel(ctx)
+	// losers are cancelled when the winner is found
+	defer cancel()
+
+	type result struct {
+		candidate int
+		digest    integrity.Digest
+		err       error
+	}
+	results := make(chan result, len(candidates))
+	errs := make([]error, len(candidates))
+	next, running := 0, 0
+	start := func() {
+		candidate := candidates[next]
+		next++
+		running++
+		go func() {
+			digest, err := attempt(ctx, candidate)
+			results <- result{candidate, digest, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(hedgeDelay)
+	defer timer.Stop()
+	for running > 0 {
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				return r.digest, r.candidate, errs
+			}
+			errs[slices.Index(candidates, r.candidate)] = r.err
+			if next < len(candidates) {
+				start()
+				timer.Reset(hedgeDelay)
+			}
+		case <-timer.C:
+			if next < len(candidates) {
+				start()
+				timer.Reset(hedgeDelay)
+			}
+		}
+	}
+	return integrity.Digest{}, -1, errs
+}
+
+// movingAverage is an exponentially weighted moving average.
+// The first samples are averaged evenly, so that early observations are not overweighted.
+func movingAverage(average, sample float64, samples int64) float64 {
+	const window = 10
+	weight := 1 / float64(min(samples, window))
+	return average + weight*(sample-average)
+}
@@ -0,0 +1,63 @@
+package downloader
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tweag/asset-fuse/service/retry"
+)
+
+func TestMirrorsOrder(t *testing.T) {
+	uris := []string{"https://a.example.com/file", "https://b.example.com/file", "https://c.example.com/file"}
+
+	for _, tc := range []struct {
+		name      string
+		preferred []string
+		failing   []string
+		cooldown  time.Duration
+		expected  []int
+	}{
+		{name: "manifest order", expected: []int{0, 1, 2}},
+		{name: "preferred hosts first", preferred: []string{"c.example.com", "b.example.com"}, expected: []int{2, 1, 0}},
+		{name: "unhealthy hosts are skipped", failing: []string{uris[0]}, cooldown: time.Hour, expected: []int{1, 2}},
+		{name: "all hosts unhealthy", failing: uris, cooldown: time.Hour, expected: []int{0, 1, 2}},
+		// a cooldown of zero makes hosts half-open right away
+		{name: "half-open hosts are kept", failing: []string{uris[1]}, expected: []int{0, 1, 2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			health := retry.NewHostHealth(1, tc.cooldown)
+			for _, uri := range tc.failing {
+				health.Failure(uri, transientError)
+			}
+			m := newMirrors(MirrorStrategyOrdered, tc.preferred, health)
+			// ordering must not reserve the probe of half-open hosts, so the result is the same every time
+			for range 3 {
+				if got := m.order(uris); !slices.Equal(got, tc.expected) {
+					t.Fatalf("expected order %v, got %v", tc.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMirrorsRecord(t *testing.T) {
+	m := newMirrors(MirrorStrategyWeighted, []string{"b.example.com"}, nil)
+	m.record("https://a.example.com/file", 1000, time.Second, nil)
+	m.record("https://a.example.com/other", 0, time.Second, transientError)
+	m.record("https://b.example.com/file", 2000, time.Second, nil)
+
+	stats := m.snapshot()
+	if len(stats) != 2 || stats[0].Host != "a.example.com" || stats[1].Host != "b.example.com" {
+		t.Fatalf("expected one stat per host (sorted), got %+v", stats)
+	}
+	if stats[0].Successes != 1 || stats[0].Failures != 1 || stats[0].ErrorRate != 0.5 || stats[0].BytesPerSecond != 1000 {
+		t.Fatalf("unexpected stat %+v", stats[0])
+	}
+	if !stats[1].Preferred || stats[0].Preferred {
+		t.Fatal("only preferred hosts should be marked")
+	}
+}
+
+var transientError = &retry.HTTPStatusError{StatusCode: http.StatusServiceUnavailable}
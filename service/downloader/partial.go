@@ -0,0 +1,335 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"golang.org/x/sys/unix"
+)
+
+// partialDownload is a download that can be resumed after an interruption,
+// even by another process.
+// It consists of a data file and a state file in the partial directory of the disk cache,
+// both named after the expected checksum of the blob.
+// The data file is locked while a download is in progress.
+type partialDownload struct {
+	file      *os.File
+	statePath string
+
+	// mux protects state (segments complete concurrently)
+	mux   sync.Mutex
+	state partialState
+	// persisted is set if the state file describes the data file.
+	// Otherwise, both files are removed on close.
+	persisted bool
+}
+
+// partialState describes which parts of the data file are valid.
+type partialState struct {
+	Version int `json:"version"`
+	// URI and validators of the response the data was received from.
+	URI          string `json:"uri"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// TotalSize is the size of the blob (-1 if unknown).
+	TotalSize int64 `json:"total_size"`
+
+	// Received is the number of bytes received by a single-stream download.
+	Received int64 `json:"received,omitempty"`
+	// HasherStates are the marshalled states of the checksum hashers after Received bytes.
+	HasherStates [][]byte `json:"hasher_states,omitempty"`
+
+	// SegmentSize and Segments (start offsets of complete segments) describe a segmented download.
+	SegmentSize int64   `json:"segment_size,omitempty"`
+	Segments    []int64 `json:"segments,omitempty"`
+}
+
+// openPartial opens (or creates) the partial download of the blob with the expected content.
+// It returns nil if resuming is disabled or the blob is already being downloaded by another process.
+func (d *Downloader) openPartial(expectedContent integrity.Integrity, digestFunction integrity.Algorithm) *partialDownload {
+	if len(d.partialDir) == 0 {
+		return nil
+	}
+	checksum, ok := expectedContent.BestSingleChecksum(digestFunction)
+	if !ok {
+		return nil
+	}
+	name := checksum.Algorithm.String() + "-" + checksum.Hex()
+	file, err := lockPartialFile(filepath.Join(d.partialDir, name))
+	if err != nil {
+		logging.Warningf("opening partial download: %v", err)
+		return nil
+	}
+	if file == nil {
+		// another process is downloading the same blob
+		return nil
+	}
+	p := &partialDownload{file: file, statePath: file.Name() + ".json"}
+	if raw, err := os.ReadFile(p.statePath); err == nil {
+		if err := json.Unmarshal(raw, &p.state); err != nil || p.state.Version != partialStateVersion {
+			p.state = partialState{}
+		} else {
+			p.persisted = true
+		}
+	}
+	return p
+}
+
+// lockPartialFile opens (or creates) the data file at path and locks it.
+// It returns nil if the file is locked by another process.
+// The previous owner of the lock may have removed the file before releasing the lock,
+// so the file is opened again until the locked file is the one at path.
+func lockPartialFile(path string) (*os.File, error) {
+	for range maxLockAttempts {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		if err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+			file.Close()
+			return nil, nil
+		}
+		if isCurrentFile(file) {
+			return file, nil
+		}
+		file.Close()
+	}
+	return nil, fmt.Errorf("%s is replaced concurrently", path)
+}
+
+// isCurrentFile reports whether file is still reachable under its name.
+func isCurrentFile(file *os.File) bool {
+	opened, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(file.Name())
+	return err == nil && os.SameFile(opened, current)
+}
+
+// validator returns the value for an If-Range header, or "" if resuming cannot be validated.
+func (p *partialDownload) validator() string {
+	// weak ETags must not be used with If-Range
+	if len(p.state.ETag) > 0 && !strings.HasPrefix(p.state.ETag, "W/") {
+		return p.state.ETag
+	}
+	return p.state.LastModified
+}
+
+// resumableFrom returns the number of bytes that a single-stream download from uri can skip.
+func (p *partialDownload) resumableFrom(uri string) int64 {
+	if p == nil || p.state.URI != uri || len(p.validator()) == 0 || len(p.state.HasherStates) == 0 {
+		return 0
+	}
+	return p.state.Received
+}
+
+// restore feeds the data received by an earlier single-stream download into the verifier.
+// The data is hashed again instead of trusting the saved hasher states,
+// and it must reproduce these states exactly. Otherwise, the data file was
+// truncated or modified since the last checkpoint and must not be resumed.
+func (p *partialDownload) restore(verifier *checksumVerifier) error {
+	info, err := p.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < p.state.Received {
+		return fmt.Errorf("partial data has %d bytes, expected at least %d", info.Size(), p.state.Received)
+	}
+	if _, err := io.Copy(verifier, io.NewSectionReader(p.file, 0, p.state.Received)); err != nil {
+		return err
+	}
+	hasherStates, err := verifier.marshal()
+	if err != nil {
+		return err
+	}
+	if !slices.EqualFunc(hasherStates, p.state.HasherStates, bytes.Equal) {
+		return errors.New("partial data does not match the saved progress")
+	}
+	return nil
+}
+
+// reset discards all data and starts a new download described by resp.
+func (p *partialDownload) reset(uri string, resp *http.Response, totalSize int64) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.state = partialState{
+		Version:      partialStateVersion,
+		URI:          uri,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		TotalSize:    totalSize,
+	}
+	p.persisted = false
+	os.Remove(p.statePath)
+	if err := p.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := p.file.Seek(0, io.SeekStart)
+	return err
+}
+
+// matches reports whether resp belongs to the same version of the blob as the partial data.
+func (p *partialDownload) matches(uri string, resp *http.Response, totalSize int64) bool {
+	if p.state.URI != uri || p.state.TotalSize != totalSize || len(p.validator()) == 0 {
+		return false
+	}
+	if etag := resp.Header.Get("ETag"); len(p.state.ETag) > 0 && etag != p.state.ETag {
+		return false
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); len(p.state.LastModified) > 0 && lastModified != p.state.LastModified {
+		return false
+	}
+	return true
+}
+
+// checkpoint persists the progress of a single-stream download.
+// The data file is synced first, so the state never claims more bytes than were written.
+func (p *partialDownload) checkpoint(received int64, verifier *checksumVerifier) error {
+	hasherStates, err := verifier.marshal()
+	if err != nil {
+		return err
+	}
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.state.Received = received
+	p.state.HasherStates = hasherStates
+	return p.saveLocked()
+}
+
+// completeSegment records a complete segment of a segmented download.
+func (p *partialDownload) completeSegment(segmentSize, start int64) error {
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.state.SegmentSize = segmentSize
+	p.state.Segments = append(p.state.Segments, start)
+	return p.saveLocked()
+}
+
+// completeSegments returns the start offsets of complete segments of the given size.
+func (p *partialDownload) completeSegments(segmentSize int64) []int64 {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.state.SegmentSize != segmentSize {
+		return nil
+	}
+	return slices.Clone(p.state.Segments)
+}
+
+func (p *partialDownload) saveLocked() error {
+	if len(p.validator()) == 0 {
+		// without a validator, the download cannot be resumed safely
+		return nil
+	}
+	raw, err := json.Marshal(p.state)
+	if err != nil {
+		return err
+	}
+	tmp := p.statePath + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p.statePath); err != nil {
+		return err
+	}
+	p.persisted = true
+	return nil
+}
+
+// discard marks the partial download as obsolete
+// (after the blob was imported into the CAS, or if the data is known to be bad).
+func (p *partialDownload) discard() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.persisted = false
+}
+
+// close releases the lock. Resumable data is kept for the next attempt.
+// It is safe to call close on a nil partialDownload.
+func (p *partialDownload) close() {
+	if p == nil {
+		return
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if !p.persisted && isCurrentFile(p.file) {
+		// remove the files before releasing the lock
+		os.Remove(p.statePath)
+		os.Remove(p.file.Name())
+	}
+	p.file.Close()
+}
+
+// checkpointWriter checkpoints a partial download at regular intervals.
+type checkpointWriter struct {
+	partial  *partialDownload
+	verifier *checksumVerifier
+	// total number of bytes in the data file (including resumed bytes)
+	written        int64
+	lastCheckpoint int64
+}
+
+func (w *checkpointWriter) Write(b []byte) (int, error) {
+	n, err := io.MultiWriter(w.partial.file, w.verifier).Write(b)
+	w.written += int64(n)
+	if err == nil && w.written-w.lastCheckpoint >= checkpointInterval {
+		if err := w.partial.checkpoint(w.written, w.verifier); err != nil {
+			logging.Warningf("saving progress of partial download: %v", err)
+		}
+		w.lastCheckpoint = w.written
+	}
+	return n, err
+}
+
+// allHashers returns the hashers of the verifier in a stable order.
+func (v *checksumVerifier) allHashers() []hash.Hash {
+	if v.hasherForSingleDigest == nil {
+		return v.hashers
+	}
+	return append(slices.Clone(v.hashers), v.hasherForSingleDigest)
+}
+
+// marshal returns the states of all hashers.
+func (v *checksumVerifier) marshal() ([][]byte, error) {
+	var states [][]byte
+	for _, hasher := range v.allHashers() {
+		marshaler, ok := hasher.(encoding.BinaryMarshaler)
+		if !ok {
+			return nil, errors.New("hasher does not support saving its state")
+		}
+		state, err := marshaler.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+const (
+	partialStateVersion = 1
+	// checkpointInterval is the number of bytes after which the progress of a single-stream download is saved.
+	// (64 MiB)
+	checkpointInterval = 1 << 26
+	// maxLockAttempts limits how often opening a partial download races with its removal.
+	maxLockAttempts = 3
+)
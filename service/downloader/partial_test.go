@@ -0,0 +1,121 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+)
+
+func TestPartialResume(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789abcdef", 8))
+	const received = 48
+
+	for _, tc := range []struct {
+		name string
+		// tamper modifies the data file after the checkpoint
+		tamper       func(file *os.File) error
+		expectResume bool
+	}{
+		{name: "intact data", tamper: func(*os.File) error { return nil }, expectResume: true},
+		{name: "data was truncated", tamper: func(file *os.File) error { return file.Truncate(received / 2) }},
+		{name: "data was modified", tamper: func(file *os.File) error {
+			_, err := file.WriteAt([]byte("XXXX"), 8)
+			return err
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mux sync.Mutex
+			var ranges []string
+			server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				mux.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				mux.Unlock()
+				serveRanges(content, nil)(w, r)
+			})
+
+			d, disk := testDownloader(t, Options{})
+			d.partialDir = disk.PartialDir(integrity.SHA256)
+			uri := server.URL + "/file"
+			expected := testIntegrity(t, content)
+			checkpointPartial(t, d, uri, expected, content[:received])
+			partial := d.openPartial(expected, integrity.SHA256)
+			if err := tc.tamper(partial.file); err != nil {
+				t.Fatal(err)
+			}
+			partial.close()
+
+			resp, err := d.FetchBlob(context.Background(), 0, time.Time{}, api.Asset{URIs: []string{uri}, Integrity: expected}, integrity.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectBlob(t, disk, resp.BlobDigest, content)
+			resumed := len(ranges) > 0 && ranges[0] == "bytes=48-"
+			if resumed != tc.expectResume {
+				t.Fatalf("expected resume=%v, got requests with ranges %q", tc.expectResume, ranges)
+			}
+		})
+	}
+}
+
+func TestLockPartialFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "partial")
+	file, err := lockPartialFile(path)
+	if err != nil || file == nil {
+		t.Fatalf("expected to lock a new file, got %v", err)
+	}
+	if other, err := lockPartialFile(path); err != nil || other != nil {
+		t.Fatalf("expected the file to be locked by the first owner, got %v, %v", other, err)
+	}
+	// the owner removes the file while holding the lock
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	file, err = lockPartialFile(path)
+	if err != nil || file == nil {
+		t.Fatalf("expected to lock a new file, got %v", err)
+	}
+	defer file.Close()
+	if !isCurrentFile(file) {
+		t.Fatal("locked file should be the one at the path")
+	}
+}
+
+// checkpointPartial saves a partial download of uri that received prefix.
+func checkpointPartial(t *testing.T, d *Downloader, uri string, expected integrity.Integrity, prefix []byte) {
+	t.Helper()
+	partial := d.openPartial(expected, integrity.SHA256)
+	if partial == nil {
+		t.Fatal("expected a partial download")
+	}
+	defer partial.close()
+	resp := &http.Response{Header: http.Header{"Etag": []string{`"v1"`}}}
+	if err := partial.reset(uri, resp, -1); err != nil {
+		t.Fatal(err)
+	}
+	verifier := newChecksumVerifier(uri, expected, integrity.SHA256)
+	writer := &checkpointWriter{partial: partial, verifier: verifier}
+	if _, err := writer.Write(prefix); err != nil {
+		t.Fatal(err)
+	}
+	if err := partial.checkpoint(writer.written, verifier); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
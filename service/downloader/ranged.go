@@ -0,0 +1,565 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/service/retry"
+)
+
+// OriginStreaming decides how reads of large assets are served when there is no remote CAS to stream from.
+type OriginStreaming string
+
+const (
+	// OriginStreamingOff materializes the whole asset in the local CAS before the first read is served.
+	OriginStreamingOff OriginStreaming = "off"
+	// OriginStreamingOnDemand serves reads with range requests against the URIs of the asset.
+	// Blocks that were read are kept in the disk cache.
+	// Once every block was read, the checksums are verified (the read that completes the blob fails on a mismatch)
+	// and the blob is imported into the local CAS.
+	OriginStreamingOnDemand OriginStreaming = "on_demand"
+	// OriginStreamingReadThenVerify serves reads like OriginStreamingOnDemand,
+	// but also downloads the remaining blocks in the background,
+	// so the blob is verified (and imported) even if it is never read completely.
+	// Reads fail once a mismatch was detected.
+	OriginStreamingReadThenVerify OriginStreaming = "read_then_verify"
+)
+
+// OriginStreamingModes lists all valid modes.
+var OriginStreamingModes = []OriginStreaming{OriginStreamingOff, OriginStreamingOnDemand, OriginStreamingReadThenVerify}
+
+// ErrNotStreamable is returned by OpenRange if an asset should be materialized instead.
+var ErrNotStreamable = errors.New("asset cannot be streamed from its origin")
+
+// RangeReader reads an asset directly from its origin.
+// All readers of the same asset share a single block cache.
+type RangeReader struct {
+	blob *rangedBlob
+
+	mux    sync.Mutex
+	offset int64
+	closed bool
+}
+
+// rangedBlob is the shared state of all readers of an asset.
+// Blocks are stored in a sparse file (the partial download of the blob, if possible).
+type rangedBlob struct {
+	d              *Downloader
+	key            string
+	sources        []source
+	size           int64
+	expected       integrity.Integrity
+	digestFunction integrity.Algorithm
+	imported       func(integrity.Digest)
+
+	// ctx is cancelled when the last reader is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// wg tracks background fetches (readahead and read_then_verify).
+	wg sync.WaitGroup
+
+	file *os.File
+	// partial is nil if the blob is staged in a temporary file.
+	partial *partialDownload
+
+	// mux protects the fields below
+	mux      sync.Mutex
+	refs     int
+	present  []bool
+	missing  int
+	fetching map[int64]chan struct{}
+	// err is set if the blob failed verification.
+	err error
+	// verified is closed once the complete blob was verified.
+	verified chan struct{}
+}
+
+// OpenRange opens a reader that serves reads with HTTP range requests against the URIs of the asset.
+// This requires a server that supports range requests and blobs of at least minSize bytes.
+// Otherwise, an error wrapping ErrNotStreamable is returned.
+// sizeHint is the size of the blob, if known (or -1). If the size is unknown,
+// the origin is asked for it with a HEAD request, so small blobs are not downloaded twice.
+// Blocks are fetched on demand and the blob is imported into the local CAS once all blocks were seen and verified.
+// imported is called with the digest of the blob after it was imported.
+// The reader may outlive the request that opened it, so streamCtx should be bound to the lifetime of the service.
+func (d *Downloader) OpenRange(ctx, streamCtx context.Context, apiAsset api.Asset, digestFunction integrity.Algorithm, sizeHint, minSize int64,
+	imported func(integrity.Digest),
+) (*RangeReader, error) {
+	if len(d.originStreaming) == 0 || d.originStreaming == OriginStreamingOff {
+		return nil, fmt.Errorf("%w: origin streaming is disabled", ErrNotStreamable)
+	}
+	if sizeHint >= 0 && sizeHint < minSize {
+		return nil, fmt.Errorf("%w: blob is smaller than %d bytes", ErrNotStreamable, minSize)
+	}
+	if len(apiAsset.Compression) > 0 {
+		return nil, fmt.Errorf("%w: asset is compressed at its origin", ErrNotStreamable)
+	}
+	key := apiAsset.Integrity.ToSRIString()
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%w: no digests to validate", ErrNotStreamable)
+	}
+	if reader, ok := d.openSharedRange(key); ok {
+		return reader, nil
+	}
+
+	allSources, err := assetSources(apiAsset)
+	if err != nil {
+		return nil, err
+	}
+	var sources []source
+	for _, i := range d.mirrors.order(apiAsset.URIs) {
+		sources = append(sources, allSources[i])
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("%w: asset has no uris", ErrNotStreamable)
+	}
+
+	// Blocks that were read earlier are kept in the partial download of the blob.
+	partial := d.openPartial(apiAsset.Integrity, digestFunction)
+	// The first block tells us if the server supports ranges and the size of the blob.
+	// If it is cached already, a single byte is enough.
+	probeSize := int64(originBlockSize)
+	if partial != nil && slices.Contains(partial.completeSegments(originBlockSize), 0) {
+		probeSize = 1
+	}
+	var resp *http.Response
+	for i, src := range sources {
+		if sizeHint < 0 {
+			err = d.probeSize(ctx, src, minSize)
+		}
+		if err == nil {
+			resp, err = d.probeRange(ctx, src, probeSize)
+		}
+		if err == nil {
+			// start with the source that answered
+			sources[0], sources[i] = sources[i], sources[0]
+			break
+		}
+		if errors.Is(err, ErrNotStreamable) || ctx.Err() != nil {
+			break
+		}
+		logging.Debugf("probing %s for range requests: %v", src.uri, err)
+	}
+	if err != nil {
+		partial.close()
+		return nil, err
+	}
+	defer resp.Body.Close()
+	_, end, total, _ := parseContentRange(resp.Header.Get("Content-Range"))
+	if total < minSize {
+		partial.close()
+		return nil, fmt.Errorf("%w: blob is smaller than %d bytes", ErrNotStreamable, minSize)
+	}
+
+	blob, err := d.newRangedBlob(key, sources, resp, total, partial, apiAsset.Integrity, digestFunction, imported)
+	if err != nil {
+		return nil, err
+	}
+	blob.ctx, blob.cancel = context.WithCancel(streamCtx)
+	if !blob.present[0] && end+1 == min(originBlockSize, total) {
+		if err := copySegment(blob.file, 0, end+1, resp.Body); err == nil {
+			blob.completeBlock(0)
+		}
+	}
+
+	d.rangedMux.Lock()
+	if _, ok := d.ranged[key]; ok {
+		// another reader won the race
+		d.rangedMux.Unlock()
+		blob.cancel()
+		blob.close()
+		if reader, ok := d.openSharedRange(key); ok {
+			return reader, nil
+		}
+		return nil, fmt.Errorf("%w: concurrent reader was closed", ErrNotStreamable)
+	}
+	d.ranged[key] = blob
+	blob.refs = 1
+	d.rangedMux.Unlock()
+
+	if blob.missing == 0 {
+		if err := blob.verifyAndImport(); err != nil {
+			blob.release()
+			return nil, err
+		}
+	} else if d.originStreaming == OriginStreamingReadThenVerify {
+		blob.background(blob.fill)
+	}
+	logging.Debugf("streaming asset from %s (%d bytes, %d of %d blocks cached)", sources[0].uri, total, len(blob.present)-blob.missing, len(blob.present))
+	return &RangeReader{blob: blob}, nil
+}
+
+func (d *Downloader) openSharedRange(key string) (*RangeReader, bool) {
+	d.rangedMux.Lock()
+	defer d.rangedMux.Unlock()
+	blob, ok := d.ranged[key]
+	if !ok {
+		return nil, false
+	}
+	blob.mux.Lock()
+	blob.refs++
+	blob.mux.Unlock()
+	return &RangeReader{blob: blob}, true
+}
+
+// probeSize asks the source for the size of the blob with a HEAD request.
+// It returns an error wrapping ErrNotStreamable if the blob is smaller than minSize
+// or the server doesn't support range requests.
+// Servers that don't answer HEAD requests are probed with a range request instead.
+func (d *Downloader) probeSize(ctx context.Context, src source, minSize int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, src.uri, http.NoBody)
+	if err != nil {
+		return err
+	}
+	maps.Copy(req.Header, src.headers)
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented:
+		return nil
+	case resp.StatusCode != http.StatusOK:
+		return retry.NewHTTPStatusError(resp)
+	case resp.Header.Get("Accept-Ranges") == "none":
+		return fmt.Errorf("%w: server does not support range requests", ErrNotStreamable)
+	case resp.ContentLength >= 0 && resp.ContentLength < minSize:
+		return fmt.Errorf("%w: blob is smaller than %d bytes", ErrNotStreamable, minSize)
+	}
+	return nil
+}
+
+// probeRange requests the first size bytes of the blob.
+// It returns a response with a valid Content-Range or an error.
+func (d *Downloader) probeRange(ctx context.Context, src source, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.uri, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(req.Header, src.headers)
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, _, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if ok && start == 0 {
+			return resp, nil
+		}
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: unexpected Content-Range %q", ErrNotStreamable, resp.Header.Get("Content-Range"))
+	case http.StatusOK:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: server does not support range requests", ErrNotStreamable)
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: blob is empty", ErrNotStreamable)
+	default:
+		resp.Body.Close()
+		return nil, retry.NewHTTPStatusError(resp)
+	}
+}
+
+// newRangedBlob creates the block cache of a blob.
+// If partial is nil, blocks are cached in a temporary file.
+func (d *Downloader) newRangedBlob(key string, sources []source, resp *http.Response, size int64, partial *partialDownload,
+	expected integrity.Integrity, digestFunction integrity.Algorithm, imported func(integrity.Digest),
+) (*rangedBlob, error) {
+	blocks := int((size + originBlockSize - 1) / originBlockSize)
+	blob := &rangedBlob{
+		d:              d,
+		key:            key,
+		sources:        sources,
+		size:           size,
+		expected:       expected,
+		digestFunction: digestFunction,
+		imported:       imported,
+		present:        make([]bool, blocks),
+		missing:        blocks,
+		fetching:       make(map[int64]chan struct{}),
+		verified:       make(chan struct{}),
+	}
+	if partial != nil {
+		// blocks that were read by an earlier process are reused
+		if partial.matches(sources[0].uri, resp, size) {
+			for _, start := range partial.completeSegments(originBlockSize) {
+				if block := start / originBlockSize; block < int64(blocks) && !blob.present[block] {
+					blob.present[block] = true
+					blob.missing--
+				}
+			}
+		} else if err := partial.reset(sources[0].uri, resp, size); err != nil {
+			partial.close()
+			return nil, err
+		}
+		blob.partial = partial
+		blob.file = partial.file
+	} else {
+		tmpFile, err := os.CreateTemp(d.stagingDir, "asset-fuse-stream-")
+		if err != nil {
+			return nil, err
+		}
+		blob.file = tmpFile
+	}
+	if err := blob.file.Truncate(size); err != nil {
+		blob.close()
+		return nil, err
+	}
+	return blob, nil
+}
+
+// ReadAt implements io.ReaderAt. Missing blocks are fetched before the read is served.
+func (r *RangeReader) ReadAt(p []byte, off int64) (int, error) {
+	b := r.blob
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), b.size)
+	firstBlock, lastBlock := off/originBlockSize, (end-1)/originBlockSize
+	for block := firstBlock; block <= lastBlock; block++ {
+		if err := b.ensure(block); err != nil {
+			return 0, err
+		}
+	}
+	if b.needsFetch(lastBlock + 1) {
+		// read ahead, assuming that reads are mostly sequential
+		b.background(func() { b.ensure(lastBlock + 1) })
+	}
+	n, err := b.file.ReadAt(p[:end-off], off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Read implements io.Reader.
+func (r *RangeReader) Read(p []byte) (int, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Close releases the reader. The block cache is removed with the last reader,
+// unless it can be used to resume the download later.
+func (r *RangeReader) Close() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.blob.release()
+	return nil
+}
+
+// ensure makes sure that the block is present in the block cache.
+func (b *rangedBlob) ensure(block int64) error {
+	for {
+		b.mux.Lock()
+		if b.err != nil {
+			b.mux.Unlock()
+			return b.err
+		}
+		if b.missing == 0 {
+			// the read that completed the blob might still be verifying it
+			b.mux.Unlock()
+			select {
+			case <-b.verified:
+			case <-b.ctx.Done():
+				return b.ctx.Err()
+			}
+			b.mux.Lock()
+			defer b.mux.Unlock()
+			return b.err
+		}
+		if b.present[block] {
+			b.mux.Unlock()
+			return nil
+		}
+		if wait, ok := b.fetching[block]; ok {
+			b.mux.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-b.ctx.Done():
+				return b.ctx.Err()
+			}
+		}
+		done := make(chan struct{})
+		b.fetching[block] = done
+		b.mux.Unlock()
+
+		start := block * originBlockSize
+		end := min(start+originBlockSize, b.size) - 1
+		err := b.d.fetchSegment(b.ctx, b.sources, int(block), start, end, b.size, b.file)
+		b.mux.Lock()
+		delete(b.fetching, block)
+		close(done)
+		b.mux.Unlock()
+		if errors.Is(err, errWholeBlob) {
+			// the source ignored the range request and sent the complete blob
+			if b.completeAll() {
+				return b.verifyAndImport()
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b.completeBlock(block) {
+			return b.verifyAndImport()
+		}
+		return nil
+	}
+}
+
+// needsFetch reports whether the block exists and is neither present nor being fetched.
+func (b *rangedBlob) needsFetch(block int64) bool {
+	if block >= int64(len(b.present)) {
+		return false
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	_, fetching := b.fetching[block]
+	return b.err == nil && !b.present[block] && !fetching
+}
+
+// completeAll marks all blocks as present and reports whether any block was missing before.
+func (b *rangedBlob) completeAll() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	wasMissing := b.missing > 0
+	for block := range b.present {
+		b.present[block] = true
+	}
+	b.missing = 0
+	return wasMissing
+}
+
+// completeBlock marks the block as present and reports whether it was the last missing block.
+func (b *rangedBlob) completeBlock(block int64) bool {
+	b.mux.Lock()
+	if !b.present[block] {
+		b.present[block] = true
+		b.missing--
+	}
+	complete := b.missing == 0
+	b.mux.Unlock()
+	if b.partial != nil {
+		if err := b.partial.completeSegment(originBlockSize, block*originBlockSize); err != nil {
+			logging.Warningf("saving progress of partial download: %v", err)
+		}
+	}
+	return complete
+}
+
+// verifyAndImport verifies the checksums of the complete blob and imports it into the local CAS.
+// On a mismatch, all further reads fail.
+// It is called exactly once, by the fetch that completed the blob.
+func (b *rangedBlob) verifyAndImport() error {
+	defer close(b.verified)
+	verifier := newChecksumVerifier(b.sources[0].uri, b.expected, b.digestFunction)
+	_, err := io.Copy(verifier, io.NewSectionReader(b.file, 0, b.size))
+	var knownDigest integrity.Digest
+	if err == nil {
+		knownDigest, err = verifier.verify(b.size)
+	}
+	if err != nil {
+		logging.Errorf("streaming asset from %s: %v", b.sources[0].uri, err)
+		b.mux.Lock()
+		b.err = err
+		b.mux.Unlock()
+		if b.partial != nil {
+			b.partial.discard()
+		}
+		return err
+	}
+	digest, err := b.d.localCAS.ImportBlob(b.ctx, b.expected, knownDigest, b.digestFunction, io.NewSectionReader(b.file, 0, b.size))
+	if err != nil {
+		// the data is valid, so reads can continue
+		logging.Warningf("importing streamed asset into the local CAS: %v", err)
+		return nil
+	}
+	if b.partial != nil {
+		b.partial.discard()
+	}
+	if b.imported != nil {
+		b.imported(digest)
+	}
+	return nil
+}
+
+// fill fetches all missing blocks in the background (for OriginStreamingReadThenVerify).
+func (b *rangedBlob) fill() {
+	for block := range int64(len(b.present)) {
+		if err := b.ensure(block); err != nil {
+			if b.ctx.Err() == nil {
+				logging.Warningf("streaming asset from %s in the background: %v", b.sources[0].uri, err)
+			}
+			return
+		}
+	}
+}
+
+// background runs f in a goroutine that is tracked by wg, unless the last reader was released.
+// wg.Add is called under mux (like the last release), so it cannot race with the wg.Wait in release.
+func (b *rangedBlob) background(f func()) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.refs == 0 {
+		return
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		f()
+	}()
+}
+
+// release drops a reference and closes the blob with the last reader.
+func (b *rangedBlob) release() {
+	b.d.rangedMux.Lock()
+	b.mux.Lock()
+	b.refs--
+	last := b.refs == 0
+	b.mux.Unlock()
+	if last {
+		delete(b.d.ranged, b.key)
+	}
+	b.d.rangedMux.Unlock()
+	if last {
+		b.cancel()
+		b.wg.Wait()
+		b.close()
+	}
+}
+
+func (b *rangedBlob) close() {
+	if b.partial != nil {
+		b.partial.close()
+		return
+	}
+	b.file.Close()
+	os.Remove(b.file.Name())
+}
+
+// originBlockSize is the size of a single range request when streaming from the origin (2 MiB).
+const originBlockSize = 1 << 21
@@ -0,0 +1,107 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+)
+
+func TestOpenRange(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), (2*originBlockSize+100)/16)
+	size := int64(len(content))
+
+	for _, tc := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		sizeHint int64
+		minSize  int64
+		// expectGets is the number of GET requests before the reader is used (-1 to skip the check)
+		expectGets      int64
+		expectStreaming bool
+	}{
+		{name: "server supports ranges", handler: serveRanges(content, nil), sizeHint: -1, minSize: size, expectGets: 1, expectStreaming: true},
+		{name: "known size", handler: serveRanges(content, nil), sizeHint: size, minSize: size, expectGets: 1, expectStreaming: true},
+		{name: "known size below the limit", handler: serveRanges(content, nil), sizeHint: size, minSize: size + 1},
+		{name: "size below the limit", handler: serveRanges(content, nil), sizeHint: -1, minSize: size + 1},
+		{name: "server ignores ranges", handler: serveIgnoringRanges(content), sizeHint: -1, minSize: 1, expectGets: 1},
+		{name: "server rejects HEAD", handler: func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			serveRanges(content, nil)(w, r)
+		}, sizeHint: -1, minSize: size, expectGets: 1, expectStreaming: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var gets atomic.Int64
+			server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					gets.Add(1)
+				}
+				tc.handler(w, r)
+			})
+			d, disk := testDownloader(t, Options{OriginStreaming: OriginStreamingOnDemand})
+			asset := api.Asset{URIs: []string{server.URL + "/file"}, Integrity: testIntegrity(t, content)}
+
+			var imported atomic.Pointer[integrity.Digest]
+			reader, err := d.OpenRange(context.Background(), context.Background(), asset, integrity.SHA256, tc.sizeHint, tc.minSize,
+				func(digest integrity.Digest) { imported.Store(&digest) })
+			if got := gets.Load(); got != tc.expectGets {
+				t.Fatalf("expected %d GET requests to probe the origin, got %d", tc.expectGets, got)
+			}
+			if !tc.expectStreaming {
+				if !errors.Is(err, ErrNotStreamable) {
+					t.Fatalf("expected ErrNotStreamable, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatal("streamed content differs")
+			}
+			if err := reader.Close(); err != nil {
+				t.Fatal(err)
+			}
+			digest := imported.Load()
+			if digest == nil {
+				t.Fatal("expected the blob to be imported after reading every block")
+			}
+			expectBlob(t, disk, *digest, content)
+		})
+	}
+}
+
+func TestRangeReaderCloseDuringReadahead(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 3*originBlockSize)
+	server := newTestServer(t, serveRanges(content, nil))
+	d, _ := testDownloader(t, Options{OriginStreaming: OriginStreamingReadThenVerify})
+	asset := api.Asset{URIs: []string{server.URL + "/file"}, Integrity: testIntegrity(t, content)}
+
+	// the race detector reports readahead that is started while the last reader is closed
+	for range 5 {
+		reader, err := d.OpenRange(context.Background(), context.Background(), asset, integrity.SHA256, -1, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			reader.ReadAt(make([]byte, 16), 0)
+		}()
+		reader.Close()
+		<-done
+	}
+}
@@ -0,0 +1,316 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/service/retry"
+)
+
+// source is a uri of an asset together with the headers to use for requests.
+type source struct {
+	uri     string
+	headers map[string][]string
+}
+
+type segmentOptions struct {
+	connections int
+	size        int64
+}
+
+func newSegmentOptions(connections int, size int64) segmentOptions {
+	if size <= 0 {
+		size = defaultSegmentSize
+	}
+	return segmentOptions{connections: connections, size: size}
+}
+
+// downloadSegments downloads a blob of totalSize bytes using concurrent range requests.
+// The first segment (of firstSize bytes) is read from the body of firstResp, which is the response to the initial request.
+// The other segments are distributed over all sources, which are expected to serve identical content.
+// The checksums are verified over the assembled blob before it is imported into the local CAS.
+// If partial is not nil, segments that were completed by an earlier attempt are skipped.
+func (d *Downloader) downloadSegments(ctx context.Context, sources []source, firstResp *http.Response, firstSize, totalSize int64,
+	partial *partialDownload, expectedContent integrity.Integrity, digestFunction integrity.Algorithm,
+) (integrity.Digest, error) {
+	var file *os.File
+	var done []int64
+	if partial != nil {
+		if firstSize == d.segments.size && partial.matches(sources[0].uri, firstResp, totalSize) {
+			done = partial.completeSegments(d.segments.size)
+		} else if err := partial.reset(sources[0].uri, firstResp, totalSize); err != nil {
+			return integrity.Digest{}, err
+		}
+		file = partial.file
+	} else {
+		tmpFile, err := os.CreateTemp(d.stagingDir, "asset-fuse-download-")
+		if err != nil {
+			return integrity.Digest{}, err
+		}
+		defer os.Remove(tmpFile.Name())
+		defer tmpFile.Close()
+		file = tmpFile
+	}
+	if err := file.Truncate(totalSize); err != nil {
+		return integrity.Digest{}, err
+	}
+	completed := func(start int64) {
+		if partial == nil {
+			return
+		}
+		if err := partial.completeSegment(d.segments.size, start); err != nil {
+			logging.Warningf("saving progress of partial download: %v", err)
+		}
+	}
+
+	type segment struct{ start, end int64 }
+	var segments []segment
+	for start := firstSize; start < totalSize; start += d.segments.size {
+		if !slices.Contains(done, start) {
+			segments = append(segments, segment{start, min(start+d.segments.size, totalSize) - 1})
+		}
+	}
+	if len(done) > 0 {
+		logging.Debugf("resuming download of %s: %d segment(s) already complete", sources[0].uri, len(done))
+	}
+	remaining := len(segments)
+	if !slices.Contains(done, 0) {
+		remaining++
+	}
+	logging.Debugf("downloading %s in %d segments from %d source(s)", sources[0].uri, remaining, len(sources))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var firstErr error
+	var errOnce sync.Once
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	// whole is set if a source ignored a range request and sent the complete blob instead.
+	// The other segments are cancelled, since the blob was downloaded in a single stream.
+	var whole atomic.Bool
+	fetchSegment := func(index int, start, end int64) error {
+		err := d.fetchSegment(ctx, sources, index, start, end, totalSize, file)
+		if errors.Is(err, errWholeBlob) {
+			whole.Store(true)
+			cancel()
+			return nil
+		}
+		if err != nil && whole.Load() {
+			// cancelled after another segment received the complete blob
+			return nil
+		}
+		return err
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, d.segments.connections)
+	// the first segment already occupies a connection
+	slots <- struct{}{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() { <-slots }()
+		if slices.Contains(done, 0) {
+			return
+		}
+		if err := copySegment(file, 0, firstSize, firstResp.Body); err != nil {
+			// the initial connection broke: fetch the segment again
+			if err := fetchSegment(0, 0, firstSize-1); err != nil {
+				fail(err)
+				return
+			}
+		}
+		completed(0)
+	}()
+	for i, seg := range segments {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil || whole.Load() {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := fetchSegment(i+1, seg.start, seg.end); err != nil {
+				fail(err)
+				return
+			}
+			completed(seg.start)
+		}()
+	}
+	wg.Wait()
+	if whole.Load() {
+		logging.Debugf("downloaded %s in a single stream (a source ignored the range request)", sources[0].uri)
+	} else if firstErr != nil {
+		return integrity.Digest{}, firstErr
+	} else if err := ctx.Err(); err != nil {
+		return integrity.Digest{}, err
+	}
+
+	verifier := newChecksumVerifier(sources[0].uri, expectedContent, digestFunction)
+	if _, err := io.Copy(verifier, io.NewSectionReader(file, 0, totalSize)); err != nil {
+		return integrity.Digest{}, err
+	}
+	knownDigest, err := verifier.verify(totalSize)
+	if err != nil {
+		if partial != nil {
+			// some segment is corrupt: start over next time
+			partial.discard()
+		}
+		return integrity.Digest{}, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return integrity.Digest{}, err
+	}
+	digest, err := d.localCAS.ImportBlob(ctx, expectedContent, knownDigest, digestFunction, file)
+	if err == nil && partial != nil {
+		partial.discard()
+	}
+	return digest, err
+}
+
+// fetchSegment downloads the bytes [start, end] into file.
+// Sources are tried in turns, starting at a different source for every segment.
+// If a source answers with the complete blob (of totalSize bytes), it is written to file and errWholeBlob is returned.
+func (d *Downloader) fetchSegment(ctx context.Context, sources []source, index int, start, end, totalSize int64, file *os.File) error {
+	attempts := max(d.retryPolicy.MaxAttempts, len(sources))
+	var err error
+	for attempt := range attempts {
+		src := sources[(index+attempt)%len(sources)]
+		if attempt > 0 && len(sources) > 1 && !d.hostHealth.Allow(src.uri) {
+			continue
+		}
+		err = d.fetchRangeFrom(ctx, src, start, end, totalSize, file)
+		if err == nil || errors.Is(err, errWholeBlob) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logging.Debugf("downloading bytes %d-%d from %s: %v", start, end, src.uri, err)
+		if retry.Retryable(err) {
+			delay := d.retryPolicy.Backoff(attempt + 1)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+	return fmt.Errorf("downloading bytes %d-%d: %w", start, end, err)
+}
+
+// fetchRangeFrom fetches a range from a single source and records the outcome in the health of its host.
+func (d *Downloader) fetchRangeFrom(ctx context.Context, src source, start, end, totalSize int64, file *os.File) error {
+	release := d.hostHealth.Reserve(src.uri)
+	defer release()
+	err := d.fetchRange(ctx, src, start, end, totalSize, file)
+	if err == nil || errors.Is(err, errWholeBlob) {
+		d.hostHealth.Success(src.uri)
+	} else if ctx.Err() == nil {
+		d.hostHealth.Failure(src.uri, err)
+	}
+	return err
+}
+
+func (d *Downloader) fetchRange(ctx context.Context, src source, start, end, totalSize int64, file *os.File) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.uri, http.NoBody)
+	if err != nil {
+		return err
+	}
+	maps.Copy(req.Header, src.headers)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		// the server ignored the range: use the complete body instead
+		if resp.ContentLength >= 0 && resp.ContentLength != totalSize {
+			return fmt.Errorf("server ignored the range request and sent %d bytes instead of %d", resp.ContentLength, totalSize)
+		}
+		if err := copySegment(file, 0, totalSize, resp.Body); err != nil {
+			return err
+		}
+		return errWholeBlob
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return retry.NewHTTPStatusError(resp)
+	}
+	gotStart, gotEnd, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || gotStart != start || gotEnd != end {
+		return fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+	}
+	return copySegment(file, start, end-start+1, resp.Body)
+}
+
+// copySegment writes exactly size bytes from body to file at offset.
+func copySegment(file *os.File, offset, size int64, body io.Reader) error {
+	n, err := io.Copy(io.NewOffsetWriter(file, offset), io.LimitReader(body, size))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// parseContentRange parses a Content-Range header of the form "bytes START-END/TOTAL".
+// A missing or unknown total ("*") is reported as invalid,
+// since segmented downloads need to know the size in advance.
+func parseContentRange(value string) (start, end, total int64, ok bool) {
+	rangeSpec, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	byteRange, totalSpec, found := strings.Cut(rangeSpec, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	startSpec, endSpec, found := strings.Cut(byteRange, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	var err error
+	if start, err = strconv.ParseInt(startSpec, 10, 64); err != nil {
+		return 0, 0, 0, false
+	}
+	if end, err = strconv.ParseInt(endSpec, 10, 64); err != nil {
+		return 0, 0, 0, false
+	}
+	if total, err = strconv.ParseInt(totalSpec, 10, 64); err != nil {
+		return 0, 0, 0, false
+	}
+	if start < 0 || end < start || total <= end {
+		return 0, 0, 0, false
+	}
+	return start, end, total, true
+}
+
+// errWholeBlob signals that a source sent the complete blob instead of the requested range.
+var errWholeBlob = errors.New("source sent the complete blob")
+
+// defaultSegmentSize is the size of a single range request (32 MiB).
+const defaultSegmentSize = 1 << 25
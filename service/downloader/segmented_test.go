@@ -0,0 +1,171 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/service/cas"
+	"github.com/tweag/asset-fuse/service/retry"
+)
+
+func TestSegmentedDownload(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789abcdef", 10) + "tail")
+	corrupt := bytes.ToUpper(content)
+
+	for _, tc := range []struct {
+		name string
+		// mirror serves the other segments
+		mirror      http.HandlerFunc
+		expectError bool
+	}{
+		{name: "ranges from all sources", mirror: serveRanges(content, nil)},
+		{name: "mirror ignores ranges", mirror: serveIgnoringRanges(content)},
+		{name: "mirror serves other content", mirror: serveRanges(corrupt, nil), expectError: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			primary := httptest.NewServer(serveRanges(content, nil))
+			defer primary.Close()
+			mirror := httptest.NewServer(tc.mirror)
+			defer mirror.Close()
+
+			d, disk := testDownloader(t, Options{Connections: 4, SegmentSize: 16})
+			asset := api.Asset{URIs: []string{primary.URL + "/file", mirror.URL + "/file"}, Integrity: testIntegrity(t, content)}
+			resp, err := d.FetchBlob(context.Background(), 0, time.Time{}, asset, integrity.SHA256)
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("expected a checksum mismatch")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectBlob(t, disk, resp.BlobDigest, content)
+		})
+	}
+}
+
+func TestFetchSegmentRetriesOtherSources(t *testing.T) {
+	content := []byte("0123456789abcdef")
+	var failures atomic.Int64
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failures.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	working := httptest.NewServer(serveRanges(content, nil))
+	defer working.Close()
+
+	d, _ := testDownloader(t, Options{})
+	file, err := os.CreateTemp(t.TempDir(), "segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	sources := []source{{uri: failing.URL}, {uri: working.URL}}
+	if err := d.fetchSegment(context.Background(), sources, 0, 4, 7, int64(len(content)), file); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := file.ReadAt(got, 4); err != nil || string(got) != "4567" {
+		t.Fatalf("expected bytes 4-7, got %q (%v)", got, err)
+	}
+	if failures.Load() != 1 {
+		t.Fatalf("expected a single request to the failing source, got %d", failures.Load())
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	for _, tc := range []struct {
+		value             string
+		start, end, total int64
+		ok                bool
+	}{
+		{value: "bytes 0-9/10", start: 0, end: 9, total: 10, ok: true},
+		{value: "bytes 5-5/100", start: 5, end: 5, total: 100, ok: true},
+		{value: "bytes 0-9/*"},
+		{value: "bytes 0-10/10"},
+		{value: "bytes 9-0/10"},
+		{value: "items 0-9/10"},
+		{value: ""},
+	} {
+		start, end, total, ok := parseContentRange(tc.value)
+		if ok != tc.ok || start != tc.start || end != tc.end || total != tc.total {
+			t.Errorf("parseContentRange(%q) = %d, %d, %d, %v", tc.value, start, end, total, ok)
+		}
+	}
+}
+
+// serveRanges serves content with support for range requests.
+// If requests is not nil, it counts the requests.
+func serveRanges(content []byte, requests *atomic.Int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requests != nil {
+			requests.Add(1)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}
+}
+
+// serveIgnoringRanges always answers with the complete content.
+func serveIgnoringRanges(content []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+	}
+}
+
+// testDownloader creates a downloader with a disk cache in a temporary directory.
+func testDownloader(t *testing.T, opts Options) (*Downloader, *cas.Disk) {
+	t.Helper()
+	disk, err := cas.NewDisk(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.RetryPolicy.MaxAttempts == 0 {
+		opts.RetryPolicy = retry.Policy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	}
+	opts.StagingDir = disk.StagingDir(integrity.SHA256)
+	return New(disk, http.DefaultClient, opts), disk
+}
+
+func testIntegrity(t *testing.T, content []byte) integrity.Integrity {
+	t.Helper()
+	contentIntegrity, _, err := integrity.IntegrityFromContent(bytes.NewReader(content), integrity.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contentIntegrity
+}
+
+// expectBlob checks that the disk cache holds content under digest.
+func expectBlob(t *testing.T, disk *cas.Disk, digest integrity.Digest, content []byte) {
+	t.Helper()
+	if digest.SizeBytes != int64(len(content)) {
+		t.Fatalf("expected a blob of %d bytes, got %d", len(content), digest.SizeBytes)
+	}
+	reader, err := disk.ReadStream(context.Background(), digest, integrity.SHA256, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("unexpected blob content %q", got)
+	}
+}
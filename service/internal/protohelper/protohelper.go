@@ -1,7 +1,10 @@
 package protohelper
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"slices"
 	"strings"
 	"sync"
@@ -11,6 +14,8 @@ import (
 	"github.com/tweag/asset-fuse/auth/grpcheaderinterceptor"
 	"github.com/tweag/asset-fuse/integrity"
 	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/internal/transport"
+	"github.com/tweag/asset-fuse/service/retry"
 	"github.com/tweag/asset-fuse/service/status"
 	gstatus "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
@@ -56,7 +61,9 @@ func FromProtoStatus(googleStatus *gstatus.Status) status.Status {
 	}
 }
 
-func Client(uri string, helper credhelper.Helper, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+// Client creates a connection to the server at uri (grpc://, grpcs:// or unix://).
+// If network is non-nil, its proxy and TLS settings are applied.
+func Client(uri string, helper credhelper.Helper, network *transport.Transport, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
 	opts = slices.Clone(opts)
 	schemeAndRest := strings.SplitN(uri, "://", 2)
 	if len(schemeAndRest) != 2 {
@@ -69,12 +76,37 @@ func Client(uri string, helper credhelper.Helper, opts ...grpc.DialOption) (*grp
 		warnUnencryptedGRPC(uri)
 		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	case "grpcs":
-		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(nil)))
+		var tlsConfig *tls.Config
+		if network != nil {
+			host, _, err := net.SplitHostPort(schemeAndRest[1])
+			if err != nil {
+				host = schemeAndRest[1]
+			}
+			tlsConfig = network.TLSConfig(host)
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	case "unix":
+		// local socket (like a proxy on the same machine) that is neither encrypted nor proxied
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		opts = append(opts, grpcheaderinterceptor.DialOptions(helper)...)
+		target := "unix:" + schemeAndRest[1]
+		if strings.HasPrefix(schemeAndRest[1], "/") {
+			target = "unix://" + schemeAndRest[1]
+		}
+		return grpc.NewClient(target, opts...)
 	default:
 		return nil, fmt.Errorf("unsupported scheme for grpc: %s", schemeAndRest[0])
 	}
 
 	target := fmt.Sprintf("dns:%s", schemeAndRest[1])
+	if network != nil {
+		networkTarget, networkOpts, err := network.GRPCDialOptions(schemeAndRest[1])
+		if err != nil {
+			return nil, err
+		}
+		target = networkTarget
+		opts = append(opts, networkOpts...)
+	}
 
 	opts = append(opts, grpcheaderinterceptor.DialOptions(helper)...)
 
@@ -98,3 +130,28 @@ var (
 	WarnedURIs = make(map[string]struct{})
 	warnMutex  sync.Mutex
 )
+
+// GetCapabilities asks the server at conn for its capabilities.
+func GetCapabilities(ctx context.Context, conn grpc.ClientConnInterface, instanceName string, retryPolicy retry.Policy) (*remoteexecution_proto.ServerCapabilities, error) {
+	client := remoteexecution_proto.NewCapabilitiesClient(conn)
+	var resp *remoteexecution_proto.ServerCapabilities
+	err := retryPolicy.Do(ctx, "GetCapabilities", func(ctx context.Context) error {
+		var err error
+		resp, err = client.GetCapabilities(ctx, &remoteexecution_proto.GetCapabilitiesRequest{InstanceName: instanceName})
+		return err
+	})
+	return resp, err
+}
+
+// FromProtoDigestFunctions converts the digest functions that asset-fuse knows and skips all others.
+func FromProtoDigestFunctions(digestFunctions []remoteexecution_proto.DigestFunction_Value) []integrity.Algorithm {
+	var out []integrity.Algorithm
+	for _, digestFunction := range digestFunctions {
+		for _, algorithm := range []integrity.Algorithm{integrity.SHA256, integrity.SHA384, integrity.SHA512, integrity.Blake3} {
+			if ProtoDigestFunction(algorithm) == digestFunction {
+				out = append(out, algorithm)
+			}
+		}
+	}
+	return out
+}
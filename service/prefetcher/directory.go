@@ -0,0 +1,63 @@
+package prefetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
+	casService "github.com/tweag/asset-fuse/service/cas"
+	"github.com/tweag/asset-fuse/service/status"
+)
+
+// FetchDirectory resolves a directory asset (like a git repository or an extracted archive)
+// to a tree in the remote CAS using the remote asset service.
+// The digests of all files in the tree are learned (in memory only, since they are derived from the tree),
+// so they can be read like any other asset with the integrity returned by FileIntegrity.
+func (p *Prefetcher) FetchDirectory(ctx context.Context, asset api.Asset) (casService.Tree, error) {
+	if p.remoteAsset == nil || p.remoteCAS == nil {
+		return casService.Tree{}, errors.New("directory assets require a remote asset service and a remote CAS")
+	}
+	p.publish(EventFetchStarted, "remote", asset, integrity.Digest{}, nil)
+	tree, err := p.fetchDirectory(ctx, asset)
+	if err != nil {
+		p.publish(EventFetchFailed, "remote", asset, integrity.Digest{}, err)
+		return casService.Tree{}, err
+	}
+	p.publish(EventFetchFinished, "remote", asset, tree.Root, nil)
+	return tree, nil
+}
+
+func (p *Prefetcher) fetchDirectory(ctx context.Context, asset api.Asset) (casService.Tree, error) {
+	resp, err := p.remoteAsset.FetchDirectory(ctx, noFetchTimeout, noFetchOldestContentAcceptable, asset, p.digestFunction)
+	if err != nil {
+		return casService.Tree{}, fmt.Errorf("fetching directory %v: %w", asset.URIs, err)
+	}
+	if resp.Status.Code != status.Status_OK {
+		return casService.Tree{}, fmt.Errorf("fetching directory %v: %s (code %d)", asset.URIs, resp.Status.Message, resp.Status.Code)
+	}
+	if resp.DigestFunction != p.digestFunction {
+		return casService.Tree{}, fmt.Errorf("fetching directory %v: got digest function %s, expected %s", asset.URIs, resp.DigestFunction.String(), p.digestFunction.String())
+	}
+	tree, err := p.remoteCAS.GetTree(ctx, resp.RootDirectoryDigest, p.digestFunction)
+	if err != nil {
+		return casService.Tree{}, fmt.Errorf("getting tree %s of directory %v: %w", resp.RootDirectoryDigest.Hex(p.digestFunction), asset.URIs, err)
+	}
+	var files int
+	for _, directory := range tree.Directories {
+		for _, file := range directory.Files {
+			p.checksumCache.PutIntegrityInMemory(FileIntegrity(file.Digest, p.digestFunction), file.Digest)
+			files++
+		}
+	}
+	logging.Debugf("fetched directory %v (%s: %s; %d directories, %d files)", asset.URIs, p.digestFunction.String(), tree.Root.Hex(p.digestFunction), len(tree.Directories), files)
+	return tree, nil
+}
+
+// FileIntegrity returns the integrity of a file in a directory tree.
+// Files of trees are only known by their digest, so the integrity consists of a single checksum.
+func FileIntegrity(digest integrity.Digest, digestFunction integrity.Algorithm) integrity.Integrity {
+	return integrity.IntegrityFromChecksums(integrity.ChecksumFromDigest(digest, digestFunction))
+}
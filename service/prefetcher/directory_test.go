@@ -0,0 +1,90 @@
+package prefetcher
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+	assetService "github.com/tweag/asset-fuse/service/asset"
+	casService "github.com/tweag/asset-fuse/service/cas"
+	"github.com/tweag/asset-fuse/service/status"
+)
+
+func TestFetchDirectory(t *testing.T) {
+	_, file := testAsset(t, "content")
+	root := integrity.NewDigest(make([]byte, 32), 10, integrity.SHA256)
+	tree := casService.Tree{Root: root, Directories: map[string]casService.Directory{
+		root.Hex(integrity.SHA256): {Files: []casService.FileNode{{Name: "file", Digest: file}}},
+	}}
+	directoryAsset := api.Asset{URIs: []string{"https://example.com/repo.git"}}
+
+	for _, tc := range []struct {
+		name        string
+		response    assetService.FetchDirectoryResponse
+		expectError string
+	}{
+		{
+			name:     "found",
+			response: assetService.FetchDirectoryResponse{RootDirectoryDigest: root, DigestFunction: integrity.SHA256},
+		},
+		{
+			name:        "not found",
+			response:    assetService.FetchDirectoryResponse{Status: status.Status{Code: status.Status_NOT_FOUND, Message: "no such repository"}, DigestFunction: integrity.SHA256},
+			expectError: "no such repository",
+		},
+		{
+			name:        "other digest function",
+			response:    assetService.FetchDirectoryResponse{RootDirectoryDigest: root, DigestFunction: integrity.Blake3},
+			expectError: "digest function",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			remoteCAS := &fakeTreeCAS{tree: tree}
+			p := NewPrefetcher(nil, remoteCAS, &fakeDirectoryAsset{response: tc.response}, nil, nil, integrity.NewCache(), integrity.SHA256)
+			_, err := p.FetchDirectory(context.Background(), directoryAsset)
+			if tc.expectError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+					t.Fatalf("expected an error containing %q, got %v", tc.expectError, err)
+				}
+				if remoteCAS.requests != 0 {
+					t.Fatal("the tree of a failed fetch was requested")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			digest, ok := p.CachedDigest(api.Asset{Integrity: FileIntegrity(file, integrity.SHA256)})
+			if !ok || !digest.Equals(file, integrity.SHA256) {
+				t.Fatal("the digest of the file in the tree was not learned")
+			}
+		})
+	}
+}
+
+// fakeTreeCAS returns a fixed tree for GetTree requests.
+type fakeTreeCAS struct {
+	casService.CAS
+	tree     casService.Tree
+	requests int
+}
+
+func (f *fakeTreeCAS) GetTree(ctx context.Context, rootDigest integrity.Digest, digestFunction integrity.Algorithm) (casService.Tree, error) {
+	f.requests++
+	return f.tree, nil
+}
+
+// fakeDirectoryAsset returns a fixed response for FetchDirectory requests.
+type fakeDirectoryAsset struct {
+	assetService.Asset
+	response assetService.FetchDirectoryResponse
+}
+
+func (f *fakeDirectoryAsset) FetchDirectory(ctx context.Context, timeout time.Duration, oldestContentAccepted time.Time,
+	asset api.Asset, digestFunction integrity.Algorithm,
+) (assetService.FetchDirectoryResponse, error) {
+	return f.response, nil
+}
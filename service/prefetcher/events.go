@@ -0,0 +1,99 @@
+package prefetcher
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType describes what happened to a fetch.
+type EventType string
+
+const (
+	EventFetchStarted  EventType = "fetch_started"
+	EventFetchFinished EventType = "fetch_finished"
+	EventFetchFailed   EventType = "fetch_failed"
+)
+
+// Event is emitted by the prefetcher when a fetch starts, finishes or fails.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type EventType `json:"type"`
+	// Destination is "local" (disk cache) or "remote" (remote CAS).
+	Destination string   `json:"destination"`
+	URIs        []string `json:"uris,omitempty"`
+	Integrity   string   `json:"integrity,omitempty"`
+	// Digest is the hex encoded digest of the blob (if known).
+	Digest    string `json:"digest,omitempty"`
+	SizeBytes int64  `json:"size_bytes,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Stats is a snapshot of the state of the prefetcher.
+type Stats struct {
+	RemoteQueue     QueueStats `json:"remote_queue"`
+	LocalQueue      QueueStats `json:"local_queue"`
+	UploadQueue     QueueStats `json:"upload_queue"`
+	FetchesStarted  int64      `json:"fetches_started"`
+	FetchesFinished int64      `json:"fetches_finished"`
+	FetchesFailed   int64      `json:"fetches_failed"`
+}
+
+// QueueStats is a snapshot of the state of a work queue.
+type QueueStats struct {
+	Workers int `json:"workers"`
+	// Queued is the number of requests waiting for a worker.
+	Queued int `json:"queued"`
+	// Active is the number of requests that are currently processed.
+	Active int64 `json:"active"`
+}
+
+// eventBus distributes events to subscribers.
+// Slow subscribers miss events instead of blocking the prefetcher.
+type eventBus struct {
+	mux         sync.Mutex
+	subscribers map[chan Event]struct{}
+
+	started  atomic.Int64
+	finished atomic.Int64
+	failed   atomic.Int64
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[chan Event]struct{})}
+}
+
+func (b *eventBus) publish(event Event) {
+	switch event.Type {
+	case EventFetchStarted:
+		b.started.Add(1)
+	case EventFetchFinished:
+		b.finished.Add(1)
+	case EventFetchFailed:
+		b.failed.Add(1)
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+func (b *eventBus) subscribe(buffer int) (<-chan Event, func()) {
+	subscriber := make(chan Event, buffer)
+	b.mux.Lock()
+	b.subscribers[subscriber] = struct{}{}
+	b.mux.Unlock()
+	var once sync.Once
+	return subscriber, func() {
+		once.Do(func() {
+			b.mux.Lock()
+			delete(b.subscribers, subscriber)
+			b.mux.Unlock()
+			close(subscriber)
+		})
+	}
+}
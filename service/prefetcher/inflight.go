@@ -0,0 +1,65 @@
+package prefetcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// inflight deduplicates concurrent calls for the same key.
+// Callers that arrive while a call for their key is running wait for its result
+// instead of doing the same work again.
+// This is important when multiple mounts (or the background queues and a reader)
+// request the same asset at the same time.
+type inflight[K comparable, V any] struct {
+	mux   sync.Mutex
+	calls map[K]*inflightCall[V]
+}
+
+type inflightCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+func newInflight[K comparable, V any]() *inflight[K, V] {
+	return &inflight[K, V]{calls: make(map[K]*inflightCall[V])}
+}
+
+// do runs fn for the given key, unless a call for the same key is already running.
+// If the running call was cancelled, but ctx of a waiting caller is still alive,
+// the waiting caller retries.
+func (g *inflight[K, V]) do(ctx context.Context, key K, fn func(ctx context.Context) (V, error)) (V, error) {
+	for {
+		g.mux.Lock()
+		call, running := g.calls[key]
+		if !running {
+			call = &inflightCall[V]{done: make(chan struct{})}
+			g.calls[key] = call
+			g.mux.Unlock()
+
+			call.value, call.err = fn(ctx)
+			g.mux.Lock()
+			delete(g.calls, key)
+			g.mux.Unlock()
+			close(call.done)
+			return call.value, call.err
+		}
+		g.mux.Unlock()
+
+		select {
+		case <-ctx.Done():
+			var zero V
+			return zero, ctx.Err()
+		case <-call.done:
+		}
+		if isCancellation(call.err) && ctx.Err() == nil {
+			continue
+		}
+		return call.value, call.err
+	}
+}
+
+func isCancellation(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
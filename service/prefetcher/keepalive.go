@@ -0,0 +1,237 @@
+package prefetcher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
+	casService "github.com/tweag/asset-fuse/service/cas"
+)
+
+// Clients (like Bazel) use digests advertised via xattr for remote execution,
+// possibly hours after reading them. In the meantime, the remote CAS may evict the blobs.
+// The prefetcher keeps track of advertised assets and periodically refreshes their remote presence.
+
+// RemoteRefresh configures how the remote presence of advertised assets is kept alive.
+type RemoteRefresh struct {
+	// Window is the time after the last advertisement of an asset during which it is kept alive.
+	// Zero disables refreshing of advertised assets (pinned assets are still refreshed).
+	Window time.Duration
+	// Interval is the time between refreshes.
+	Interval time.Duration
+	// Pins returns the assets that are kept alive until they are unpinned (may be nil).
+	// It is called on every refresh, so pins made by other processes are picked up.
+	Pins func() ([]casService.RemotePin, error)
+}
+
+// enabled reports whether there is anything to refresh.
+func (r RemoteRefresh) enabled() bool {
+	return r.Interval > 0 && (r.Window > 0 || r.Pins != nil)
+}
+
+// advertisedAsset is an asset whose digest was handed out to a client.
+type advertisedAsset struct {
+	asset          api.Asset
+	lastAdvertised time.Time
+	// expiresAt is reported by the remote asset service for the last fetch (zero if unknown).
+	expiresAt time.Time
+}
+
+// advertisements tracks advertised assets by integrity.
+type advertisements struct {
+	mu     sync.Mutex
+	assets map[string]*advertisedAsset
+}
+
+func newAdvertisements() *advertisements {
+	return &advertisements{assets: make(map[string]*advertisedAsset)}
+}
+
+// advertise records that the digest of the asset was handed out.
+func (a *advertisements) advertise(asset api.Asset, now time.Time) {
+	key := asset.IntegrityKey().ToSRIString()
+	if len(key) == 0 {
+		// without integrity, we cannot tell if two assets are the same
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if entry, ok := a.assets[key]; ok {
+		entry.lastAdvertised = now
+		return
+	}
+	a.assets[key] = &advertisedAsset{asset: asset, lastAdvertised: now}
+}
+
+// touch extends the window of an asset that was advertised before.
+// It returns false if the asset was never advertised (or has been forgotten).
+func (a *advertisements) touch(asset api.Asset, now time.Time) bool {
+	key := asset.IntegrityKey().ToSRIString()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, ok := a.assets[key]
+	if ok {
+		entry.lastAdvertised = now
+	}
+	return ok
+}
+
+// fetched records the expiry of a fetch from the remote asset service.
+func (a *advertisements) fetched(asset api.Asset, expiresAt time.Time) {
+	key := asset.IntegrityKey().ToSRIString()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if entry, ok := a.assets[key]; ok {
+		entry.expiresAt = expiresAt
+	}
+}
+
+// active returns the assets advertised within the window and forgets all others.
+func (a *advertisements) active(now time.Time, window time.Duration) []advertisedAsset {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make([]advertisedAsset, 0, len(a.assets))
+	for key, entry := range a.assets {
+		if now.Sub(entry.lastAdvertised) > window {
+			delete(a.assets, key)
+			continue
+		}
+		out = append(out, *entry)
+	}
+	return out
+}
+
+// Advertise records that the digest of the asset was handed out to a client (like Bazel reading it via xattr).
+// The client may reference the digest for remote execution at any time,
+// so the remote presence of advertised assets is refreshed periodically.
+func (p *Prefetcher) Advertise(asset api.Asset) {
+	p.advertised.advertise(asset, time.Now())
+}
+
+// Touch signals that an asset is still in use.
+// It only has an effect on assets that were advertised before.
+func (p *Prefetcher) Touch(asset api.Asset) {
+	p.advertised.touch(asset, time.Now())
+}
+
+// keepRemoteAlive refreshes the remote presence of advertised assets every interval until ctx is cancelled.
+func (p *Prefetcher) keepRemoteAlive(ctx context.Context, refresh RemoteRefresh) {
+	ticker := time.NewTicker(refresh.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := p.refreshRemote(ctx, refresh); err != nil && ctx.Err() == nil {
+			logging.Warningf("refreshing remote cache: %v", err)
+		}
+	}
+}
+
+// refreshRemote checks that the blobs of recently advertised assets are still in the remote CAS.
+// Checking a blob with FindMissingBlobs extends its lease.
+// Assets whose blobs are missing, or whose fetch expires before the next refresh, are fetched again.
+func (p *Prefetcher) refreshRemote(ctx context.Context, refresh RemoteRefresh) error {
+	now := time.Now()
+	if refresh.Pins != nil {
+		pins, err := refresh.Pins()
+		if err != nil {
+			return fmt.Errorf("reading remote pins: %w", err)
+		}
+		for _, pin := range pins {
+			if _, ok := p.knownDigest(pin.Asset); !ok {
+				p.learnDigest(pin.Asset, pin.Digest)
+			}
+			// pinned assets are advertised on every refresh, so they never leave the window
+			p.advertised.advertise(pin.Asset, now)
+		}
+	}
+	var digests []integrity.Digest
+	byDigest := make(map[string][]advertisedAsset)
+	for _, entry := range p.advertised.active(now, refresh.Window) {
+		digest, ok := p.knownDigest(entry.asset)
+		if !ok {
+			// the digest is still being learned
+			continue
+		}
+		key := digest.Hex(p.digestFunction)
+		if _, ok := byDigest[key]; !ok {
+			digests = append(digests, digest)
+		}
+		byDigest[key] = append(byDigest[key], entry)
+	}
+	if len(digests) == 0 {
+		return nil
+	}
+
+	missing := make(map[string]bool)
+	for start := 0; start < len(digests); start += findMissingBatchSize {
+		missingBlobs, err := p.remoteCAS.FindMissingBlobs(ctx, digests[start:min(start+findMissingBatchSize, len(digests))], p.digestFunction)
+		if err != nil {
+			return err
+		}
+		for _, digest := range missingBlobs {
+			missing[digest.Hex(p.digestFunction)] = true
+		}
+	}
+
+	var stale []api.Asset
+	for key, entries := range byDigest {
+		for i, entry := range entries {
+			// fetching one asset is enough to restore a missing blob,
+			// but every expired asset needs to be fetched again
+			expired := !entry.expiresAt.IsZero() && entry.expiresAt.Before(now.Add(refresh.Interval))
+			if (missing[key] && i == 0) || expired {
+				stale = append(stale, entry.asset)
+			}
+		}
+	}
+	logging.Debugf("refreshed %d advertised blobs in remote CAS (%d missing, fetching %d assets again)", len(digests), len(missing), len(stale))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, refreshConcurrency)
+	for _, asset := range stale {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if _, err := p.deduplicate(ctx, p.refreshInflight, "remote", asset, p.refetchRemote); err != nil && ctx.Err() == nil {
+				logging.Warningf("fetching %v again: %v", asset.URIs, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// refetchRemote makes the asset available in the remote CAS again, even if it is still present.
+// Cached fetches are not accepted, since they would not restore a blob that was evicted from the remote CAS.
+func (p *Prefetcher) refetchRemote(ctx context.Context, asset api.Asset) (integrity.Digest, error) {
+	if len(asset.Compression) > 0 || p.remoteAsset == nil {
+		// the remote asset service can't provide the content, so it is uploaded from the local cache
+		return p.UploadViaLocal(ctx, asset)
+	}
+	fetchBlobResponse, err := p.remoteAsset.FetchBlob(ctx, noFetchTimeout, time.Now(), asset, p.digestFunction)
+	if err != nil {
+		return integrity.Digest{}, err
+	}
+	if knownDigest, ok := p.knownDigest(asset); ok && !knownDigest.Equals(fetchBlobResponse.BlobDigest, p.digestFunction) {
+		return integrity.Digest{}, fmt.Errorf("expected digest %s, got %s", knownDigest.Hex(p.digestFunction), fetchBlobResponse.BlobDigest.Hex(p.digestFunction))
+	}
+	p.advertised.fetched(asset, fetchBlobResponse.ExpiresAt)
+	return fetchBlobResponse.BlobDigest, nil
+}
+
+const (
+	// findMissingBatchSize is the number of digests checked per FindMissingBlobs request.
+	findMissingBatchSize = 10000
+	// refreshConcurrency is the number of assets fetched again concurrently.
+	refreshConcurrency = 4
+)
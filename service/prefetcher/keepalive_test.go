@@ -0,0 +1,201 @@
+package prefetcher
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+	assetService "github.com/tweag/asset-fuse/service/asset"
+	casService "github.com/tweag/asset-fuse/service/cas"
+)
+
+func TestRefreshRemote(t *testing.T) {
+	asset, digest := testAsset(t, "content")
+	refresh := RemoteRefresh{Window: time.Hour, Interval: time.Minute}
+
+	for _, tc := range []struct {
+		name           string
+		lastAdvertised time.Duration
+		pinned         bool
+		missing        bool
+		expiresIn      time.Duration
+		expectChecks   int
+		expectFetches  int
+	}{
+		{name: "present blob", expiresIn: time.Hour, expectChecks: 1},
+		{name: "missing blob", missing: true, expiresIn: time.Hour, expectChecks: 1, expectFetches: 1},
+		{name: "fetch expires before the next refresh", expiresIn: time.Second, expectChecks: 1, expectFetches: 1},
+		{name: "advertised outside the window", lastAdvertised: 2 * time.Hour, missing: true},
+		{name: "pinned asset", lastAdvertised: -1, pinned: true, missing: true, expectChecks: 1, expectFetches: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			remoteCAS := &fakeRemoteCAS{missing: tc.missing}
+			remoteAsset := &fakeRemoteAsset{digest: digest, expiresAt: time.Now().Add(2 * time.Hour).Truncate(time.Second)}
+			p := NewPrefetcher(nil, remoteCAS, remoteAsset, nil, nil, integrity.NewCache(), integrity.SHA256)
+			p.learnDigest(asset, digest)
+			if tc.lastAdvertised >= 0 {
+				p.advertised.advertise(asset, time.Now().Add(-tc.lastAdvertised))
+				p.advertised.fetched(asset, time.Now().Add(tc.expiresIn))
+			}
+			refresh := refresh
+			if tc.pinned {
+				refresh.Pins = func() ([]casService.RemotePin, error) {
+					return []casService.RemotePin{{Asset: asset, Digest: digest}}, nil
+				}
+			}
+
+			before := time.Now()
+			if err := p.refreshRemote(context.Background(), refresh); err != nil {
+				t.Fatal(err)
+			}
+			if remoteCAS.checks != tc.expectChecks {
+				t.Fatalf("expected %d FindMissingBlobs requests, got %d", tc.expectChecks, remoteCAS.checks)
+			}
+			if len(remoteAsset.recordedFetches()) != tc.expectFetches {
+				t.Fatalf("expected %d fetches, got %d", tc.expectFetches, len(remoteAsset.recordedFetches()))
+			}
+			for _, oldestContentAccepted := range remoteAsset.recordedFetches() {
+				// a cached fetch would not restore an evicted blob
+				if oldestContentAccepted.Before(before) {
+					t.Fatalf("refetch accepted content from %v, before the refresh started", oldestContentAccepted)
+				}
+			}
+			if tc.expectFetches > 0 {
+				if got := advertisedExpiry(p, asset); !got.Equal(remoteAsset.expiresAt) {
+					t.Fatalf("expected the refetch to record expiry %v, got %v", remoteAsset.expiresAt, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRefreshRemoteDuringPrefetch(t *testing.T) {
+	asset, digest := testAsset(t, "content")
+	remoteCAS := &fakeRemoteCAS{missing: true}
+	remoteAsset := &fakeRemoteAsset{
+		digest:        digest,
+		expiresAt:     time.Now().Add(2 * time.Hour).Truncate(time.Second),
+		blockCached:   make(chan struct{}),
+		cachedStarted: make(chan struct{}),
+	}
+	p := NewPrefetcher(nil, remoteCAS, remoteAsset, nil, nil, integrity.NewCache(), integrity.SHA256)
+	p.learnDigest(asset, digest)
+	p.advertised.advertise(asset, time.Now())
+
+	// a regular prefetch of the same asset is running and accepts cached fetches
+	prefetchDone := make(chan error, 1)
+	go func() {
+		_, err := p.PrefetchRemote(context.Background(), asset)
+		prefetchDone <- err
+	}()
+	<-remoteAsset.cachedStarted
+	defer func() {
+		close(remoteAsset.blockCached)
+		if err := <-prefetchDone; err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	refreshDone := make(chan error, 1)
+	before := time.Now()
+	go func() {
+		refreshDone <- p.refreshRemote(context.Background(), RemoteRefresh{Window: time.Hour, Interval: time.Minute})
+	}()
+	select {
+	case err := <-refreshDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the refresh joined the running prefetch instead of fetching again")
+	}
+	fresh := false
+	for _, oldestContentAccepted := range remoteAsset.recordedFetches() {
+		fresh = fresh || !oldestContentAccepted.Before(before)
+	}
+	if !fresh {
+		t.Fatal("the refresh didn't fetch the asset without accepting cached content")
+	}
+	if got := advertisedExpiry(p, asset); !got.Equal(remoteAsset.expiresAt) {
+		t.Fatalf("expected the refetch to record expiry %v, got %v", remoteAsset.expiresAt, got)
+	}
+}
+
+// advertisedExpiry returns the expiry of the last fetch of an advertised asset.
+func advertisedExpiry(p *Prefetcher, asset api.Asset) time.Time {
+	p.advertised.mu.Lock()
+	defer p.advertised.mu.Unlock()
+	entry, ok := p.advertised.assets[asset.IntegrityKey().ToSRIString()]
+	if !ok {
+		return time.Time{}
+	}
+	return entry.expiresAt
+}
+
+func testAsset(t *testing.T, content string) (api.Asset, integrity.Digest) {
+	t.Helper()
+	contentIntegrity, size, err := integrity.IntegrityFromContent(strings.NewReader(content), integrity.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, _ := contentIntegrity.ChecksumForAlgorithm(integrity.SHA256)
+	asset := api.Asset{URIs: []string{"https://example.com/" + content}, Integrity: contentIntegrity}
+	return asset, integrity.NewDigest(checksum.Hash, size, integrity.SHA256)
+}
+
+// fakeRemoteCAS answers FindMissingBlobs requests.
+type fakeRemoteCAS struct {
+	casService.CAS
+	missing bool
+
+	mux    sync.Mutex
+	checks int
+}
+
+func (f *fakeRemoteCAS) FindMissingBlobs(ctx context.Context, blobDigests []integrity.Digest, digestFunction integrity.Algorithm) ([]integrity.Digest, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.checks++
+	if f.missing {
+		return blobDigests, nil
+	}
+	return nil, nil
+}
+
+// fakeRemoteAsset records the oldestContentAccepted of every FetchBlob request.
+// If blockCached is set, requests that accept cached content signal cachedStarted
+// and wait until blockCached is closed.
+type fakeRemoteAsset struct {
+	assetService.Asset
+	digest        integrity.Digest
+	expiresAt     time.Time
+	blockCached   chan struct{}
+	cachedStarted chan struct{}
+
+	mux     sync.Mutex
+	fetches []time.Time
+}
+
+func (f *fakeRemoteAsset) FetchBlob(ctx context.Context, timeout time.Duration, oldestContentAccepted time.Time,
+	asset api.Asset, digestFunction integrity.Algorithm,
+) (assetService.FetchBlobResponse, error) {
+	f.mux.Lock()
+	f.fetches = append(f.fetches, oldestContentAccepted)
+	f.mux.Unlock()
+	if f.blockCached != nil && oldestContentAccepted.Equal(noFetchOldestContentAcceptable) {
+		close(f.cachedStarted)
+		<-f.blockCached
+	}
+	return assetService.FetchBlobResponse{BlobDigest: f.digest, ExpiresAt: f.expiresAt}, nil
+}
+
+func (f *fakeRemoteAsset) recordedFetches() []time.Time {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return slices.Clone(f.fetches)
+}
@@ -15,6 +15,7 @@ import (
 	assetService "github.com/tweag/asset-fuse/service/asset"
 	casService "github.com/tweag/asset-fuse/service/cas"
 	"github.com/tweag/asset-fuse/service/downloader"
+	"github.com/tweag/asset-fuse/service/uploader"
 )
 
 // Prefetcher implements a simple prefetching mechanism.
@@ -34,35 +35,89 @@ type Prefetcher struct {
 	localCAS    casService.LocalCAS
 	remoteAsset assetService.Asset
 	downloader  *downloader.Downloader
+	// uploader is nil without remote CAS.
+	uploader *uploader.Uploader
 
 	remoteDownloadQueue *workQueue[api.Asset, integrity.Digest]
 	localDownloadQueue  *workQueue[api.Asset, integrity.Digest]
+	uploadQueue         *workQueue[api.Asset, integrity.Digest]
 
 	checksumCache  *integrity.ChecksumCache
 	digestFunction integritypkg.Algorithm
+
+	// remoteInflight, localInflight and uploadInflight deduplicate concurrent requests for the same asset.
+	remoteInflight *inflight[string, integrity.Digest]
+	localInflight  *inflight[string, integrity.Digest]
+	uploadInflight *inflight[string, integrity.Digest]
+	// refreshInflight deduplicates refetches of stale assets.
+	// They must not join a running prefetch, which may accept cached fetches.
+	refreshInflight *inflight[string, integrity.Digest]
+
+	events *eventBus
+
+	// advertised tracks assets whose digests were handed out to clients, so their remote presence can be refreshed.
+	advertised *advertisements
+
+	// streamCtx is used for streams that outlive the request that opened them.
+	// It is cancelled when the prefetcher is stopped.
+	streamCtx    context.Context
+	cancelStream context.CancelFunc
 }
 
 // NewPrefetcher creates a new Prefetcher.
-func NewPrefetcher(localCAS casService.LocalCAS, remoteCAS casService.CAS, remoteAsset assetService.Asset, downloader *downloader.Downloader, checksumCache *integritypkg.ChecksumCache, digestFunction integritypkg.Algorithm) *Prefetcher {
+// The uploader may be nil if there is no remote CAS.
+func NewPrefetcher(localCAS casService.LocalCAS, remoteCAS casService.CAS, remoteAsset assetService.Asset, downloader *downloader.Downloader, uploader *uploader.Uploader, checksumCache *integritypkg.ChecksumCache, digestFunction integritypkg.Algorithm) *Prefetcher {
 	p := &Prefetcher{
-		localCAS:       localCAS,
-		remoteCAS:      remoteCAS,
-		remoteAsset:    remoteAsset,
-		downloader:     downloader,
-		checksumCache:  checksumCache,
-		digestFunction: digestFunction,
+		localCAS:        localCAS,
+		remoteCAS:       remoteCAS,
+		remoteAsset:     remoteAsset,
+		downloader:      downloader,
+		uploader:        uploader,
+		checksumCache:   checksumCache,
+		digestFunction:  digestFunction,
+		remoteInflight:  newInflight[string, integrity.Digest](),
+		localInflight:   newInflight[string, integrity.Digest](),
+		uploadInflight:  newInflight[string, integrity.Digest](),
+		refreshInflight: newInflight[string, integrity.Digest](),
+		events:          newEventBus(),
+		advertised:      newAdvertisements(),
 	}
 	p.remoteDownloadQueue = newWorkQueue(p.PrefetchRemote, 12)
 	p.localDownloadQueue = newWorkQueue(p.MaterializeLocal, 4)
+	p.uploadQueue = newWorkQueue(p.UploadViaLocal, 4)
+	p.streamCtx, p.cancelStream = context.WithCancel(context.Background())
 	return p
 }
 
-func (p *Prefetcher) Start(ctx context.Context) (stopFunc func() error, err error) {
+// Start starts the background workers.
+// The returned stop function stops accepting new work and waits for queued and in-flight work
+// for up to shutdownGracePeriod. After that, in-flight work is cancelled.
+// If there is a remote CAS, the remote presence of advertised assets is refreshed as configured.
+func (p *Prefetcher) Start(ctx context.Context, shutdownGracePeriod time.Duration, refresh RemoteRefresh) (stopFunc func() error, err error) {
+	p.streamCtx, p.cancelStream = context.WithCancel(context.WithoutCancel(ctx))
 	p.remoteDownloadQueue.Start(ctx)
 	p.localDownloadQueue.Start(ctx)
+	p.uploadQueue.Start(ctx)
+	refreshCtx, stopRefresh := context.WithCancel(ctx)
+	refreshDone := make(chan struct{})
+	go func() {
+		defer close(refreshDone)
+		if p.remoteCAS != nil && refresh.enabled() {
+			p.keepRemoteAlive(refreshCtx, refresh)
+		}
+	}()
 	return func() error {
-		p.remoteDownloadQueue.Stop()
-		p.localDownloadQueue.Stop()
+		defer p.cancelStream()
+		stopRefresh()
+		<-refreshDone
+		// all queues share the same deadline
+		deadline := time.Now().Add(shutdownGracePeriod)
+		remoteDrained := p.remoteDownloadQueue.Stop(shutdownGracePeriod)
+		localDrained := p.localDownloadQueue.Stop(max(0, time.Until(deadline)))
+		uploadDrained := p.uploadQueue.Stop(max(0, time.Until(deadline)))
+		if !remoteDrained || !localDrained || !uploadDrained {
+			return fmt.Errorf("shutdown grace period of %v exceeded - cancelled in-flight downloads", shutdownGracePeriod)
+		}
 		return nil
 	}, nil
 }
@@ -75,10 +130,20 @@ func (p *Prefetcher) EnqueueLocalDownload(asset api.Asset, callbacks ...func(api
 	p.localDownloadQueue.Enqueue(asset, callbacks...)
 }
 
+// EnqueueRemoteUpload downloads the asset locally and uploads it to the remote CAS (see UploadViaLocal).
+func (p *Prefetcher) EnqueueRemoteUpload(asset api.Asset, callbacks ...func(api.Asset, integrity.Digest, error)) {
+	p.uploadQueue.Enqueue(asset, callbacks...)
+}
+
 func (p *Prefetcher) AssetDigest(ctx context.Context, asset api.Asset) (integritypkg.Digest, error) {
 	return p.getOrLearnDigest(ctx, asset)
 }
 
+// CachedDigest returns the digest of an asset if it is known without fetching the asset.
+func (p *Prefetcher) CachedDigest(asset api.Asset) (integritypkg.Digest, bool) {
+	return p.knownDigest(asset)
+}
+
 // RandomAccessStream creates a reader for an asset.
 // It is used to implement reading from a leaf file handle.
 // Prefetcher can choose to stream the asset from any source.
@@ -87,17 +152,25 @@ func (p *Prefetcher) AssetDigest(ctx context.Context, asset api.Asset) (integrit
 // - Download small files eagerly.
 // - TODO: Stream large files from the remote CAS, but also download them to the local cache (in the background).
 // - TODO: For very large files, we could stream them from the remote CAS and store in-demand chunks in the local cache.
+// Without a remote CAS, large files are streamed from their origin with range requests (if the server supports it).
 func (p *Prefetcher) RandomAccessStream(ctx context.Context, asset api.Asset, offset, limit int64) (readerAtCloser, error) {
+	if p.remoteCAS == nil {
+		if reader, ok := p.originStream(ctx, asset); ok {
+			return reader, nil
+		}
+	}
+
 	digest, err := p.getOrLearnDigest(ctx, asset)
 	if err != nil {
 		return nil, fmt.Errorf("obtaining digest to stream asset: %w", err)
 	}
 
 	// check if materializing is efficient or necessary
-	if digest.SizeBytes < byteStreamThreshold || p.remoteCAS == nil {
+	if digest.SizeBytes < casService.ByteStreamThreshold || p.remoteCAS == nil || len(asset.Compression) > 0 {
 		// One of the following conditions is true:
 		// - The file is small enough to download in a single request
 		// - We don't have a remote CAS to stream from
+		// - The asset needs to be decompressed locally
 		if _, err := p.MaterializeLocal(ctx, asset); err != nil {
 			return nil, err
 		}
@@ -119,25 +192,72 @@ func (p *Prefetcher) RandomAccessStream(ctx context.Context, asset api.Asset, of
 	if _, err = p.PrefetchRemote(ctx, asset); err != nil {
 		return nil, err
 	}
+	if p.remoteAsset == nil {
+		// without remote asset service, PrefetchRemote may have downloaded the data locally
+		if missingLocal, err := p.localCAS.FindMissingBlobs(ctx, []integritypkg.Digest{digest}, p.digestFunction); err == nil && len(missingLocal) == 0 {
+			return p.localCAS.ReadRandomAccessStream(ctx, digest, p.digestFunction, offset, min(limit, digest.SizeBytes))
+		}
+	}
 	logging.Debugf("streaming asset from remote CAS (%s: %s; %d bytes)", p.digestFunction.String(), digest.Hex(p.digestFunction), digest.SizeBytes)
-	return handle.NewStreamingFileHandle(p.remoteCAS, digest, p.digestFunction, offset), nil
+	return handle.NewStreamingFileHandle(p.streamCtx, p.remoteCAS, digest, p.digestFunction, offset), nil
+}
+
+// originStream opens a reader that serves reads with range requests against the URIs of the asset.
+// It returns false if the asset is small, already in the local cache, or the origin doesn't support range requests.
+// In this case, the asset should be materialized instead.
+func (p *Prefetcher) originStream(ctx context.Context, asset api.Asset) (readerAtCloser, bool) {
+	if p.localCAS == nil || p.downloader == nil {
+		return nil, false
+	}
+	sizeHint := int64(-1)
+	if digest, ok := p.knownDigest(asset); ok {
+		sizeHint = digest.SizeBytes
+		if digest.SizeBytes < downloadLimit {
+			return nil, false
+		}
+		missingLocal, err := p.localCAS.FindMissingBlobs(ctx, []integritypkg.Digest{digest}, p.digestFunction)
+		if err != nil || len(missingLocal) == 0 {
+			return nil, false
+		}
+	} else if _, ok, err := p.localCAS.FindAssetWithAlgorithm(ctx, asset, p.digestFunction); err != nil || ok {
+		return nil, false
+	}
+
+	reader, err := p.downloader.OpenRange(ctx, p.streamCtx, asset, p.digestFunction, sizeHint, downloadLimit, func(digest integritypkg.Digest) {
+		if _, ok := p.knownDigest(asset); ok {
+			return
+		}
+		p.learnDigest(asset, digest)
+	})
+	if err != nil {
+		logging.Debugf("not streaming asset %v from its origin - materializing instead: %v", asset.URIs, err)
+		return nil, false
+	}
+	return reader, true
 }
 
 // PrefetchRemote ensures that the asset referenced by the given URIs and integrity is available in the remote CAS.
 // Our only goal is to make the data available remotely, so we efficiently access it for remote execution.
 // This means that calling PrefetchRemote doesn't guarantee that the data is available locally.
+// Concurrent requests for the same asset are deduplicated.
 // TODO: decide how users can get notified when the prefetching is done.
-// TODO: deduplicate requests.
 // TODO: cache the result of the prefetching with a configurable TTL.
 func (p *Prefetcher) PrefetchRemote(ctx context.Context, asset api.Asset) (integrity.Digest, error) {
+	return p.deduplicate(ctx, p.remoteInflight, "remote", asset, p.prefetchRemote)
+}
+
+func (p *Prefetcher) prefetchRemote(ctx context.Context, asset api.Asset) (integrity.Digest, error) {
 	// TODO: make this non-blocking with a method to get notified when the prefetching is done.
 	// TODO: for now, this is blocking - bad.
 
-	if p.remoteAsset == nil {
+	if len(asset.Compression) > 0 {
+		return p.prefetchRemoteDecompressed(ctx, asset)
+	}
+	if p.remoteAsset == nil && p.uploader == nil {
 		return integritypkg.Digest{}, errors.New("Prefetch called without remote asset service")
 	}
 
-	knownDigest, digestIsKnown := p.checksumCache.FromIntegrityWithAlgorithm(asset.Integrity, p.digestFunction)
+	knownDigest, digestIsKnown := p.knownDigest(asset)
 
 	if p.remoteCAS != nil && digestIsKnown {
 		// check if the remote cache has the data already (without fetching)
@@ -152,6 +272,12 @@ func (p *Prefetcher) PrefetchRemote(ctx context.Context, asset api.Asset) (integ
 		// otherwise, we know the expected digest, but the remote cache doesn't have the data... continue with fetching.
 	}
 
+	if p.remoteAsset == nil {
+		// Without remote asset service (like with an HTTP cache), nobody can fetch the asset for us.
+		// Instead, we download it locally and upload it to the remote CAS.
+		return p.uploadViaLocal(ctx, asset)
+	}
+
 	fetchBlobResponse, err := p.remoteAsset.FetchBlob(ctx, noFetchTimeout, noFetchOldestContentAcceptable, asset, p.digestFunction)
 	if err != nil {
 		return integritypkg.Digest{}, err
@@ -162,28 +288,115 @@ func (p *Prefetcher) PrefetchRemote(ctx context.Context, asset api.Asset) (integ
 			return integritypkg.Digest{}, fmt.Errorf("expected digest %s, got %s", knownDigest.Hex(p.digestFunction), fetchBlobResponse.BlobDigest.Hex(p.digestFunction))
 		}
 	} else {
-		// we learned a new association between the asset and the digest
-		var integrityStrings []string
-		for integrityString := range asset.Integrity.Items() {
-			integrityStrings = append(integrityStrings, integrityString.ToSRI())
-		}
-		logging.Basicf("Learned new association: %v -> %s (content size: %d bytes)", integrityStrings, fetchBlobResponse.BlobDigest.Hex(p.digestFunction), fetchBlobResponse.BlobDigest.SizeBytes)
-		p.checksumCache.PutIntegrity(asset.Integrity, fetchBlobResponse.BlobDigest)
+		p.learnDigest(asset, fetchBlobResponse.BlobDigest)
 	}
+	p.advertised.fetched(asset, fetchBlobResponse.ExpiresAt)
 	return fetchBlobResponse.BlobDigest, nil
 }
 
+// prefetchRemoteDecompressed ensures that the decompressed content of a compressed asset is available in the remote CAS.
+// The remote asset API would only fetch the compressed content,
+// so the asset is materialized (and decompressed) locally and uploaded to the remote CAS.
+func (p *Prefetcher) prefetchRemoteDecompressed(ctx context.Context, asset api.Asset) (integrity.Digest, error) {
+	if p.remoteCAS == nil {
+		return integritypkg.Digest{}, errors.New("Prefetch of compressed asset called without remote CAS")
+	}
+	if knownDigest, ok := p.knownDigest(asset); ok {
+		missingBlobs, err := p.remoteCAS.FindMissingBlobs(ctx, []integritypkg.Digest{knownDigest}, p.digestFunction)
+		if err != nil {
+			return integritypkg.Digest{}, err
+		}
+		if len(missingBlobs) == 0 {
+			// the data is already in the remote cache
+			return knownDigest, nil
+		}
+	}
+	if p.uploader == nil {
+		return integritypkg.Digest{}, errors.New("Prefetch of compressed asset called without uploader")
+	}
+	digest, err := p.MaterializeLocal(ctx, asset)
+	if err != nil {
+		return integritypkg.Digest{}, err
+	}
+	return digest, p.uploader.Upload(ctx, digest)
+}
+
+// UploadViaLocal ensures that the asset is available in the remote CAS without using the remote asset service for fetching.
+// The asset is downloaded to the local cache directly (unless it is already there) and uploaded to the remote CAS.
+// This is useful if the remote downloader cannot reach the origin of the asset (like an internal mirror).
+// Afterwards, the asset is pushed to the remote asset service (if any),
+// so FetchBlob requests of other clients for the same URIs hit.
+// Concurrent requests for the same asset are deduplicated.
+func (p *Prefetcher) UploadViaLocal(ctx context.Context, asset api.Asset) (integrity.Digest, error) {
+	return p.deduplicate(ctx, p.uploadInflight, "remote", asset, p.uploadViaLocal)
+}
+
+func (p *Prefetcher) uploadViaLocal(ctx context.Context, asset api.Asset) (integrity.Digest, error) {
+	if p.localCAS == nil || p.uploader == nil {
+		return integrity.Digest{}, errors.New("Upload called without disk cache or remote CAS")
+	}
+	digest, err := p.downloadLocal(ctx, asset)
+	if err != nil {
+		return integrity.Digest{}, err
+	}
+	if err := p.uploader.Upload(ctx, digest); err != nil {
+		return digest, err
+	}
+	if len(asset.Compression) > 0 {
+		// the URIs refer to the compressed content, so the decompressed content can't be pushed
+		return digest, nil
+	}
+	if err := p.uploader.Push(ctx, asset, digest); err != nil {
+		// the content is available in the remote CAS, so this is not fatal
+		logging.Warningf("%v", err)
+	}
+	return digest, nil
+}
+
+// downloadLocal ensures that the asset is in the local cache, downloading it from its origin if needed.
+// Unlike MaterializeLocal, it never uses the remote cache or the remote asset service.
+func (p *Prefetcher) downloadLocal(ctx context.Context, asset api.Asset) (integrity.Digest, error) {
+	if digest, ok := p.knownDigest(asset); ok {
+		missingBlobs, err := p.localCAS.FindMissingBlobs(ctx, []integritypkg.Digest{digest}, p.digestFunction)
+		if err != nil {
+			return integrity.Digest{}, err
+		}
+		if len(missingBlobs) == 0 {
+			return digest, nil
+		}
+	} else if diskDigest, ok, err := p.localCAS.FindAssetWithAlgorithm(ctx, asset, p.digestFunction); err != nil {
+		return integrity.Digest{}, err
+	} else if ok {
+		p.learnDigest(asset, diskDigest)
+		return diskDigest, nil
+	}
+	resp, err := p.downloader.FetchBlob(ctx, noFetchTimeout, noFetchOldestContentAcceptable, asset, p.digestFunction)
+	if err != nil {
+		return integrity.Digest{}, err
+	}
+	if _, ok := p.knownDigest(asset); !ok {
+		p.learnDigest(asset, resp.BlobDigest)
+	}
+	p.learnCompressedDigest(asset, resp)
+	return resp.BlobDigest, nil
+}
+
 // MaterializeLocal ensures that the asset referenced by the given URIs and integrity is available in the local cache for reading.
 // Our only goal is to make the data available locally, so we can stop as soon as localCAS has the expected data.
 // This means that calling MaterializeLocal doesn't guarantee that the data is available remotely.
+// Concurrent requests for the same asset are deduplicated.
 func (p *Prefetcher) MaterializeLocal(ctx context.Context, asset api.Asset) (integrity.Digest, error) {
+	return p.deduplicate(ctx, p.localInflight, "local", asset, p.materializeLocal)
+}
+
+func (p *Prefetcher) materializeLocal(ctx context.Context, asset api.Asset) (integrity.Digest, error) {
 	// TODO: make this non-blocking with a method to get notified when the prefetching is done.
 	// TODO: for now, this is blocking - bad.
 	if p.localCAS == nil {
 		return integrity.Digest{}, errors.New("Materialize called without disk cache")
 	}
 
-	if digest, ok := p.checksumCache.FromIntegrityWithAlgorithm(asset.Integrity, p.digestFunction); ok {
+	if digest, ok := p.knownDigest(asset); ok {
 		// we know the hash and size of the expected data
 		// we can construct the digest in advance
 		return digest, p.materializeWithDigest(ctx, asset, digest)
@@ -194,22 +407,20 @@ func (p *Prefetcher) MaterializeLocal(ctx context.Context, asset api.Asset) (int
 	if diskDigest, ok, err := p.localCAS.FindAssetWithAlgorithm(ctx, asset, p.digestFunction); err != nil {
 		return integrity.Digest{}, err
 	} else if ok {
-		// we learned a new association between the asset and the digest
-		var integrityStrings []string
-		for integrityString := range asset.Integrity.Items() {
-			integrityStrings = append(integrityStrings, integrityString.ToSRI())
-		}
-		logging.Basicf("Learned new association: %v -> %s (content size: %d bytes)", integrityStrings, diskDigest.Hex(p.digestFunction), diskDigest.SizeBytes)
-		p.checksumCache.PutIntegrity(asset.Integrity, diskDigest)
+		p.learnDigest(asset, diskDigest)
 		return diskDigest, nil
 	}
 
 	// disk cache doesn't have the data
 	// we need to fetch the data to learn the hash and size
-	if digest, err := p.PrefetchRemote(ctx, asset); err != nil {
-		logging.Debugf("materializing asset %v failed when trying to prefetch remotely - falling back to direct download: %v", asset, err)
-	} else {
-		return digest, p.materializeWithDigest(ctx, asset, digest)
+	// (compressed assets are always decompressed locally, so we download them directly)
+	// Without remote asset service, prefetching remotely would download the asset locally anyway.
+	if len(asset.Compression) == 0 && p.remoteAsset != nil {
+		if digest, err := p.PrefetchRemote(ctx, asset); err != nil {
+			logging.Debugf("materializing asset %v failed when trying to prefetch remotely - falling back to direct download: %v", asset, err)
+		} else {
+			return digest, p.materializeWithDigest(ctx, asset, digest)
+		}
 	}
 
 	// we failed to prefetch the data remotely
@@ -219,16 +430,69 @@ func (p *Prefetcher) MaterializeLocal(ctx context.Context, asset api.Asset) (int
 		logging.Warningf("materializing asset failed when trying to download directly: %v", err)
 		return integrity.Digest{}, err
 	}
-	// we learned a new association between the asset and the digest
-	var integrityStrings []string
-	for integrityString := range asset.Integrity.Items() {
-		integrityStrings = append(integrityStrings, integrityString.ToSRI())
-	}
-	logging.Basicf("Learned new association: %v -> %s (content size: %d bytes)", integrityStrings, resp.BlobDigest.Hex(p.digestFunction), resp.BlobDigest.SizeBytes)
-	p.checksumCache.PutIntegrity(asset.Integrity, resp.BlobDigest)
+	p.learnDigest(asset, resp.BlobDigest)
+	p.learnCompressedDigest(asset, resp)
 	return resp.BlobDigest, nil
 }
 
+// deduplicate runs fn at most once at a time for assets with the same integrity.
+// It publishes events for every fetch that is actually started.
+func (p *Prefetcher) deduplicate(ctx context.Context, group *inflight[string, integrity.Digest], destination string, asset api.Asset, fn func(context.Context, api.Asset) (integrity.Digest, error)) (integrity.Digest, error) {
+	fetch := func(ctx context.Context) (integrity.Digest, error) {
+		p.publish(EventFetchStarted, destination, asset, integrity.Digest{}, nil)
+		digest, err := fn(ctx, asset)
+		if err != nil {
+			p.publish(EventFetchFailed, destination, asset, digest, err)
+		} else {
+			p.publish(EventFetchFinished, destination, asset, digest, nil)
+		}
+		return digest, err
+	}
+	key := asset.IntegrityKey().ToSRIString()
+	if len(key) == 0 {
+		// without integrity, we cannot tell if two assets are the same
+		return fetch(ctx)
+	}
+	return group.do(ctx, key, fetch)
+}
+
+// Subscribe returns a channel that receives events about fetches.
+// Events are dropped if the subscriber doesn't keep up.
+// The returned function unsubscribes and closes the channel.
+func (p *Prefetcher) Subscribe() (<-chan Event, func()) {
+	return p.events.subscribe(eventBufferSize)
+}
+
+// Stats returns a snapshot of the queues and fetch counters.
+func (p *Prefetcher) Stats() Stats {
+	return Stats{
+		RemoteQueue:     p.remoteDownloadQueue.Stats(),
+		LocalQueue:      p.localDownloadQueue.Stats(),
+		UploadQueue:     p.uploadQueue.Stats(),
+		FetchesStarted:  p.events.started.Load(),
+		FetchesFinished: p.events.finished.Load(),
+		FetchesFailed:   p.events.failed.Load(),
+	}
+}
+
+func (p *Prefetcher) publish(eventType EventType, destination string, asset api.Asset, digest integrity.Digest, err error) {
+	event := Event{
+		Time:        time.Now(),
+		Type:        eventType,
+		Destination: destination,
+		URIs:        asset.URIs,
+		Integrity:   asset.Integrity.ToSRIString(),
+	}
+	if !digest.Uninitialized() {
+		event.Digest = digest.Hex(p.digestFunction)
+		event.SizeBytes = digest.SizeBytes
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	p.events.publish(event)
+}
+
 func (p *Prefetcher) casRemoteToLocalTransfer(ctx context.Context, digests ...integritypkg.Digest) error {
 	if p.localCAS == nil {
 		return errors.New("cannot transfer data from remote CAS to disk cache without disk cache")
@@ -256,7 +520,8 @@ func (p *Prefetcher) casRemoteToLocalTransferPart(ctx context.Context, digests .
 	if len(digests) == 0 {
 		return nil, nil
 	}
-	if digests[0].SizeBytes >= byteStreamThreshold {
+	batchThreshold := casService.BatchThreshold(p.remoteCAS)
+	if digests[0].SizeBytes >= batchThreshold {
 		// The single blob is too large to fetch in a single request.
 		// We need to stream it.
 		reader, err := p.remoteCAS.ReadStream(ctx, digests[0], p.digestFunction, 0, 0)
@@ -268,16 +533,21 @@ func (p *Prefetcher) casRemoteToLocalTransferPart(ctx context.Context, digests .
 		if err != nil {
 			return nil, err
 		}
-		defer writer.Close()
 		logging.Debugf("streaming large blob from remote to local CAS (%s: %s; %d bytes)", p.digestFunction.String(), digests[0].Hex(p.digestFunction), digests[0].SizeBytes)
 
 		n, err := io.Copy(writer, reader)
 		if err != nil {
+			// don't leave partial blobs behind (e.g. when the transfer was cancelled)
+			casService.AbortWrite(writer)
 			return nil, err
 		}
 		if n != digests[0].SizeBytes {
+			casService.AbortWrite(writer)
 			return nil, fmt.Errorf("transfering data from remote to local cas: expected to read %d bytes, got %d", digests[0].SizeBytes, n)
 		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
 		return digests[1:], nil
 	}
 
@@ -285,7 +555,7 @@ func (p *Prefetcher) casRemoteToLocalTransferPart(ctx context.Context, digests .
 	cumulativeSize := int64(0)
 	numDigests := 0
 	for _, digest := range digests {
-		if cumulativeSize+digest.SizeBytes >= byteStreamThreshold {
+		if cumulativeSize+digest.SizeBytes >= batchThreshold {
 			break
 		}
 		cumulativeSize += digest.SizeBytes
@@ -343,7 +613,7 @@ func (p *Prefetcher) materializeWithDigest(ctx context.Context, asset api.Asset,
 		}
 	}
 
-	if !isAvailableRemotely && p.remoteAsset != nil && p.remoteCAS != nil {
+	if !isAvailableRemotely && p.remoteAsset != nil && p.remoteCAS != nil && len(asset.Compression) == 0 {
 		// TODO: make timeout and oldestContentAccepted configurable.
 		// TODO: choose reasonable defaults.
 		fetchBlobResponse, err := p.remoteAsset.FetchBlob(ctx, noFetchTimeout, noFetchOldestContentAcceptable, asset, p.digestFunction)
@@ -368,16 +638,17 @@ func (p *Prefetcher) materializeWithDigest(ctx context.Context, asset api.Asset,
 	}
 
 	// finally, fall back to using HTTP requests directly
-	_, err = p.downloader.FetchBlob(ctx, noFetchTimeout, noFetchOldestContentAcceptable, asset, p.digestFunction)
+	resp, err := p.downloader.FetchBlob(ctx, noFetchTimeout, noFetchOldestContentAcceptable, asset, p.digestFunction)
 	if err != nil {
 		return err
 	}
+	p.learnCompressedDigest(asset, resp)
 	logging.Debugf("successfully downloaded asset (%s: %s; %d bytes)", p.digestFunction.String(), digest.Hex(p.digestFunction), digest.SizeBytes)
 	return nil
 }
 
 func (p *Prefetcher) getOrLearnDigest(ctx context.Context, asset api.Asset) (digest integritypkg.Digest, err error) {
-	if digest, ok := p.checksumCache.FromIntegrityWithAlgorithm(asset.Integrity, p.digestFunction); ok {
+	if digest, ok := p.knownDigest(asset); ok {
 		return digest, nil
 	}
 
@@ -386,13 +657,7 @@ func (p *Prefetcher) getOrLearnDigest(ctx context.Context, asset api.Asset) (dig
 			return
 		}
 		// any digest we learn is stored in the cache
-		// we learned a new association between the asset and the digest
-		var integrityStrings []string
-		for integrityString := range asset.Integrity.Items() {
-			integrityStrings = append(integrityStrings, integrityString.ToSRI())
-		}
-		logging.Basicf("Learned new association: %v -> %s (content size: %d bytes)", integrityStrings, digest.Hex(p.digestFunction), digest.SizeBytes)
-		p.checksumCache.PutIntegrity(asset.Integrity, digest)
+		p.learnDigest(asset, digest)
 	}()
 
 	if p.localCAS != nil {
@@ -405,7 +670,7 @@ func (p *Prefetcher) getOrLearnDigest(ctx context.Context, asset api.Asset) (dig
 		}
 	}
 
-	if p.remoteAsset != nil {
+	if p.remoteAsset != nil && len(asset.Compression) == 0 {
 		fetchBlobResponse, err := p.remoteAsset.FetchBlob(ctx, noFetchTimeout, noFetchOldestContentAcceptable, asset, p.digestFunction)
 		if err != nil {
 			logging.Errorf("failed to learn digest via Remote Asset API - falling back to direct download: %v", err)
@@ -419,30 +684,55 @@ func (p *Prefetcher) getOrLearnDigest(ctx context.Context, asset api.Asset) (dig
 		if err != nil {
 			logging.Errorf("failed to learn digest via direct download: %v", err)
 		} else {
+			p.learnCompressedDigest(asset, resp)
 			return resp.BlobDigest, nil
 		}
 	}
 	return integritypkg.Digest{}, errors.New("failed to learn digest")
 }
 
+// knownDigest returns the digest of the content of the asset if it is in the checksum cache.
+func (p *Prefetcher) knownDigest(asset api.Asset) (integritypkg.Digest, bool) {
+	return p.checksumCache.FromIntegrityWithAlgorithm(asset.IntegrityKey(), p.digestFunction)
+}
+
+// learnDigest stores a new association between the asset and the digest of its content in the checksum cache.
+func (p *Prefetcher) learnDigest(asset api.Asset, digest integritypkg.Digest) {
+	integrityStrings := asset.Integrity.ToSRIList()
+	if asset.Integrity.Empty() {
+		for _, sri := range asset.CompressedIntegrity.ToSRIList() {
+			integrityStrings = append(integrityStrings, asset.Compression+"("+sri+")")
+		}
+	}
+	logging.Basicf("Learned new association: %v -> %s (content size: %d bytes)", integrityStrings, digest.Hex(p.digestFunction), digest.SizeBytes)
+	p.checksumCache.PutIntegrity(asset.IntegrityKey(), digest)
+}
+
+// learnCompressedDigest stores the digest of the compressed content of an asset (if the response has one).
+// This way, the compressed content in the local CAS can be found by its integrity.
+func (p *Prefetcher) learnCompressedDigest(asset api.Asset, resp assetService.FetchBlobResponse) {
+	if len(asset.Compression) == 0 || asset.CompressedIntegrity.Empty() || resp.CompressedBlobDigest.Uninitialized() {
+		return
+	}
+	if _, ok := p.checksumCache.FromIntegrityWithAlgorithm(asset.CompressedIntegrity, p.digestFunction); ok {
+		return
+	}
+	p.checksumCache.PutIntegrity(asset.CompressedIntegrity, resp.CompressedBlobDigest)
+}
+
 var (
 	noFetchTimeout                 = time.Duration(0)
 	noFetchOldestContentAcceptable = time.Unix(0, 0).UTC()
 )
 
 const (
-	// byteStreamThreshold is the threshold at which we switch
-	// fetching data in a single request to streaming (1 MiB).
-	//
-	// This value was chosen arbitrarily.
-	// TODO: make this configurable.
-	// TODO: use capabilities API to determine the best value.
-	byteStreamThreshold = 1 << 20
+	// eventBufferSize is the number of events buffered per subscriber.
+	eventBufferSize = 256
 	// downloadLimit is the maximum blob size that we consider adding to the local cache (64 MiB).
 	// If the blob is larger than this, we will always stream it.
 	// Smaller files may still be streamed, but the prefetcher can try
 	// to make them available in the local cache asynchronously.
-	// Very small files (below byteStreamThreshold) are always fetched
+	// Very small files (below casService.ByteStreamThreshold) are always fetched
 	// in a single request and will always be in the local cache.
 	//
 	// This value was chosen arbitrarily.
@@ -2,7 +2,10 @@ package prefetcher
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tweag/asset-fuse/internal/logging"
 )
@@ -13,6 +16,21 @@ type workQueue[T, U any] struct {
 	handler  func(context.Context, T) (U, error)
 	wg       sync.WaitGroup
 	stopOnce sync.Once
+	// cancel aborts in-flight work.
+	// It is set by Start.
+	cancel context.CancelFunc
+
+	// closed is set when the queue stops accepting new work.
+	// It is protected by closedMux, which must be held
+	// for reading while sending on requests.
+	closed    bool
+	closedMux sync.RWMutex
+	// stopping is closed when Stop is called.
+	// It unblocks senders waiting on a full queue, so Stop can acquire closedMux.
+	stopping chan struct{}
+
+	// active is the number of requests that are currently processed.
+	active atomic.Int64
 }
 
 func newWorkQueue[T, U any](handler func(context.Context, T) (U, error), workers int) *workQueue[T, U] {
@@ -20,17 +38,30 @@ func newWorkQueue[T, U any](handler func(context.Context, T) (U, error), workers
 		requests: make(chan workRequest[T, U], workqueueBufferSize),
 		workers:  workers,
 		handler:  handler,
+		stopping: make(chan struct{}),
 	}
 	return q
 }
 
 func (q *workQueue[T, U]) Start(ctx context.Context) {
+	// In-flight work should not be interrupted as soon as the parent context is cancelled.
+	// Instead, Stop decides when to give up on in-flight work.
+	ctx, q.cancel = context.WithCancel(context.WithoutCancel(ctx))
 	q.wg.Add(q.workers)
 	for range q.workers {
 		go func() {
 			defer q.wg.Done()
 			for req := range q.requests {
-				resp, err := q.handler(ctx, req.message)
+				var resp U
+				var err error
+				if ctx.Err() != nil {
+					// we are past the grace period - only drain the queue
+					err = ErrQueueStopped
+				} else {
+					q.active.Add(1)
+					resp, err = q.handler(ctx, req.message)
+					q.active.Add(-1)
+				}
 				if err != nil && len(req.callbacks) == 0 {
 					logging.Errorf("background processing: %v", err)
 				}
@@ -42,15 +73,77 @@ func (q *workQueue[T, U]) Start(ctx context.Context) {
 	}
 }
 
-func (q *workQueue[T, U]) Stop() {
+// Stop stops accepting new work and waits for queued and in-flight work to finish.
+// If this takes longer than gracePeriod, in-flight work is cancelled and
+// remaining requests fail with ErrQueueStopped.
+// Stop returns false if the grace period was exceeded.
+func (q *workQueue[T, U]) Stop(gracePeriod time.Duration) bool {
 	q.stopOnce.Do(func() {
+		close(q.stopping)
+		q.closedMux.Lock()
+		defer q.closedMux.Unlock()
+		q.closed = true
 		close(q.requests)
 	})
-	q.wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+
+	drained := true
+	select {
+	case <-done:
+	case <-timer.C:
+		drained = false
+	}
+	if q.cancel != nil {
+		q.cancel()
+	}
+	<-done
+	return drained
 }
 
+// Enqueue adds a request to the queue.
+// If the queue was stopped, the callbacks are invoked immediately with ErrQueueStopped.
 func (q *workQueue[T, U]) Enqueue(message T, callbacks ...func(T, U, error)) {
-	q.requests <- workRequest[T, U]{message, callbacks}
+	q.closedMux.RLock()
+	if q.closed {
+		q.closedMux.RUnlock()
+		q.reject(message, callbacks)
+		return
+	}
+	select {
+	case q.requests <- workRequest[T, U]{message, callbacks}:
+		q.closedMux.RUnlock()
+	case <-q.stopping:
+		// the queue is full and Stop is waiting for closedMux
+		q.closedMux.RUnlock()
+		q.reject(message, callbacks)
+	}
+}
+
+// reject invokes the callbacks of a request that is not accepted with ErrQueueStopped.
+func (q *workQueue[T, U]) reject(message T, callbacks []func(T, U, error)) {
+	if len(callbacks) == 0 {
+		logging.Debugf("background processing: dropping request: %v", ErrQueueStopped)
+	}
+	var zero U
+	for _, callback := range callbacks {
+		callback(message, zero, ErrQueueStopped)
+	}
+}
+
+// Stats returns a snapshot of the state of the queue.
+func (q *workQueue[T, U]) Stats() QueueStats {
+	return QueueStats{
+		Workers: q.workers,
+		Queued:  len(q.requests),
+		Active:  q.active.Load(),
+	}
 }
 
 type workRequest[T, U any] struct {
@@ -58,6 +151,9 @@ type workRequest[T, U any] struct {
 	callbacks []func(T, U, error)
 }
 
+// ErrQueueStopped is returned for requests that were not processed because the prefetcher is shutting down.
+var ErrQueueStopped = errors.New("prefetcher is shutting down")
+
 // workqueueBufferSize is the size of the workqueue channel
 // buffer. This is a tradeoff between memory usage and
 // responsiveness.
@@ -0,0 +1,135 @@
+package retry
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/tweag/asset-fuse/internal/logging"
+)
+
+// HostHealth tracks failures per host and acts as a circuit breaker:
+// after a number of consecutive transient failures, a host is considered unhealthy
+// and skipped for a cooldown period. After the cooldown, a single request is let through
+// to probe the host (see Reserve). A nil *HostHealth considers every host healthy.
+type HostHealth struct {
+	failureThreshold int
+	cooldown         time.Duration
+	now              func() time.Time
+
+	mux   sync.Mutex
+	hosts map[string]*hostState
+}
+
+type hostState struct {
+	consecutiveFailures int
+	// openUntil is the end of the cooldown (zero if the circuit is closed)
+	openUntil time.Time
+	// probing is set while a single request tests a host after the cooldown.
+	// It is cleared by the release function returned from Reserve.
+	probing bool
+}
+
+// NewHostHealth creates a HostHealth. A failureThreshold of 0 or less disables circuit breaking.
+func NewHostHealth(failureThreshold int, cooldown time.Duration) *HostHealth {
+	if failureThreshold <= 0 {
+		return nil
+	}
+	return &HostHealth{
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		now:              time.Now,
+		hosts:            make(map[string]*hostState),
+	}
+}
+
+// Allow reports whether a request to the host of uri should be attempted.
+// It has no side effects, so it can be used to rank candidates.
+// The request that is actually sent must be wrapped in Reserve.
+func (h *HostHealth) Allow(uri string) bool {
+	if h == nil {
+		return true
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	state, ok := h.hosts[HostOf(uri)]
+	if !ok || state.openUntil.IsZero() {
+		return true
+	}
+	// half-open: only a single request may probe the host
+	return !h.now().Before(state.openUntil) && !state.probing
+}
+
+// Reserve marks a request to the host of uri as in flight.
+// If the host is past its cooldown, the request becomes the probe,
+// and Allow rejects other requests until the returned release function is called.
+// The release function must be called on every path (after Success or Failure was recorded).
+func (h *HostHealth) Reserve(uri string) (release func()) {
+	if h == nil {
+		return func() {}
+	}
+	host := HostOf(uri)
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	state, ok := h.hosts[host]
+	if !ok || state.openUntil.IsZero() || h.now().Before(state.openUntil) || state.probing {
+		return func() {}
+	}
+	state.probing = true
+	return func() {
+		h.mux.Lock()
+		defer h.mux.Unlock()
+		// the state is replaced when the host becomes healthy again
+		if current, ok := h.hosts[host]; ok && current == state {
+			state.probing = false
+		}
+	}
+}
+
+// Success records a successful request to the host of uri.
+func (h *HostHealth) Success(uri string) {
+	if h == nil {
+		return
+	}
+	host := HostOf(uri)
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if state, ok := h.hosts[host]; ok {
+		if !state.openUntil.IsZero() {
+			logging.Basicf("%s is healthy again", host)
+		}
+		delete(h.hosts, host)
+	}
+}
+
+// Failure records a failed request to the host of uri.
+// Only transient failures (see Retryable) count towards the threshold.
+func (h *HostHealth) Failure(uri string, err error) {
+	if h == nil || !Retryable(err) {
+		return
+	}
+	host := HostOf(uri)
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	state, ok := h.hosts[host]
+	if !ok {
+		state = &hostState{}
+		h.hosts[host] = state
+	}
+	state.consecutiveFailures++
+	if state.consecutiveFailures >= h.failureThreshold {
+		if state.openUntil.IsZero() {
+			logging.Warningf("%s failed %d times in a row, skipping it for %v", host, state.consecutiveFailures, h.cooldown)
+		}
+		state.openUntil = h.now().Add(h.cooldown)
+	}
+}
+
+// HostOf returns the host (with port) of uri, or uri itself if it has no host.
+func HostOf(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil || len(parsed.Host) == 0 {
+		return uri
+	}
+	return parsed.Host
+}
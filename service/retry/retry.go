@@ -0,0 +1,167 @@
+// Package retry implements the retry policy shared by all network clients:
+// exponential backoff with jitter that honours server-provided delays
+// (HTTP Retry-After and gRPC RetryInfo), and per-host health tracking
+// that temporarily skips failing mirrors.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/tweag/asset-fuse/internal/logging"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Policy describes how often and how fast failed operations are retried.
+// The zero value performs a single attempt.
+type Policy struct {
+	// MaxAttempts is the total number of attempts (including the first one).
+	MaxAttempts int
+	// InitialBackoff is the upper bound of the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the (exponentially growing) delay between attempts.
+	MaxBackoff time.Duration
+}
+
+// Do calls fn until it succeeds, returns a permanent error, or the attempts are exhausted.
+// The delay between attempts grows exponentially (with full jitter),
+// unless the error specifies a delay (see Delay). Server-provided delays are capped by MaxBackoff.
+func (p Policy) Do(ctx context.Context, description string, fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn(ctx)
+		if err == nil || !Retryable(err) || attempt >= p.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		delay := p.Backoff(attempt)
+		if serverDelay, ok := Delay(err); ok {
+			delay = min(serverDelay, p.MaxBackoff)
+		}
+		logging.Debugf("%s: attempt %d of %d failed, retrying in %v: %v", description, attempt, p.MaxAttempts, delay, err)
+		if !Sleep(ctx, delay) {
+			return err
+		}
+	}
+}
+
+// Sleep waits for delay and reports whether the delay passed before ctx was done.
+func Sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Backoff returns the delay after the given (failed) attempt.
+// It is drawn uniformly from [0, min(MaxBackoff, InitialBackoff * 2^(attempt-1))].
+func (p Policy) Backoff(attempt int) time.Duration {
+	ceiling := p.InitialBackoff
+	for i := 1; i < attempt && ceiling < p.MaxBackoff; i++ {
+		ceiling *= 2
+	}
+	ceiling = min(ceiling, p.MaxBackoff)
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling + 1)
+}
+
+// HTTPStatusError is returned for HTTP responses with an unexpected status code.
+type HTTPStatusError struct {
+	StatusCode int
+	// RetryAfter is the delay requested by the server (0 if not set).
+	RetryAfter time.Duration
+}
+
+// NewHTTPStatusError creates an error for resp, including the value of the Retry-After header.
+func NewHTTPStatusError(resp *http.Response) *HTTPStatusError {
+	return &HTTPStatusError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+}
+
+// Retryable reports whether err is transient, so that the operation should be retried.
+// Transient errors are network errors, HTTP 408, 429 and 5xx responses
+// and the gRPC codes UNAVAILABLE, RESOURCE_EXHAUSTED, ABORTED and DEADLINE_EXCEEDED.
+// Cancellation of the caller's context is never retryable.
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var httpErr *HTTPStatusError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if s, ok := status.FromError(err); ok && s.Code() != codes.Unknown {
+		switch s.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		// a per-attempt timeout
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// Delay returns the delay requested by the server for err, if any.
+func Delay(err error) (time.Duration, bool) {
+	var httpErr *HTTPStatusError
+	if errors.As(err, &httpErr) && httpErr.RetryAfter > 0 {
+		return httpErr.RetryAfter, true
+	}
+	if s, ok := status.FromError(err); ok {
+		for _, detail := range s.Details() {
+			if retryInfo, ok := detail.(*errdetails.RetryInfo); ok && retryInfo.RetryDelay != nil {
+				return retryInfo.RetryDelay.AsDuration(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// parseRetryAfter parses the value of a Retry-After header,
+// which is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,157 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestDoRetriesTransientErrors(t *testing.T) {
+	policy := Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	var calls int
+	err := policy.Do(context.Background(), "test", func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return status.Error(codes.Unavailable, "try again")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success after 3 calls, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = policy.Do(context.Background(), "test", func(ctx context.Context) error {
+		calls++
+		return &HTTPStatusError{StatusCode: http.StatusServiceUnavailable}
+	})
+	if err == nil || calls != 3 {
+		t.Fatalf("expected failure after 3 calls, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = policy.Do(context.Background(), "test", func(ctx context.Context) error {
+		calls++
+		return &HTTPStatusError{StatusCode: http.StatusNotFound}
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("permanent errors should not be retried, got %v after %d calls", err, calls)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{status.Error(codes.Unavailable, ""), true},
+		{status.Error(codes.ResourceExhausted, ""), true},
+		{status.Error(codes.NotFound, ""), false},
+		{status.Error(codes.InvalidArgument, ""), false},
+		{&HTTPStatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&HTTPStatusError{StatusCode: http.StatusBadGateway}, true},
+		{&HTTPStatusError{StatusCode: http.StatusForbidden}, false},
+		{context.Canceled, false},
+		{errors.New("checksum mismatch"), false},
+	} {
+		if got := Retryable(tc.err); got != tc.want {
+			t.Errorf("Retryable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := parseRetryAfter("120", now); got != 2*time.Minute {
+		t.Errorf("expected 2m, got %v", got)
+	}
+	if got := parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now); got != time.Minute {
+		t.Errorf("expected 1m, got %v", got)
+	}
+	if got := parseRetryAfter("soon", now); got != 0 {
+		t.Errorf("expected 0, got %v", got)
+	}
+
+	s, err := status.New(codes.Unavailable, "overloaded").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(3 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := Delay(s.Err()); !ok || got != 3*time.Second {
+		t.Errorf("expected RetryInfo delay of 3s, got %v (%v)", got, ok)
+	}
+}
+
+func TestBackoffIsBounded(t *testing.T) {
+	policy := Policy{MaxAttempts: 10, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt := 1; attempt < 10; attempt++ {
+		if got := policy.Backoff(attempt); got < 0 || got > time.Second {
+			t.Fatalf("backoff for attempt %d out of bounds: %v", attempt, got)
+		}
+	}
+	if got := policy.Backoff(1); got > 100*time.Millisecond {
+		t.Fatalf("first backoff should not exceed the initial backoff, got %v", got)
+	}
+}
+
+func TestHostHealth(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	health := NewHostHealth(2, time.Minute)
+	health.now = func() time.Time { return now }
+	const uri = "https://mirror.example.com/file"
+	transient := &HTTPStatusError{StatusCode: http.StatusServiceUnavailable}
+
+	health.Failure(uri, &HTTPStatusError{StatusCode: http.StatusNotFound})
+	health.Failure(uri, transient)
+	if !health.Allow(uri) {
+		t.Fatal("host should be healthy below the threshold (permanent errors don't count)")
+	}
+	health.Failure(uri, transient)
+	if health.Allow(uri) {
+		t.Fatal("host should be skipped after reaching the threshold")
+	}
+	if !health.Allow("https://other.example.com/file") {
+		t.Fatal("other hosts should not be affected")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if !health.Allow(uri) || !health.Allow(uri) {
+		t.Fatal("a probe should be allowed after the cooldown (and Allow has no side effects)")
+	}
+	release := health.Reserve(uri)
+	if health.Allow(uri) {
+		t.Fatal("only a single probe should be allowed")
+	}
+	// the probe was abandoned without a result (like a cancelled request)
+	release()
+	if !health.Allow(uri) {
+		t.Fatal("a released probe should not block the host")
+	}
+	release = health.Reserve(uri)
+	health.Failure(uri, transient)
+	release()
+	if health.Allow(uri) {
+		t.Fatal("a failed probe should start another cooldown")
+	}
+	now = now.Add(2 * time.Minute)
+	release = health.Reserve(uri)
+	health.Success(uri)
+	release()
+	if !health.Allow(uri) {
+		t.Fatal("host should be healthy after a successful probe")
+	}
+
+	var disabled *HostHealth
+	disabled.Failure(uri, transient)
+	disabled.Reserve(uri)()
+	if !disabled.Allow(uri) {
+		t.Fatal("a nil HostHealth should allow every host")
+	}
+}
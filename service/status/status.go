@@ -40,4 +40,6 @@ const (
 	// Internal errors. This means that some invariants expected by the underlying system have been broken.
 	// This error code is reserved for serious errors.
 	Status_INTERNAL = 13
+	// Unrecoverable data loss or corruption.
+	Status_DATA_LOSS = 15
 )
@@ -0,0 +1,129 @@
+// Package uploader copies blobs from the disk cache to the remote CAS.
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tweag/asset-fuse/api"
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/internal/logging"
+	"github.com/tweag/asset-fuse/service/asset"
+	"github.com/tweag/asset-fuse/service/cas"
+	"github.com/tweag/asset-fuse/service/retry"
+	"github.com/tweag/asset-fuse/service/status"
+)
+
+// Uploader makes blobs of the local CAS available in the remote CAS,
+// so they can be used for remote execution.
+// Afterwards, assets can be pushed to the remote asset service,
+// so FetchBlob requests of other clients for the same URIs are served from the remote CAS.
+type Uploader struct {
+	localCAS       cas.LocalCAS
+	remoteCAS      cas.CAS
+	pusher         asset.Push
+	digestFunction integrity.Algorithm
+	retryPolicy    retry.Policy
+}
+
+// New creates an uploader.
+// The pusher may be nil, in which case assets are not pushed.
+func New(localCAS cas.LocalCAS, remoteCAS cas.CAS, pusher asset.Push, digestFunction integrity.Algorithm, retryPolicy retry.Policy) *Uploader {
+	return &Uploader{
+		localCAS:       localCAS,
+		remoteCAS:      remoteCAS,
+		pusher:         pusher,
+		digestFunction: digestFunction,
+		retryPolicy:    retryPolicy,
+	}
+}
+
+// Upload uploads the blobs that are missing in the remote CAS.
+// Small blobs are uploaded with batch requests, large blobs are streamed.
+func (u *Uploader) Upload(ctx context.Context, digests ...integrity.Digest) error {
+	missing, err := u.remoteCAS.FindMissingBlobs(ctx, digests, u.digestFunction)
+	if err != nil {
+		return fmt.Errorf("checking for missing blobs in remote CAS: %w", err)
+	}
+	threshold := cas.BatchThreshold(u.remoteCAS)
+	var batch []integrity.Digest
+	var batchSize int64
+	for _, digest := range missing {
+		if digest.SizeBytes >= threshold {
+			if err := u.uploadStream(ctx, digest); err != nil {
+				return err
+			}
+			continue
+		}
+		if batchSize+digest.SizeBytes >= threshold {
+			if err := u.uploadBatch(ctx, batch); err != nil {
+				return err
+			}
+			batch, batchSize = nil, 0
+		}
+		batch = append(batch, digest)
+		batchSize += digest.SizeBytes
+	}
+	if len(batch) > 0 {
+		return u.uploadBatch(ctx, batch)
+	}
+	return nil
+}
+
+// Push associates the asset with the digest of its content in the remote asset service.
+// It does nothing if there is no remote asset service.
+func (u *Uploader) Push(ctx context.Context, apiAsset api.Asset, digest integrity.Digest) error {
+	if u.pusher == nil {
+		return nil
+	}
+	if err := u.pusher.PushBlob(ctx, time.Time{}, apiAsset, digest, u.digestFunction); err != nil {
+		return fmt.Errorf("pushing asset %v: %w", apiAsset.URIs, err)
+	}
+	return nil
+}
+
+func (u *Uploader) uploadBatch(ctx context.Context, digests []integrity.Digest) error {
+	readResponses, err := u.localCAS.BatchReadBlobs(ctx, digests, u.digestFunction)
+	if err != nil {
+		return fmt.Errorf("reading blobs from local CAS: %w", err)
+	}
+	digestsAndData := make(cas.DigestsAndData, len(readResponses))
+	for i, readResponse := range readResponses {
+		digestsAndData[i] = cas.DigestAndData{Digest: readResponse.Digest, Data: readResponse.Data}
+	}
+	logging.Debugf("uploading %d blobs from local to remote CAS", len(digestsAndData))
+	updateResponses, err := u.remoteCAS.BatchUpdateBlobs(ctx, digestsAndData, u.digestFunction)
+	if errors.Is(err, cas.BatchResponseHasNonZeroStatus) {
+		for _, response := range updateResponses {
+			if response.Status.Code != status.Status_OK {
+				return fmt.Errorf("uploading blob %s to remote CAS: %s (code %d)", response.Digest.Hex(u.digestFunction), response.Status.Message, response.Status.Code)
+			}
+		}
+	}
+	return err
+}
+
+// uploadStream streams a single blob to the remote CAS.
+// Uploads can't be resumed, so failed attempts start over.
+func (u *Uploader) uploadStream(ctx context.Context, digest integrity.Digest) error {
+	logging.Debugf("uploading blob from local to remote CAS (%s: %s; %d bytes)", u.digestFunction.String(), digest.Hex(u.digestFunction), digest.SizeBytes)
+	return u.retryPolicy.Do(ctx, "upload", func(ctx context.Context) error {
+		reader, err := u.localCAS.ReadStream(ctx, digest, u.digestFunction, 0, 0)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		writer, err := u.remoteCAS.WriteStream(ctx, digest, u.digestFunction)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(writer, reader); err != nil {
+			cas.AbortWrite(writer)
+			return err
+		}
+		return writer.Close()
+	})
+}
@@ -0,0 +1,179 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tweag/asset-fuse/integrity"
+	"github.com/tweag/asset-fuse/service/cas"
+	"github.com/tweag/asset-fuse/service/retry"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+func TestUpload(t *testing.T) {
+	small := []byte("small blob")
+	other := []byte("another small blob")
+	large := []byte(strings.Repeat("x", cas.ByteStreamThreshold))
+
+	for _, tc := range []struct {
+		name    string
+		blobs   [][]byte
+		present [][]byte
+		// batchLimit is the batch size limit of the remote CAS (0 means no limit)
+		batchLimit int64
+		// failWrites is the number of stream uploads that fail with a transient error
+		failWrites        int
+		expectBatches     int
+		expectStreams     int
+		expectUploaded    int
+		expectWriteAborts int
+	}{
+		{name: "small blobs are batched", blobs: [][]byte{small, other}, expectBatches: 1, expectUploaded: 2},
+		{name: "large blobs are streamed", blobs: [][]byte{small, large}, expectBatches: 1, expectStreams: 1, expectUploaded: 2},
+		{name: "present blobs are skipped", blobs: [][]byte{small, other}, present: [][]byte{small}, expectBatches: 1, expectUploaded: 1},
+		{name: "batch limit of the remote CAS", blobs: [][]byte{small, other}, batchLimit: 20, expectStreams: 2, expectUploaded: 2},
+		{name: "failed streams are retried", blobs: [][]byte{large}, failWrites: 1, expectStreams: 2, expectUploaded: 1, expectWriteAborts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			disk, err := cas.NewDisk(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote := &fakeRemote{blobs: make(map[string][]byte), batchLimit: tc.batchLimit, failWrites: tc.failWrites}
+			var digests []integrity.Digest
+			for _, blob := range tc.blobs {
+				contentIntegrity, _, err := integrity.IntegrityFromContent(bytes.NewReader(blob), integrity.SHA256)
+				if err != nil {
+					t.Fatal(err)
+				}
+				digest, err := disk.ImportBlob(context.Background(), contentIntegrity, integrity.Digest{}, integrity.SHA256, bytes.NewReader(blob))
+				if err != nil {
+					t.Fatal(err)
+				}
+				digests = append(digests, digest)
+			}
+			for _, blob := range tc.present {
+				remote.put(blob)
+			}
+
+			policy := retry.Policy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+			uploader := New(disk, remote, nil, integrity.SHA256, policy)
+			if err := uploader.Upload(context.Background(), digests...); err != nil {
+				t.Fatal(err)
+			}
+			if remote.batches != tc.expectBatches || remote.streams != tc.expectStreams || remote.aborts != tc.expectWriteAborts {
+				t.Fatalf("expected %d batches, %d streams and %d aborts, got %d, %d and %d",
+					tc.expectBatches, tc.expectStreams, tc.expectWriteAborts, remote.batches, remote.streams, remote.aborts)
+			}
+			if uploaded := len(remote.blobs) - len(tc.present); uploaded != tc.expectUploaded {
+				t.Fatalf("expected %d uploaded blobs, got %d", tc.expectUploaded, uploaded)
+			}
+			for _, blob := range tc.blobs {
+				if !bytes.Equal(remote.get(blob), blob) {
+					t.Fatalf("blob of %d bytes is missing in the remote CAS", len(blob))
+				}
+			}
+		})
+	}
+}
+
+// fakeRemote is an in-memory remote CAS that counts batch and stream uploads.
+type fakeRemote struct {
+	cas.Reader
+	batchLimit int64
+	failWrites int
+
+	mux     sync.Mutex
+	blobs   map[string][]byte
+	batches int
+	streams int
+	aborts  int
+}
+
+func (f *fakeRemote) MaxBatchTotalSizeBytes() int64 {
+	return f.batchLimit
+}
+
+func (f *fakeRemote) key(data []byte) string {
+	hasher := integrity.SHA256.Hasher()
+	hasher.Write(data)
+	return integrity.NewDigest(hasher.Sum(nil), int64(len(data)), integrity.SHA256).Hex(integrity.SHA256)
+}
+
+func (f *fakeRemote) put(data []byte) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.blobs[f.key(data)] = data
+}
+
+func (f *fakeRemote) get(data []byte) []byte {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.blobs[f.key(data)]
+}
+
+func (f *fakeRemote) FindMissingBlobs(ctx context.Context, blobDigests []integrity.Digest, digestFunction integrity.Algorithm) ([]integrity.Digest, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	var missing []integrity.Digest
+	for _, digest := range blobDigests {
+		if _, ok := f.blobs[digest.Hex(digestFunction)]; !ok {
+			missing = append(missing, digest)
+		}
+	}
+	return missing, nil
+}
+
+func (f *fakeRemote) BatchUpdateBlobs(ctx context.Context, blobData cas.DigestsAndData, digestFunction integrity.Algorithm) (cas.BatchUpdateBlobsResponse, error) {
+	f.mux.Lock()
+	f.batches++
+	f.mux.Unlock()
+	var responses cas.BatchUpdateBlobsResponse
+	for _, blob := range blobData {
+		f.put(blob.Data)
+		responses = append(responses, cas.UpdateBlobsResponse{Digest: blob.Digest})
+	}
+	return responses, nil
+}
+
+func (f *fakeRemote) WriteStream(ctx context.Context, blobDigest integrity.Digest, digestFunction integrity.Algorithm) (io.WriteCloser, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.streams++
+	fail := f.failWrites > 0
+	if fail {
+		f.failWrites--
+	}
+	return &fakeWriter{remote: f, fail: fail}, nil
+}
+
+type fakeWriter struct {
+	remote *fakeRemote
+	fail   bool
+	buf    bytes.Buffer
+}
+
+func (w *fakeWriter) Write(p []byte) (int, error) {
+	if w.fail {
+		return 0, grpcstatus.Error(codes.Unavailable, "connection reset")
+	}
+	return w.buf.Write(p)
+}
+
+func (w *fakeWriter) Close() error {
+	w.remote.put(w.buf.Bytes())
+	return nil
+}
+
+func (w *fakeWriter) Abort() error {
+	w.remote.mux.Lock()
+	defer w.remote.mux.Unlock()
+	w.remote.aborts++
+	return nil
+}